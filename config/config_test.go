@@ -0,0 +1,19 @@
+package config
+
+import "testing"
+
+func TestLoadConfigSmarthostTLS(t *testing.T) {
+	for _, value := range []string{"none", "starttls", "TLS"} {
+		t.Setenv("SMTP_SMARTHOST_TLS", value)
+		if _, err := LoadConfig(); err != nil {
+			t.Errorf("%q: %v", value, err)
+		}
+	}
+	// A typo is refused instead of connecting in plaintext
+	for _, value := range []string{"startls", "ssl"} {
+		t.Setenv("SMTP_SMARTHOST_TLS", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("%q: accepted", value)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package delivery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DANE for SMTP (RFC 7672): TLSA records in a DNSSEC-signed zone pin the certificate of an
+// MX host; when usable records exist, STARTTLS is mandatory and the certificate must match one
+// Only DANE-TA(2) and DANE-EE(3) are usable for SMTP; PKIX usages (0, 1) are ignored
+
+// TLSA certificate usages, selectors and matching types (RFC 6698 section 2.1)
+const (
+	TLSA_USAGE_DANE_TA uint8 = 2 // Trust anchor: the chain must lead to the matched CA, names are checked
+	TLSA_USAGE_DANE_EE uint8 = 3 // End entity: the server certificate itself matches, names and expiry are not checked
+
+	TLSA_SELECTOR_CERT uint8 = 0 // Full certificate
+	TLSA_SELECTOR_SPKI uint8 = 1 // SubjectPublicKeyInfo
+
+	TLSA_MATCH_FULL   uint8 = 0 // Exact data
+	TLSA_MATCH_SHA256 uint8 = 1
+	TLSA_MATCH_SHA512 uint8 = 2
+)
+
+// dnsTypeTLSA is the TLSA resource record type
+const dnsTypeTLSA = 52
+
+// TLSARecord is one TLSA resource record
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// usable reports whether the record can authenticate an SMTP server (RFC 7672 section 3.1)
+func (r TLSARecord) usable() bool {
+	return (r.Usage == TLSA_USAGE_DANE_TA || r.Usage == TLSA_USAGE_DANE_EE) &&
+		r.Selector <= TLSA_SELECTOR_SPKI && r.MatchingType <= TLSA_MATCH_SHA512
+}
+
+// matches reports whether a certificate matches the record data
+func (r TLSARecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == TLSA_SELECTOR_SPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case TLSA_MATCH_SHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case TLSA_MATCH_SHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// TLSAResolver looks up TLSA records
+// secure reports whether the answer was DNSSEC-validated; insecure answers must not be used
+// A name without records returns no error
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []TLSARecord, secure bool, err error)
+}
+
+// DNSTLSAResolver queries a DNSSEC-validating recursive resolver and trusts its AD bit
+// Only use a resolver reached over a trusted path, usually one on localhost
+type DNSTLSAResolver struct {
+	Server  string        // host:port ("" = first nameserver in /etc/resolv.conf)
+	Timeout time.Duration // Per query (5s if 0)
+}
+
+// LookupTLSA sends a TLSA query with the DO bit over UDP, and over TCP if the answer was truncated
+func (r *DNSTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSARecord, bool, error) {
+	server := r.Server
+	if server == "" {
+		server = systemNameserver()
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query, id, err := buildTLSAQuery(name)
+	if err != nil {
+		return nil, false, err
+	}
+	answer, err := exchangeDNS(ctx, "udp", server, query)
+	if err == nil && len(answer) > 2 && answer[2]&0x02 != 0 {
+		// Truncated: repeat over TCP
+		answer, err = exchangeDNS(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("TLSA lookup for %s failed: %w", name, err)
+	}
+	return parseTLSAAnswer(answer, id, name)
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, or the local resolver
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// buildTLSAQuery builds a recursive query that asks for DNSSEC validation (AD and DO bits)
+func buildTLSAQuery(name string) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	var query bytes.Buffer
+	// Header: id, flags RD+AD (RFC 6840 section 5.7), 1 question, 1 additional (OPT)
+	binary.Write(&query, binary.BigEndian, [6]uint16{id, 0x0120, 1, 0, 0, 1})
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid DNS name %q", name)
+		}
+		query.WriteByte(byte(len(label)))
+		query.WriteString(label)
+	}
+	query.WriteByte(0)
+	binary.Write(&query, binary.BigEndian, [2]uint16{dnsTypeTLSA, 1}) // TLSA, IN
+	// EDNS0 OPT record: root name, type 41, 4096 byte payload, DO bit set, no options
+	query.WriteByte(0)
+	binary.Write(&query, binary.BigEndian, [5]uint16{41, 4096, 0, 0x8000, 0})
+	return query.Bytes(), id, nil
+}
+
+// exchangeDNS sends a query and returns the raw answer
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// TCP messages carry a two byte length prefix
+		message := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(message, uint16(len(query)))
+		copy(message[2:], query)
+		if _, err := conn.Write(message); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return nil, err
+		}
+		return answer, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 4096)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return nil, err
+	}
+	return answer[:n], nil
+}
+
+// parseTLSAAnswer extracts the TLSA records of a response and whether it was validated (AD bit)
+func parseTLSAAnswer(answer []byte, id uint16, name string) ([]TLSARecord, bool, error) {
+	if len(answer) < 12 {
+		return nil, false, errors.New("short DNS response")
+	}
+	if binary.BigEndian.Uint16(answer[0:2]) != id {
+		return nil, false, errors.New("DNS response id mismatch")
+	}
+	flags := binary.BigEndian.Uint16(answer[2:4])
+	secure := flags&0x0020 != 0
+	switch rcode := flags & 0x000f; rcode {
+	case 0:
+	case 3:
+		// NXDOMAIN: no records (denial of existence is secure if AD is set)
+		return nil, secure, nil
+	default:
+		return nil, false, fmt.Errorf("TLSA lookup for %s failed: DNS rcode %d", name, rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(answer[4:6]))
+	answers := int(binary.BigEndian.Uint16(answer[6:8]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		next, err := skipDNSName(answer, offset)
+		if err != nil {
+			return nil, false, err
+		}
+		offset = next + 4 // Type and class
+	}
+
+	records := make([]TLSARecord, 0)
+	for i := 0; i < answers; i++ {
+		next, err := skipDNSName(answer, offset)
+		if err != nil {
+			return nil, false, err
+		}
+		if next+10 > len(answer) {
+			return nil, false, errors.New("truncated DNS record")
+		}
+		recordType := binary.BigEndian.Uint16(answer[next : next+2])
+		length := int(binary.BigEndian.Uint16(answer[next+8 : next+10]))
+		data := next + 10
+		if data+length > len(answer) {
+			return nil, false, errors.New("truncated DNS record data")
+		}
+		// CNAMEs on the way are followed by the resolver; only the TLSA records matter
+		if recordType == dnsTypeTLSA && length >= 3 {
+			records = append(records, TLSARecord{
+				Usage:        answer[data],
+				Selector:     answer[data+1],
+				MatchingType: answer[data+2],
+				Data:         append([]byte(nil), answer[data+3:data+length]...),
+			})
+		}
+		offset = data + length
+	}
+	return records, secure, nil
+}
+
+// skipDNSName returns the offset after a (possibly compressed) name
+func skipDNSName(message []byte, offset int) (int, error) {
+	for {
+		if offset >= len(message) {
+			return 0, errors.New("truncated DNS name")
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			// Compression pointer: the name ends here
+			return offset + 2, nil
+		default:
+			offset += 1 + length
+		}
+	}
+}
+
+// daneTLSConfig returns a STARTTLS config that accepts the server only if its certificate
+// matches one of the usable TLSA records of host
+func daneTLSConfig(base *tls.Config, host string, records []TLSARecord) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	config.ServerName = host
+	config.MinVersion = max(config.MinVersion, tls.VersionTLS12)
+	// The usual PKIX checks do not apply; VerifyConnection does the DANE checks instead
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return verifyDANE(state.PeerCertificates, host, records)
+	}
+	return config
+}
+
+// verifyDANE checks a certificate chain against TLSA records (RFC 7672 section 3.1)
+func verifyDANE(chain []*x509.Certificate, host string, records []TLSARecord) error {
+	if len(chain) == 0 {
+		return errors.New("DANE: no server certificate")
+	}
+	leaf := chain[0]
+	for _, record := range records {
+		switch record.Usage {
+		case TLSA_USAGE_DANE_EE:
+			if record.matches(leaf) {
+				return nil
+			}
+		case TLSA_USAGE_DANE_TA:
+			if verifyTrustAnchor(chain, host, record) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("DANE: certificate of %s matches none of its %d TLSA records", host, len(records))
+}
+
+// verifyTrustAnchor reports whether the chain leads to the trust anchor of a DANE-TA record
+// and the leaf is valid for the MX hostname
+// Servers must send the anchor certificate (RFC 7672 section 3.1.2) unless the record holds the
+// full public key (selector SPKI, matching type Full); then the anchor may be left out and the
+// top of the chain, which may be the leaf itself, must be signed by that key
+func verifyTrustAnchor(chain []*x509.Certificate, host string, record TLSARecord) bool {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verify := func(anchor *x509.Certificate) bool {
+		roots := x509.NewCertPool()
+		roots.AddCert(anchor)
+		_, err := chain[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+		return err == nil
+	}
+
+	for _, anchor := range chain {
+		if record.matches(anchor) && verify(anchor) {
+			return true
+		}
+	}
+
+	if record.Selector != TLSA_SELECTOR_SPKI || record.MatchingType != TLSA_MATCH_FULL {
+		return false
+	}
+	key, err := x509.ParsePKIXPublicKey(record.Data)
+	if err != nil {
+		return false
+	}
+	top := chain[len(chain)-1]
+	signer := &x509.Certificate{PublicKey: key}
+	if signer.CheckSignature(top.SignatureAlgorithm, top.RawTBSCertificate, top.Signature) != nil {
+		return false
+	}
+	// The top certificate was issued by the anchor, so it stands in for it
+	return verify(top)
+}
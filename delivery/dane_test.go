@@ -0,0 +1,179 @@
+package delivery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsaQuestion is the encoded question name the test answers point back to
+var tlsaQuestion = []byte("\x03_25\x04_tcp\x02mx\x07example\x03com\x00")
+
+// dnsResponse builds a response with one TLSA question for "_25._tcp.mx.example.com"
+func dnsResponse(id, flags uint16, answers ...[]byte) []byte {
+	message := binary.BigEndian.AppendUint16(nil, id)
+	message = binary.BigEndian.AppendUint16(message, flags)
+	message = binary.BigEndian.AppendUint16(message, 1)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(answers)))
+	message = append(message, 0, 0, 0, 0)
+	message = append(message, tlsaQuestion...)
+	message = append(message, 0, dnsTypeTLSA, 0, 1)
+	for _, answer := range answers {
+		message = append(message, answer...)
+	}
+	return message
+}
+
+// dnsRecord builds a resource record; name is raw (labels or a compression pointer)
+func dnsRecord(name []byte, recordType uint16, data []byte) []byte {
+	record := append([]byte{}, name...)
+	record = binary.BigEndian.AppendUint16(record, recordType)
+	record = append(record, 0, 1, 0, 0, 0x0E, 0x10) // IN, TTL 3600
+	record = binary.BigEndian.AppendUint16(record, uint16(len(data)))
+	return append(record, data...)
+}
+
+func TestParseTLSAAnswer(t *testing.T) {
+	pointer := []byte{0xC0, 12} // Back to the question name
+	ee := dnsRecord(pointer, dnsTypeTLSA, []byte{3, 1, 1, 0xAA, 0xBB})
+	ta := dnsRecord(tlsaQuestion, dnsTypeTLSA, []byte{2, 0, 1, 0xCC})
+	rrsig := dnsRecord(pointer, 46, []byte{0, 52, 13, 5})
+
+	tests := []struct {
+		name    string
+		answer  []byte
+		records int
+		secure  bool
+		err     string
+	}{
+		{"validated", dnsResponse(0x1234, 0x81A0, ee, ta, rrsig), 2, true, ""},
+		{"not validated", dnsResponse(0x1234, 0x8180, ee), 1, false, ""},
+		{"no records", dnsResponse(0x1234, 0x81A0), 0, true, ""},
+		{"NXDOMAIN validated", dnsResponse(0x1234, 0x81A3), 0, true, ""},
+		{"NXDOMAIN not validated", dnsResponse(0x1234, 0x8183), 0, false, ""},
+		{"SERVFAIL", dnsResponse(0x1234, 0x8182), 0, false, "DNS rcode 2"},
+		{"REFUSED", dnsResponse(0x1234, 0x81A5, ee), 0, false, "DNS rcode 5"},
+		{"id mismatch", dnsResponse(0x4321, 0x81A0, ee), 0, false, "id mismatch"},
+		{"short header", []byte{0x12, 0x34, 0x81, 0xA0}, 0, false, "short DNS response"},
+		{"truncated record", dnsResponse(0x1234, 0x81A0, ee[:8]), 0, false, "truncated DNS record"},
+		{"truncated data", dnsResponse(0x1234, 0x81A0, ee[:len(ee)-1]), 0, false, "truncated DNS record data"},
+		{"truncated name", dnsResponse(0x1234, 0x81A0, []byte{0x07, 'e', 'x'}), 0, false, "truncated DNS name"},
+	}
+	for _, test := range tests {
+		records, secure, err := parseTLSAAnswer(test.answer, 0x1234, "_25._tcp.mx.example.com")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(records) != test.records || secure != test.secure {
+			t.Errorf("%s: got %d records (secure %v), want %d (secure %v)", test.name, len(records), secure, test.records, test.secure)
+		}
+	}
+
+	records, _, _ := parseTLSAAnswer(dnsResponse(0x1234, 0x81A0, ee, ta), 0x1234, "_25._tcp.mx.example.com")
+	want := []TLSARecord{{3, 1, 1, []byte{0xAA, 0xBB}}, {2, 0, 1, []byte{0xCC}}}
+	for i, record := range records {
+		if record.Usage != want[i].Usage || record.Selector != want[i].Selector ||
+			record.MatchingType != want[i].MatchingType || string(record.Data) != string(want[i].Data) {
+			t.Errorf("record %d = %+v, want %+v", i, record, want[i])
+		}
+	}
+}
+
+// testCertificate issues a certificate; a nil parent makes it self-signed
+func testCertificate(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{name}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// sha256Record returns a record with the SHA-256 digest of the selected data
+func sha256Record(usage, selector uint8, cert *x509.Certificate) TLSARecord {
+	data := cert.Raw
+	if selector == TLSA_SELECTOR_SPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(data)
+	return TLSARecord{Usage: usage, Selector: selector, MatchingType: TLSA_MATCH_SHA256, Data: sum[:]}
+}
+
+func TestVerifyDANE(t *testing.T) {
+	ca, caKey := testCertificate(t, "Example CA", true, nil, nil)
+	leaf, _ := testCertificate(t, "mx.example.com", false, ca, caKey)
+	other, _ := testCertificate(t, "mx.example.com", false, nil, nil)
+	caKeyRecord := TLSARecord{Usage: TLSA_USAGE_DANE_TA, Selector: TLSA_SELECTOR_SPKI, MatchingType: TLSA_MATCH_FULL, Data: ca.RawSubjectPublicKeyInfo}
+	pkixEE := TLSARecord{Usage: 1, Selector: TLSA_SELECTOR_CERT, MatchingType: TLSA_MATCH_FULL, Data: leaf.Raw}
+
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		host    string
+		records []TLSARecord
+		ok      bool
+	}{
+		{"EE certificate", []*x509.Certificate{leaf, ca}, "mx.example.com", []TLSARecord{sha256Record(3, TLSA_SELECTOR_CERT, leaf)}, true},
+		{"EE public key", []*x509.Certificate{leaf}, "mx.example.com", []TLSARecord{sha256Record(3, TLSA_SELECTOR_SPKI, leaf)}, true},
+		{"EE ignores the name", []*x509.Certificate{leaf}, "mx2.example.net", []TLSARecord{sha256Record(3, TLSA_SELECTOR_SPKI, leaf)}, true},
+		{"EE other certificate", []*x509.Certificate{other}, "mx.example.com", []TLSARecord{sha256Record(3, TLSA_SELECTOR_SPKI, leaf)}, false},
+		{"EE second record", []*x509.Certificate{leaf}, "mx.example.com", []TLSARecord{sha256Record(3, TLSA_SELECTOR_SPKI, other), sha256Record(3, TLSA_SELECTOR_SPKI, leaf)}, true},
+		{"TA in chain", []*x509.Certificate{leaf, ca}, "mx.example.com", []TLSARecord{sha256Record(2, TLSA_SELECTOR_CERT, ca)}, true},
+		{"TA public key in chain", []*x509.Certificate{leaf, ca}, "mx.example.com", []TLSARecord{sha256Record(2, TLSA_SELECTOR_SPKI, ca)}, true},
+		{"TA name mismatch", []*x509.Certificate{leaf, ca}, "mx.example.net", []TLSARecord{sha256Record(2, TLSA_SELECTOR_CERT, ca)}, false},
+		{"TA not the issuer", []*x509.Certificate{other, ca}, "mx.example.com", []TLSARecord{sha256Record(2, TLSA_SELECTOR_CERT, ca)}, false},
+		{"TA digest without anchor", []*x509.Certificate{leaf}, "mx.example.com", []TLSARecord{sha256Record(2, TLSA_SELECTOR_SPKI, ca)}, false},
+		{"TA full key without anchor", []*x509.Certificate{leaf}, "mx.example.com", []TLSARecord{caKeyRecord}, true},
+		{"TA full key name mismatch", []*x509.Certificate{leaf}, "mx.example.net", []TLSARecord{caKeyRecord}, false},
+		{"TA full key other issuer", []*x509.Certificate{other}, "mx.example.com", []TLSARecord{caKeyRecord}, false},
+		{"TA self-signed leaf", []*x509.Certificate{other}, "mx.example.com", []TLSARecord{sha256Record(2, TLSA_SELECTOR_CERT, other)}, true},
+		{"PKIX usage ignored", []*x509.Certificate{leaf, ca}, "mx.example.com", []TLSARecord{pkixEE}, false},
+		{"no certificate", nil, "mx.example.com", []TLSARecord{sha256Record(3, TLSA_SELECTOR_SPKI, leaf)}, false},
+	}
+	for _, test := range tests {
+		err := verifyDANE(test.chain, test.host, test.records)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Package delivery delivers mail directly to the mail exchangers of the recipient domains,
+// the way an MTA does: recipients are grouped by domain, MX records are resolved (with the
+// A/AAAA fallback), each host is tried in preference order on port 25 with STARTTLS as the
+// TLS policy, MTA-STS (RFC 8461) or DANE (RFC 7672) demand, and recipients that fail
+// temporarily move on to the next MX
+// Smarthost sends everything through one configured relay server instead
+//
+// Example:
+//
+//	deliverer := delivery.NewDeliverer(cfg)
+//	result := deliverer.DeliverMail(context.Background(), *m)
+//	for _, rcpt := range result.Deferred() {
+//		// retry later
+//	}
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/dkim"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// DefaultPort is the SMTP port used for relaying between MTAs
+const DefaultPort uint16 = 25
+
+// Deliverer delivers mail to the MX hosts of the recipient domains
+// The TLS used with a host comes from DANE, else from the domain's MTA-STS policy in enforce
+// mode, else from TLSPolicy
+type Deliverer struct {
+	Resolver    Resolver       // DNS lookups (net.DefaultResolver if nil)
+	Port        uint16         // Destination port (DefaultPort if 0)
+	Hostname    string         // Name sent with EHLO ("" = config.ClientHostname)
+	TLSPolicy   smtp.TLSPolicy // STARTTLS without DANE or MTA-STS (TLS_POLICY_OPPORTUNISTIC if "")
+	TLSConfig   *tls.Config    // Base config for STARTTLS (nil = default for the policy)
+	MTASTS      *MTASTS        // MTA-STS policy lookups (nil = disabled)
+	DANE        TLSAResolver   // TLSA lookups for DANE (nil = disabled)
+	Dialer      smtp.Dialer    // Opens the connections, e.g. through a proxy (smtp.SourceDialer() if nil)
+	Sources     *smtp.Sources  // Local address and EHLO name per sender or recipient domain (nil = default route and Hostname)
+	DKIM        *dkim.Signer   // Signs every message delivered (nil = unsigned)
+	DialTimeout time.Duration  // Timeout per connection attempt (30s if 0)
+}
+
+// NewDeliverer returns a Deliverer using the system resolver, the configured client hostname,
+// the SMTP_SOURCE_ADDRESSES, the SMTP_DKIM_* signer and the SMTP_DELIVERY_TLS_POLICY, SMTP_MTA_STS and SMTP_DANE settings
+func NewDeliverer(cfg *config.Config) *Deliverer {
+	deliverer := &Deliverer{
+		Resolver:    net.DefaultResolver,
+		Port:        DefaultPort,
+		Hostname:    cfg.ClientHostname,
+		TLSPolicy:   smtp.TLS_POLICY_OPPORTUNISTIC,
+		Sources:     smtp.SourcesFromConfig(cfg),
+		DKIM:        smtp.DKIMFromConfig(cfg),
+		DialTimeout: cfg.ClientConnectTimeout,
+	}
+	if policy, err := smtp.ParseTLSPolicy(cfg.DeliveryTLSPolicy); err == nil {
+		deliverer.TLSPolicy = policy
+	} else if cfg.DeliveryTLSPolicy != "" {
+		fmt.Fprintf(os.Stderr, "DELIVERY: Invalid SMTP_DELIVERY_TLS_POLICY, using %s: %v\n", deliverer.TLSPolicy, err)
+	}
+	if cfg.MTASTS {
+		deliverer.MTASTS = NewMTASTS()
+	}
+	if cfg.DANE {
+		deliverer.DANE = &DNSTLSAResolver{Server: cfg.DANEResolver}
+	}
+	return deliverer
+}
+
+// DeliverMail delivers a mail to all its To, Cc and Bcc recipients with its From as reverse-path
+func (d *Deliverer) DeliverMail(ctx context.Context, m mail.Mail) *Result {
+	recipients := make([]string, 0)
+	recipients = append(recipients, m.GetTo()...)
+	recipients = append(recipients, m.GetCC()...)
+	recipients = append(recipients, m.GetBCC()...)
+	return d.Deliver(ctx, m.GetFrom(), recipients, m)
+}
+
+// Deliver delivers a message to the given envelope recipients
+// from may be "" for the null reverse-path (bounces)
+// Every recipient gets a status: delivered, deferred (4xx, retry later) or failed (5xx)
+func (d *Deliverer) Deliver(ctx context.Context, from string, recipients []string, m mail.Mail) *Result {
+	statuses := make(map[string]RecipientStatus)
+
+	// Group recipients by domain, keeping the order in which domains first appear
+	domains := make([]string, 0)
+	byDomain := make(map[string][]string)
+	for _, rcpt := range recipients {
+		domain := recipientDomain(rcpt)
+		if domain == "" {
+			statuses[rcpt] = failure(rcpt, "", protocol.CODE_MAILBOX_UNAVAILABLE, "5.1.3", "Bad recipient address syntax")
+			continue
+		}
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	for _, domain := range domains {
+		for _, status := range d.deliverDomain(ctx, domain, from, byDomain[domain], m) {
+			statuses[status.Recipient] = status
+		}
+	}
+
+	result := &Result{Recipients: make([]RecipientStatus, 0, len(recipients))}
+	for _, rcpt := range recipients {
+		result.Recipients = append(result.Recipients, statuses[rcpt])
+	}
+	return result
+}
+
+// deliverDomain tries the MX hosts of one domain in order until no recipient is left with a temporary failure
+func (d *Deliverer) deliverDomain(ctx context.Context, domain, from string, recipients []string, m mail.Mail) []RecipientStatus {
+	hosts, err := LookupMX(ctx, d.resolver(), domain)
+	if err != nil {
+		return failAll(recipients, "", err)
+	}
+	policy := d.stsPolicy(ctx, domain)
+	source := d.Sources.Select(ctx, recipientDomain(from), domain)
+
+	statuses := make(map[string]RecipientStatus)
+	pending := recipients
+	for _, host := range hosts {
+		if len(pending) == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		var hostStatuses []RecipientStatus
+		plan, err := d.tlsPlan(ctx, domain, host, policy)
+		if err != nil {
+			hostStatuses = failAll(pending, host.Host, err)
+		} else {
+			hostStatuses = d.deliverHost(ctx, host, plan, source, from, pending, m)
+		}
+		next := make([]string, 0)
+		for _, status := range hostStatuses {
+			statuses[status.Recipient] = status
+			// Temporary failures are retried on the next MX
+			if status.Temporary() {
+				next = append(next, status.Recipient)
+			}
+		}
+		pending = next
+	}
+
+	ordered := make([]RecipientStatus, 0, len(recipients))
+	for _, rcpt := range recipients {
+		status, ok := statuses[rcpt]
+		if !ok {
+			status = failure(rcpt, "", protocol.CODE_LOCAL_ERROR, "4.4.1", "No MX host of "+domain+" could be reached")
+		}
+		ordered = append(ordered, status)
+	}
+	return ordered
+}
+
+// deliverHost connects to each address of an MX host until one answers
+// source (nil = default route) picks the local address and the EHLO name
+func (d *Deliverer) deliverHost(ctx context.Context, host MXHost, plan tlsPlan, source *smtp.Source, from string, recipients []string, m mail.Mail) []RecipientStatus {
+	addrs, err := d.resolver().LookupIPAddr(ctx, host.Host)
+	if err != nil {
+		return failAll(recipients, host.Host, &statusError{enhanced: "4.4.3", message: "Address lookup for " + host.Host + " failed: " + err.Error()})
+	}
+
+	var lastErr error = errors.New("no addresses")
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, source, addr.IP)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		statuses, tlsFailed := d.session(ctx, conn, host, plan, d.hostname(source), from, recipients, m)
+		if tlsFailed {
+			// Opportunistic TLS: a broken STARTTLS must not stop delivery, retry in plaintext
+			conn, err = d.dial(ctx, source, addr.IP)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			statuses, _ = d.session(ctx, conn, host, tlsPlan{policy: smtp.TLS_POLICY_NONE}, d.hostname(source), from, recipients, m)
+		}
+		return statuses
+	}
+	return failAll(recipients, host.Host, &statusError{enhanced: "4.4.1", message: "Connection to " + host.Host + " failed: " + lastErr.Error()})
+}
+
+// session runs one SMTP session with an MX host
+// tlsFailed is true when opportunistic STARTTLS failed, so the caller can retry without it
+// Cancelling ctx aborts the session wherever it is
+func (d *Deliverer) session(ctx context.Context, conn net.Conn, host MXHost, plan tlsPlan, hostname, from string, recipients []string, m mail.Mail) ([]RecipientStatus, bool) {
+	client, err := smtp.NewClientContext(ctx, conn, host.Host)
+	if err != nil {
+		conn.Close()
+		return failAll(recipients, host.Host, err), false
+	}
+	defer client.Close()
+
+	if err := client.Hello(hostname); err != nil {
+		return failAll(recipients, host.Host, err), false
+	}
+	client.SetTLSPolicy(plan.policy)
+	client.SetTLSConfig(plan.config)
+	if err := client.EnsureTLS(); err != nil {
+		if plan.policy == smtp.TLS_POLICY_OPPORTUNISTIC {
+			return failAll(recipients, host.Host, err), true
+		}
+		return failAll(recipients, host.Host, plan.failure(host.Host, err)), false
+	}
+
+	client.SetDKIM(d.DKIM)
+	result, err := client.SendEnvelope(from, recipients, m)
+	client.Quit()
+	return statusesFromSend(host.Host, recipients, result, err), false
+}
+
+func (d *Deliverer) dial(ctx context.Context, source *smtp.Source, ip net.IP) (net.Conn, error) {
+	port := d.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = smtp.SourceDialer(source)
+	}
+	return dialTimeout(ctx, dialer, d.DialTimeout, net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port)))
+}
+
+// hostname returns the EHLO name for connections from source: its own name if it has one
+func (d *Deliverer) hostname(source *smtp.Source) string {
+	if source != nil && source.Hostname != "" {
+		return source.Hostname
+	}
+	return d.Hostname
+}
+
+func (d *Deliverer) resolver() Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+// recipientDomain returns the lower-cased domain of an address, or "" if it has none
+func recipientDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+}
+
+// dialTimeout connects with a dialer (smtp.DefaultDialer() if nil) within timeout (30s if 0)
+func dialTimeout(ctx context.Context, dialer smtp.Dialer, timeout time.Duration, address string) (net.Conn, error) {
+	if dialer == nil {
+		dialer = smtp.DefaultDialer()
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return dialer.DialContext(ctx, "tcp", address)
+}
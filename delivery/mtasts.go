@@ -0,0 +1,286 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS (RFC 8461): a domain announces in DNS ("_mta-sts" TXT record) that it publishes a
+// policy over HTTPS; in enforce mode mail may only go to the MX hosts the policy lists, over
+// TLS with a certificate that is valid for the MX hostname
+
+// STSMode is the mode of an MTA-STS policy
+type STSMode string
+
+const (
+	STS_MODE_ENFORCE STSMode = "enforce" // Deliver only to matching MX hosts over verified TLS
+	STS_MODE_TESTING STSMode = "testing" // Report violations, deliver anyway
+	STS_MODE_NONE    STSMode = "none"    // The domain withdrew its policy
+)
+
+// stsMaxAge is the longest time a policy may be cached (RFC 8461 section 3.2)
+const stsMaxAge = 31557600 * time.Second
+
+// stsMaxPolicySize bounds the policy body (RFC 8461 section 3.3 suggests 64 KB)
+const stsMaxPolicySize = 64 * 1024
+
+// STSPolicy is a fetched MTA-STS policy
+type STSPolicy struct {
+	ID      string // id of the TXT record the policy was fetched for
+	Mode    STSMode
+	MX      []string // Permitted MX hosts; "*.example.com" matches exactly one extra label
+	MaxAge  time.Duration
+	Fetched time.Time
+}
+
+// Matches reports whether an MX host is permitted by the policy
+func (p *STSPolicy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			// The wildcard stands for the leftmost label only
+			if label, rest, found := strings.Cut(host, "."); found && label != "" && rest == suffix {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether the policy must not be used any more
+func (p *STSPolicy) expired(now time.Time) bool {
+	return now.After(p.Fetched.Add(p.MaxAge))
+}
+
+// TXTResolver looks up TXT records; *net.Resolver satisfies it
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// HTTPClient fetches policies; *http.Client satisfies it, tests can stub it
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// MTASTS looks up and caches MTA-STS policies; it is safe for concurrent use
+type MTASTS struct {
+	Resolver TXTResolver // net.DefaultResolver if nil
+	Client   HTTPClient  // nil = verifying HTTPS client that does not follow redirects
+
+	mu    sync.Mutex
+	cache map[string]*STSPolicy // By domain
+}
+
+// NewMTASTS returns policy lookups with the system resolver and the default HTTPS client
+func NewMTASTS() *MTASTS {
+	return &MTASTS{Resolver: net.DefaultResolver}
+}
+
+// Policy returns the MTA-STS policy of a domain, or nil if it has none
+// A cached policy is reused while its TXT record id is unchanged, and also while DNS or HTTPS
+// fail, until it expires (RFC 8461 section 5.1); err explains a lookup that failed anyway
+func (s *MTASTS) Policy(ctx context.Context, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+	cached := s.cached(domain, now)
+
+	id, err := s.lookupID(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			// No record: a cached policy stays in force until it expires
+			return cached, nil
+		}
+		return cached, err
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := s.fetch(ctx, domain)
+	if err != nil {
+		return cached, err
+	}
+	policy.ID = id
+	policy.Fetched = now
+	s.mu.Lock()
+	if s.cache == nil {
+		s.cache = make(map[string]*STSPolicy)
+	}
+	s.cache[domain] = policy
+	s.mu.Unlock()
+	return policy, nil
+}
+
+// cached returns the unexpired cached policy of a domain
+func (s *MTASTS) cached(domain string, now time.Time) *STSPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy, ok := s.cache[domain]
+	if !ok {
+		return nil
+	}
+	if policy.expired(now) {
+		delete(s.cache, domain)
+		return nil
+	}
+	return policy
+}
+
+// lookupID returns the id of the domain's "v=STSv1" TXT record (RFC 8461 section 3.1)
+func (s *MTASTS) lookupID(ctx context.Context, domain string) (string, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	records, err := resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, 0, 1)
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		fields := parseTagList(record)
+		if fields["v"] != "STSv1" || !validSTSID(fields["id"]) {
+			return "", fmt.Errorf("invalid MTA-STS record for %s: %q", domain, record)
+		}
+		ids = append(ids, fields["id"])
+	}
+	switch len(ids) {
+	case 0:
+		return "", &net.DNSError{Err: "no MTA-STS record", Name: "_mta-sts." + domain, IsNotFound: true}
+	case 1:
+		return ids[0], nil
+	default:
+		// Several records are treated as none at all, but unlike a missing record this is an error
+		return "", fmt.Errorf("%d MTA-STS records for %s", len(ids), domain)
+	}
+}
+
+// fetch downloads and parses https://mta-sts.<domain>/.well-known/mta-sts.txt
+func (s *MTASTS) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if client == nil {
+		client = defaultSTSClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("fetching MTA-STS policy of %s failed: %w", domain, err)
+	}
+	defer response.Body.Close()
+	// Redirects are not followed, so they end up here too (RFC 8461 section 3.3)
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching MTA-STS policy of %s failed: HTTP %d", domain, response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(strings.ToLower(contentType), "text/plain") {
+		return nil, fmt.Errorf("MTA-STS policy of %s has content type %q, not text/plain", domain, contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, stsMaxPolicySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching MTA-STS policy of %s failed: %w", domain, err)
+	}
+	if len(body) > stsMaxPolicySize {
+		return nil, fmt.Errorf("MTA-STS policy of %s is larger than %d bytes", domain, stsMaxPolicySize)
+	}
+	policy, err := ParseSTSPolicy(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("MTA-STS policy of %s: %w", domain, err)
+	}
+	return policy, nil
+}
+
+// defaultSTSClient verifies certificates (the default transport) and never follows redirects
+var defaultSTSClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// ParseSTSPolicy parses the "key: value" lines of a policy file (RFC 8461 section 3.2)
+func ParseSTSPolicy(text string) (*STSPolicy, error) {
+	policy := &STSPolicy{MX: make([]string, 0)}
+	version := ""
+	maxAge := ""
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = STSMode(value)
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			maxAge = value
+		}
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+	switch policy.Mode {
+	case STS_MODE_ENFORCE, STS_MODE_TESTING:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("no mx entries")
+		}
+	case STS_MODE_NONE:
+	default:
+		return nil, fmt.Errorf("invalid mode %q", policy.Mode)
+	}
+	seconds, err := strconv.ParseUint(maxAge, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_age %q", maxAge)
+	}
+	policy.MaxAge = min(time.Duration(seconds)*time.Second, stsMaxAge)
+	return policy, nil
+}
+
+// parseTagList splits "v=STSv1; id=20240101;" into its fields
+func parseTagList(record string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(record, ";") {
+		key, value, ok := strings.Cut(field, "=")
+		if ok {
+			fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
+
+// validSTSID reports whether an id is 1 to 32 letters and digits
+func validSTSID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
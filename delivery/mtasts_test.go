@@ -0,0 +1,187 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		mode   STSMode
+		mx     int
+		maxAge time.Duration
+		err    string
+	}{
+		{"enforce", "version: STSv1\nmode: enforce\nmx: mx1.example.com\nmx: *.example.net\nmax_age: 86400\n", STS_MODE_ENFORCE, 2, 24 * time.Hour, ""},
+		{"CRLF and spaces", "version: STSv1\r\nmode:testing\r\nmx:  mx.example.com \r\nmax_age: 600\r\n", STS_MODE_TESTING, 1, 10 * time.Minute, ""},
+		{"none without mx", "version: STSv1\nmode: none\nmax_age: 0\n", STS_MODE_NONE, 0, 0, ""},
+		{"unknown keys", "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 60\nfuture: yes\nnot a field\n", STS_MODE_ENFORCE, 1, time.Minute, ""},
+		{"max_age capped", "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 99999999\n", STS_MODE_ENFORCE, 1, stsMaxAge, ""},
+		{"no version", "mode: enforce\nmx: mx.example.com\nmax_age: 60\n", "", 0, 0, "unsupported version"},
+		{"wrong version", "version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 60\n", "", 0, 0, "unsupported version"},
+		{"invalid mode", "version: STSv1\nmode: Enforce\nmx: mx.example.com\nmax_age: 60\n", "", 0, 0, "invalid mode"},
+		{"enforce without mx", "version: STSv1\nmode: enforce\nmax_age: 60\n", "", 0, 0, "no mx entries"},
+		{"testing without mx", "version: STSv1\nmode: testing\nmax_age: 60\n", "", 0, 0, "no mx entries"},
+		{"no max_age", "version: STSv1\nmode: enforce\nmx: mx.example.com\n", "", 0, 0, "invalid max_age"},
+		{"negative max_age", "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: -1\n", "", 0, 0, "invalid max_age"},
+	}
+	for _, test := range tests {
+		policy, err := ParseSTSPolicy(test.text)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if policy.Mode != test.mode || len(policy.MX) != test.mx || policy.MaxAge != test.maxAge {
+			t.Errorf("%s: got mode %q, %d mx, max_age %s", test.name, policy.Mode, len(policy.MX), policy.MaxAge)
+		}
+	}
+}
+
+func TestSTSPolicyMatches(t *testing.T) {
+	policy := &STSPolicy{MX: []string{"mx1.example.com", "*.example.net", "MX.Example.ORG."}}
+	tests := map[string]bool{
+		"mx1.example.com":      true,
+		"MX1.EXAMPLE.COM.":     true,
+		"mx2.example.com":      false,
+		"mx.example.net":       true,
+		"example.net":          false,
+		"a.mx.example.net":     false,
+		".example.net":         false,
+		"mx.example.org":       true,
+		"mx1.example.com.evil": false,
+	}
+	for host, want := range tests {
+		if got := policy.Matches(host); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// stubTXT answers TXT lookups from a map; err is returned for every lookup if set
+type stubTXT struct {
+	records map[string][]string
+	err     error
+}
+
+func (r *stubTXT) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.records[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// stubHTTP serves one policy body and counts the requests
+type stubHTTP struct {
+	status      int
+	contentType string
+	body        string
+	requests    []string
+}
+
+func (c *stubHTTP) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req.URL.String())
+	header := http.Header{}
+	header.Set("Content-Type", c.contentType)
+	return &http.Response{StatusCode: c.status, Header: header, Body: io.NopCloser(strings.NewReader(c.body))}, nil
+}
+
+func TestMTASTSPolicyCache(t *testing.T) {
+	resolver := &stubTXT{records: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=20240101;"}}}
+	client := &stubHTTP{status: http.StatusOK, contentType: "text/plain; charset=utf-8",
+		body: "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n"}
+	sts := &MTASTS{Resolver: resolver, Client: client}
+	ctx := context.Background()
+
+	policy, err := sts.Policy(ctx, "Example.COM.")
+	if err != nil || policy == nil || policy.ID != "20240101" || policy.Mode != STS_MODE_ENFORCE {
+		t.Fatalf("got %+v (%v)", policy, err)
+	}
+	if len(client.requests) != 1 || client.requests[0] != "https://mta-sts.example.com/.well-known/mta-sts.txt" {
+		t.Fatalf("got requests %v", client.requests)
+	}
+
+	// Same id: the cached policy is used without fetching
+	if again, err := sts.Policy(ctx, "example.com"); again != policy || err != nil || len(client.requests) != 1 {
+		t.Errorf("same id: got %+v (%v) after %d requests", again, err, len(client.requests))
+	}
+
+	// New id: the policy is fetched again
+	resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=20240202"}
+	client.body = "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 3600\n"
+	policy, err = sts.Policy(ctx, "example.com")
+	if err != nil || policy.ID != "20240202" || policy.Mode != STS_MODE_TESTING || len(client.requests) != 2 {
+		t.Errorf("new id: got %+v (%v) after %d requests", policy, err, len(client.requests))
+	}
+
+	// Failed fetch, DNS failure or a removed record: the cached policy stays in force
+	resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=20240303"}
+	client.status = http.StatusNotFound
+	if got, err := sts.Policy(ctx, "example.com"); got != policy || err == nil {
+		t.Errorf("failed fetch: got %+v (%v), want the cached policy and the error", got, err)
+	}
+	resolver.err = errors.New("SERVFAIL")
+	if got, err := sts.Policy(ctx, "example.com"); got != policy || err == nil {
+		t.Errorf("DNS failure: got %+v (%v), want the cached policy and the error", got, err)
+	}
+	resolver.err = nil
+	delete(resolver.records, "_mta-sts.example.com")
+	if got, err := sts.Policy(ctx, "example.com"); got != policy || err != nil {
+		t.Errorf("removed record: got %+v (%v), want the cached policy", got, err)
+	}
+
+	// Past max_age the policy is dropped
+	policy.Fetched = time.Now().Add(-policy.MaxAge - time.Second)
+	if got, err := sts.Policy(ctx, "example.com"); got != nil || err != nil {
+		t.Errorf("expired: got %+v (%v), want no policy", got, err)
+	}
+}
+
+func TestMTASTSPolicyErrors(t *testing.T) {
+	policy := "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n"
+	tests := []struct {
+		name    string
+		records []string
+		client  *stubHTTP
+		err     string // "" = no policy and no error
+	}{
+		{"no record", nil, &stubHTTP{status: http.StatusOK, contentType: "text/plain", body: policy}, ""},
+		{"other TXT records", []string{"v=spf1 -all"}, &stubHTTP{status: http.StatusOK, contentType: "text/plain", body: policy}, ""},
+		{"invalid id", []string{"v=STSv1; id=2024-01-01"}, &stubHTTP{}, "invalid MTA-STS record"},
+		{"two records", []string{"v=STSv1; id=1", "v=STSv1; id=2"}, &stubHTTP{}, "2 MTA-STS records"},
+		{"redirect", []string{"v=STSv1; id=1"}, &stubHTTP{status: http.StatusFound}, "HTTP 302"},
+		{"content type", []string{"v=STSv1; id=1"}, &stubHTTP{status: http.StatusOK, contentType: "text/html", body: policy}, "not text/plain"},
+		{"too large", []string{"v=STSv1; id=1"}, &stubHTTP{status: http.StatusOK, contentType: "text/plain", body: policy + strings.Repeat("#", stsMaxPolicySize)}, "larger than"},
+		{"invalid policy", []string{"v=STSv1; id=1"}, &stubHTTP{status: http.StatusOK, contentType: "text/plain", body: "version: STSv1\n"}, "invalid mode"},
+	}
+	for _, test := range tests {
+		resolver := &stubTXT{records: map[string][]string{}}
+		if test.records != nil {
+			resolver.records["_mta-sts.example.com"] = test.records
+		}
+		sts := &MTASTS{Resolver: resolver, Client: test.client}
+		policy, err := sts.Policy(context.Background(), "example.com")
+		if policy != nil {
+			t.Errorf("%s: got policy %+v", test.name, policy)
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
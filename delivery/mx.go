@@ -0,0 +1,82 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver looks up the DNS records needed for delivery
+// *net.Resolver (e.g. net.DefaultResolver) satisfies it; tests can stub it with fixed records
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// MXHost is one mail exchanger of a domain
+type MXHost struct {
+	Host       string // Hostname without the trailing dot
+	Preference uint16
+	Implicit   bool // No MX records - the domain itself is used (RFC 5321 section 5.1)
+}
+
+// statusError is a failure without a server reply (DNS, TLS policy, AUTH) with the status to report
+type statusError struct {
+	permanent bool
+	enhanced  string
+	message   string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// LookupMX returns the mail exchangers of a domain, most preferred first
+// Domains without MX records fall back to their A/AAAA records (implicit MX)
+// A null MX (RFC 7505) or a non-existent domain is a permanent failure
+func LookupMX(ctx context.Context, resolver Resolver, domain string) ([]MXHost, error) {
+	records, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, &statusError{enhanced: "4.4.3", message: "MX lookup for " + domain + " failed: " + err.Error()}
+		}
+		// No MX records - use the domain itself if it has an address
+		if _, err := resolver.LookupIPAddr(ctx, domain); err != nil {
+			if isNotFound(err) {
+				return nil, &statusError{permanent: true, enhanced: "5.1.2", message: "Domain " + domain + " does not exist"}
+			}
+			return nil, &statusError{enhanced: "4.4.3", message: "Address lookup for " + domain + " failed: " + err.Error()}
+		}
+		return []MXHost{{Host: domain, Implicit: true}}, nil
+	}
+
+	// Null MX: "MX 0 ." means the domain accepts no mail (RFC 7505)
+	if len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return nil, &statusError{permanent: true, enhanced: "5.1.10", message: "Domain " + domain + " does not accept mail (null MX)"}
+	}
+
+	hosts := make([]MXHost, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Host, ".")
+		if host == "" {
+			continue
+		}
+		hosts = append(hosts, MXHost{Host: host, Preference: record.Pref})
+	}
+	if len(hosts) == 0 {
+		return nil, &statusError{permanent: true, enhanced: "5.1.2", message: "Domain " + domain + " has no usable MX records"}
+	}
+	// Lowest preference first; the resolver already shuffles hosts of equal preference
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].Preference < hosts[j].Preference
+	})
+	return hosts, nil
+}
+
+// isNotFound reports whether a lookup failed because the name or record does not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
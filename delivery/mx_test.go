@@ -0,0 +1,92 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// stubResolver answers with fixed records; names without records are not found
+type stubResolver struct {
+	mx    map[string][]*net.MX
+	addrs map[string][]net.IPAddr
+	err   error // Returned for every MX lookup if set
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.addrs[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestLookupMXOrder(t *testing.T) {
+	resolver := &stubResolver{mx: map[string][]*net.MX{
+		"example.com": {
+			{Host: "backup.example.com.", Pref: 20},
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "last.example.com.", Pref: 30},
+			{Host: "mx2.example.com.", Pref: 10},
+		},
+	}}
+	hosts, err := LookupMX(context.Background(), resolver, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mx1.example.com", "mx2.example.com", "backup.example.com", "last.example.com"}
+	if len(hosts) != len(want) {
+		t.Fatalf("got %d hosts, want %d", len(hosts), len(want))
+	}
+	for i, host := range hosts {
+		if host.Host != want[i] || host.Implicit {
+			t.Errorf("host %d = %+v, want %s", i, host, want[i])
+		}
+	}
+}
+
+func TestLookupMXImplicit(t *testing.T) {
+	resolver := &stubResolver{addrs: map[string][]net.IPAddr{"example.org": {{IP: net.ParseIP("192.0.2.1")}}}}
+	hosts, err := LookupMX(context.Background(), resolver, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Host != "example.org" || !hosts[0].Implicit {
+		t.Errorf("got %+v, want the implicit MX example.org", hosts)
+	}
+}
+
+func TestLookupMXFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		resolver  *stubResolver
+		domain    string
+		permanent bool
+		enhanced  string
+	}{
+		{"null MX", &stubResolver{mx: map[string][]*net.MX{"example.com": {{Host: ".", Pref: 0}}}}, "example.com", true, "5.1.10"},
+		{"no such domain", &stubResolver{}, "nowhere.example", true, "5.1.2"},
+		{"lookup error", &stubResolver{err: errors.New("server failure")}, "example.com", false, "4.4.3"},
+	}
+	for _, test := range tests {
+		_, err := LookupMX(context.Background(), test.resolver, test.domain)
+		var statusErr *statusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("%s: got error %v, want a status", test.name, err)
+			continue
+		}
+		if statusErr.permanent != test.permanent || statusErr.enhanced != test.enhanced {
+			t.Errorf("%s: got permanent=%v %s, want permanent=%v %s", test.name, statusErr.permanent, statusErr.enhanced, test.permanent, test.enhanced)
+		}
+	}
+}
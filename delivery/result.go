@@ -0,0 +1,125 @@
+package delivery
+
+import (
+	"errors"
+
+	"github.com/ImBubbles/MySMTP/smtp"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// RecipientStatus is the outcome of delivery for one recipient
+type RecipientStatus struct {
+	smtp.RecipientResult
+	Host    string // MX host that gave the final answer ("" if none was reached)
+	QueueID string // Queue ID assigned by the receiving server, if it reported one
+	DSN     bool   // The receiving server supports DSN and sends the notifications requested for this recipient
+}
+
+// Delivered reports whether the receiving server accepted the message for this recipient
+func (s RecipientStatus) Delivered() bool {
+	return s.Accepted()
+}
+
+// Permanent reports whether delivery failed for good (5xx) and the sender should be notified
+func (s RecipientStatus) Permanent() bool {
+	return s.Code >= 500
+}
+
+// Result is the outcome of one Deliver call, one status per recipient in input order
+type Result struct {
+	Recipients []RecipientStatus
+}
+
+// Delivered returns the recipients whose servers accepted the message
+func (r *Result) Delivered() []RecipientStatus {
+	return r.filter(RecipientStatus.Delivered)
+}
+
+// Deferred returns the recipients that failed temporarily and should be retried later
+func (r *Result) Deferred() []RecipientStatus {
+	return r.filter(func(s RecipientStatus) bool { return s.Temporary() })
+}
+
+// Failed returns the recipients that failed permanently
+func (r *Result) Failed() []RecipientStatus {
+	return r.filter(RecipientStatus.Permanent)
+}
+
+func (r *Result) filter(match func(RecipientStatus) bool) []RecipientStatus {
+	statuses := make([]RecipientStatus, 0)
+	for _, status := range r.Recipients {
+		if match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// failure builds a status that did not come from a server reply
+func failure(rcpt, host string, code protocol.SMTPCode, enhanced, message string) RecipientStatus {
+	return RecipientStatus{
+		RecipientResult: smtp.RecipientResult{Recipient: rcpt, Code: code, Enhanced: enhanced, Message: message},
+		Host:            host,
+	}
+}
+
+// failAll gives every recipient the status described by err
+func failAll(recipients []string, host string, err error) []RecipientStatus {
+	statuses := make([]RecipientStatus, 0, len(recipients))
+	for _, rcpt := range recipients {
+		statuses = append(statuses, statusFromError(rcpt, host, err))
+	}
+	return statuses
+}
+
+// statusFromError maps an error to a recipient status
+// Server replies keep their code; DNS errors carry their own; anything else (network, TLS)
+// is a temporary failure so the message is retried
+func statusFromError(rcpt, host string, err error) RecipientStatus {
+	var replyErr *smtp.ReplyError
+	if errors.As(err, &replyErr) {
+		return failure(rcpt, host, replyErr.Reply.Code, replyErr.Reply.Enhanced, replyErr.Reply.Message())
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		if statusErr.permanent {
+			return failure(rcpt, host, protocol.CODE_MAILBOX_UNAVAILABLE, statusErr.enhanced, statusErr.message)
+		}
+		return failure(rcpt, host, protocol.CODE_LOCAL_ERROR, statusErr.enhanced, statusErr.message)
+	}
+	return failure(rcpt, host, protocol.CODE_LOCAL_ERROR, "4.4.2", err.Error())
+}
+
+// statusesFromSend maps the outcome of a transaction to recipient statuses
+func statusesFromSend(host string, recipients []string, result *smtp.SendResult, err error) []RecipientStatus {
+	replies := make(map[string]smtp.RecipientResult)
+	if result != nil {
+		for _, rcpt := range result.Recipients {
+			replies[rcpt.Recipient] = rcpt
+		}
+	}
+
+	statuses := make([]RecipientStatus, 0, len(recipients))
+	for _, rcpt := range recipients {
+		reply, ok := replies[rcpt]
+		switch {
+		case ok && !reply.Accepted():
+			// Rejected at RCPT TO
+			statuses = append(statuses, RecipientStatus{RecipientResult: reply, Host: host})
+		case ok && result.DataCode != 0:
+			// Accepted at RCPT TO - the final reply to the message decides
+			statuses = append(statuses, RecipientStatus{
+				RecipientResult: smtp.RecipientResult{Recipient: rcpt, Code: result.DataCode, Enhanced: result.DataEnhanced, Message: result.DataMessage},
+				Host:            host,
+				QueueID:         result.QueueID,
+				DSN:             result.DSN,
+			})
+		case err != nil:
+			// MAIL FROM or DATA failed, or the connection broke
+			statuses = append(statuses, statusFromError(rcpt, host, err))
+		default:
+			statuses = append(statuses, failure(rcpt, host, protocol.CODE_LOCAL_ERROR, "4.4.2", "No reply from "+host))
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,189 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/dkim"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp"
+)
+
+// SmarthostTLS is how the connection to a smarthost is secured
+type SmarthostTLS string
+
+const (
+	SMARTHOST_TLS_NONE     SmarthostTLS = "none"     // Plaintext
+	SMARTHOST_TLS_STARTTLS SmarthostTLS = "starttls" // STARTTLS is required, delivery is deferred without it
+	SMARTHOST_TLS_IMPLICIT SmarthostTLS = "tls"      // TLS from the start (SMTPS, usually port 465)
+)
+
+// ParseSmarthostTLS parses a SMTP_SMARTHOST_TLS value
+func ParseSmarthostTLS(value string) (SmarthostTLS, error) {
+	mode := SmarthostTLS(strings.ToLower(strings.TrimSpace(value)))
+	switch mode {
+	case SMARTHOST_TLS_NONE, SMARTHOST_TLS_STARTTLS, SMARTHOST_TLS_IMPLICIT:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown smarthost TLS mode %q (none, starttls or tls)", value)
+}
+
+// Smarthost sends all mail through one relay server instead of the recipient MX hosts
+// It has the same Deliver method as Deliverer, so either can feed a queue
+type Smarthost struct {
+	Host              string
+	Port              uint16        // 587 if 0
+	TLS               SmarthostTLS  // SMARTHOST_TLS_STARTTLS unless SMARTHOST_TLS_NONE or SMARTHOST_TLS_IMPLICIT
+	TLSConfig         *tls.Config   // nil = verify the certificate against Host
+	Auth              smtp.Auth     // AUTH with the smarthost (nil = no AUTH)
+	AllowInsecureAuth bool          // Allow AUTH without TLS (SMARTHOST_TLS_NONE)
+	Hostname          string        // Name sent with EHLO ("" = config.ClientHostname)
+	Dialer            smtp.Dialer   // Opens the connection, e.g. through a proxy (smtp.SourceDialer() if nil)
+	Sources           *smtp.Sources // Local address and EHLO name per sender domain (nil = default route and Hostname)
+	DKIM              *dkim.Signer  // Signs every message relayed (nil = unsigned)
+	DialTimeout       time.Duration // Timeout for the connect and the implicit TLS handshake (30s if 0)
+}
+
+// NewSmarthost returns the smarthost configured by SMTP_SMARTHOST and SMTP_SMARTHOST_*, signing with SMTP_DKIM_*
+func NewSmarthost(cfg *config.Config) *Smarthost {
+	smarthost := &Smarthost{
+		Host:              cfg.SmarthostHost,
+		Port:              cfg.SmarthostPort,
+		TLS:               SMARTHOST_TLS_STARTTLS,
+		AllowInsecureAuth: cfg.ClientAllowInsecureAuth,
+		Hostname:          cfg.ClientHostname,
+		Sources:           smtp.SourcesFromConfig(cfg),
+		DKIM:              smtp.DKIMFromConfig(cfg),
+		DialTimeout:       cfg.ClientConnectTimeout,
+	}
+	if mode, err := ParseSmarthostTLS(cfg.SmarthostTLS); err == nil {
+		smarthost.TLS = mode
+	} else if cfg.SmarthostTLS != "" {
+		fmt.Fprintf(os.Stderr, "DELIVERY: Invalid SMTP_SMARTHOST_TLS, using %s: %v\n", smarthost.TLS, err)
+	}
+	if cfg.SmarthostUsername != "" {
+		smarthost.Auth = smtp.CredentialsAuth("", cfg.SmarthostUsername, cfg.SmarthostPassword, "")
+	}
+	return smarthost
+}
+
+// Deliver hands a message for all recipients to the smarthost in one transaction
+// from may be "" for the null reverse-path (bounces)
+// Connection, TLS and AUTH problems defer every recipient; the smarthost's replies decide otherwise
+func (s *Smarthost) Deliver(ctx context.Context, from string, recipients []string, m mail.Mail) *Result {
+	client, err := s.connect(ctx, from)
+	if err != nil {
+		return &Result{Recipients: failAll(recipients, s.Host, err)}
+	}
+	defer client.Close()
+
+	client.SetDKIM(s.DKIM)
+	result, err := client.SendEnvelope(from, recipients, m)
+	client.Quit()
+	return &Result{Recipients: statusesFromSend(s.Host, recipients, result, err)}
+}
+
+// connect opens a session with the smarthost that is ready for a transaction
+// The source address is chosen by the sender domain and the smarthost as destination
+func (s *Smarthost) connect(ctx context.Context, from string) (*smtp.ClientConn, error) {
+	mode := s.TLS
+	if mode != SMARTHOST_TLS_NONE && mode != SMARTHOST_TLS_IMPLICIT {
+		// Only an explicit SMARTHOST_TLS_NONE connects without TLS
+		mode = SMARTHOST_TLS_STARTTLS
+	}
+	source := s.Sources.Select(ctx, recipientDomain(from), s.Host)
+	conn, err := s.dial(ctx, source, mode)
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClientContext(ctx, conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	hostname := s.Hostname
+	if source != nil && source.Hostname != "" {
+		hostname = source.Hostname
+	}
+	if err := client.Hello(hostname); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if mode == SMARTHOST_TLS_STARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, temporary("4.7.10", "Smarthost "+s.Host+" does not offer STARTTLS")
+		}
+		if err := client.StartTLS(s.tlsConfig()); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if s.Auth != nil {
+		client.SetAllowInsecureAuth(s.AllowInsecureAuth)
+		if err := client.Auth(s.Auth); err != nil {
+			client.Close()
+			// Bad credentials are a configuration problem - keep the mail queued until it is fixed
+			return nil, temporary("4.7.0", "Authentication with smarthost "+s.Host+" failed: "+err.Error())
+		}
+	}
+	return client, nil
+}
+
+func (s *Smarthost) dial(ctx context.Context, source *smtp.Source, mode SmarthostTLS) (net.Conn, error) {
+	port := s.Port
+	if port == 0 {
+		port = 587
+	}
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dialer := s.Dialer
+	if dialer == nil {
+		dialer = smtp.SourceDialer(source)
+	}
+	conn, err := dialTimeout(ctx, dialer, timeout, net.JoinHostPort(s.Host, fmt.Sprintf("%d", port)))
+	if err != nil {
+		return nil, err
+	}
+	if mode == SMARTHOST_TLS_IMPLICIT {
+		tlsConn := tls.Client(conn, s.tlsConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", s.Host, err)
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+// tlsConfig verifies the smarthost certificate unless a config says otherwise
+// Unlike MX delivery the smarthost is a known, configured server
+func (s *Smarthost) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		config := s.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = s.Host
+		}
+		return config
+	}
+	return &tls.Config{
+		ServerName: s.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// temporary builds an error that statusFromError maps to a temporary failure with this status
+func temporary(enhanced string, message string) error {
+	return &statusError{enhanced: enhanced, message: message}
+}
@@ -0,0 +1,84 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+func TestParseSmarthostTLS(t *testing.T) {
+	tests := map[string]SmarthostTLS{
+		"none":       SMARTHOST_TLS_NONE,
+		"starttls":   SMARTHOST_TLS_STARTTLS,
+		" STARTTLS ": SMARTHOST_TLS_STARTTLS,
+		"tls":        SMARTHOST_TLS_IMPLICIT,
+	}
+	for value, want := range tests {
+		if got, err := ParseSmarthostTLS(value); got != want || err != nil {
+			t.Errorf("%q: got %q (%v), want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "startls", "ssl", "plain"} {
+		if _, err := ParseSmarthostTLS(value); err == nil {
+			t.Errorf("%q: accepted", value)
+		}
+	}
+}
+
+// pipeDialer connects to a server that offers no STARTTLS and records the commands it gets
+type pipeDialer struct {
+	commands chan []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		var commands []string
+		defer func() { d.commands <- commands }()
+		reader := bufio.NewReader(server)
+		server.Write([]byte("220 smarthost.example.com ESMTP\r\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			commands = append(commands, strings.Fields(line + " x")[0])
+			switch strings.ToUpper(commands[len(commands)-1]) {
+			case "EHLO":
+				server.Write([]byte("250 smarthost.example.com\r\n"))
+			case "QUIT":
+				server.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				server.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return client, nil
+}
+
+func TestSmarthostUnknownTLSRequiresSTARTTLS(t *testing.T) {
+	for _, value := range []string{"startls", ""} {
+		smarthost := NewSmarthost(&config.Config{SmarthostHost: "smarthost.example.com", SmarthostTLS: value, ClientHostname: "mx.example.org"})
+		if smarthost.TLS != SMARTHOST_TLS_STARTTLS {
+			t.Errorf("%q: got mode %q, want starttls", value, smarthost.TLS)
+		}
+	}
+
+	// A mode set directly is not trusted either: only "none" skips STARTTLS
+	dialer := &pipeDialer{commands: make(chan []string, 1)}
+	smarthost := &Smarthost{Host: "smarthost.example.com", TLS: "startls", Hostname: "mx.example.org", Dialer: dialer}
+	result := smarthost.Deliver(context.Background(), "alice@example.org", []string{"bob@example.com"}, mail.Mail{})
+	if deferred := result.Deferred(); len(deferred) != 1 || deferred[0].Enhanced != "4.7.10" {
+		t.Errorf("got %+v, want the recipient deferred for missing STARTTLS", result.Recipients)
+	}
+	if commands := <-dialer.commands; strings.Contains(strings.Join(commands, " "), "MAIL") {
+		t.Errorf("server got %q, want no transaction in plaintext", commands)
+	}
+}
@@ -0,0 +1,96 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ImBubbles/MySMTP/smtp"
+)
+
+// tlsPlan is how the session with one MX host uses TLS
+type tlsPlan struct {
+	policy smtp.TLSPolicy
+	config *tls.Config // nil = default for the policy
+	source string      // What demands TLS ("DANE", "MTA-STS"); "" for the configured policy
+}
+
+// failure turns a STARTTLS error into a temporary failure: the next MX, or a later retry,
+// may do better, and sending without the required protection is not an option
+func (p tlsPlan) failure(host string, err error) error {
+	source := p.source
+	if source == "" {
+		source = "TLS policy " + string(p.policy)
+	}
+	if errors.Is(err, smtp.ErrTLSUnavailable) {
+		return temporary("4.7.10", fmt.Sprintf("%s does not offer STARTTLS, required by %s", host, source))
+	}
+	return temporary("4.7.5", fmt.Sprintf("TLS with %s failed (%s): %v", host, source, err))
+}
+
+// stsPolicy returns the MTA-STS policy of a domain, or nil if there is none or it is disabled
+// A failed lookup is logged and treated like no policy, unless a cached policy is still valid
+func (d *Deliverer) stsPolicy(ctx context.Context, domain string) *STSPolicy {
+	if d.MTASTS == nil {
+		return nil
+	}
+	policy, err := d.MTASTS.Policy(ctx, domain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DELIVERY: MTA-STS lookup for %s failed: %v\n", domain, err)
+	}
+	if policy == nil || policy.Mode == STS_MODE_NONE {
+		return nil
+	}
+	return policy
+}
+
+// tlsPlan decides the TLS for an MX host: DANE takes precedence over MTA-STS (RFC 8461
+// section 2), and either overrides the configured policy
+// An error means the host must not be used now (policy mismatch, failed TLSA lookup)
+func (d *Deliverer) tlsPlan(ctx context.Context, domain string, host MXHost, sts *STSPolicy) (tlsPlan, error) {
+	if d.DANE != nil {
+		port := d.Port
+		if port == 0 {
+			port = DefaultPort
+		}
+		records, secure, err := d.DANE.LookupTLSA(ctx, fmt.Sprintf("_%d._tcp.%s", port, host.Host))
+		if err != nil {
+			// The records may exist; sending without them could bypass DANE (RFC 7672 section 2.2)
+			return tlsPlan{}, temporary("4.7.5", err.Error())
+		}
+		if secure && len(records) > 0 {
+			usable := make([]TLSARecord, 0, len(records))
+			for _, record := range records {
+				if record.usable() {
+					usable = append(usable, record)
+				}
+			}
+			if len(usable) == 0 {
+				// Only unusable records: TLS is still mandatory, but can't be authenticated
+				return tlsPlan{policy: smtp.TLS_POLICY_REQUIRED, config: d.TLSConfig, source: "DANE"}, nil
+			}
+			return tlsPlan{policy: smtp.TLS_POLICY_REQUIRED, config: daneTLSConfig(d.TLSConfig, host.Host, usable), source: "DANE"}, nil
+		}
+	}
+
+	if sts != nil {
+		matches := sts.Matches(host.Host)
+		switch {
+		case sts.Mode == STS_MODE_ENFORCE && !matches:
+			return tlsPlan{}, temporary("4.7.5", fmt.Sprintf("MX host %s is not permitted by the MTA-STS policy of %s", host.Host, domain))
+		case sts.Mode == STS_MODE_ENFORCE:
+			return tlsPlan{policy: smtp.TLS_POLICY_VERIFY, config: d.TLSConfig, source: "MTA-STS"}, nil
+		case !matches:
+			// Testing mode: report and deliver anyway
+			fmt.Fprintf(os.Stderr, "DELIVERY: MX host %s is not permitted by the MTA-STS policy of %s (testing mode)\n", host.Host, domain)
+		}
+	}
+
+	policy := d.TLSPolicy
+	if policy == "" {
+		policy = smtp.TLS_POLICY_OPPORTUNISTIC
+	}
+	return tlsPlan{policy: policy, config: d.TLSConfig}, nil
+}
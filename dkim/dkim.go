@@ -0,0 +1,169 @@
+// Package dkim signs outgoing mail with DomainKeys Identified Mail signatures (RFC 6376)
+// using RSA-SHA256 or Ed25519-SHA256 (RFC 8463), with simple or relaxed canonicalization,
+// and verifies the signatures of incoming mail
+//
+// Example:
+//
+//	key, err := dkim.LoadKey("dkim.pem")
+//	signer := dkim.NewSigner("example.com", "mail", key)
+//	signed, err := signer.Sign(message)
+//	record, err := signer.Record() // TXT record for mail._domainkey.example.com
+//
+//	for _, result := range dkim.Verify(ctx, received, nil) {
+//		fmt.Println(result) // dkim=pass header.d=example.com header.s=mail header.b=...
+//	}
+package dkim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Algorithms of the a= tag
+const (
+	ALGORITHM_RSA_SHA256     = "rsa-sha256"
+	ALGORITHM_ED25519_SHA256 = "ed25519-sha256"
+)
+
+// Canonicalizations of the c= tag (RFC 6376 section 3.4)
+const (
+	CANONICALIZATION_SIMPLE  = "simple"  // Header fields and body as they are, except trailing empty lines
+	CANONICALIZATION_RELAXED = "relaxed" // Tolerates whitespace changes and header field name case
+)
+
+// SIGNATURE_HEADER is the name of the header field holding a signature
+const SIGNATURE_HEADER = "DKIM-Signature"
+
+// DefaultHeaders are the header fields signed when a Signer names none
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Sender", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"Content-Disposition", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// ParseCanonicalization parses a c= value such as "relaxed/simple"
+// A single name applies to the header only; the body then uses simple (RFC 6376 section 3.5)
+func ParseCanonicalization(value string) (header string, body string, err error) {
+	header, body, found := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "/")
+	if !found {
+		body = CANONICALIZATION_SIMPLE
+	}
+	for _, name := range []string{header, body} {
+		if name != CANONICALIZATION_SIMPLE && name != CANONICALIZATION_RELAXED {
+			return "", "", fmt.Errorf("unknown canonicalization %q (simple or relaxed)", value)
+		}
+	}
+	return header, body, nil
+}
+
+// headerField is one header field of a message, continuation lines included
+type headerField struct {
+	name string // Field name as written
+	raw  string // Whole field with its line breaks, ending with CRLF
+}
+
+// splitMessage converts line endings to CRLF and splits a message into its header fields and body
+// A message without an empty line has no body
+func splitMessage(message []byte) ([]headerField, []byte) {
+	message = toCRLF(message)
+	fields := make([]headerField, 0)
+	rest := message
+	for len(rest) > 0 {
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			return fields, rest[2:]
+		}
+		end := 0
+		for {
+			next := bytes.Index(rest[end:], []byte("\r\n"))
+			if next < 0 {
+				end = len(rest)
+				break
+			}
+			end += next + 2
+			// Lines starting with whitespace continue the field
+			if end >= len(rest) || (rest[end] != ' ' && rest[end] != '\t') {
+				break
+			}
+		}
+		raw := string(rest[:end])
+		if !strings.HasSuffix(raw, "\r\n") {
+			raw += "\r\n"
+		}
+		name, _, _ := strings.Cut(raw, ":")
+		fields = append(fields, headerField{name: strings.TrimRight(name, " \t"), raw: raw})
+		rest = rest[end:]
+	}
+	return fields, nil
+}
+
+// toCRLF turns bare LF line endings into CRLF, as the SMTP client sends them
+func toCRLF(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) {
+		return data
+	}
+	converted := make([]byte, 0, len(data)+len(data)/40)
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, b)
+	}
+	return converted
+}
+
+// canonicalHeader canonicalizes one header field, CRLF included (RFC 6376 section 3.4.1 and 3.4.2)
+func canonicalHeader(raw string, canonicalization string) string {
+	if canonicalization == CANONICALIZATION_SIMPLE {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// canonicalBody canonicalizes a body (RFC 6376 section 3.4.3 and 3.4.4)
+func canonicalBody(body []byte, canonicalization string) []byte {
+	if canonicalization == CANONICALIZATION_RELAXED {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			lines[i] = relaxLine(line)
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	// Trailing empty lines are ignored; the body ends with exactly one CRLF
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		if canonicalization == CANONICALIZATION_RELAXED {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return append(body[:len(body):len(body)], '\r', '\n')
+}
+
+// relaxLine removes whitespace at the end of a body line and reduces other runs of it to one space
+func relaxLine(line []byte) []byte {
+	line = bytes.TrimRight(line, " \t")
+	relaxed := make([]byte, 0, len(line))
+	space := false
+	for _, b := range line {
+		if b == ' ' || b == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			relaxed = append(relaxed, ' ')
+			space = false
+		}
+		relaxed = append(relaxed, b)
+	}
+	return relaxed
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
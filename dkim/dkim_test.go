@@ -0,0 +1,197 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"strings"
+	"testing"
+)
+
+// stubResolver serves TXT records from a map; other names do not exist
+type stubResolver struct {
+	records map[string]string
+	err     error // Returned for every lookup if set
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	record, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return []string{record}, nil
+}
+
+// Example message of RFC 8463 appendix A, signed with its Ed25519 key
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const testMessage = "From: Alice <alice@example.com>\nTo: bob@example.org\nSubject:  hello\n   world\n\nBody  line \n\n\n"
+
+func testKeys(t *testing.T) []crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []crypto.Signer{rsaKey, edKey}
+}
+
+// publish returns a resolver holding the key record of a signer
+func publish(t *testing.T, signer *Signer) *stubResolver {
+	t.Helper()
+	record, err := signer.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &stubResolver{records: map[string]string{signer.Selector + "._domainkey." + signer.Domain: record}}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, key := range testKeys(t) {
+		for _, canonicalization := range []string{"relaxed/relaxed", "simple/simple", "relaxed/simple", "simple/relaxed"} {
+			signer := NewSigner("example.com", "mail", key)
+			signer.HeaderCanonicalization, signer.BodyCanonicalization, _ = ParseCanonicalization(canonicalization)
+			signed, err := signer.Sign([]byte(testMessage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := Verify(context.Background(), signed, publish(t, signer))
+			if len(results) != 1 || results[0].Status != STATUS_PASS {
+				t.Errorf("%T %s: got %v", key, canonicalization, results)
+				continue
+			}
+			if results[0].Domain != "example.com" || results[0].Selector != "mail" || results[0].Identity != "@example.com" {
+				t.Errorf("%T %s: unexpected result %+v", key, canonicalization, results[0])
+			}
+		}
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	signer := NewSigner("example.com", "mail", testKeys(t)[1])
+	signed, err := signer.Sign([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := publish(t, signer)
+	tests := map[string]string{
+		"body":          strings.Replace(string(signed), "Body", "Fake", 1),
+		"header":        strings.Replace(string(signed), "Subject:  hello", "Subject:  howdy", 1),
+		"added From":    "From: mallory@example.net\r\n" + string(signed),
+		"appended From": string(signed[:len(signed)-len("\r\nBody  line \r\n\r\n\r\n")]) + "From: mallory@example.net\r\n\r\nBody  line \r\n\r\n\r\n",
+	}
+	for name, message := range tests {
+		results := Verify(context.Background(), []byte(message), resolver)
+		if len(results) != 1 || results[0].Status != STATUS_FAIL {
+			t.Errorf("%s: got %v, want fail", name, results)
+		}
+	}
+
+	// Whitespace changes pass with relaxed canonicalization
+	reformatted := strings.Replace(string(signed), "Body  line", "Body line", 1)
+	if results := Verify(context.Background(), []byte(reformatted), resolver); results[0].Status != STATUS_PASS {
+		t.Errorf("relaxed body: got %v, want pass", results)
+	}
+}
+
+func TestVerifyKeyErrors(t *testing.T) {
+	signer := NewSigner("example.com", "mail", testKeys(t)[0])
+	signed, err := signer.Sign([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		resolver *stubResolver
+		status   Status
+	}{
+		{"no key", &stubResolver{}, STATUS_PERMERROR},
+		{"revoked key", &stubResolver{records: map[string]string{"mail._domainkey.example.com": "v=DKIM1; k=rsa; p="}}, STATUS_PERMERROR},
+		{"wrong key type", &stubResolver{records: map[string]string{"mail._domainkey.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}}, STATUS_PERMERROR},
+		{"DNS timeout", &stubResolver{err: &net.DNSError{Err: "i/o timeout", Name: "mail._domainkey.example.com", IsTimeout: true}}, STATUS_TEMPERROR},
+	}
+	for _, test := range tests {
+		results := Verify(context.Background(), signed, test.resolver)
+		if len(results) != 1 || results[0].Status != test.status {
+			t.Errorf("%s: got %v, want %s", test.name, results, test.status)
+		}
+	}
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	resolver := &stubResolver{records: map[string]string{
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	}}
+	results := Verify(context.Background(), []byte(rfc8463Message), resolver)
+	if len(results) != 1 || results[0].Status != STATUS_PASS {
+		t.Fatalf("got %v, want pass", results)
+	}
+	if got := results[0].String(); !strings.HasPrefix(got, "dkim=pass header.d=football.example.com header.s=brisbane") {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	if results := Verify(context.Background(), []byte(testMessage), &stubResolver{}); len(results) != 0 {
+		t.Errorf("got %v for an unsigned message", results)
+	}
+}
+
+func TestParseCanonicalization(t *testing.T) {
+	tests := map[string][2]string{
+		"relaxed/simple": {"relaxed", "simple"},
+		"Relaxed":        {"relaxed", "simple"},
+		"simple/relaxed": {"simple", "relaxed"},
+	}
+	for value, want := range tests {
+		header, body, err := ParseCanonicalization(value)
+		if err != nil || header != want[0] || body != want[1] {
+			t.Errorf("%q: got %s/%s %v, want %s/%s", value, header, body, err, want[0], want[1])
+		}
+	}
+	if _, _, err := ParseCanonicalization("loose/simple"); err == nil {
+		t.Error("accepted an unknown canonicalization")
+	}
+}
+
+func TestAligned(t *testing.T) {
+	signer := &Signer{Domain: "Example.com."}
+	for domain, want := range map[string]bool{
+		"example.com":      true,
+		"mail.example.com": true,
+		"EXAMPLE.COM.":     true,
+		"notexample.com":   false,
+		"example.org":      false,
+		"":                 false,
+	} {
+		if got := signer.Aligned(domain); got != want {
+			t.Errorf("Aligned(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signatures are folded at this line length
+const maxLineLength = 78
+
+// Signer adds a DKIM-Signature to messages of one domain
+type Signer struct {
+	Domain                 string        // Signing domain (d=)
+	Selector               string        // Key selector (s=); the public key is at <selector>._domainkey.<domain>
+	Key                    crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers                []string      // Header fields to sign, every instance present (DefaultHeaders if empty)
+	Oversign               []string      // Fields signed once more than present, so no instance can be added later
+	HeaderCanonicalization string        // simple or relaxed (relaxed if "")
+	BodyCanonicalization   string        // simple or relaxed (relaxed if "")
+	Expiration             time.Duration // Signatures expire this long after signing (x=; 0 = never)
+}
+
+// NewSigner returns a Signer with relaxed/relaxed canonicalization, the DefaultHeaders and From oversigned
+func NewSigner(domain string, selector string, key crypto.Signer) *Signer {
+	return &Signer{
+		Domain:                 domain,
+		Selector:               selector,
+		Key:                    key,
+		Oversign:               []string{"From"},
+		HeaderCanonicalization: CANONICALIZATION_RELAXED,
+		BodyCanonicalization:   CANONICALIZATION_RELAXED,
+	}
+}
+
+// LoadKey reads a PEM private key file (see ParseKey)
+func LoadKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM key: %w", err)
+	}
+	return ParseKey(data)
+}
+
+// ParseKey parses a PEM private key: RSA in PKCS #1 ("RSA PRIVATE KEY"), or RSA or Ed25519
+// in PKCS #8 ("PRIVATE KEY"); RSA keys need at least 1024 bits (RFC 8301 section 3.2)
+func ParseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in DKIM key")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("DKIM RSA key has %d bits, at least 1024 are required", key.N.BitLen())
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported DKIM key algorithm %T (RSA or Ed25519)", key)
+}
+
+// Algorithm returns the a= value for the key
+func (s *Signer) Algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return ALGORITHM_RSA_SHA256, nil
+	case ed25519.PrivateKey:
+		return ALGORITHM_ED25519_SHA256, nil
+	}
+	return "", fmt.Errorf("unsupported DKIM key algorithm %T (RSA or Ed25519)", s.Key)
+}
+
+// Record returns the TXT record to publish at <selector>._domainkey.<domain>
+func (s *Signer) Record() (string, error) {
+	algorithm, err := s.Algorithm()
+	if err != nil {
+		return "", err
+	}
+	if algorithm == ALGORITHM_ED25519_SHA256 {
+		// Ed25519 records hold the raw 32-byte key (RFC 8463 section 4.2)
+		public := s.Key.Public().(ed25519.PublicKey)
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public), nil
+	}
+	public, err := x509.MarshalPKIXPublicKey(s.Key.Public())
+	if err != nil {
+		return "", err
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public), nil
+}
+
+// Aligned reports whether mail from a domain may carry this signer's signature: the domain is
+// the signing domain or a subdomain of it (the relaxed DMARC alignment of RFC 7489 section 3.1.1)
+func (s *Signer) Aligned(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	signing := strings.ToLower(strings.TrimSuffix(s.Domain, "."))
+	return signing != "" && (domain == signing || strings.HasSuffix(domain, "."+signing))
+}
+
+// Sign returns the message with a DKIM-Signature header field in front
+// Line endings are converted to CRLF first, so the result is what goes over SMTP
+func (s *Signer) Sign(message []byte) ([]byte, error) {
+	message = toCRLF(message)
+	signature, err := s.Signature(message)
+	if err != nil {
+		return nil, err
+	}
+	signed := make([]byte, 0, len(signature)+len(message))
+	signed = append(signed, signature...)
+	return append(signed, message...), nil
+}
+
+// Signature returns the DKIM-Signature header field for a message, ending with CRLF
+func (s *Signer) Signature(message []byte) (string, error) {
+	if s.Domain == "" || s.Selector == "" {
+		return "", errors.New("DKIM domain and selector are required")
+	}
+	algorithm, err := s.Algorithm()
+	if err != nil {
+		return "", err
+	}
+	headerCanonicalization := orDefault(s.HeaderCanonicalization, CANONICALIZATION_RELAXED)
+	bodyCanonicalization := orDefault(s.BodyCanonicalization, CANONICALIZATION_RELAXED)
+
+	fields, body := splitMessage(message)
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanonicalization))
+	signed := s.signedHeaders(fields)
+	if len(signed) == 0 {
+		return "", errors.New("no header fields to sign")
+	}
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=" + headerCanonicalization + "/" + bodyCanonicalization,
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if s.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(s.Expiration).Unix(), 10))
+	}
+	tags = append(tags, "h="+strings.Join(signed, ":"), "bh="+base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// b= stays empty while hashing and is filled in last, so the verifier can remove it again
+	header := foldTags(tags) + "\r\n b="
+
+	hash := sha256.New()
+	for _, field := range selectHeaders(fields, signed) {
+		hash.Write([]byte(canonicalHeader(field, headerCanonicalization)))
+	}
+	// The signature field itself goes in last, without its CRLF (RFC 6376 section 3.7)
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(header+"\r\n", headerCanonicalization), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var signature []byte
+	if algorithm == ALGORITHM_ED25519_SHA256 {
+		// Ed25519 signs the SHA-256 hash (RFC 8463 section 3)
+		signature, err = s.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		signature, err = s.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("DKIM signing failed: %w", err)
+	}
+	return header + foldBase64(base64.StdEncoding.EncodeToString(signature), len(" b=")) + "\r\n", nil
+}
+
+// signedHeaders returns the h= field names: each configured field once per instance in the
+// message, and the oversigned ones once more
+func (s *Signer) signedHeaders(fields []headerField) []string {
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	signed := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, field := range fields {
+			if strings.EqualFold(field.name, name) {
+				signed = append(signed, name)
+			}
+		}
+		for _, oversigned := range s.Oversign {
+			if strings.EqualFold(oversigned, name) {
+				signed = append(signed, name)
+			}
+		}
+	}
+	return signed
+}
+
+// selectHeaders returns the fields named in h=, in that order; a name repeated in h= takes the
+// next instance from the bottom of the header, and names without one more instance are skipped
+// (RFC 6376 section 5.4.2)
+func selectHeaders(fields []headerField, names []string) []string {
+	used := make(map[string]int)
+	selected := make([]string, 0, len(names))
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		skip := used[key]
+		used[key]++
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !strings.EqualFold(fields[i].name, key) {
+				continue
+			}
+			if skip == 0 {
+				selected = append(selected, fields[i].raw)
+				break
+			}
+			skip--
+		}
+	}
+	return selected
+}
+
+// foldTags writes "DKIM-Signature: tag; tag;" folding between tags, and within h= after colons
+func foldTags(tags []string) string {
+	var builder strings.Builder
+	builder.WriteString(SIGNATURE_HEADER + ":")
+	lineLength := len(SIGNATURE_HEADER) + 1
+	for _, tag := range tags {
+		pieces := []string{tag + ";"}
+		if strings.HasPrefix(tag, "h=") {
+			pieces = strings.SplitAfter(tag+";", ":")
+		}
+		for i, piece := range pieces {
+			separator := ""
+			if i == 0 {
+				separator = " "
+			}
+			if lineLength+len(separator)+len(piece) > maxLineLength {
+				builder.WriteString("\r\n ")
+				lineLength = 1
+				separator = ""
+			}
+			builder.WriteString(separator + piece)
+			lineLength += len(separator) + len(piece)
+		}
+	}
+	return builder.String()
+}
+
+// foldBase64 puts the b= value on continuation lines of at most maxLineLength characters
+func foldBase64(value string, first int) string {
+	var builder strings.Builder
+	room := maxLineLength - first
+	for len(value) > room {
+		builder.WriteString(value[:room])
+		builder.WriteString("\r\n ")
+		value = value[room:]
+		room = maxLineLength - 1
+	}
+	builder.WriteString(value)
+	return builder.String()
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
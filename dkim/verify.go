@@ -0,0 +1,362 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_SIGNATURES limits how many signatures of a message are verified; later ones are ignored
+const MAX_SIGNATURES = 10
+
+// Status is the outcome of verifying one signature, as named in Authentication-Results (RFC 8601)
+type Status string
+
+const (
+	STATUS_PASS      Status = "pass"      // The signature verified
+	STATUS_FAIL      Status = "fail"      // The body hash or the signature did not match
+	STATUS_TEMPERROR Status = "temperror" // The key could not be fetched now, e.g. a DNS timeout
+	STATUS_PERMERROR Status = "permerror" // The signature or its key is invalid, missing or unsupported
+)
+
+// Resolver looks up the TXT records holding public keys; *net.Resolver satisfies it
+// Return a *net.DNSError with IsNotFound set for names that do not exist
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Result is the outcome for one DKIM-Signature header field
+type Result struct {
+	Status    Status
+	Domain    string // Signing domain (d=)
+	Selector  string // Key selector (s=)
+	Identity  string // Agent or user identifier (i=, "@" + Domain if not given)
+	Algorithm string // a=
+	Signature string // Signature data (b=), its start identifies the signature in Authentication-Results
+	Testing   bool   // The key record is in testing mode (t=y)
+	Err       error  // Why the signature did not pass (nil for STATUS_PASS)
+}
+
+// Verify checks the DKIM signatures of a message and returns one result per signature, in the
+// order of the header; a message without signatures gives no results
+// resolver fetches the keys (net.DefaultResolver if nil)
+func Verify(ctx context.Context, message []byte, resolver Resolver) []Result {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	fields, body := splitMessage(message)
+	results := make([]Result, 0)
+	for _, field := range fields {
+		if !strings.EqualFold(field.name, SIGNATURE_HEADER) {
+			continue
+		}
+		if len(results) == MAX_SIGNATURES {
+			break
+		}
+		results = append(results, verifySignature(ctx, field.raw, fields, body, resolver))
+	}
+	return results
+}
+
+// String formats the result as a method of an Authentication-Results header field:
+// dkim=pass header.d=example.com header.s=mail header.b=abcdefgh
+func (r Result) String() string {
+	var builder strings.Builder
+	builder.WriteString("dkim=" + string(r.Status))
+	if r.Err != nil {
+		builder.WriteString(" reason=" + strconv.Quote(r.Err.Error()))
+	}
+	if r.Domain != "" {
+		builder.WriteString(" header.d=" + r.Domain)
+	}
+	if r.Selector != "" {
+		builder.WriteString(" header.s=" + r.Selector)
+	}
+	if r.Signature != "" {
+		// Eight characters tell signatures of the same domain apart (RFC 6008)
+		builder.WriteString(" header.b=" + r.Signature[:min(8, len(r.Signature))])
+	}
+	return builder.String()
+}
+
+// verifySignature verifies one signature field against the header fields and the body
+// (RFC 6376 section 6.1)
+func verifySignature(ctx context.Context, raw string, fields []headerField, body []byte, resolver Resolver) Result {
+	result := Result{Status: STATUS_PERMERROR}
+	_, value, _ := strings.Cut(raw, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Domain = tags["d"]
+	result.Selector = tags["s"]
+	result.Algorithm = tags["a"]
+	result.Signature = tags["b"]
+	result.Identity = tags["i"]
+	if result.Identity == "" {
+		result.Identity = "@" + result.Domain
+	}
+
+	if err := checkTags(tags); err != nil {
+		result.Err = err
+		return result
+	}
+	headerCanonicalization, bodyCanonicalization := CANONICALIZATION_SIMPLE, CANONICALIZATION_SIMPLE
+	if c, ok := tags["c"]; ok {
+		if headerCanonicalization, bodyCanonicalization, err = ParseCanonicalization(c); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		result.Err = errors.New("invalid signature data")
+		return result
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		result.Err = errors.New("invalid body hash")
+		return result
+	}
+
+	key, testing, err := lookupKey(ctx, resolver, tags, result.Identity)
+	result.Testing = testing
+	if err != nil {
+		var temporary *temporaryError
+		if errors.As(err, &temporary) {
+			result.Status = STATUS_TEMPERROR
+		}
+		result.Err = err
+		return result
+	}
+
+	// The body hash, over at most l= bytes of the canonical body
+	canonical := canonicalBody(body, bodyCanonicalization)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.ParseUint(l, 10, 64)
+		if err != nil || length > uint64(len(canonical)) {
+			result.Err = errors.New("invalid body length")
+			return result
+		}
+		canonical = canonical[:length]
+	}
+	computed := sha256.Sum256(canonical)
+	result.Status = STATUS_FAIL
+	if string(computed[:]) != string(bodyHash) {
+		result.Err = errors.New("body hash did not verify")
+		return result
+	}
+
+	hash := sha256.New()
+	for _, field := range selectHeaders(fields, strings.Split(tags["h"], ":")) {
+		hash.Write([]byte(canonicalHeader(field, headerCanonicalization)))
+	}
+	stripped := stripSignature(strings.TrimSuffix(raw, "\r\n"))
+	hash.Write([]byte(strings.TrimSuffix(canonicalHeader(stripped+"\r\n", headerCanonicalization), "\r\n")))
+	digest := hash.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, signature) {
+			err = errors.New("ed25519 verification failed")
+		}
+	}
+	if err != nil {
+		result.Err = errors.New("signature did not verify")
+		return result
+	}
+	result.Status = STATUS_PASS
+	return result
+}
+
+// parseTags parses a tag list ("v=1; a=rsa-sha256; ...", RFC 6376 section 3.2)
+// Whitespace is removed from every value; it is only meaningful in none of the tags used here
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, tagValue, found := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid tag %q", strings.TrimSpace(spec))
+		}
+		if _, duplicate := tags[name]; duplicate {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.Join(strings.Fields(tagValue), "")
+	}
+	return tags, nil
+}
+
+// checkTags validates the tags of a signature before its key is fetched
+func checkTags(tags map[string]string) error {
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("missing tag %s=", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	switch tags["a"] {
+	case ALGORITHM_RSA_SHA256, ALGORITHM_ED25519_SHA256:
+	default:
+		// rsa-sha1 is no longer accepted (RFC 8301 section 3.1)
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(":"+q+":", ":dns/txt:") {
+		return fmt.Errorf("unsupported query method %q", q)
+	}
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(name, "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return errors.New("From field not signed")
+	}
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndex(i, "@")
+		domain := strings.ToLower(i[at+1:])
+		d := strings.ToLower(tags["d"])
+		if at < 0 || (domain != d && !strings.HasSuffix(domain, "."+d)) {
+			return errors.New("identity not in the signing domain")
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return errors.New("invalid expiration")
+		}
+		if time.Now().Unix() > expiration {
+			return errors.New("signature expired")
+		}
+	}
+	return nil
+}
+
+// temporaryError marks key lookups that may succeed later
+type temporaryError struct {
+	err error
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+// lookupKey fetches and parses the key record at <s>._domainkey.<d> (RFC 6376 section 3.6)
+// It also reports whether the record is in testing mode
+func lookupKey(ctx context.Context, resolver Resolver, tags map[string]string, identity string) (crypto.PublicKey, bool, error) {
+	name := tags["s"] + "._domainkey." + tags["d"]
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, false, errors.New("no key for signature")
+		}
+		return nil, false, &temporaryError{fmt.Errorf("key lookup failed: %w", err)}
+	}
+	if len(records) == 0 {
+		return nil, false, errors.New("no key for signature")
+	}
+	// Only the first record is used when there are several (RFC 6376 section 3.6.2.2)
+	record, err := parseTags(records[0])
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid key record: %w", err)
+	}
+	testing := false
+	for _, flag := range strings.Split(record["t"], ":") {
+		switch flag {
+		case "y":
+			testing = true
+		case "s":
+			// Strict: the identity must be in d= itself, not a subdomain
+			if !strings.EqualFold(identity[strings.LastIndex(identity, "@")+1:], tags["d"]) {
+				return nil, testing, errors.New("identity not allowed by key record")
+			}
+		}
+	}
+
+	if v, ok := record["v"]; ok && v != "DKIM1" {
+		return nil, testing, fmt.Errorf("unsupported key record version %q", v)
+	}
+	if h, ok := record["h"]; ok && !strings.Contains(":"+h+":", ":sha256:") {
+		return nil, testing, errors.New("hash algorithm not allowed by key record")
+	}
+	if s, ok := record["s"]; ok && !strings.Contains(":"+s+":", ":*:") && !strings.Contains(":"+s+":", ":email:") {
+		return nil, testing, errors.New("key record not for email")
+	}
+	p, ok := record["p"]
+	if !ok {
+		return nil, testing, errors.New("key record without key")
+	}
+	if p == "" {
+		return nil, testing, errors.New("key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, testing, errors.New("invalid key data")
+	}
+
+	keyType := record["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	wanted := strings.TrimSuffix(tags["a"], "-sha256")
+	if keyType != wanted {
+		return nil, testing, fmt.Errorf("key type %q does not match algorithm %q", keyType, tags["a"])
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, testing, errors.New("invalid key data")
+		}
+		return ed25519.PublicKey(data), testing, nil
+	}
+	// RSA keys are SubjectPublicKeyInfo; some publishers use a bare RSAPublicKey
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(data); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else if parsed, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		key = parsed
+	}
+	if key == nil {
+		return nil, testing, errors.New("invalid key data")
+	}
+	if key.N.BitLen() < 1024 {
+		return nil, testing, errors.New("key too short")
+	}
+	return key, testing, nil
+}
+
+// stripSignature empties the b= value of a signature field, leaving everything else as it is
+func stripSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, found := strings.Cut(spec, "=")
+		if found && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:strings.Index(spec, "=")+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
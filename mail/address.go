@@ -0,0 +1,508 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Address lists (RFC 5322 section 3.4) as they appear in From, To, Cc, Reply-To and similar
+// header fields:
+//
+//	"Doe, John" <john@example.com>, jane@example.com (Jane Doe),
+//	Team: a@example.com, b@example.com;, undisclosed-recipients:;
+//
+// Display names may be encoded words (RFC 2047) and are returned decoded; comments are
+// dropped, except that a comment after a bare address serves as its display name
+
+// ParseAddressList parses the value of an address header field
+// Malformed entries are skipped and reported in err; the others are still returned
+func ParseAddressList(value string) ([]NamedAddress, error) {
+	p := &addressParser{s: value}
+	result := make([]NamedAddress, 0)
+	var firstErr error
+	for {
+		p.skipCFWS()
+		if p.end() {
+			break
+		}
+		if p.peek() == ',' {
+			// Empty list elements are allowed (RFC 5322 section 4.4)
+			p.pos++
+			continue
+		}
+		start := p.pos
+		addresses, err := p.parseAddress()
+		if err == nil {
+			p.skipCFWS()
+			if !p.end() && p.peek() != ',' {
+				err = fmt.Errorf("unexpected %q after address", p.peek())
+			}
+		}
+		if err != nil {
+			// Every bad entry is skipped, only the first is reported
+			end := p.skipEntry(start)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid address %q: %w", strings.TrimSpace(p.s[start:end]), err)
+			}
+			continue
+		}
+		for i := range addresses {
+			addresses[i].header = Header{"", strings.TrimSpace(p.s[start:p.pos])}
+		}
+		result = append(result, addresses...)
+	}
+	return result, firstErr
+}
+
+// ParseAddress parses a single mailbox such as "Jane Doe <jane@example.com>"
+func ParseAddress(value string) (NamedAddress, error) {
+	p := &addressParser{s: value}
+	address, err := p.parseMailbox()
+	if err == nil {
+		p.skipCFWS()
+		if !p.end() {
+			err = fmt.Errorf("unexpected %q after address", p.peek())
+		}
+	}
+	if err != nil {
+		return NamedAddress{}, fmt.Errorf("invalid address %q: %w", value, err)
+	}
+	address.header = Header{"", strings.TrimSpace(value)}
+	return address, nil
+}
+
+// FormatAddress formats a mailbox for a header field: "Name" <local@domain>, or <local@domain>
+// without a name; names that are not ASCII become encoded words
+func FormatAddress(name string, address string) string {
+	address = formatAddrSpec(strings.Trim(strings.TrimSpace(address), "<>"))
+	if name == "" {
+		return "<" + address + ">"
+	}
+	return formatPhrase(name) + " <" + address + ">"
+}
+
+// FormatAddressList formats mailboxes as a comma-separated list; members of a group are
+// written as "Group: a, b;"
+func FormatAddressList(addresses []NamedAddress) string {
+	parts := make([]string, 0, len(addresses))
+	for i := 0; i < len(addresses); {
+		group := addresses[i].group
+		if group == "" {
+			parts = append(parts, addresses[i].String())
+			i++
+			continue
+		}
+		members := make([]string, 0)
+		for ; i < len(addresses) && addresses[i].group == group; i++ {
+			members = append(members, addresses[i].String())
+		}
+		parts = append(parts, formatPhrase(group)+": "+strings.Join(members, ", ")+";")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FormatAddresses formats plain addresses as a list; entries that already carry a display
+// name ("Jane <jane@example.com>") keep it
+func FormatAddresses(addresses []string) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if parsed, err := ParseAddress(address); err == nil {
+			formatted = append(formatted, parsed.String())
+		} else {
+			formatted = append(formatted, FormatAddress("", address))
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// formatPhrase returns a display name as atoms, a quoted string or encoded words
+func formatPhrase(name string) string {
+	if needsEncoding(name) {
+		return EncodePhrase(name)
+	}
+	for _, word := range strings.Split(name, " ") {
+		if word == "" || !isAtom(word) {
+			return quoteString(name)
+		}
+	}
+	return name
+}
+
+// formatAddrSpec quotes a local part that is not a dot-atom ("john doe"@example.com)
+func formatAddrSpec(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	local := address[:at]
+	if isDotAtom(local) {
+		return address
+	}
+	return quoteString(local) + address[at:]
+}
+
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func isDotAtom(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if !isAtom(atom) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isAtext(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether a byte may appear in an atom; UTF-8 is allowed (RFC 6532)
+func isAtext(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= 0x80 ||
+		strings.IndexByte("!#$%&'*+-/=?^_`{|}~", b) >= 0
+}
+
+// addressParser is a cursor over an address header value
+type addressParser struct {
+	s   string
+	pos int
+}
+
+func (p *addressParser) end() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *addressParser) peek() byte {
+	return p.s[p.pos]
+}
+
+// parseAddress parses a mailbox, or a group and returns its members
+func (p *addressParser) parseAddress() ([]NamedAddress, error) {
+	start := p.pos
+	// A phrase followed by ":" starts a group
+	if phrase, err := p.parsePhrase(); err == nil && phrase != "" {
+		p.skipCFWS()
+		if !p.end() && p.peek() == ':' {
+			p.pos++
+			return p.parseGroup(DecodeHeader(phrase))
+		}
+	}
+	p.pos = start
+	address, err := p.parseMailbox()
+	if err != nil {
+		return nil, err
+	}
+	return []NamedAddress{address}, nil
+}
+
+// parseGroup parses the mailbox list of a group up to and including ";"
+func (p *addressParser) parseGroup(name string) ([]NamedAddress, error) {
+	members := make([]NamedAddress, 0)
+	for {
+		p.skipCFWS()
+		if p.end() {
+			// The ";" is missing; be lenient
+			return members, nil
+		}
+		switch p.peek() {
+		case ';':
+			p.pos++
+			return members, nil
+		case ',':
+			p.pos++
+			continue
+		}
+		member, err := p.parseMailbox()
+		if err != nil {
+			return nil, err
+		}
+		member.group = name
+		members = append(members, member)
+	}
+}
+
+// parseMailbox parses name-addr ("Name" <addr>, <addr>) or a bare addr-spec
+func (p *addressParser) parseMailbox() (NamedAddress, error) {
+	start := p.pos
+	// A bare addr-spec, possibly followed by a comment with the name
+	if address, err := p.parseAddrSpec(); err == nil {
+		comment := p.skipCFWS()
+		if p.end() || p.peek() == ',' || p.peek() == ';' {
+			return NamedAddress{name: DecodeHeader(comment), address: address}, nil
+		}
+	}
+	p.pos = start
+
+	phrase, err := p.parsePhrase()
+	if err != nil {
+		return NamedAddress{}, err
+	}
+	p.skipCFWS()
+	if p.end() || p.peek() != '<' {
+		if phrase == "" {
+			return NamedAddress{}, errors.New("no address")
+		}
+		return NamedAddress{}, errors.New("missing @ or <address>")
+	}
+	p.pos++
+	p.skipRoute()
+	address, err := p.parseAddrSpec()
+	if err != nil {
+		return NamedAddress{}, err
+	}
+	p.skipCFWS()
+	if p.end() || p.peek() != '>' {
+		return NamedAddress{}, errors.New("missing >")
+	}
+	p.pos++
+	return NamedAddress{name: DecodeHeader(phrase), address: address}, nil
+}
+
+// skipRoute skips an obsolete source route: <@relay1,@relay2:user@example.com>
+func (p *addressParser) skipRoute() {
+	p.skipCFWS()
+	if p.end() || p.peek() != '@' {
+		return
+	}
+	if colon := strings.IndexByte(p.s[p.pos:], ':'); colon >= 0 {
+		p.pos += colon + 1
+	}
+}
+
+// parsePhrase parses a display name: atoms and quoted strings (and dots, obs-phrase)
+// Words separated by whitespace or comments are joined with a single space
+func (p *addressParser) parsePhrase() (string, error) {
+	var builder strings.Builder
+	for {
+		start := p.pos
+		p.skipCFWS()
+		if p.end() {
+			break
+		}
+		spaced := p.pos > start
+		word := ""
+		switch b := p.peek(); {
+		case b == '"':
+			quoted, err := p.parseQuotedString()
+			if err != nil {
+				return "", err
+			}
+			word = quoted
+		case b == '.':
+			p.pos++
+			word = "."
+		case isAtext(b):
+			word = p.parseAtom()
+		default:
+			return builder.String(), nil
+		}
+		if spaced && builder.Len() > 0 && word != "." {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(word)
+	}
+	return builder.String(), nil
+}
+
+// parseAddrSpec parses local-part "@" domain
+func (p *addressParser) parseAddrSpec() (string, error) {
+	local, err := p.parseLocalPart()
+	if err != nil {
+		return "", err
+	}
+	p.skipCFWS()
+	if p.end() || p.peek() != '@' {
+		return "", errors.New("missing @")
+	}
+	p.pos++
+	p.skipCFWS()
+	domain, err := p.parseDomain()
+	if err != nil {
+		return "", err
+	}
+	return local + "@" + domain, nil
+}
+
+// parseLocalPart parses a dot-atom or quoted string (obs-local-part: words joined by dots)
+func (p *addressParser) parseLocalPart() (string, error) {
+	var builder strings.Builder
+	for {
+		p.skipCFWS()
+		if p.end() {
+			return "", errors.New("missing local part")
+		}
+		switch b := p.peek(); {
+		case b == '"':
+			word, err := p.parseQuotedString()
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(word)
+		case isAtext(b):
+			builder.WriteString(p.parseAtom())
+		default:
+			return "", fmt.Errorf("unexpected %q in local part", b)
+		}
+		p.skipCFWS()
+		if p.end() || p.peek() != '.' {
+			return builder.String(), nil
+		}
+		p.pos++
+		builder.WriteByte('.')
+	}
+}
+
+// parseDomain parses a dot-atom or a domain literal ([192.0.2.1])
+func (p *addressParser) parseDomain() (string, error) {
+	if !p.end() && p.peek() == '[' {
+		end := strings.IndexByte(p.s[p.pos:], ']')
+		if end < 0 {
+			return "", errors.New("missing ] in domain literal")
+		}
+		literal := p.s[p.pos : p.pos+end+1]
+		p.pos += end + 1
+		return literal, nil
+	}
+	var builder strings.Builder
+	for {
+		p.skipCFWS()
+		if p.end() || !isAtext(p.peek()) {
+			return "", errors.New("missing domain")
+		}
+		builder.WriteString(p.parseAtom())
+		// A comment after the last label is left for the caller, it may be the display name
+		end := p.pos
+		p.skipCFWS()
+		if p.end() || p.peek() != '.' {
+			p.pos = end
+			return builder.String(), nil
+		}
+		p.pos++
+		builder.WriteByte('.')
+	}
+}
+
+func (p *addressParser) parseAtom() string {
+	start := p.pos
+	for !p.end() && isAtext(p.peek()) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// parseQuotedString parses "..." and returns its content without quotes and escapes
+func (p *addressParser) parseQuotedString() (string, error) {
+	var builder strings.Builder
+	p.pos++ // Opening quote
+	for !p.end() {
+		b := p.peek()
+		p.pos++
+		switch b {
+		case '"':
+			return builder.String(), nil
+		case '\\':
+			if !p.end() {
+				builder.WriteByte(p.peek())
+				p.pos++
+			}
+		case '\r', '\n':
+			// Folding inside the quoted string
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	return "", errors.New("missing closing quote")
+}
+
+// skipCFWS skips whitespace and comments and returns the text of the last comment
+func (p *addressParser) skipCFWS() string {
+	comment := ""
+	for !p.end() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '(':
+			comment = p.skipComment()
+		default:
+			return comment
+		}
+	}
+	return comment
+}
+
+// skipComment skips a (possibly nested) comment and returns its text
+func (p *addressParser) skipComment() string {
+	var builder strings.Builder
+	depth := 0
+	for !p.end() {
+		b := p.peek()
+		p.pos++
+		switch b {
+		case '(':
+			if depth > 0 {
+				builder.WriteByte(b)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return strings.TrimSpace(builder.String())
+			}
+			builder.WriteByte(b)
+		case '\\':
+			if !p.end() {
+				builder.WriteByte(p.peek())
+				p.pos++
+			}
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+// skipEntry moves past the malformed list element starting at start, to the next comma
+// outside quotes, comments, angle brackets, domain literals and groups, and returns where the
+// element ends; a group ends at its ";", so a bad member drops the group but no later entry
+func (p *addressParser) skipEntry(start int) int {
+	p.pos = start
+	depth := 0
+	quoted := false
+	group := false
+	for !p.end() {
+		b := p.peek()
+		switch {
+		case quoted && b == '\\':
+			p.pos++
+		case b == '"':
+			quoted = !quoted
+		case quoted:
+		case b == '(' || b == '<' || b == '[':
+			depth++
+		case (b == ')' || b == '>' || b == ']') && depth > 0:
+			depth--
+		case depth > 0:
+		case b == ':':
+			group = true
+		case b == ';':
+			group = false
+		case b == ',' && !group:
+			end := p.pos
+			p.pos++
+			return end
+		}
+		p.pos++
+	}
+	return len(p.s)
+}
@@ -0,0 +1,119 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+// entries lists parsed addresses as "name <address> [group]"
+func entries(addresses []NamedAddress) []string {
+	result := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		entry := address.GetName() + " <" + address.GetAddress() + ">"
+		if address.group != "" {
+			entry += " [" + address.group + "]"
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+		err   string // Error for a skipped entry ("" = none)
+	}{
+		{"bare address", "jane@example.com", []string{" <jane@example.com>"}, ""},
+		{"name-addr", "Jane Doe <jane@example.com>", []string{"Jane Doe <jane@example.com>"}, ""},
+		{"angle brackets only", "<jane@example.com>", []string{" <jane@example.com>"}, ""},
+		{"quoted name with comma", `"Doe, John" <john@example.com>, jane@example.com`,
+			[]string{"Doe, John <john@example.com>", " <jane@example.com>"}, ""},
+		{"quoted name with escapes", `"Jane \"JD\" Doe" <jane@example.com>`, []string{`Jane "JD" Doe <jane@example.com>`}, ""},
+		{"comment as name", "jane@example.com (Jane Doe)", []string{"Jane Doe <jane@example.com>"}, ""},
+		{"comments dropped", `Pete(A nice \) chap) <pete(his account)@silly.test(his host)>`, []string{"Pete <pete@silly.test>"}, ""},
+		{"nested comment", "Jane (the (real) one) <jane@example.com>", []string{"Jane <jane@example.com>"}, ""},
+		{"obs-phrase with dot", "John Q. Public <jqp@example.com>", []string{"John Q. Public <jqp@example.com>"}, ""},
+		{"encoded word", "=?utf-8?q?J=C3=B6rg?= <jorg@example.de>", []string{"Jörg <jorg@example.de>"}, ""},
+		{"folded", "Jane\r\n Doe <jane@example.com>,\r\n\tbob@example.com",
+			[]string{"Jane Doe <jane@example.com>", " <bob@example.com>"}, ""},
+		{"quoted local part", `"john doe"@example.com`, []string{" <john doe@example.com>"}, ""},
+		{"domain literal", "Host <user@[192.0.2.1]>", []string{"Host <user@[192.0.2.1]>"}, ""},
+		{"obs-route", "<@relay1.example,@relay2.example:user@example.com>", []string{" <user@example.com>"}, ""},
+		{"obs-route with name", "User <@relay.example:user@example.com>", []string{"User <user@example.com>"}, ""},
+		{"empty elements", ", a@example.com,, b@example.com,", []string{" <a@example.com>", " <b@example.com>"}, ""},
+		{"group", `Team: a@example.com, "B b" <b@example.com>;, c@example.org`,
+			[]string{" <a@example.com> [Team]", "B b <b@example.com> [Team]", " <c@example.org>"}, ""},
+		{"quoted group name", `"The Team": a@example.com;`, []string{" <a@example.com> [The Team]"}, ""},
+		{"empty group", "undisclosed-recipients:;", []string{}, ""},
+		{"group without semicolon", "Team: a@example.com, b@example.com", []string{" <a@example.com> [Team]", " <b@example.com> [Team]"}, ""},
+		{"empty", "", []string{}, ""},
+
+		{"missing @", "jane, bob@example.com", []string{" <bob@example.com>"}, `invalid address "jane"`},
+		{"missing domain", "jane@, bob@example.com", []string{" <bob@example.com>"}, `invalid address "jane@"`},
+		{"missing >", "Jane <jane@example.com", []string{}, "missing >"},
+		{"no address in brackets", "Jane <>", []string{}, "in local part"},
+		{"unterminated quote", `"Jane <jane@example.com>, bob@example.com`, []string{}, "missing closing quote"},
+		{"unterminated literal", "user@[192.0.2.1, bob@example.com", []string{}, `invalid address "user@[192.0.2.1, bob@example.com"`},
+		{"junk after address", "jane@example.com junk, bob@example.com", []string{" <bob@example.com>"}, `invalid address "jane@example.com junk"`},
+		{"name without address", "Jane Doe, bob@example.com", []string{" <bob@example.com>"}, "missing @ or <address>"},
+		{"bad group member", "Team: a@example.com, bad member, b@example.com;, c@example.org",
+			[]string{" <c@example.org>"}, `invalid address "Team: a@example.com, bad member, b@example.com;"`},
+		{"bad member in unterminated group", "Team: a@example.com, bad member, b@example.com", []string{}, "missing @"},
+		{"two bad entries", "bad, b@example.com;, worse, c@example.org", []string{" <c@example.org>"}, `invalid address "bad"`},
+		{"bad entry before group", "bad entry, Team: a@example.com;", []string{" <a@example.com> [Team]"}, `invalid address "bad entry"`},
+	}
+	for _, test := range tests {
+		addresses, err := ParseAddressList(test.value)
+		if got := entries(addresses); strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	address, err := ParseAddress(` "Doe, Jane" <jane@example.com> `)
+	if err != nil || address.GetName() != "Doe, Jane" || address.GetAddress() != "jane@example.com" {
+		t.Errorf("got %q <%s> (%v)", address.GetName(), address.GetAddress(), err)
+	}
+	for _, value := range []string{"", "a@example.com, b@example.com", "Team: a@example.com;", "Jane"} {
+		if _, err := ParseAddress(value); err == nil {
+			t.Errorf("%q: accepted", value)
+		}
+	}
+}
+
+func TestFormatAddressList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"jane@example.com", "<jane@example.com>"},
+		{"Jane Doe <jane@example.com>", `Jane Doe <jane@example.com>`},
+		{`"Doe, Jane" <jane@example.com>`, `"Doe, Jane" <jane@example.com>`},
+		{`"john doe"@example.com`, `<"john doe"@example.com>`},
+		{"=?utf-8?q?J=C3=B6rg?= <jorg@example.de>", "=?utf-8?b?SsO2cmc=?= <jorg@example.de>"},
+		{`Team: a@example.com, "B b" <b@example.com>;, c@example.org`, "Team: <a@example.com>, B b <b@example.com>;, <c@example.org>"},
+		{"<@relay.example:user@example.com>", "<user@example.com>"},
+	}
+	for _, test := range tests {
+		addresses, err := ParseAddressList(test.value)
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		formatted := FormatAddressList(addresses)
+		if formatted != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, formatted, test.want)
+		}
+		// The formatted list parses back to the same addresses
+		again, err := ParseAddressList(formatted)
+		if err != nil || strings.Join(entries(again), "|") != strings.Join(entries(addresses), "|") {
+			t.Errorf("%q: round trip gave %q (%v)", test.value, entries(again), err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to a built message, or an inline part referenced by Content-ID
+type Attachment struct {
+	Filename    string
+	ContentType string // Guessed from the file name if "" (application/octet-stream otherwise)
+	ContentID   string // Inline parts only: referenced as "cid:<ContentID>" from the HTML body
+	Data        []byte
+}
+
+// Builder builds an RFC 5322 message with a MIME structure:
+//
+//	multipart/mixed                  only with attachments
+//	  multipart/alternative          only with both text and HTML
+//	    text/plain
+//	    multipart/related            only with inline parts
+//	      text/html
+//	      image/png (Content-ID)
+//	  application/pdf (attachment)
+//
+// Each part gets the Content-Transfer-Encoding it needs; Date and Message-ID are added unless set
+//
+//	m, err := mail.NewBuilder().
+//		SetFrom("Alice", "alice@example.com").
+//		AppendTo("bob@example.com").
+//		SetSubject("Report").
+//		SetText("See the attached report.").
+//		SetHTML(`<p>See the attached report.</p><img src="cid:logo">`).
+//		Embed("logo", "logo.png", png).
+//		Attach("report.pdf", pdf).
+//		Build()
+type Builder struct {
+	fromName    string
+	from        string
+	to          []string
+	cc          []string
+	bcc         []string
+	replyTo     string
+	subject     string
+	text        string
+	html        string
+	hasText     bool
+	hasHTML     bool
+	date        time.Time
+	messageID   string
+	headers     []Header
+	inline      []Attachment
+	attachments []Attachment
+}
+
+// NewBuilder returns an empty message builder
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// SetFrom sets the author; name is the display name ("" for none)
+func (b *Builder) SetFrom(name string, address string) *Builder {
+	b.fromName = name
+	b.from = address
+	return b
+}
+
+func (b *Builder) AppendTo(to ...string) *Builder {
+	b.to = append(b.to, to...)
+	return b
+}
+
+func (b *Builder) AppendCC(cc ...string) *Builder {
+	b.cc = append(b.cc, cc...)
+	return b
+}
+
+// AppendBCC adds envelope recipients that do not appear in the headers
+func (b *Builder) AppendBCC(bcc ...string) *Builder {
+	b.bcc = append(b.bcc, bcc...)
+	return b
+}
+
+func (b *Builder) SetReplyTo(address string) *Builder {
+	b.replyTo = address
+	return b
+}
+
+func (b *Builder) SetSubject(subject string) *Builder {
+	b.subject = subject
+	return b
+}
+
+// SetText sets the plain text body
+func (b *Builder) SetText(text string) *Builder {
+	b.text = text
+	b.hasText = true
+	return b
+}
+
+// SetHTML sets the HTML body; with a text body as well both go out as multipart/alternative
+func (b *Builder) SetHTML(html string) *Builder {
+	b.html = html
+	b.hasHTML = true
+	return b
+}
+
+// SetDate sets the Date header (the time of Build if not set)
+func (b *Builder) SetDate(date time.Time) *Builder {
+	b.date = date
+	return b
+}
+
+// SetMessageID sets the Message-ID, with or without angle brackets (generated if not set)
+func (b *Builder) SetMessageID(id string) *Builder {
+	b.messageID = strings.Trim(id, "<>")
+	return b
+}
+
+// SetHeader adds a header field, or replaces the ones with the same name; a Date, Message-ID,
+// From, To, Cc, Reply-To or Subject replaces the generated one (the envelope keeps using SetFrom
+// and the recipients); structural headers (MIME-Version, Content-*) are generated and cannot be set
+// Address fields must be valid address lists; Build fails on them and on invalid field names
+func (b *Builder) SetHeader(key string, value string) *Builder {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	headers := b.headers[:0]
+	for _, header := range b.headers {
+		if header.key != key {
+			headers = append(headers, header)
+		}
+	}
+	b.headers = append(headers, Header{key, value})
+	return b
+}
+
+// Attach adds a file attachment; the content type is guessed from the file name
+func (b *Builder) Attach(filename string, data []byte) *Builder {
+	return b.AttachFile(Attachment{Filename: filename, Data: data})
+}
+
+// AttachFile adds an attachment with an explicit content type
+func (b *Builder) AttachFile(attachment Attachment) *Builder {
+	attachment.ContentID = ""
+	b.attachments = append(b.attachments, attachment)
+	return b
+}
+
+// Embed adds an inline part (usually an image) that the HTML body shows with src="cid:<contentID>"
+func (b *Builder) Embed(contentID string, filename string, data []byte) *Builder {
+	return b.EmbedFile(Attachment{Filename: filename, ContentID: contentID, Data: data})
+}
+
+// EmbedFile adds an inline part with an explicit content type
+func (b *Builder) EmbedFile(attachment Attachment) *Builder {
+	attachment.ContentID = strings.Trim(attachment.ContentID, "<>")
+	b.inline = append(b.inline, attachment)
+	return b
+}
+
+// Build returns the message as a raw Mail with its envelope sender and recipients set
+func (b *Builder) Build() (*Mail, error) {
+	data, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	m := NewBlankMail().
+		SetFrom(b.from).
+		AppendTo(b.to...).
+		AppendCC(b.cc...).
+		AppendBCC(b.bcc...).
+		SetSubject(b.subject).
+		SetData(string(data)).
+		SetRaw(true)
+	return m, nil
+}
+
+// Bytes returns the message with CRLF line endings
+func (b *Builder) Bytes() ([]byte, error) {
+	if b.from == "" {
+		return nil, errors.New("no From address specified")
+	}
+	if len(b.inline) > 0 && !b.hasHTML {
+		return nil, errors.New("inline parts need an HTML body to reference them")
+	}
+	for _, part := range b.inline {
+		if part.ContentID == "" {
+			return nil, fmt.Errorf("inline part %q has no Content-ID", part.Filename)
+		}
+	}
+	for _, header := range b.headers {
+		if !validFieldName(header.key) {
+			return nil, fmt.Errorf("invalid header field name %q", header.key)
+		}
+		if addressFields[header.key] {
+			if _, err := ParseAddressList(header.value); err != nil {
+				return nil, fmt.Errorf("invalid %s header: %w", header.key, err)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	b.writeHeaders(&buffer)
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	b.body().write(&buffer)
+	return buffer.Bytes(), nil
+}
+
+// writeHeaders writes the RFC 5322 header fields of the message
+func (b *Builder) writeHeaders(buffer *bytes.Buffer) {
+	date := b.date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := b.messageID
+	if messageID == "" {
+		messageID = GenerateMessageID(b.from)
+	}
+
+	if !b.hasHeader("Date") {
+		writeHeader(buffer, "Date", date.Format(time.RFC1123Z))
+	}
+	if !b.hasHeader("From") {
+		writeHeader(buffer, "From", FormatAddress(b.fromName, b.from))
+	}
+	if len(b.to) > 0 && !b.hasHeader("To") {
+		writeHeader(buffer, "To", FormatAddresses(b.to))
+	}
+	if len(b.cc) > 0 && !b.hasHeader("Cc") {
+		writeHeader(buffer, "Cc", FormatAddresses(b.cc))
+	}
+	if b.replyTo != "" && !b.hasHeader("Reply-To") {
+		writeHeader(buffer, "Reply-To", FormatAddresses([]string{b.replyTo}))
+	}
+	if !b.hasHeader("Message-Id") {
+		writeHeader(buffer, "Message-ID", "<"+messageID+">")
+	}
+	if b.subject != "" && !b.hasHeader("Subject") {
+		writeHeader(buffer, "Subject", EncodeHeaderText(b.subject))
+	}
+	for _, header := range b.headers {
+		switch header.key {
+		case "Mime-Version", "Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Id":
+			continue
+		}
+		writeHeader(buffer, header.key, headerValue(header))
+	}
+}
+
+// addressFields are the header fields that hold address lists (canonical keys)
+var addressFields = map[string]bool{
+	"From": true, "Sender": true, "Reply-To": true, "To": true, "Cc": true, "Bcc": true,
+	"Resent-From": true, "Resent-Sender": true, "Resent-To": true, "Resent-Cc": true, "Resent-Bcc": true,
+}
+
+// headerValue returns the value of a SetHeader field as it is written
+// Address lists are formatted again, so only their display names become encoded words; an
+// encoded word inside a quoted string or an angle-addr would not be decoded (RFC 2047 section 5)
+func headerValue(header Header) string {
+	if addressFields[header.key] {
+		if addresses, err := ParseAddressList(header.value); err == nil && len(addresses) > 0 {
+			return FormatAddressList(addresses)
+		}
+	}
+	return EncodeHeaderText(header.value)
+}
+
+// validFieldName reports whether a header field name is printable US-ASCII without a colon
+// (RFC 5322 section 2.2), so it cannot end the field early or start another one
+func validFieldName(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < '!' || key[i] > '~' || key[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// hasHeader reports whether SetHeader set a field (canonical key)
+func (b *Builder) hasHeader(key string) bool {
+	for _, header := range b.headers {
+		if header.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the MIME tree of the message
+func (b *Builder) body() *mimePart {
+	var content *mimePart
+	if b.hasHTML {
+		content = textPart("text/html", b.html)
+		if len(b.inline) > 0 {
+			related := multipart("related")
+			related.parts = append(related.parts, content)
+			for _, part := range b.inline {
+				related.parts = append(related.parts, attachmentPart(part, "inline"))
+			}
+			content = related
+		}
+		if b.hasText {
+			alternative := multipart("alternative")
+			// Least preferred first (RFC 2046 section 5.1.4)
+			alternative.parts = append(alternative.parts, textPart("text/plain", b.text), content)
+			content = alternative
+		}
+	} else if b.hasText || len(b.attachments) == 0 {
+		content = textPart("text/plain", b.text)
+	}
+
+	if len(b.attachments) == 0 {
+		return content
+	}
+	mixed := multipart("mixed")
+	if content != nil {
+		mixed.parts = append(mixed.parts, content)
+	}
+	for _, part := range b.attachments {
+		mixed.parts = append(mixed.parts, attachmentPart(part, "attachment"))
+	}
+	return mixed
+}
+
+// mimePart is one entity of the MIME tree: a leaf with data, or a multipart with parts
+type mimePart struct {
+	header   []Header
+	data     []byte // Encoded body of a leaf
+	boundary string
+	parts    []*mimePart
+}
+
+// textPart returns a UTF-8 text part with CRLF line endings and the encoding it needs
+func textPart(contentType string, text string) *mimePart {
+	data := []byte(toCRLF(text))
+	encoding := ChooseTransferEncoding(data, true)
+	return &mimePart{
+		header: []Header{
+			{"Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"})},
+			{"Content-Transfer-Encoding", encoding},
+		},
+		data: EncodeTransfer(data, encoding),
+	}
+}
+
+// attachmentPart returns a file part; disposition is "attachment" or "inline"
+func attachmentPart(attachment Attachment, disposition string) *mimePart {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = contentTypeByName(attachment.Filename)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	if attachment.Filename != "" {
+		params["name"] = attachment.Filename
+	}
+	// Text attachments keep their line endings; the encoding only has to survive SMTP
+	encoding := ChooseTransferEncoding(attachment.Data, strings.HasPrefix(mediaType, "text/"))
+	if encoding == ENCODING_QUOTED_PRINTABLE && bytes.Contains(attachment.Data, []byte("\r")) {
+		// Quoted-printable would turn CR into line breaks; base64 keeps the bytes exact
+		encoding = ENCODING_BASE64
+	}
+
+	part := &mimePart{data: EncodeTransfer(attachment.Data, encoding)}
+	part.header = append(part.header, Header{"Content-Type", mime.FormatMediaType(mediaType, params)})
+	part.header = append(part.header, Header{"Content-Transfer-Encoding", encoding})
+	dispositionParams := map[string]string{}
+	if attachment.Filename != "" {
+		dispositionParams["filename"] = attachment.Filename
+	}
+	part.header = append(part.header, Header{"Content-Disposition", mime.FormatMediaType(disposition, dispositionParams)})
+	if attachment.ContentID != "" {
+		part.header = append(part.header, Header{"Content-ID", "<" + attachment.ContentID + ">"})
+	}
+	return part
+}
+
+// multipart returns an empty multipart/<subtype> with a fresh boundary
+func multipart(subtype string) *mimePart {
+	// "=_" cannot occur in quoted-printable or base64 data, so the boundary never collides with it
+	boundary := "=_" + randomHex(12)
+	return &mimePart{
+		header:   []Header{{"Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})}},
+		boundary: boundary,
+	}
+}
+
+// write writes the header fields of the part, a blank line, and its body
+func (p *mimePart) write(buffer *bytes.Buffer) {
+	for _, header := range p.header {
+		writeHeader(buffer, header.key, header.value)
+	}
+	buffer.WriteString("\r\n")
+	if p.boundary == "" {
+		// The CRLF before the next boundary belongs to the boundary, not to the data
+		buffer.Write(p.data)
+		buffer.WriteString("\r\n")
+		return
+	}
+	buffer.WriteString("This is a multi-part message in MIME format.\r\n")
+	for _, part := range p.parts {
+		buffer.WriteString("--" + p.boundary + "\r\n")
+		part.write(buffer)
+	}
+	buffer.WriteString("--" + p.boundary + "--\r\n")
+}
+
+// writeHeader writes one header field, folded at 78 characters where possible
+func writeHeader(buffer *bytes.Buffer, key string, value string) {
+	buffer.WriteString(FoldHeader(key, value))
+}
+
+// contentTypeByName guesses a content type from a file extension
+func contentTypeByName(filename string) string {
+	if dot := strings.LastIndex(filename, "."); dot >= 0 {
+		if contentType := mime.TypeByExtension(filename[dot:]); contentType != "" {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// GenerateMessageID returns a unique id at the domain of the sender, or at the local hostname
+func GenerateMessageID(from string) string {
+	domain := ""
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "<> ")
+	}
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), randomHex(8), domain)
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	buffer := make([]byte, n)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
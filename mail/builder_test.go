@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuilderSetHeaderReplacesGenerated(t *testing.T) {
+	data, err := NewBuilder().
+		SetFrom("Alice", "alice@example.com").
+		AppendTo("bob@example.com").
+		SetReplyTo("alice@example.com").
+		SetSubject("Generated").
+		SetText("body").
+		SetHeader("subject", "Custom").
+		SetHeader("From", "Alice via List <list@example.com>").
+		SetHeader("Reply-To", "list@example.com").
+		SetHeader("X-Mailer", "test").
+		SetHeader("Content-Type", "text/html").
+		Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(data)
+	header, _, _ := strings.Cut(message, "\r\n\r\n")
+	for field, count := range map[string]int{"Subject:": 1, "From:": 1, "Reply-To:": 1, "To:": 1, "Content-Type:": 1, "Date:": 1, "Message-ID:": 1} {
+		if got := strings.Count("\r\n"+header, "\r\n"+field); got != count {
+			t.Errorf("%d %s fields, want %d:\n%s", got, field, count, header)
+		}
+	}
+	for _, field := range []string{"Subject: Custom\r\n", "From: Alice via List <list@example.com>\r\n", "Reply-To: <list@example.com>\r\n", "X-Mailer: test\r\n", "Content-Type: text/plain"} {
+		if !strings.Contains(message, field) {
+			t.Errorf("missing %q:\n%s", field, header)
+		}
+	}
+}
+
+func TestBuilderEnvelope(t *testing.T) {
+	m, err := NewBuilder().
+		SetFrom("", "alice@example.com").
+		AppendTo("bob@example.com").
+		AppendBCC("carol@example.com").
+		SetHeader("From", "someone@example.org").
+		SetText("body").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The envelope sender stays the SetFrom address, Bcc never shows up in the headers
+	if m.GetFrom() != "alice@example.com" || len(m.GetBCC()) != 1 {
+		t.Errorf("unexpected envelope %s %v", m.GetFrom(), m.GetBCC())
+	}
+	if strings.Contains(m.GetData(), "carol@example.com") {
+		t.Error("Bcc recipient in the message")
+	}
+}
+
+func TestBuilderSetHeaderAddressList(t *testing.T) {
+	data, err := NewBuilder().
+		SetFrom("", "h@example.com").
+		SetText("body").
+		SetHeader("From", `"Müller, Hans" <h@example.com>`).
+		SetHeader("Cc", "Team: a@example.com, \"Jörg\" <b@example.com>;").
+		Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, _ := strings.Cut(string(data), "\r\n\r\n")
+	for _, field := range []string{
+		"From: =?utf-8?q?M=C3=BCller=2C_Hans?= <h@example.com>\r\n",
+		"Cc: Team: <a@example.com>, =?utf-8?b?SsO2cmc=?= <b@example.com>;\r\n",
+	} {
+		if !strings.Contains(header+"\r\n", field) {
+			t.Errorf("missing %q:\n%s", field, header)
+		}
+	}
+}
+
+func TestBuilderRejectsBadHeaders(t *testing.T) {
+	for key, value := range map[string]string{
+		"X-Test\r\nBcc":  "evil@example.com",
+		"X-Test: Inject": "value",
+		"X Test":         "value",
+		"X-Tést":         "value",
+		"To":             "not an address",
+	} {
+		_, err := NewBuilder().SetFrom("", "alice@example.com").SetText("body").SetHeader(key, value).Bytes()
+		if err == nil {
+			t.Errorf("%q: %q was accepted", key, value)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package mail
 
 import (
-	"github.com/ImBubbles/MySMTP/util/smtp"
 	"strings"
 )
 
@@ -11,9 +10,15 @@ type Header struct {
 }
 
 type NamedAddress struct {
-	header  Header
+	header  Header // Field name and the text of this entry as it was parsed
 	name    string
 	address string
+	group   string // Name of the group the address was listed in ("" for none)
+}
+
+// NewNamedAddress returns an address with an optional display name
+func NewNamedAddress(name string, address string) NamedAddress {
+	return NamedAddress{name: name, address: address}
 }
 
 // GetAddress returns the email address
@@ -26,6 +31,18 @@ func (n *NamedAddress) GetName() string {
 	return n.name
 }
 
+// GetGroup returns the name of the group the address belongs to ("" for none)
+func (n *NamedAddress) GetGroup() string {
+	return n.group
+}
+
+// String formats the address for a header field (see FormatAddress)
+func (n *NamedAddress) String() string {
+	return FormatAddress(n.name, n.address)
+}
+
+// ParseNamedAddress parses a header line such as "Cc: Jane <jane@example.com>, john@example.com"
+// Malformed entries are left out (see ParseAddressList)
 func ParseNamedAddress(line string) *[]NamedAddress {
 	keyEndIndex := strings.Index(line, ":")
 	if keyEndIndex == -1 {
@@ -33,33 +50,9 @@ func ParseNamedAddress(line string) *[]NamedAddress {
 		return &[]NamedAddress{}
 	}
 	key := strings.TrimSpace(line[:keyEndIndex])
-	value := strings.TrimSpace(line[keyEndIndex+1:])
-	var hasMultiple bool = strings.ContainsRune(value, ',')
-
-	alloc := strings.Count(line, ",") + 1
-	if alloc < 1 {
-		alloc = 1
-	}
-	var result []NamedAddress = make([]NamedAddress, alloc)
-	if !hasMultiple {
-		result[0] = rawToNamedAddress(key, value, value)
-		return &result
+	result, _ := ParseAddressList(line[keyEndIndex+1:])
+	for i := range result {
+		result[i].header.key = key
 	}
-
-	for i, entry := range strings.Split(value, ",") {
-		result[i] = rawToNamedAddress(entry, key, value)
-	}
-
 	return &result
-
-}
-
-func rawToNamedAddress(key string, value string, raw string) NamedAddress {
-	name, address := smtp.CleanFromData(value)
-	result := NamedAddress{
-		header:  Header{key, value},
-		name:    name,
-		address: address,
-	}
-	return result
 }
@@ -0,0 +1,193 @@
+package mail
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ImBubbles/MySMTP/mail/message"
+)
+
+// Header lines are folded to this length where possible (RFC 5322 section 2.1.1)
+const maxHeaderLineLength = 78
+
+// No line may be longer than this many octets, CRLF excluded (RFC 5322 section 2.1.1)
+const maxHeaderLineOctets = 998
+
+// An encoded word may be 75 characters long (RFC 2047 section 2); shorter words leave room
+// for the field name, so "Subject: " and one word fit into the first 78 character line
+const maxEncodedWordLength = 66
+
+// EncodeHeaderText encodes unstructured header text such as a Subject (RFC 2047)
+// Words that are plain ASCII stay readable; runs of words with other characters become
+// UTF-8 encoded words, Q or B encoded, whichever is shorter
+func EncodeHeaderText(text string) string {
+	words := strings.Split(text, " ")
+	var builder strings.Builder
+	for i := 0; i < len(words); {
+		if !needsEncoding(words[i]) {
+			if i > 0 {
+				builder.WriteByte(' ')
+			}
+			builder.WriteString(words[i])
+			i++
+			continue
+		}
+		// Spaces between encoded words are dropped by decoders, so a run of words that need
+		// encoding is encoded as a whole, spaces included
+		end := i + 1
+		for end < len(words) && needsEncoding(words[end]) {
+			end++
+		}
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(encodeWords(strings.Join(words[i:end], " ")))
+		i = end
+	}
+	return builder.String()
+}
+
+// EncodePhrase encodes a display name that is not plain ASCII as encoded words
+// ASCII names are returned unchanged; quoting them is up to the caller
+func EncodePhrase(phrase string) string {
+	if !needsEncoding(phrase) {
+		return phrase
+	}
+	return encodeWords(phrase)
+}
+
+// DecodeHeader decodes the encoded words of a header value to UTF-8 (see message.DecodeHeader)
+func DecodeHeader(value string) string {
+	return message.DecodeHeader(value)
+}
+
+// needsEncoding reports whether a word cannot appear in a header as it is: it has non-ASCII
+// or control characters, or would be mistaken for an encoded word
+func needsEncoding(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if word[i] >= 0x7f || (word[i] < ' ' && word[i] != '\t') {
+			return true
+		}
+	}
+	return strings.Contains(word, "=?")
+}
+
+// encodeWords encodes text as space-separated encoded words of at most maxEncodedWordLength characters
+// Every word holds whole characters, so each one decodes on its own
+func encodeWords(text string) string {
+	encoding := "q"
+	if len(base64.StdEncoding.EncodeToString([]byte(text))) < qEncodedLength(text) {
+		encoding = "b"
+	}
+	prefix := "=?utf-8?" + encoding + "?"
+	room := maxEncodedWordLength - len(prefix) - len("?=")
+
+	words := make([]string, 0, 1)
+	chunk := ""
+	for _, r := range text {
+		next := chunk + string(r)
+		if encodedLength(next, encoding) > room && chunk != "" {
+			words = append(words, prefix+encodeChunk(chunk, encoding)+"?=")
+			next = string(r)
+		}
+		chunk = next
+	}
+	if chunk != "" || len(words) == 0 {
+		words = append(words, prefix+encodeChunk(chunk, encoding)+"?=")
+	}
+	return strings.Join(words, " ")
+}
+
+func encodedLength(text string, encoding string) int {
+	if encoding == "b" {
+		return base64.StdEncoding.EncodedLen(len(text))
+	}
+	return qEncodedLength(text)
+}
+
+func encodeChunk(text string, encoding string) string {
+	if encoding == "b" {
+		return base64.StdEncoding.EncodeToString([]byte(text))
+	}
+	var builder strings.Builder
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		switch {
+		case b == ' ':
+			builder.WriteByte('_')
+		case qSafe(b):
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "=%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+// qEncodedLength is the length of text in Q encoding
+func qEncodedLength(text string) int {
+	length := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] == ' ' || qSafe(text[i]) {
+			length++
+		} else {
+			length += 3
+		}
+	}
+	return length
+}
+
+// qSafe reports whether a byte may appear literally in a Q-encoded word, also in a phrase
+// such as a display name (RFC 2047 section 5, rule 3)
+func qSafe(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+		b == '!' || b == '*' || b == '+' || b == '-' || b == '/'
+}
+
+// FoldHeader returns "Key: value" with CRLF, folded at spaces so lines stay within 78
+// characters where the value allows it; a longer word is kept whole unless it would exceed
+// 998 octets, then it is split, the one case where folding adds a space to the value
+func FoldHeader(key string, value string) string {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	var builder strings.Builder
+	builder.WriteString(key)
+	builder.WriteString(":")
+	lineLength := len(key) + 1
+	lineOctets := len(key) + 1
+	words := strings.Split(value, " ")
+	for i, word := range words {
+		if word == "" && i > 0 {
+			// Keep runs of spaces, they may matter inside quoted strings
+			builder.WriteByte(' ')
+			lineLength++
+			lineOctets++
+			continue
+		}
+		if lineLength+1+utf8.RuneCountInString(word) > maxHeaderLineLength && lineLength > len(key)+1 {
+			builder.WriteString("\r\n")
+			lineLength, lineOctets = 0, 0
+		}
+		for lineOctets+1+len(word) > maxHeaderLineOctets {
+			// Split at a character boundary
+			cut := maxHeaderLineOctets - lineOctets - 1
+			for cut > 0 && !utf8.RuneStart(word[cut]) {
+				cut--
+			}
+			if cut > 0 {
+				builder.WriteByte(' ')
+				builder.WriteString(word[:cut])
+				word = word[cut:]
+			}
+			builder.WriteString("\r\n")
+			lineLength, lineOctets = 0, 0
+		}
+		builder.WriteByte(' ')
+		builder.WriteString(word)
+		lineLength += 1 + utf8.RuneCountInString(word)
+		lineOctets += 1 + len(word)
+	}
+	builder.WriteString("\r\n")
+	return builder.String()
+}
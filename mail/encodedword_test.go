@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEncodeHeaderTextRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		encoding string // Expected encoding, "=?" for either ("" = left as it is)
+	}{
+		{"ASCII", "Meeting at 10:00 (room 4)", ""},
+		{"mostly ASCII", "Aufgabenübersicht fertig", "?q?"},
+		{"question mark in Q", "Rückfragenliste? done", "?q?"},
+		{"mostly non-ASCII", "日本語のテキスト", "?b?"},
+		{"looks encoded", "=?utf-8?q?not_encoded?=", "=?"},
+		{"control characters", "tab\there bell\x07", "?q?"},
+		{"mixed", "Re: [list] Ünïcödé and ASCII words", "=?"},
+		{"long Latin", strings.Repeat("Größenänderung ", 12), "=?"},
+		{"long CJK", strings.Repeat("漢字かな交じり文", 20), "?b?"},
+		{"emoji", strings.Repeat("🎉 party ", 15), "?b?"},
+	}
+	for _, test := range tests {
+		encoded := EncodeHeaderText(test.text)
+		if test.encoding == "" && encoded != test.text {
+			t.Errorf("%s: got %q, want the text unchanged", test.name, encoded)
+		}
+		if test.encoding != "" && !strings.Contains(encoded, test.encoding) {
+			t.Errorf("%s: got %q, want %s encoding", test.name, encoded, test.encoding)
+		}
+		if decoded := DecodeHeader(encoded); decoded != test.text {
+			t.Errorf("%s: round trip gave %q, want %q", test.name, decoded, test.text)
+		}
+		for _, word := range strings.Fields(encoded) {
+			if !strings.HasPrefix(word, "=?") {
+				continue
+			}
+			// RFC 2047 section 2: at most 75 characters, and each word decodes on its own
+			if len(word) > 75 {
+				t.Errorf("%s: encoded word of %d characters: %s", test.name, len(word), word)
+			}
+			if decoded := DecodeHeader(word); !utf8.ValidString(decoded) || strings.ContainsRune(decoded, utf8.RuneError) {
+				t.Errorf("%s: %s splits a character (%q)", test.name, word, decoded)
+			}
+		}
+	}
+}
+
+func TestEncodePhrase(t *testing.T) {
+	if got := EncodePhrase("Jane Doe"); got != "Jane Doe" {
+		t.Errorf("ASCII phrase: got %q", got)
+	}
+	// Q in a phrase may only use letters, digits and !*+-/ (RFC 2047 section 5)
+	encoded := EncodePhrase(`Müller, "Hans" <admin>`)
+	if strings.ContainsAny(encoded, `,"<>`) || DecodeHeader(encoded) != `Müller, "Hans" <admin>` {
+		t.Errorf("got %q", encoded)
+	}
+}
+
+// unfold undoes FoldHeader: CRLF followed by a space becomes that space
+func unfold(header string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(header, "\r\n"), "\r\n ", " ")
+}
+
+func TestFoldHeader(t *testing.T) {
+	subject := strings.Repeat("folding keeps every word whole ", 8)
+	folded := FoldHeader("Subject", subject)
+	if unfold(folded) != "Subject: "+subject {
+		t.Errorf("unfolded %q", unfold(folded))
+	}
+	lines := strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Errorf("got %d lines, want the subject folded", len(lines))
+	}
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) > 78 {
+			t.Errorf("line of %d characters: %q", utf8.RuneCountInString(line), line)
+		}
+	}
+
+	// A word longer than 78 characters is kept whole
+	word := strings.Repeat("x", 200)
+	if got := FoldHeader("Message-ID", "<"+word+"@example.com>"); got != "Message-ID: <"+word+"@example.com>\r\n" {
+		t.Errorf("long word: got %q", got)
+	}
+	if got := FoldHeader("Subject", "short "+word); got != "Subject: short\r\n "+word+"\r\n" {
+		t.Errorf("long word after a short one: got %q", got)
+	}
+}
+
+func TestFoldHeaderOctetLimit(t *testing.T) {
+	for _, word := range []string{strings.Repeat("x", 2500), strings.Repeat("é", 1500), strings.Repeat("€", 1000)} {
+		folded := FoldHeader("X-Long", word)
+		for _, line := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+			if len(line) > 998 {
+				t.Errorf("line of %d octets", len(line))
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("line splits a character: ...%q", line[len(line)-4:])
+			}
+		}
+		if got := strings.ReplaceAll(unfold(folded), " ", ""); got != "X-Long:"+word {
+			t.Errorf("split word lost characters (%d octets left)", len(got))
+		}
+	}
+}
+
+func TestFoldHeaderStripsLineBreaks(t *testing.T) {
+	tests := map[string]string{
+		"Hello\r\nBcc: victim@example.com": "Subject: Hello Bcc: victim@example.com\r\n",
+		"bare\nLF and bare\rCR":            "Subject: bare LF and bare CR\r\n",
+		"two spaces  kept":                 "Subject: two spaces  kept\r\n",
+	}
+	for value, want := range tests {
+		if got := FoldHeader("Subject", value); got != want {
+			t.Errorf("%q: got %q, want %q", value, got, want)
+		}
+	}
+	// Encoded text never carries a line break either
+	if encoded := EncodeHeaderText("Grüße\r\nBcc: victim@example.com"); strings.ContainsAny(encoded, "\r\n") {
+		t.Errorf("encoded text has a line break: %q", encoded)
+	}
+}
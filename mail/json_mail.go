@@ -14,6 +14,17 @@ type JSONMail struct {
 	Subject string            `json:"subject,omitempty"`
 	Body    string            `json:"body,omitempty"`    // Email body/content
 	Headers map[string]string `json:"headers,omitempty"` // Additional custom headers
+	Raw     bool              `json:"raw,omitempty"`     // Body is the complete message, headers included
+	Auth    *JSONAuth         `json:"auth,omitempty"`    // SMTP AUTH credentials for sending (not part of the mail)
+}
+
+// JSONAuth holds SMTP AUTH credentials sent along with a JSONMail
+// They override the configured client credentials for that send only
+type JSONAuth struct {
+	Mechanism string `json:"mechanism,omitempty"` // PLAIN, LOGIN, CRAM-MD5 or XOAUTH2 ("" = negotiate)
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Token     string `json:"token,omitempty"` // OAuth 2.0 access token for XOAUTH2
 }
 
 // ToMail converts JSONMail to Mail struct for sending
@@ -44,6 +55,7 @@ func (j *JSONMail) ToMail() *Mail {
 	if j.Body != "" {
 		mail.SetData(j.Body)
 	}
+	mail.SetRaw(j.Raw)
 
 	// Convert custom headers to flags
 	for key, value := range j.Headers {
@@ -66,6 +78,7 @@ func FromMail(m *Mail) *JSONMail {
 		Subject: m.GetSubject(),
 		Body:    m.GetData(),
 		Headers: make(map[string]string),
+		Raw:     m.IsRaw(),
 	}
 
 	// Convert flags to headers
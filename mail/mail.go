@@ -1,13 +1,26 @@
 package mail
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/dkim"
+	"github.com/ImBubbles/MySMTP/mail/message"
+)
+
 type Mail struct {
-	from    string
-	flags   []FromFlag
-	to      []string
-	cc      []string
-	bcc     []string
-	subject string
-	data    string
+	from      string
+	flags     []FromFlag
+	rcptFlags map[string][]FromFlag // RCPT TO parameters keyed by recipient (e.g. NOTIFY, ORCPT)
+	to        []string
+	cc        []string
+	bcc       []string
+	subject   string
+	data      string
+	session   Session       // Client the message was received from (server side only)
+	dkim      []dkim.Result // DKIM verification results (server side only)
+	raw       bool          // data is the complete message (headers and body), sent as is
 }
 
 func NewBlankMail() *Mail {
@@ -29,6 +42,19 @@ func (m *Mail) AppendTo(to ...string) *Mail {
 	return m
 }
 
+// SetTo replaces the recipients; the RCPT TO parameters of the others are dropped
+func (m *Mail) SetTo(to ...string) *Mail {
+	rcptFlags := make(map[string][]FromFlag)
+	for _, rcpt := range to {
+		if flags, ok := m.rcptFlags[rcpt]; ok {
+			rcptFlags[rcpt] = flags
+		}
+	}
+	m.to = to
+	m.rcptFlags = rcptFlags
+	return m
+}
+
 func (m *Mail) AppendCC(cc ...string) *Mail {
 	m.cc = append(m.cc, cc...)
 	return m
@@ -44,11 +70,39 @@ func (m *Mail) AppendFlag(flags ...FromFlag) *Mail {
 	return m
 }
 
+// AppendRcptFlag stores RCPT TO parameters for one recipient
+func (m *Mail) AppendRcptFlag(rcpt string, flags ...FromFlag) *Mail {
+	if m.rcptFlags == nil {
+		m.rcptFlags = make(map[string][]FromFlag)
+	}
+	m.rcptFlags[rcpt] = append(m.rcptFlags[rcpt], flags...)
+	return m
+}
+
+// SetSession records the client session the message was received from
+func (m *Mail) SetSession(session Session) *Mail {
+	m.session = session
+	return m
+}
+
+// SetDKIMResults records the outcome of verifying the DKIM signatures of a received message
+func (m *Mail) SetDKIMResults(results []dkim.Result) *Mail {
+	m.dkim = results
+	return m
+}
+
 func (m *Mail) SetData(data string) *Mail {
 	m.data = data
 	return m
 }
 
+// SetRaw marks the data as the complete message, headers included (e.g. mail received by
+// the server); the client then sends it unchanged instead of generating headers
+func (m *Mail) SetRaw(raw bool) *Mail {
+	m.raw = raw
+	return m
+}
+
 // Getter methods
 func (m *Mail) GetFrom() string {
 	return m.from
@@ -74,6 +128,127 @@ func (m *Mail) GetData() string {
 	return m.data
 }
 
+// Parse parses the message into its text and HTML bodies and attachments (see package message)
+// A mail that is not raw only has a body, which is read as plain text
+func (m *Mail) Parse() *message.Message {
+	if m.raw {
+		return message.Parse([]byte(m.data))
+	}
+	// An empty line first: no header fields, everything is body
+	return message.Parse([]byte("\r\n" + m.data))
+}
+
+// IsRaw reports whether the data is the complete message, headers included
+func (m *Mail) IsRaw() bool {
+	return m.raw
+}
+
+// Render returns the complete message as the SMTP client transmits it: the data of a raw mail
+// as it is, otherwise the generated headers, a blank line and the body
+// The body is sent as UTF-8 text/plain unless a flag sets the Content-Type; then it is sent as it is
+// Date and Message-ID are generated on every call unless flags set them
+func (m *Mail) Render() string {
+	if m.raw {
+		return m.data
+	}
+	body := m.data
+	if _, ok := m.header("Content-Type"); ok {
+		return m.renderHeaders("") + "\r\n" + body
+	}
+	body, encoding := EncodeText(body)
+	return m.renderHeaders(encoding) + "\r\n" + body
+}
+
+// header returns the value of a header set through the flags of the mail
+func (m *Mail) header(key string) (string, bool) {
+	for _, flag := range m.flags {
+		if strings.EqualFold(flag.GetKey(), key) && flag.GetValue() != "" {
+			return flag.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// renderHeaders returns the header fields of a mail that is not raw, ending with CRLF
+// encoding is the Content-Transfer-Encoding of the text/plain body ("" when a flag sets the Content-Type)
+func (m *Mail) renderHeaders(encoding string) string {
+	var builder strings.Builder
+
+	// Date and Message-ID are required or expected by receivers (RFC 5322 section 3.6)
+	if _, ok := m.header("Date"); !ok {
+		builder.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	}
+	if _, ok := m.header("Message-ID"); !ok {
+		builder.WriteString(fmt.Sprintf("Message-ID: <%s>\r\n", GenerateMessageID(m.from)))
+	}
+
+	if m.from != "" {
+		builder.WriteString(FoldHeader("From", FormatAddresses([]string{m.from})))
+	}
+	if len(m.to) > 0 {
+		builder.WriteString(FoldHeader("To", FormatAddresses(m.to)))
+	}
+	if len(m.cc) > 0 {
+		builder.WriteString(FoldHeader("Cc", FormatAddresses(m.cc)))
+	}
+	// Non-ASCII text goes out as encoded words (RFC 2047)
+	if m.subject != "" {
+		builder.WriteString(FoldHeader("Subject", EncodeHeaderText(m.subject)))
+	}
+
+	// Other headers from flags
+	for _, flag := range m.flags {
+		if flag.GetKey() != "" && flag.GetValue() != "" {
+			builder.WriteString(FoldHeader(flag.GetKey(), EncodeHeaderText(flag.GetValue())))
+		}
+	}
+
+	if encoding != "" {
+		if _, ok := m.header("MIME-Version"); !ok {
+			builder.WriteString("MIME-Version: 1.0\r\n")
+		}
+		builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		builder.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", encoding))
+	}
+	return builder.String()
+}
+
+// GetSession returns the client session the message was received from
+func (m *Mail) GetSession() Session {
+	return m.session
+}
+
+// GetDKIMResults returns one result per DKIM signature of a received message
+// (empty if it had none, or verification is disabled)
+func (m *Mail) GetDKIMResults() []dkim.Result {
+	return m.dkim
+}
+
 func (m *Mail) GetFlags() []FromFlag {
 	return m.flags
 }
+
+// GetFlag returns the value of a MAIL FROM parameter (case-insensitive key)
+func (m *Mail) GetFlag(key string) (string, bool) {
+	for _, flag := range m.flags {
+		if strings.EqualFold(flag.GetKey(), key) {
+			return flag.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// GetRcptFlags returns the RCPT TO parameters given for a recipient
+func (m *Mail) GetRcptFlags(rcpt string) []FromFlag {
+	return m.rcptFlags[rcpt]
+}
+
+// GetRcptFlag returns the value of one RCPT TO parameter for a recipient (case-insensitive key)
+func (m *Mail) GetRcptFlag(rcpt string, key string) (string, bool) {
+	for _, flag := range m.rcptFlags[rcpt] {
+		if strings.EqualFold(flag.GetKey(), key) {
+			return flag.GetValue(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,219 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// CharsetDecoder converts text in one charset to UTF-8
+type CharsetDecoder func(data []byte) string
+
+var (
+	charsetsMu sync.RWMutex
+	charsets   = map[string]CharsetDecoder{
+		"utf-8":        decodeUTF8,
+		"us-ascii":     decodeUTF8, // 8-bit bytes in "ASCII" text are usually UTF-8 in practice
+		"iso-8859-1":   decodeLatin1,
+		"latin1":       decodeLatin1,
+		"windows-1252": decodeWindows1252,
+		"cp1252":       decodeWindows1252,
+		"iso-8859-15":  decodeLatin9,
+		"utf-16":       decodeUTF16,
+		"utf-16be":     decodeUTF16BE,
+		"utf-16le":     decodeUTF16LE,
+	}
+)
+
+// RegisterCharset adds or replaces the decoder of a charset (case-insensitive name)
+func RegisterCharset(name string, decoder CharsetDecoder) {
+	charsetsMu.Lock()
+	charsets[strings.ToLower(name)] = decoder
+	charsetsMu.Unlock()
+}
+
+// DecodeCharset converts text to UTF-8; unknown charsets are read as UTF-8 and invalid
+// sequences become U+FFFD
+func DecodeCharset(data []byte, charset string) string {
+	charset = strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"`))
+	charsetsMu.RLock()
+	decoder, ok := charsets[charset]
+	charsetsMu.RUnlock()
+	if !ok {
+		decoder = decodeUTF8
+	}
+	return decoder(data)
+}
+
+// DecodeHeader decodes the encoded words (RFC 2047) of a header value to UTF-8
+// Whitespace between adjacent encoded words is dropped, and adjacent words in the same charset
+// are decoded together so characters split across words survive; malformed words are kept
+// as they are
+func DecodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+	var builder strings.Builder
+	var pending []byte // Decoded bytes of adjacent words not yet converted
+	var pendingCharset string
+	flush := func() {
+		if pending != nil {
+			builder.WriteString(DecodeCharset(pending, pendingCharset))
+			pending = nil
+		}
+	}
+
+	rest := value
+	afterWord := false
+	for rest != "" {
+		start := strings.Index(rest, "=?")
+		if start < 0 {
+			break
+		}
+		charset, data, length, ok := decodeWord(rest[start:])
+		if !ok {
+			flush()
+			builder.WriteString(rest[:start+2])
+			rest = rest[start+2:]
+			afterWord = false
+			continue
+		}
+		between := rest[:start]
+		if !afterWord || strings.Trim(between, " \t") != "" {
+			flush()
+			builder.WriteString(between)
+		}
+		if pending != nil && charset != pendingCharset {
+			flush()
+		}
+		pending = append(pending, data...)
+		pendingCharset = charset
+		rest = rest[start+length:]
+		afterWord = true
+	}
+	flush()
+	builder.WriteString(rest)
+	return builder.String()
+}
+
+// decodeWord decodes the encoded word "=?charset?encoding?text?=" at the start of s and
+// returns its charset, its bytes and its length in s
+func decodeWord(s string) (string, []byte, int, bool) {
+	// charset and encoding contain no "?"; the text contains neither "?" nor whitespace
+	fields := strings.SplitN(s[2:], "?", 4)
+	if len(fields) < 4 || !strings.HasPrefix(fields[3], "=") || len(fields[1]) != 1 {
+		return "", nil, 0, false
+	}
+	charset, encoding, text := fields[0], fields[1], fields[2]
+	if charset == "" || strings.ContainsAny(charset+text, " \t\r\n") {
+		return "", nil, 0, false
+	}
+	// RFC 2231 section 5 allows a language after the charset: "utf-8*en"
+	charset, _, _ = strings.Cut(charset, "*")
+	length := 2 + len(fields[0]) + 1 + 1 + 1 + len(text) + 2
+
+	switch encoding {
+	case "b", "B":
+		return strings.ToLower(charset), decodeBase64([]byte(text)), length, true
+	case "q", "Q":
+		return strings.ToLower(charset), decodeQ(text), length, true
+	}
+	return "", nil, 0, false
+}
+
+// decodeQ decodes Q encoding: quoted-printable escapes, and "_" for space
+func decodeQ(text string) []byte {
+	data := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '_':
+			data = append(data, ' ')
+		case text[i] == '=' && i+2 < len(text) && isHex(text[i+1]) && isHex(text[i+2]):
+			data = append(data, unhex(text[i+1])<<4|unhex(text[i+2]))
+			i += 2
+		default:
+			data = append(data, text[i])
+		}
+	}
+	return data
+}
+
+func decodeUTF8(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// windows1252 maps 0x80-0x9F, where windows-1252 differs from ISO-8859-1
+var windows1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		if b >= 0x80 && b <= 0x9f {
+			runes[i] = windows1252[b-0x80]
+		} else {
+			runes[i] = rune(b)
+		}
+	}
+	return string(runes)
+}
+
+// latin9 holds the eight positions where ISO-8859-15 differs from ISO-8859-1
+var latin9 = map[byte]rune{
+	0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+}
+
+func decodeLatin9(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		if r, ok := latin9[b]; ok {
+			runes[i] = r
+		} else {
+			runes[i] = rune(b)
+		}
+	}
+	return string(runes)
+}
+
+// decodeUTF16 honours a byte order mark and defaults to big endian (RFC 2781)
+func decodeUTF16(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return decodeUTF16With(data[2:], binary.LittleEndian)
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return decodeUTF16With(data[2:], binary.BigEndian)
+	}
+	return decodeUTF16With(data, binary.BigEndian)
+}
+
+func decodeUTF16BE(data []byte) string {
+	return decodeUTF16With(data, binary.BigEndian)
+}
+
+func decodeUTF16LE(data []byte) string {
+	return decodeUTF16With(data, binary.LittleEndian)
+}
+
+func decodeUTF16With(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, order.Uint16(data[i:]))
+	}
+	return string(utf16.Decode(units))
+}
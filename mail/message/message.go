@@ -0,0 +1,292 @@
+// Package message parses received messages (RFC 5322 with MIME, RFC 2045-2049) into a tree of
+// parts and picks out what a handler usually wants: the text body, the HTML body and the files
+//
+// Parsing never fails on malformed input: a broken Content-Type is read as text/plain, a
+// missing closing boundary ends the part at the end of the message, invalid base64 and
+// quoted-printable is decoded as far as possible, and unknown charsets are read as UTF-8
+//
+// Example (in a MailHandler):
+//
+//	msg := m.Parse()
+//	fmt.Println(msg.Subject(), msg.Text)
+//	for _, file := range msg.Attachments {
+//		save(file.Filename, file.Reader())
+//	}
+package message
+
+import (
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// Limits that keep hostile messages from using up memory and stack
+const (
+	MAX_DEPTH = 32   // Nested multiparts below this are kept as one opaque part
+	MAX_PARTS = 1000 // Parts after this many are not split any further
+)
+
+// Message is a parsed message
+type Message struct {
+	Header      textproto.MIMEHeader // Top-level header fields, unfolded
+	Root        *Part                // The MIME tree; the message itself is the root part
+	Text        string               // text/plain body in UTF-8 ("" if none)
+	HTML        string               // text/html body in UTF-8 ("" if none)
+	Attachments []*Part              // Files: parts with a file name or "attachment" disposition, and non-text parts
+	Inline      []*Part              // Parts the HTML body references by Content-ID (cid:)
+}
+
+// Parse parses a complete message, headers and body
+func Parse(data []byte) *Message {
+	p := &parser{}
+	root := p.parseEntity(data, 0, "text/plain")
+	msg := &Message{
+		Header:      root.Header,
+		Root:        root,
+		Attachments: make([]*Part, 0),
+		Inline:      make([]*Part, 0),
+	}
+	msg.collect(root, false)
+	return msg
+}
+
+// Read parses a message from a reader
+func Read(r io.Reader) (*Message, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data), nil
+}
+
+// Subject returns the decoded Subject header
+func (m *Message) Subject() string {
+	return DecodeHeader(m.Header.Get("Subject"))
+}
+
+// Parts returns every part of the tree in document order, multiparts included
+func (m *Message) Parts() []*Part {
+	parts := make([]*Part, 0)
+	var walk func(part *Part)
+	walk = func(part *Part) {
+		parts = append(parts, part)
+		for _, child := range part.Parts {
+			walk(child)
+		}
+	}
+	walk(m.Root)
+	return parts
+}
+
+// collect sorts the leaves of the tree into bodies, inline parts and attachments
+// related is true below a multipart/related, where parts with a Content-ID belong to the HTML
+func (m *Message) collect(part *Part, related bool) {
+	if part.IsMultipart() {
+		if part.ContentType == "multipart/alternative" {
+			m.collectAlternative(part, related)
+			return
+		}
+		for _, child := range part.Parts {
+			m.collect(child, related || part.ContentType == "multipart/related")
+		}
+		return
+	}
+
+	if !part.IsAttachment() {
+		switch part.ContentType {
+		case "text/plain":
+			// Text split into several parts (e.g. a signature added by a list) is joined
+			m.Text = joinBody(m.Text, part.Text())
+			return
+		case "text/html":
+			m.HTML = joinBody(m.HTML, part.Text())
+			return
+		}
+	}
+	if part.ContentID != "" && (related || part.Disposition == "inline") {
+		m.Inline = append(m.Inline, part)
+		return
+	}
+	m.Attachments = append(m.Attachments, part)
+}
+
+// collectAlternative takes the text and the HTML version from a multipart/alternative
+// Other alternatives (e.g. text/calendar) are kept as attachments
+func (m *Message) collectAlternative(part *Part, related bool) {
+	for _, child := range part.Parts {
+		switch {
+		case child.IsMultipart():
+			m.collect(child, related)
+		case child.ContentType == "text/plain" && m.Text == "":
+			m.Text = child.Text()
+		case child.ContentType == "text/html" && m.HTML == "":
+			m.HTML = child.Text()
+		case child.ContentType != "text/plain" && child.ContentType != "text/html":
+			m.Attachments = append(m.Attachments, child)
+		}
+	}
+}
+
+// joinBody appends a body part to what was collected so far
+func joinBody(body string, text string) string {
+	if body == "" {
+		return text
+	}
+	if !strings.HasSuffix(body, "\n") {
+		body += "\r\n"
+	}
+	return body + text
+}
+
+// parser holds the state of one Parse call
+type parser struct {
+	parts int
+}
+
+// parseEntity parses the header and body of one entity
+// defaultType is the type of an entity without Content-Type (message/rfc822 in a multipart/digest)
+func (p *parser) parseEntity(data []byte, depth int, defaultType string) *Part {
+	p.parts++
+	header, body := splitHeader(data)
+	part := newPart(header, defaultType)
+
+	if !part.IsMultipart() {
+		part.raw = body
+		return part
+	}
+	boundary := part.Params["boundary"]
+	if boundary == "" || depth >= MAX_DEPTH || p.parts >= MAX_PARTS {
+		// Without a usable boundary the body cannot be split; keep it as one opaque part
+		part.ContentType = "application/octet-stream"
+		part.raw = body
+		return part
+	}
+
+	childType := "text/plain"
+	if part.ContentType == "multipart/digest" {
+		childType = "message/rfc822"
+	}
+	for _, chunk := range splitMultipart(body, boundary) {
+		if p.parts >= MAX_PARTS {
+			break
+		}
+		part.Parts = append(part.Parts, p.parseEntity(chunk, depth+1, childType))
+	}
+	return part
+}
+
+// splitHeader separates the header block from the body at the first empty line
+// A first line that is no header field means the entity has no header at all
+func splitHeader(data []byte) (textproto.MIMEHeader, []byte) {
+	header := make(textproto.MIMEHeader)
+	if len(data) == 0 {
+		return header, data
+	}
+	first, _, _ := bytes.Cut(data, []byte("\n"))
+	if len(bytes.TrimSpace(first)) > 0 && !looksLikeField(first) {
+		return header, data
+	}
+
+	var name string
+	var value strings.Builder
+	flush := func() {
+		if name != "" {
+			header.Add(name, strings.TrimSpace(value.String()))
+		}
+		name = ""
+		value.Reset()
+	}
+	rest := data
+	for len(rest) > 0 {
+		line, next, found := bytes.Cut(rest, []byte("\n"))
+		if !found {
+			next = nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			flush()
+			return header, next
+		}
+		rest = next
+		if line[0] == ' ' || line[0] == '\t' {
+			// Folded continuation of the previous field
+			if name != "" {
+				value.WriteByte(' ')
+				value.Write(bytes.TrimSpace(line))
+			}
+			continue
+		}
+		flush()
+		if key, val, ok := bytes.Cut(line, []byte(":")); ok && looksLikeField(line) {
+			name = textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(key)))
+			value.Write(bytes.TrimSpace(val))
+		}
+		// Lines that are no field are dropped
+	}
+	flush()
+	// Only a header, no empty line and no body
+	return header, nil
+}
+
+// looksLikeField reports whether a line starts with "Name:" (printable ASCII without spaces)
+func looksLikeField(line []byte) bool {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return false
+	}
+	for _, b := range bytes.TrimRight(line[:colon], " \t") {
+		if b <= ' ' || b >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// splitMultipart returns the body parts between the boundary delimiters (RFC 2046 section 5.1.1)
+// The preamble and the epilogue are dropped; without a closing delimiter the last part runs
+// to the end of the data
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	chunks := make([][]byte, 0)
+	start := -1 // Start of the current part, -1 while in the preamble
+	offset := 0
+	for offset < len(body) {
+		end := bytes.IndexByte(body[offset:], '\n')
+		lineEnd := len(body)
+		next := len(body)
+		if end >= 0 {
+			lineEnd = offset + end
+			next = lineEnd + 1
+		}
+		line := bytes.TrimRight(body[offset:lineEnd], "\r")
+
+		if bytes.HasPrefix(line, delimiter) {
+			suffix := bytes.TrimRight(line[len(delimiter):], " \t")
+			closing := bytes.Equal(suffix, []byte("--"))
+			if len(suffix) == 0 || closing {
+				if start >= 0 {
+					// The line break before the delimiter belongs to the delimiter
+					chunks = append(chunks, trimLineBreak(body[start:offset]))
+				}
+				if closing {
+					return chunks
+				}
+				start = next
+			}
+		}
+		offset = next
+	}
+	if start >= 0 && start < len(body) {
+		chunks = append(chunks, body[start:])
+	}
+	return chunks
+}
+
+// trimLineBreak removes one trailing CRLF or LF
+func trimLineBreak(data []byte) []byte {
+	if bytes.HasSuffix(data, []byte("\r\n")) {
+		return data[:len(data)-2]
+	}
+	return bytes.TrimSuffix(data, []byte("\n"))
+}
@@ -0,0 +1,113 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMultipart(t *testing.T) {
+	data := "Subject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hi</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"SGVsbG8=\r\n" +
+		"--outer--\r\n" +
+		"epilogue\r\n"
+	msg := Parse([]byte(data))
+	if msg.Subject() != "Grüße" {
+		t.Errorf("Subject = %q", msg.Subject())
+	}
+	if msg.Text != "Grüße" {
+		t.Errorf("Text = %q", msg.Text)
+	}
+	if msg.HTML != "<p>Hi</p>" {
+		t.Errorf("HTML = %q", msg.HTML)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "report.pdf" || string(msg.Attachments[0].Content()) != "Hello" {
+		t.Errorf("unexpected attachments %+v", msg.Attachments)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		text string // Expected Text
+		// Expected number of attachments
+		attachments int
+	}{
+		{"no header", "just a body\r\n", "just a body\r\n", 0},
+		{"header only", "Subject: x\r\n", "", 0},
+		{"broken content type", "Content-Type: text/plain; charset\r\n\r\nbody", "body", 0},
+		{"invalid media type", "Content-Type: garbage\r\n\r\nbody", "body", 0},
+		{"multipart without boundary", "Content-Type: multipart/mixed\r\n\r\n--x\r\nbody\r\n", "", 1},
+		{"missing closing boundary", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\nfirst\r\n--b\r\n\r\nsecond", "first\r\nsecond", 0},
+		{"no delimiter at all", "Content-Type: multipart/mixed; boundary=b\r\n\r\nbody without parts\r\n", "", 0},
+		{"unknown charset", "Content-Type: text/plain; charset=x-unknown\r\n\r\nbody", "body", 0},
+		{"unknown encoding", "Content-Transfer-Encoding: x-custom\r\n\r\nbody", "body", 0},
+		{"bare LF", "Subject: x\nContent-Type: text/plain\n\nbody\n", "body\n", 0},
+	}
+	for _, test := range tests {
+		msg := Parse([]byte(test.data))
+		if msg.Text != test.text {
+			t.Errorf("%s: Text = %q, want %q", test.name, msg.Text, test.text)
+		}
+		if len(msg.Attachments) != test.attachments {
+			t.Errorf("%s: got %d attachments, want %d", test.name, len(msg.Attachments), test.attachments)
+		}
+	}
+}
+
+func TestParseInvalidTransferEncoding(t *testing.T) {
+	base64 := Parse([]byte("Content-Transfer-Encoding: base64\r\n\r\nSGVs bG8=\r\n!!!!"))
+	if !strings.HasPrefix(base64.Text, "Hello") {
+		t.Errorf("base64: Text = %q, want the valid prefix decoded", base64.Text)
+	}
+	qp := Parse([]byte("Content-Transfer-Encoding: quoted-printable\r\n\r\na=3Db=ZZc=\r\nd"))
+	if qp.Text != "a=b=ZZcd" {
+		t.Errorf("quoted-printable: Text = %q", qp.Text)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	// Nesting deeper than MAX_DEPTH stops splitting instead of recursing on
+	var data strings.Builder
+	for i := 0; i < MAX_DEPTH+10; i++ {
+		data.WriteString("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n")
+	}
+	msg := Parse([]byte(data.String()))
+	depth := 0
+	for part := msg.Root; len(part.Parts) > 0; part = part.Parts[0] {
+		depth++
+	}
+	if depth > MAX_DEPTH {
+		t.Errorf("parsed %d levels, limit is %d", depth, MAX_DEPTH)
+	}
+
+	// A flat multipart with too many parts is cut off at MAX_PARTS
+	data.Reset()
+	data.WriteString("Content-Type: multipart/mixed; boundary=b\r\n\r\n")
+	for i := 0; i < MAX_PARTS+10; i++ {
+		data.WriteString("--b\r\n\r\nx\r\n")
+	}
+	if parts := len(Parse([]byte(data.String())).Parts()); parts > MAX_PARTS {
+		t.Errorf("got %d parts, limit is %d", parts, MAX_PARTS)
+	}
+}
@@ -0,0 +1,212 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Part is one entity of the MIME tree: a multipart with Parts, or a leaf with content
+type Part struct {
+	Header      textproto.MIMEHeader
+	ContentType string            // Lower-case media type, e.g. "text/plain" (text/plain if missing or invalid)
+	Params      map[string]string // Content-Type parameters (charset, boundary, name, ...)
+	Charset     string            // Lower-case charset of a text part ("us-ascii" if not given)
+	Encoding    string            // Lower-case Content-Transfer-Encoding ("7bit" if not given)
+	Disposition string            // "inline", "attachment" or "" (Content-Disposition)
+	Filename    string            // From Content-Disposition filename, else Content-Type name, decoded
+	ContentID   string            // Content-ID without angle brackets
+	Parts       []*Part           // Children of a multipart
+
+	raw     []byte // Body as received, still transfer-encoded
+	decoded []byte // Body after the transfer decoding, set on first use
+	done    bool
+}
+
+// newPart reads the MIME header fields of an entity
+func newPart(header textproto.MIMEHeader, defaultType string) *Part {
+	part := &Part{Header: header, Params: make(map[string]string)}
+
+	part.ContentType = defaultType
+	if value := header.Get("Content-Type"); value != "" {
+		// A value with broken parameters still has a usable media type
+		mediaType, params, err := mime.ParseMediaType(value)
+		if mediaType != "" && strings.Contains(mediaType, "/") {
+			part.ContentType = mediaType
+			if err == nil {
+				part.Params = params
+			} else {
+				part.Params = parseParamsLeniently(value)
+			}
+		}
+	}
+	part.Charset = strings.ToLower(part.Params["charset"])
+	if part.Charset == "" && strings.HasPrefix(part.ContentType, "text/") {
+		part.Charset = "us-ascii"
+	}
+
+	part.Encoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	if part.Encoding == "" {
+		part.Encoding = "7bit"
+	}
+
+	if value := header.Get("Content-Disposition"); value != "" {
+		disposition, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			params = parseParamsLeniently(value)
+		}
+		part.Disposition = strings.ToLower(disposition)
+		part.Filename = params["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = part.Params["name"]
+	}
+	// Some clients put encoded words into file names instead of RFC 2231 parameters
+	part.Filename = DecodeHeader(part.Filename)
+
+	part.ContentID = strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+	return part
+}
+
+// parseParamsLeniently reads "key=value" parameters that mime.ParseMediaType rejected
+// (e.g. unquoted values with spaces, or duplicates); the first value of a key wins
+func parseParamsLeniently(value string) map[string]string {
+	params := make(map[string]string)
+	fields := strings.Split(value, ";")
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		key = strings.TrimSuffix(key, "*")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		if _, seen := params[key]; !seen && key != "" {
+			params[key] = val
+		}
+	}
+	return params
+}
+
+// IsMultipart reports whether the part has children
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsAttachment reports whether the part is a file rather than a body
+func (p *Part) IsAttachment() bool {
+	if p.Disposition == "attachment" || p.Filename != "" {
+		return true
+	}
+	return !strings.HasPrefix(p.ContentType, "text/") && !p.IsMultipart()
+}
+
+// Content returns the body of a leaf with the transfer encoding removed (nil for a multipart)
+func (p *Part) Content() []byte {
+	if !p.done {
+		p.decoded = decodeTransfer(p.raw, p.Encoding)
+		p.done = true
+	}
+	return p.decoded
+}
+
+// Reader returns a reader over Content
+func (p *Part) Reader() *bytes.Reader {
+	return bytes.NewReader(p.Content())
+}
+
+// Size returns the length of the decoded content in bytes
+func (p *Part) Size() int {
+	return len(p.Content())
+}
+
+// Text returns the content of a text part converted from its charset to UTF-8
+func (p *Part) Text() string {
+	return DecodeCharset(p.Content(), p.Charset)
+}
+
+// decodeTransfer removes a Content-Transfer-Encoding; unknown encodings are returned as they are
+func decodeTransfer(data []byte, encoding string) []byte {
+	switch encoding {
+	case "base64":
+		return decodeBase64(data)
+	case "quoted-printable":
+		return decodeQuotedPrintable(data)
+	}
+	return data
+}
+
+// decodeBase64 decodes base64, skipping line breaks and any other character outside the
+// alphabet, and decoding a truncated last group as far as it goes
+func decodeBase64(data []byte) []byte {
+	clean := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '+', b == '/':
+			clean = append(clean, b)
+		case b == '=':
+			// Padding ends the data
+			return decodeRawBase64(clean)
+		}
+	}
+	return decodeRawBase64(clean)
+}
+
+func decodeRawBase64(clean []byte) []byte {
+	if len(clean)%4 == 1 {
+		// A single leftover character carries no complete byte
+		clean = clean[:len(clean)-1]
+	}
+	decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(clean)))
+	n, _ := base64.RawStdEncoding.Decode(decoded, clean)
+	return decoded[:n]
+}
+
+// decodeQuotedPrintable decodes quoted-printable (RFC 2045 section 6.7)
+// Soft line breaks are removed, trailing whitespace on lines is dropped, and an "=" that does
+// not start a valid escape is kept literally
+func decodeQuotedPrintable(data []byte) []byte {
+	decoded := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		data = rest
+		hasCR := bytes.HasSuffix(line, []byte("\r"))
+		line = bytes.TrimRight(line, " \t\r")
+
+		soft := bytes.HasSuffix(line, []byte("="))
+		if soft {
+			line = line[:len(line)-1]
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] == '=' && i+2 < len(line) && isHex(line[i+1]) && isHex(line[i+2]) {
+				decoded = append(decoded, unhex(line[i+1])<<4|unhex(line[i+2]))
+				i += 2
+				continue
+			}
+			decoded = append(decoded, line[i])
+		}
+		if found && !soft {
+			if hasCR {
+				decoded = append(decoded, '\r')
+			}
+			decoded = append(decoded, '\n')
+		}
+	}
+	return decoded
+}
+
+func isHex(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	}
+	return b - 'A' + 10
+}
@@ -0,0 +1,11 @@
+package mail
+
+// Session describes the SMTP client a message was received from
+// When a trusted proxy uses XCLIENT / XFORWARD these are the original client's attributes
+type Session struct {
+	ClientAddr string // Client IP address ("" if unknown)
+	ClientName string // Client hostname from reverse DNS ("" if unknown)
+	Helo       string // Argument of HELO/EHLO
+	Login      string // Authenticated user name ("" if not authenticated)
+	Protocol   string // SMTP, ESMTP, ESMTPS, ...
+}
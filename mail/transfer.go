@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Content-Transfer-Encoding values (RFC 2045 section 6)
+const (
+	ENCODING_7BIT             = "7bit"
+	ENCODING_8BIT             = "8bit"
+	ENCODING_QUOTED_PRINTABLE = "quoted-printable"
+	ENCODING_BASE64           = "base64"
+)
+
+// maxLineLength is the longest line SMTP allows, without CRLF (RFC 5321 section 4.5.3.1.6)
+const maxLineLength = 998
+
+// ChooseTransferEncoding picks the encoding a part can be sent with over any SMTP server
+// Short-lined ASCII text goes as it is (7bit); text with a few 8-bit bytes or long lines is
+// quoted-printable, which keeps it readable; binary data and mostly non-ASCII text is base64
+func ChooseTransferEncoding(data []byte, text bool) string {
+	if !text {
+		return ENCODING_BASE64
+	}
+	nonASCII := 0
+	lineLength := 0
+	longLines := false
+	for _, b := range data {
+		switch {
+		case b == '\n':
+			lineLength = 0
+			continue
+		case b == 0:
+			// NUL is not allowed in 7bit or 8bit data
+			return ENCODING_BASE64
+		case b >= 0x80:
+			nonASCII++
+		}
+		lineLength++
+		if lineLength > maxLineLength {
+			longLines = true
+		}
+	}
+	switch {
+	case nonASCII == 0 && !longLines:
+		return ENCODING_7BIT
+	case nonASCII*3 > len(data):
+		// Quoted-printable triples every 8-bit byte; base64 is shorter from here on
+		return ENCODING_BASE64
+	default:
+		return ENCODING_QUOTED_PRINTABLE
+	}
+}
+
+// EncodeTransfer encodes data with a Content-Transfer-Encoding
+// Text is expected with CRLF line endings; 7bit and 8bit data is returned unchanged
+func EncodeTransfer(data []byte, encoding string) []byte {
+	switch encoding {
+	case ENCODING_QUOTED_PRINTABLE:
+		var buffer bytes.Buffer
+		writer := quotedprintable.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+		return buffer.Bytes()
+	case ENCODING_BASE64:
+		return wrapBase64(data)
+	}
+	return data
+}
+
+// wrapBase64 encodes data as base64 in lines of 76 characters (RFC 2045 section 6.8)
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buffer bytes.Buffer
+	buffer.Grow(len(encoded) + len(encoded)/76*2 + 2)
+	for len(encoded) > 76 {
+		buffer.WriteString(encoded[:76])
+		buffer.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buffer.WriteString(encoded)
+	return buffer.Bytes()
+}
+
+// EncodeText prepares a plain text body: CRLF line endings and the transfer encoding it needs
+func EncodeText(text string) (string, string) {
+	data := []byte(toCRLF(text))
+	encoding := ChooseTransferEncoding(data, true)
+	return string(EncodeTransfer(data, encoding)), encoding
+}
+
+// toCRLF turns bare LF and bare CR line endings into CRLF
+func toCRLF(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
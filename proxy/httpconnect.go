@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTPConnect connects through an HTTP proxy with the CONNECT method
+// The proxy must allow CONNECT to the SMTP ports, which many only allow for 443
+type HTTPConnect struct {
+	Address  string // host:port of the proxy
+	Username string // Basic authentication ("" = none)
+	Password string
+	Forward  Dialer // Connects to the proxy (a direct net.Dialer if nil)
+}
+
+// DialContext connects to address ("host:port") through the proxy; only TCP is supported
+func (h *HTTPConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("HTTP proxy: unsupported network %q", network)
+	}
+	conn, err := connect(ctx, h.Forward, h.Address)
+	if err != nil {
+		return nil, err
+	}
+	var tunnel net.Conn
+	err = handshake(ctx, conn, func() error {
+		var err error
+		tunnel, err = h.negotiate(conn, address)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: connecting to %s failed: %w", h.Address, address, err)
+	}
+	return tunnel, nil
+}
+
+// negotiate sends CONNECT and reads the proxy's response
+func (h *HTTPConnect) negotiate(conn net.Conn, address string) (net.Conn, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if h.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("proxy answered %s", response.Status)
+	}
+	// The SMTP greeting may already sit in the reader's buffer
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929)
+const (
+	socksVersion         = 5
+	socksAuthNone        = 0x00
+	socksAuthPassword    = 0x02
+	socksAuthUnavailable = 0xff
+	socksCommandConnect  = 0x01
+	socksAddressIPv4     = 0x01
+	socksAddressDomain   = 0x03
+	socksAddressIPv6     = 0x04
+)
+
+// socksReplies are the SOCKS5 reply codes
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5 connects through a SOCKS5 proxy
+// Hostnames are passed to the proxy unresolved, so the proxy does the DNS lookup
+type SOCKS5 struct {
+	Address  string // host:port of the proxy
+	Username string // Username/password authentication ("" = none)
+	Password string
+	Forward  Dialer // Connects to the proxy (a direct net.Dialer if nil)
+}
+
+// DialContext connects to address ("host:port") through the proxy; only TCP is supported
+func (s *SOCKS5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 proxy: unsupported network %q", network)
+	}
+	conn, err := connect(ctx, s.Forward, s.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(ctx, conn, func() error { return s.negotiate(conn, address) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: connecting to %s failed: %w", s.Address, address, err)
+	}
+	return conn, nil
+}
+
+// negotiate selects the authentication method, authenticates and sends CONNECT
+func (s *SOCKS5) negotiate(conn net.Conn, address string) error {
+	method := byte(socksAuthNone)
+	if s.Username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %d", choice[0])
+	}
+	if choice[1] == socksAuthUnavailable || choice[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == socksAuthPassword {
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	request, err := socksConnectRequest(address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	return readSOCKSReply(conn)
+}
+
+// authenticate sends username and password (RFC 1929)
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("username or password longer than 255 bytes")
+	}
+	request := []byte{1, byte(len(s.Username))}
+	request = append(request, s.Username...)
+	request = append(request, byte(len(s.Password)))
+	request = append(request, s.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// socksConnectRequest builds a CONNECT request for "host:port"
+func socksConnectRequest(address string) ([]byte, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+	request := []byte{socksVersion, socksCommandConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socksAddressIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socksAddressIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname %q is too long", host)
+		}
+		request = append(request, socksAddressDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
+
+// readSOCKSReply reads the reply to CONNECT, including the bound address that follows it
+func readSOCKSReply(conn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %d", header[0])
+	}
+	if header[1] != 0 {
+		if reason, ok := socksReplies[header[1]]; ok {
+			return errors.New(reason)
+		}
+		return fmt.Errorf("reply code %d", header[1])
+	}
+	var length int
+	switch header[3] {
+	case socksAddressIPv4:
+		length = net.IPv4len
+	case socksAddressIPv6:
+		length = net.IPv6len
+	case socksAddressDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return err
+		}
+		length = int(size[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	// Bound address and port are not needed
+	_, err := io.ReadFull(conn, make([]byte, length+2))
+	return err
+}
@@ -0,0 +1,208 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// DSN actions (RFC 3464 section 2.3.3)
+const (
+	ACTION_FAILED  = "failed"
+	ACTION_DELAYED = "delayed"
+	ACTION_RELAYED = "relayed" // Handed to a server without DSN, which cannot send notifications
+)
+
+// report is one recipient of a delivery status notification
+type report struct {
+	Recipient
+	action string
+}
+
+// notifies reports whether the recipient asked for a notification of this kind
+// Without NOTIFY only failures are reported (RFC 3461 section 4.1)
+func (r Recipient) notifies(kind protocol.SMTPNotify) bool {
+	if r.Notify == "" {
+		return kind == protocol.NOTIFY_FAILURE
+	}
+	for _, value := range strings.Split(strings.ToUpper(r.Notify), ",") {
+		if protocol.SMTPNotify(strings.TrimSpace(value)) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// reports returns the recipients whose state changed in the last attempt and who asked to be told
+// before holds the recipients as they were before the attempt; delayed recipients are marked
+// as notified, so each gets at most one delay notification
+// Pending recipients only count as delayed if delayed is set (not after an interrupted attempt)
+func reports(item *Item, before []Recipient, delayed bool) []report {
+	previous := make(map[string]RecipientState)
+	for _, rcpt := range before {
+		previous[rcpt.Address] = rcpt.State
+	}
+	reported := make([]report, 0)
+	for i := range item.Recipients {
+		rcpt := &item.Recipients[i]
+		if previous[rcpt.Address] != STATE_PENDING {
+			continue
+		}
+		switch {
+		case rcpt.State == STATE_FAILED && rcpt.notifies(protocol.NOTIFY_FAILURE):
+			reported = append(reported, report{*rcpt, ACTION_FAILED})
+		case rcpt.State == STATE_DELIVERED && rcpt.notifies(protocol.NOTIFY_SUCCESS) && !rcpt.DSNPassed:
+			// A server with DSN got the NOTIFY request and reports the delivery itself (RFC 3461)
+			reported = append(reported, report{*rcpt, ACTION_RELAYED})
+		case delayed && rcpt.State == STATE_PENDING && !rcpt.DelayNotified && rcpt.notifies(protocol.NOTIFY_DELAY):
+			rcpt.DelayNotified = true
+			reported = append(reported, report{*rcpt, ACTION_DELAYED})
+		}
+	}
+	return reported
+}
+
+// buildDSN builds an RFC 3464 delivery status notification (multipart/report) for the sender
+// of an item: a human readable part, the machine readable delivery-status part and the
+// original message, or only its headers with RET=HDRS
+func buildDSN(item *Item, reported []report, hostname string, now time.Time) *mail.Mail {
+	boundary := fmt.Sprintf("%s.%d/%s", item.ID, now.Unix(), hostname)
+	failed := false
+	delayed := false
+	for _, r := range reported {
+		failed = failed || r.action == ACTION_FAILED
+		delayed = delayed || r.action == ACTION_DELAYED
+	}
+
+	subject := "Successful Mail Delivery Report"
+	switch {
+	case failed:
+		subject = "Undelivered Mail Returned to Sender"
+	case delayed:
+		subject = "Delayed Mail (still being retried)"
+	}
+
+	var body strings.Builder
+	body.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// Human readable explanation
+	body.WriteString("--" + boundary + "\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(fmt.Sprintf("This is the mail system at host %s.\r\n\r\n", hostname))
+	for _, r := range reported {
+		switch r.action {
+		case ACTION_FAILED:
+			body.WriteString(fmt.Sprintf("Your message could not be delivered to <%s>:\r\n", r.Address))
+		case ACTION_DELAYED:
+			body.WriteString(fmt.Sprintf("Your message to <%s> was not delivered yet; delivery will be retried:\r\n", r.Address))
+		default:
+			body.WriteString(fmt.Sprintf("Your message to <%s> was delivered to the destination mail server:\r\n", r.Address))
+		}
+		if r.Message != "" {
+			body.WriteString("    " + r.Message + "\r\n")
+		}
+		body.WriteString("\r\n")
+	}
+
+	// Machine readable report: per-message fields, then one block per recipient
+	body.WriteString("--" + boundary + "\r\n")
+	body.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	body.WriteString("Reporting-MTA: dns; " + hostname + "\r\n")
+	if item.EnvID != "" {
+		body.WriteString("Original-Envelope-Id: " + item.EnvID + "\r\n")
+	}
+	body.WriteString("Arrival-Date: " + item.CreatedAt.Format(time.RFC1123Z) + "\r\n")
+	for _, r := range reported {
+		body.WriteString("\r\n")
+		body.WriteString("Final-Recipient: rfc822; " + r.Address + "\r\n")
+		if addrType, address, ok := strings.Cut(r.ORcpt, ";"); ok {
+			body.WriteString("Original-Recipient: " + strings.ToLower(addrType) + "; " + address + "\r\n")
+		}
+		body.WriteString("Action: " + r.action + "\r\n")
+		body.WriteString("Status: " + dsnStatus(r) + "\r\n")
+		if r.Host != "" {
+			body.WriteString("Remote-MTA: dns; " + r.Host + "\r\n")
+			if r.Code != 0 {
+				// The reply of the remote server; local errors (DNS, network) only have a status
+				diagnostic := fmt.Sprintf("%d", r.Code)
+				if r.Enhanced != "" {
+					diagnostic += " " + r.Enhanced
+				}
+				if r.Message != "" {
+					diagnostic += " " + r.Message
+				}
+				body.WriteString("Diagnostic-Code: smtp; " + diagnostic + "\r\n")
+			}
+		}
+		if !item.LastAttempt.IsZero() {
+			body.WriteString("Last-Attempt-Date: " + item.LastAttempt.Format(time.RFC1123Z) + "\r\n")
+		}
+	}
+	body.WriteString("\r\n")
+
+	// The original message, or only its header section
+	body.WriteString("--" + boundary + "\r\n")
+	original := originalMessage(item.Mail)
+	if strings.EqualFold(item.Ret, string(protocol.RET_HDRS)) {
+		body.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+		body.WriteString(headerSection(original))
+	} else {
+		body.WriteString("Content-Type: message/rfc822\r\n\r\n")
+		body.WriteString(original)
+		if !strings.HasSuffix(original, "\n") {
+			body.WriteString("\r\n")
+		}
+	}
+	body.WriteString("\r\n--" + boundary + "--\r\n")
+
+	dsn := mail.NewBlankMail()
+	dsn.SetFrom("MAILER-DAEMON@" + hostname)
+	dsn.AppendTo(item.From)
+	dsn.SetSubject(subject)
+	dsn.SetData(body.String())
+	for _, header := range [][2]string{
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Auto-Submitted", "auto-replied"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/report; report-type=delivery-status; boundary=\"%s\"", boundary)},
+	} {
+		dsn.AppendFlag(mail.FromFlag(*mail.NewFlag(header[0], header[1])))
+	}
+	return dsn
+}
+
+// dsnStatus is the enhanced status of a reported recipient, derived from the reply code if the
+// server did not send one
+func dsnStatus(r report) string {
+	if r.Enhanced != "" {
+		return r.Enhanced
+	}
+	switch {
+	case r.action == ACTION_RELAYED:
+		return "2.0.0"
+	case r.action == ACTION_DELAYED || r.Code >= 400 && r.Code < 500:
+		return "4.0.0"
+	default:
+		return "5.0.0"
+	}
+}
+
+// originalMessage returns a queued message as the client transmits it
+// Items are stored rendered; older items that are not are rendered here
+func originalMessage(m *mail.JSONMail) string {
+	return m.ToMail().Render()
+}
+
+// headerSection returns a message up to and including the blank line that ends its headers
+func headerSection(message string) string {
+	if i := strings.Index(message, "\r\n\r\n"); i >= 0 {
+		return message[:i+4]
+	}
+	if i := strings.Index(message, "\n\n"); i >= 0 {
+		return message[:i+2]
+	}
+	return message
+}
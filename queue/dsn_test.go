@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/delivery"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp"
+)
+
+func TestDSNReturnsMessageAsSent(t *testing.T) {
+	q, err := Open(t.TempDir(), &stubSender{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mail.Mail{}
+	m.SetFrom("alice@example.org").AppendTo("bob@example.com").SetSubject("Grüße")
+	m.SetData("Hallo\r\n")
+	id, err := q.Enqueue(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The item holds the rendered message, which is what every attempt sends
+	sent := item.Mail.ToMail()
+	if !sent.IsRaw() {
+		t.Fatal("queued message is not stored as rendered")
+	}
+	content := sent.Render()
+	for _, field := range []string{"Date: ", "Message-ID: <", "Subject: =?utf-8?", "From: <alice@example.org>"} {
+		if !strings.Contains(content, "\r\n"+field) && !strings.HasPrefix(content, field) {
+			t.Errorf("rendered message has no %q field:\n%s", field, content)
+		}
+	}
+	if content != sent.Render() {
+		t.Error("rendering a queued message twice gave different bytes")
+	}
+
+	item.Recipients[0].State = STATE_FAILED
+	item.Recipients[0].Code = 550
+	dsn := buildDSN(item, []report{{item.Recipients[0], ACTION_FAILED}}, "mx.example.org", time.Now())
+	if !strings.Contains(dsn.GetData(), content) {
+		t.Errorf("DSN does not return the message as sent:\n%s", dsn.GetData())
+	}
+}
+
+// attempt runs finish for one attempt of an item whose recipient got the given status
+func attempt(t *testing.T, notify string, status delivery.RecipientStatus) *mail.Mail {
+	t.Helper()
+	q, err := Open(t.TempDir(), &stubSender{}, Options{Hostname: "mx.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMail()
+	if notify != "" {
+		m.AppendRcptFlag("bob@example.com", mail.FromFlag(*mail.NewFlag("NOTIFY", notify)))
+	}
+	id, err := q.Enqueue(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.Recipient = "bob@example.com"
+	return q.finish(id, snapshot, &delivery.Result{Recipients: []delivery.RecipientStatus{status}}, false)
+}
+
+func TestDSNNotify(t *testing.T) {
+	rejected := delivery.RecipientStatus{RecipientResult: smtp.RecipientResult{Code: 550, Enhanced: "5.1.1", Message: "No such user"}}
+	accepted := delivery.RecipientStatus{RecipientResult: smtp.RecipientResult{Code: 250, Message: "OK"}}
+	acceptedDSN := accepted
+	acceptedDSN.DSN = true
+
+	tests := []struct {
+		name   string
+		notify string
+		status delivery.RecipientStatus
+		action string // Expected action, "" for no notification
+	}{
+		{"failure by default", "", rejected, ACTION_FAILED},
+		{"NOTIFY=NEVER", "NEVER", rejected, ""},
+		{"NOTIFY=SUCCESS only", "SUCCESS", rejected, ""},
+		{"success not requested", "", accepted, ""},
+		{"success to a server without DSN", "SUCCESS", accepted, ACTION_RELAYED},
+		{"success to a server with DSN", "SUCCESS,FAILURE", acceptedDSN, ""},
+	}
+	for _, test := range tests {
+		dsn := attempt(t, test.notify, test.status)
+		switch {
+		case test.action == "" && dsn != nil:
+			t.Errorf("%s: unexpected notification:\n%s", test.name, dsn.GetData())
+		case test.action != "" && dsn == nil:
+			t.Errorf("%s: no notification, want %s", test.name, test.action)
+		case dsn != nil && !strings.Contains(dsn.GetData(), "Action: "+test.action+"\r\n"):
+			t.Errorf("%s: want action %s:\n%s", test.name, test.action, dsn.GetData())
+		}
+	}
+}
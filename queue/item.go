@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// RecipientState is the delivery state of one recipient
+type RecipientState string
+
+const (
+	STATE_PENDING   RecipientState = "pending"
+	STATE_DELIVERED RecipientState = "delivered"
+	STATE_FAILED    RecipientState = "failed"
+)
+
+// Recipient is one envelope recipient of a queued message
+type Recipient struct {
+	Address  string            `json:"address"`
+	State    RecipientState    `json:"state"`
+	Code     protocol.SMTPCode `json:"code,omitempty"`     // Last reply code
+	Enhanced string            `json:"enhanced,omitempty"` // Last enhanced status code
+	Message  string            `json:"message,omitempty"`  // Last reply text or error
+	Host     string            `json:"host,omitempty"`     // Host that gave the last answer
+
+	// DSN request of the recipient (RFC 3461)
+	Notify        string `json:"notify,omitempty"`         // RCPT NOTIFY= ("" = failures only)
+	ORcpt         string `json:"orcpt,omitempty"`          // RCPT ORCPT=, e.g. "rfc822;user@example.com"
+	DelayNotified bool   `json:"delay_notified,omitempty"` // A delay notification was already sent
+	DSNPassed     bool   `json:"dsn_passed,omitempty"`     // Delivered to a server with DSN, which sends further notifications
+}
+
+// Item is a queued message as stored in the spool directory
+type Item struct {
+	ID          string         `json:"id"`
+	From        string         `json:"from"` // Reverse-path ("" for bounces)
+	Recipients  []Recipient    `json:"recipients"`
+	Mail        *mail.JSONMail `json:"mail"`
+	CreatedAt   time.Time      `json:"created_at"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	Attempts    int            `json:"attempts"`
+	LastAttempt time.Time      `json:"last_attempt,omitempty"`
+
+	// DSN request of the sender (RFC 3461)
+	Ret   string `json:"ret,omitempty"`   // MAIL RET=: FULL or HDRS
+	EnvID string `json:"envid,omitempty"` // MAIL ENVID=, echoed in notifications
+}
+
+// Pending returns the addresses that still wait for delivery
+func (i *Item) Pending() []string {
+	return i.addresses(STATE_PENDING)
+}
+
+// Done reports whether no recipient is pending anymore
+func (i *Item) Done() bool {
+	return len(i.Pending()) == 0
+}
+
+func (i *Item) addresses(state RecipientState) []string {
+	addresses := make([]string, 0)
+	for _, rcpt := range i.Recipients {
+		if rcpt.State == state {
+			addresses = append(addresses, rcpt.Address)
+		}
+	}
+	return addresses
+}
+
+// toMail returns the message to deliver with the DSN parameters of its recipients, which the
+// spooled mail does not keep (the MAIL FROM parameters are among its flags)
+func (i *Item) toMail() mail.Mail {
+	m := i.Mail.ToMail()
+	for _, rcpt := range i.Recipients {
+		if rcpt.Notify != "" {
+			m.AppendRcptFlag(rcpt.Address, mail.FromFlag(*mail.NewFlag(string(protocol.FLAG_NOTIFY), rcpt.Notify)))
+		}
+		if rcpt.ORcpt != "" {
+			m.AppendRcptFlag(rcpt.Address, mail.FromFlag(*mail.NewFlag(string(protocol.FLAG_ORCPT), rcpt.ORcpt)))
+		}
+	}
+	return *m
+}
+
+// clone returns a deep copy, so callers never share an item with the workers
+func (i *Item) clone() *Item {
+	copied := *i
+	copied.Recipients = append([]Recipient(nil), i.Recipients...)
+	return &copied
+}
+
+// newID returns a unique, time-ordered queue ID
+func newID() (string, error) {
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate queue ID: %w", err)
+	}
+	return fmt.Sprintf("%X%s", time.Now().UnixNano(), strings.ToUpper(hex.EncodeToString(random))), nil
+}
+
+// itemFile is the spool file of an item
+func itemFile(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+// validID rejects IDs that could escape the spool directory
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeItem stores an item atomically: a crash leaves either the old or the new file
+func writeItem(dir string, item *Item) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode queue item %s: %w", item.ID, err)
+	}
+	tmp, err := os.CreateTemp(dir, item.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write queue item %s: %w", item.ID, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write queue item %s: %w", item.ID, err)
+	}
+	// Flush to disk before the rename makes the new version visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write queue item %s: %w", item.ID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write queue item %s: %w", item.ID, err)
+	}
+	if err := os.Rename(tmp.Name(), itemFile(dir, item.ID)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write queue item %s: %w", item.ID, err)
+	}
+	return nil
+}
+
+// readItem loads an item from its spool file
+func readItem(path string) (*Item, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("failed to decode queue item %s: %w", filepath.Base(path), err)
+	}
+	if !validID(item.ID) || item.Mail == nil {
+		return nil, fmt.Errorf("invalid queue item %s", filepath.Base(path))
+	}
+	return &item, nil
+}
@@ -0,0 +1,267 @@
+// Package queue is a durable outbound mail queue
+//
+// Messages are stored as JSON files in a spool directory, delivered by a pool of workers,
+// retried with exponential backoff on temporary failures and failed permanently once they
+// exceed their lifetime. Queued messages survive restarts: Open loads the spool directory.
+// Senders are notified of failures (and, on request, delays and successes) with RFC 3464
+// delivery status notifications sent from the null reverse-path.
+//
+// Example:
+//
+//	q, err := queue.New(cfg, delivery.NewDeliverer(cfg))
+//	if err != nil {
+//		return err
+//	}
+//	q.Start(context.Background())
+//	defer q.Stop()
+//	id, err := q.Enqueue(*m)
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/delivery"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// ErrNotFound is returned for an ID that is not (or no longer) queued
+var ErrNotFound = errors.New("queue item not found")
+
+// Sender delivers a message to a set of recipients; *delivery.Deliverer satisfies it
+type Sender interface {
+	Deliver(ctx context.Context, from string, recipients []string, m mail.Mail) *delivery.Result
+}
+
+// Options control delivery concurrency and the retry schedule
+type Options struct {
+	Workers  int           // Concurrent deliveries (1 if <= 0)
+	Lifetime time.Duration // Undelivered recipients fail after this long
+	RetryMin time.Duration // Delay before the first retry
+	RetryMax time.Duration // Maximum delay between retries
+	Hostname string        // Reporting-MTA of delivery status notifications ("localhost" if "")
+}
+
+// OptionsFromConfig returns the queue options from SMTP_QUEUE_* settings
+func OptionsFromConfig(cfg *config.Config) Options {
+	return Options{
+		Workers:  cfg.QueueWorkers,
+		Lifetime: cfg.QueueLifetime,
+		RetryMin: cfg.QueueRetryMin,
+		RetryMax: cfg.QueueRetryMax,
+		Hostname: cfg.ServerHostname,
+	}
+}
+
+// Queue is an outbound queue backed by a spool directory
+type Queue struct {
+	dir     string
+	sender  Sender
+	options Options
+
+	mu      sync.Mutex
+	items   map[string]*Item
+	running map[string]bool // Items a worker is delivering right now
+	wake    chan struct{}   // Signals the scheduler that an item became due
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// New opens the queue configured by SMTP_QUEUE_DIR and the other SMTP_QUEUE_* settings
+func New(cfg *config.Config, sender Sender) (*Queue, error) {
+	return Open(cfg.QueueDir, sender, OptionsFromConfig(cfg))
+}
+
+// Open opens (or creates) a spool directory and loads the messages queued in it
+// Delivery does not start until Start is called
+func Open(dir string, sender Sender, options Options) (*Queue, error) {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.RetryMin <= 0 {
+		options.RetryMin = time.Minute
+	}
+	if options.RetryMax < options.RetryMin {
+		options.RetryMax = options.RetryMin
+	}
+	if options.Hostname == "" {
+		options.Hostname = "localhost"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory %s: %w", dir, err)
+	}
+
+	q := &Queue{
+		dir:     dir,
+		sender:  sender,
+		options: options,
+		items:   make(map[string]*Item),
+		running: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads every item of the spool directory
+// Leftover temporary files from an interrupted write are removed, broken files are skipped
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read queue directory %s: %w", q.dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(q.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		item, err := readItem(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "QUEUE: Skipping %s: %v\n", name, err)
+			continue
+		}
+		q.items[item.ID] = item
+	}
+	return nil
+}
+
+// Enqueue queues a mail for its To, Cc and Bcc recipients with its From as reverse-path
+func (q *Queue) Enqueue(m mail.Mail) (string, error) {
+	recipients := make([]string, 0)
+	recipients = append(recipients, m.GetTo()...)
+	recipients = append(recipients, m.GetCC()...)
+	recipients = append(recipients, m.GetBCC()...)
+	return q.EnqueueEnvelope(m.GetFrom(), recipients, m)
+}
+
+// EnqueueEnvelope queues a message with an explicit envelope and returns its queue ID
+// The message is on disk when EnqueueEnvelope returns; from may be "" for bounces
+// The DSN parameters of the mail (MAIL RET/ENVID, RCPT NOTIFY/ORCPT) decide which
+// delivery status notifications the sender gets
+func (q *Queue) EnqueueEnvelope(from string, recipients []string, m mail.Mail) (string, error) {
+	if len(recipients) == 0 {
+		return "", errors.New("no recipients specified")
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	// The message is rendered once, so every attempt and a returned copy in a delivery status
+	// notification carry the same bytes, Date and Message-ID included
+	if !m.IsRaw() {
+		m.SetData(m.Render())
+		m.SetRaw(true)
+	}
+	now := time.Now()
+	item := &Item{
+		ID:          id,
+		From:        from,
+		Recipients:  make([]Recipient, 0, len(recipients)),
+		Mail:        mail.FromMail(&m),
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	item.Ret, _ = m.GetFlag(string(protocol.FLAG_RET))
+	item.EnvID, _ = m.GetFlag(string(protocol.FLAG_ENVID))
+	for _, rcpt := range recipients {
+		notify, _ := m.GetRcptFlag(rcpt, string(protocol.FLAG_NOTIFY))
+		orcpt, _ := m.GetRcptFlag(rcpt, string(protocol.FLAG_ORCPT))
+		item.Recipients = append(item.Recipients, Recipient{Address: rcpt, State: STATE_PENDING, Notify: notify, ORcpt: orcpt})
+	}
+
+	q.mu.Lock()
+	if err := writeItem(q.dir, item); err != nil {
+		q.mu.Unlock()
+		return "", err
+	}
+	q.items[id] = item
+	q.mu.Unlock()
+
+	q.notify()
+	return id, nil
+}
+
+// List returns a copy of every queued item, oldest first
+func (q *Queue) List() []*Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]*Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item.clone())
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+	return items
+}
+
+// Get returns a copy of one queued item
+func (q *Queue) Get(id string) (*Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return item.clone(), nil
+}
+
+// RetryNow makes an item due immediately instead of waiting for its next scheduled attempt
+func (q *Queue) RetryNow(id string) error {
+	q.mu.Lock()
+	item, ok := q.items[id]
+	if !ok {
+		q.mu.Unlock()
+		return ErrNotFound
+	}
+	item.NextAttempt = time.Now()
+	err := writeItem(q.dir, item)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Delete removes an item from the queue without delivering it further
+// A delivery already in progress completes, but its result is discarded
+func (q *Queue) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.items[id]; !ok {
+		return ErrNotFound
+	}
+	delete(q.items, id)
+	if err := os.Remove(itemFile(q.dir, id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete queue item %s: %w", id, err)
+	}
+	return nil
+}
+
+// notify wakes the scheduler without blocking
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
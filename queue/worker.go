@@ -0,0 +1,251 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/delivery"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+// Longest the scheduler sleeps before looking at the queue again
+const maxSchedulerSleep = time.Minute
+
+// Start launches the scheduler and the delivery workers
+// Items are delivered until Stop is called or ctx is cancelled
+func (q *Queue) Start(ctx context.Context) {
+	q.mu.Lock()
+	if q.cancel != nil {
+		q.mu.Unlock()
+		return
+	}
+	ctx, q.cancel = context.WithCancel(ctx)
+	q.mu.Unlock()
+
+	jobs := make(chan string)
+	for i := 0; i < q.options.Workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for id := range jobs {
+				q.deliver(ctx, id)
+			}
+		}()
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer close(jobs)
+		q.schedule(ctx, jobs)
+	}()
+}
+
+// Stop stops the scheduler and waits for running deliveries to finish
+// Unfinished items stay in the spool directory and are picked up by the next Start or Open
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	cancel := q.cancel
+	q.cancel = nil
+	q.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	q.wg.Wait()
+}
+
+// schedule hands due items to the workers and sleeps until the next one is due
+func (q *Queue) schedule(ctx context.Context, jobs chan<- string) {
+	for {
+		due, wait := q.due(time.Now())
+		for i, id := range due {
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				// The rest was marked running but never sent; the next Start delivers it
+				q.release(due[i:])
+				return
+			}
+		}
+		if len(due) > 0 {
+			// Look again right away, more items may have become due meanwhile
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// due marks the items whose next attempt has come as running and returns their IDs,
+// plus how long to wait for the next one
+func (q *Queue) due(now time.Time) ([]string, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make([]string, 0)
+	wait := maxSchedulerSleep
+	for id, item := range q.items {
+		if q.running[id] {
+			continue
+		}
+		if !item.NextAttempt.After(now) {
+			q.running[id] = true
+			ids = append(ids, id)
+			continue
+		}
+		if until := item.NextAttempt.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	return ids, wait
+}
+
+// release clears the running mark of items that were not delivered
+func (q *Queue) release(ids []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		delete(q.running, id)
+	}
+}
+
+// deliver makes one delivery attempt for the pending recipients of an item
+func (q *Queue) deliver(ctx context.Context, id string) {
+	q.mu.Lock()
+	item, ok := q.items[id]
+	if !ok || ctx.Err() != nil {
+		// Deleted, or stopped before the attempt started
+		delete(q.running, id)
+		q.mu.Unlock()
+		return
+	}
+	snapshot := item.clone()
+	q.mu.Unlock()
+
+	result := q.sender.Deliver(ctx, snapshot.From, snapshot.Pending(), snapshot.toMail())
+	// An attempt cut short by Stop does not count; only its final results are kept
+	dsn := q.finish(id, snapshot, result, ctx.Err() != nil)
+	// The scheduler ignored the item while it was running; let it pick up the new retry time
+	q.notify()
+
+	if dsn != nil {
+		if _, err := q.EnqueueEnvelope("", dsn.GetTo(), *dsn); err != nil {
+			fmt.Fprintf(os.Stderr, "QUEUE: Failed to queue delivery status notification for %s: %v\n", id, err)
+		}
+	}
+}
+
+// finish records the result of an attempt and schedules the next one or removes the item
+// It returns the delivery status notification for the sender, if one is due
+// An interrupted attempt only records delivered and permanently failed recipients; the others
+// keep their state, attempt count and retry time
+func (q *Queue) finish(id string, snapshot *Item, result *delivery.Result, interrupted bool) *mail.Mail {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, id)
+	item, ok := q.items[id]
+	if !ok {
+		// Deleted while the delivery was running
+		return nil
+	}
+	now := time.Now()
+	applyResult(item, result, interrupted)
+
+	if !interrupted {
+		item.Attempts++
+		item.LastAttempt = now
+	}
+	if !interrupted && !item.Done() {
+		if q.options.Lifetime > 0 && now.Sub(item.CreatedAt) >= q.options.Lifetime {
+			expire(item, q.options.Lifetime)
+		} else {
+			item.NextAttempt = now.Add(q.backoff(item.Attempts))
+		}
+	}
+
+	// Notifications are never sent for messages from the null reverse-path, e.g. other bounces
+	var dsn *mail.Mail
+	if item.From != "" {
+		if reported := reports(item, snapshot.Recipients, !interrupted); len(reported) > 0 {
+			dsn = buildDSN(item, reported, q.options.Hostname, now)
+		}
+	}
+
+	if item.Done() {
+		delete(q.items, id)
+		if err := os.Remove(itemFile(q.dir, id)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "QUEUE: Failed to remove %s: %v\n", id, err)
+		}
+		return dsn
+	}
+	if err := writeItem(q.dir, item); err != nil {
+		fmt.Fprintf(os.Stderr, "QUEUE: %v\n", err)
+	}
+	return dsn
+}
+
+// applyResult records the delivery status of every recipient that was attempted
+// With finalOnly set, temporary failures are ignored
+func applyResult(item *Item, result *delivery.Result, finalOnly bool) {
+	statuses := make(map[string]delivery.RecipientStatus)
+	for _, status := range result.Recipients {
+		statuses[status.Recipient] = status
+	}
+	for i := range item.Recipients {
+		rcpt := &item.Recipients[i]
+		status, ok := statuses[rcpt.Address]
+		if rcpt.State != STATE_PENDING || !ok || (finalOnly && !status.Delivered() && !status.Permanent()) {
+			continue
+		}
+		rcpt.Code = status.Code
+		rcpt.Enhanced = status.Enhanced
+		rcpt.Message = status.Message
+		rcpt.Host = status.Host
+		switch {
+		case status.Delivered():
+			rcpt.State = STATE_DELIVERED
+			rcpt.DSNPassed = status.DSN
+		case status.Permanent():
+			rcpt.State = STATE_FAILED
+		}
+	}
+}
+
+// expire fails every pending recipient once the message outlived the queue lifetime
+func expire(item *Item, lifetime time.Duration) {
+	for i := range item.Recipients {
+		rcpt := &item.Recipients[i]
+		if rcpt.State != STATE_PENDING {
+			continue
+		}
+		rcpt.State = STATE_FAILED
+		// 4.4.7: delivery time expired (RFC 3463)
+		rcpt.Enhanced = "4.4.7"
+		if rcpt.Message == "" {
+			rcpt.Message = fmt.Sprintf("Message expired after %s in the queue", lifetime)
+		} else {
+			rcpt.Message = fmt.Sprintf("Message expired after %s in the queue, last error: %s", lifetime, rcpt.Message)
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt: RetryMin doubled per attempt, up to RetryMax
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.options.RetryMin
+	for i := 1; i < attempts && delay < q.options.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > q.options.RetryMax {
+		delay = q.options.RetryMax
+	}
+	return delay
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/delivery"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp"
+)
+
+// stubSender accepts every recipient, or blocks until the delivery is cancelled when hang is set
+type stubSender struct {
+	mu        sync.Mutex
+	hang      bool
+	started   chan struct{}
+	delivered []string
+}
+
+func (s *stubSender) Deliver(ctx context.Context, from string, recipients []string, m mail.Mail) *delivery.Result {
+	s.mu.Lock()
+	hang := s.hang
+	s.mu.Unlock()
+	result := &delivery.Result{}
+	if hang {
+		s.started <- struct{}{}
+		<-ctx.Done()
+		for _, rcpt := range recipients {
+			result.Recipients = append(result.Recipients, delivery.RecipientStatus{
+				RecipientResult: smtp.RecipientResult{Recipient: rcpt, Code: 451, Enhanced: "4.4.2", Message: ctx.Err().Error()},
+			})
+		}
+		return result
+	}
+	s.mu.Lock()
+	s.delivered = append(s.delivered, recipients...)
+	s.mu.Unlock()
+	for _, rcpt := range recipients {
+		result.Recipients = append(result.Recipients, delivery.RecipientStatus{
+			RecipientResult: smtp.RecipientResult{Recipient: rcpt, Code: 250, Message: "OK"},
+		})
+	}
+	return result
+}
+
+func testMail() mail.Mail {
+	m := mail.Mail{}
+	m.SetFrom("alice@example.org").AppendTo("bob@example.com")
+	m.SetData("Subject: test\r\n\r\nbody\r\n").SetRaw(true)
+	return m
+}
+
+func TestStopDoesNotCountInterruptedAttempt(t *testing.T) {
+	sender := &stubSender{hang: true, started: make(chan struct{}, 1)}
+	q, err := Open(t.TempDir(), sender, Options{RetryMin: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := q.Enqueue(testMail())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Start(context.Background())
+	<-sender.started
+	q.Stop()
+
+	item, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Attempts != 0 || item.NextAttempt.After(time.Now()) {
+		t.Errorf("interrupted attempt was counted: attempts %d, next attempt %s", item.Attempts, item.NextAttempt)
+	}
+
+	// The next Start picks the item up again right away
+	sender.mu.Lock()
+	sender.hang = false
+	sender.mu.Unlock()
+	q.Start(context.Background())
+	defer q.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := q.Get(id); err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("item was not delivered after a restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(sender.delivered) != 1 || sender.delivered[0] != "bob@example.com" {
+		t.Errorf("delivered to %v", sender.delivered)
+	}
+}
+
+func TestStopReleasesUnsentItems(t *testing.T) {
+	sender := &stubSender{hang: true, started: make(chan struct{}, 1)}
+	// One worker: the second item is due but cannot be handed over while the first one hangs
+	q, err := Open(t.TempDir(), sender, Options{Workers: 1, RetryMin: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := q.Enqueue(testMail()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.Start(context.Background())
+	<-sender.started
+	q.Stop()
+
+	q.mu.Lock()
+	running := len(q.running)
+	q.mu.Unlock()
+	if running != 0 {
+		t.Errorf("%d items still marked running after Stop", running)
+	}
+}
+
+func TestDeliveredMailKeepsDSNParameters(t *testing.T) {
+	q, err := Open(t.TempDir(), &stubSender{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMail()
+	m.AppendFlag(mail.FromFlag(*mail.NewFlag("RET", "HDRS")))
+	m.AppendRcptFlag("bob@example.com", mail.FromFlag(*mail.NewFlag("NOTIFY", "SUCCESS,FAILURE")))
+	m.AppendRcptFlag("bob@example.com", mail.FromFlag(*mail.NewFlag("ORCPT", "rfc822;bob@example.com")))
+	id, err := q.Enqueue(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the sender gets from the spool still carries the parameters for the next hop
+	sent := item.toMail()
+	if ret, _ := sent.GetFlag("RET"); ret != "HDRS" {
+		t.Errorf("RET = %q", ret)
+	}
+	if notify, _ := sent.GetRcptFlag("bob@example.com", "NOTIFY"); notify != "SUCCESS,FAILURE" {
+		t.Errorf("NOTIFY = %q", notify)
+	}
+	if orcpt, _ := sent.GetRcptFlag("bob@example.com", "ORCPT"); orcpt != "rfc822;bob@example.com" {
+		t.Errorf("ORCPT = %q", orcpt)
+	}
+}
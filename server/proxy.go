@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 signature (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// A v1 header is at most 107 bytes including the CRLF
+const proxyV1MaxLength = 107
+
+// proxyConn wraps a connection accepted from a load balancer speaking the PROXY protocol
+// RemoteAddr and LocalAddr report the original client and destination from the header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader // Holds any bytes read past the header
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn
+// The returned connection reports the addresses carried in the header
+// For "PROXY UNKNOWN" (v1) and LOCAL commands (v2) the balancer's own addresses are kept
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	wrapped := &proxyConn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: conn.RemoteAddr(),
+		localAddr:  conn.LocalAddr(),
+	}
+
+	prefix, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		if err := readProxyV2(reader, wrapped); err != nil {
+			return nil, err
+		}
+		return wrapped, nil
+	}
+	// A v1 header can be shorter than the v2 signature only if it is invalid
+	if len(prefix) >= 6 && string(prefix[:6]) == "PROXY " {
+		if err := readProxyV1(reader, wrapped); err != nil {
+			return nil, err
+		}
+		return wrapped, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(reader *bufio.Reader, conn *proxyConn) error {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return errors.New("PROXY v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("PROXY v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("invalid PROXY v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		// Balancer could not determine the client - keep the connection addresses
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return errors.New("invalid PROXY v1 header")
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return errors.New("invalid address in PROXY v1 header")
+	}
+	if (fields[1] == "TCP4") != (srcIP.To4() != nil) || (fields[1] == "TCP4") != (dstIP.To4() != nil) {
+		return errors.New("address family mismatch in PROXY v1 header")
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return errors.New("invalid source port in PROXY v1 header")
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return errors.New("invalid destination port in PROXY v1 header")
+	}
+
+	conn.remoteAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	conn.localAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+// readProxyV2 parses the binary v2 header: signature, ver/cmd, family, length, addresses, TLVs
+func readProxyV2(reader *bufio.Reader, conn *proxyConn) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 0x2 {
+		return fmt.Errorf("unsupported PROXY v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	switch verCmd & 0x0F {
+	case 0x0:
+		// LOCAL: health check from the balancer itself - keep the connection addresses
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0F)
+	}
+
+	// High nibble is the address family, low nibble the transport (STREAM or DGRAM)
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return errors.New("short PROXY v2 IPv4 address block")
+		}
+		conn.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		conn.localAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return errors.New("short PROXY v2 IPv6 address block")
+		}
+		conn.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		conn.localAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		// AF_UNSPEC or AF_UNIX - nothing useful for IP based policy, keep the connection addresses
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// balancer returns the server side of a pipe on which header has been sent before closing
+func balancer(t *testing.T, header []byte) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		client.Write(header)
+		client.Close()
+	}()
+	return server
+}
+
+// proxyV2 builds a v2 header with the given command, family and address block
+func proxyV2(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xC3, 0x50, 0, 25}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::25").To16()...), 0xC3, 0x50, 0, 25)
+	tests := []struct {
+		name   string
+		header []byte
+		remote string // Expected client address ("" = the balancer's own)
+		local  string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 50000 25\r\n"), "192.0.2.1:50000", "198.51.100.7:25"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::25 50000 25\r\n"), "[2001:db8::1]:50000", "[2001:db8::25]:25"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", ""},
+		{"v2 PROXY TCP4", proxyV2(0x1, 0x11, ipv4), "192.0.2.1:50000", "198.51.100.7:25"},
+		{"v2 PROXY TCP6", proxyV2(0x1, 0x21, ipv6), "[2001:db8::1]:50000", "[2001:db8::25]:25"},
+		{"v2 PROXY with TLVs", proxyV2(0x1, 0x11, append(ipv4, 0x04, 0, 1, 0)), "192.0.2.1:50000", "198.51.100.7:25"},
+		{"v2 PROXY UNSPEC", proxyV2(0x1, 0x00, nil), "", ""},
+		{"v2 LOCAL", proxyV2(0x0, 0x00, nil), "", ""},
+		{"v2 LOCAL with addresses", proxyV2(0x0, 0x11, ipv4), "", ""},
+	}
+	for _, test := range tests {
+		conn := balancer(t, append(test.header, "EHLO client.example\r\n"...))
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		remote, local := conn.RemoteAddr().String(), conn.LocalAddr().String()
+		if test.remote != "" {
+			remote, local = test.remote, test.local
+		}
+		if proxied.RemoteAddr().String() != remote || proxied.LocalAddr().String() != local {
+			t.Errorf("%s: got %s -> %s, want %s -> %s", test.name, proxied.RemoteAddr(), proxied.LocalAddr(), remote, local)
+		}
+		// The session must still see what the client sent after the header
+		line, err := bufio.NewReader(proxied).ReadString('\n')
+		if line != "EHLO client.example\r\n" {
+			t.Errorf("%s: got first line %q (%v)", test.name, line, err)
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		err    string
+	}{
+		{"no header", []byte("EHLO client.example\r\n"), "missing PROXY protocol header"},
+		{"empty", nil, "failed to read PROXY header"},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51"), "failed to read PROXY v1 header"},
+		{"v1 oversized", []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"), "too long"},
+		{"v1 bare LF", []byte("PROXY UNKNOWN\n"), "must end with CRLF"},
+		{"v1 protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.7 50000 25\r\n"), "unsupported PROXY v1 protocol"},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 50000\r\n"), "invalid PROXY v1 header"},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 198.51.100.7 50000 25\r\n"), "address family mismatch"},
+		{"v1 port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 65536 25\r\n"), "invalid source port"},
+		{"v2 truncated header", proxyV2(0x1, 0x11, nil)[:14], "failed to read PROXY v2 header"},
+		{"v2 truncated addresses", proxyV2(0x1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xC3, 0x50, 0, 25})[:20], "failed to read PROXY v2 addresses"},
+		{"v2 short IPv4 block", proxyV2(0x1, 0x11, []byte{192, 0, 2, 1}), "short PROXY v2 IPv4 address block"},
+		{"v2 short IPv6 block", proxyV2(0x1, 0x21, make([]byte, 12)), "short PROXY v2 IPv6 address block"},
+		{"v2 version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), "unsupported PROXY v2 version"},
+		{"v2 command", proxyV2(0x2, 0x11, nil), "unsupported PROXY v2 command"},
+	}
+	for _, test := range tests {
+		_, err := readProxyHeader(balancer(t, test.header))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// dialLoopback returns the accepted side of a TCP connection from 127.0.0.1 that first sends data
+func dialLoopback(t *testing.T, data string) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Write([]byte(data))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAcceptProxy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, elsewhere, _ := net.ParseCIDR("10.0.0.0/8")
+	header := "PROXY TCP4 192.0.2.1 198.51.100.7 50000 25\r\n"
+
+	// Trusted balancer: the header sets the client address
+	proxied, err := acceptProxy(dialLoopback(t, header), []*net.IPNet{loopback}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := proxied.RemoteAddr().String(); got != "192.0.2.1:50000" {
+		t.Errorf("trusted: got client %s", got)
+	}
+
+	// Untrusted source: the header is left for the session and the real address is kept
+	conn := dialLoopback(t, header)
+	proxied, err = acceptProxy(conn, []*net.IPNet{elsewhere}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxied != conn {
+		t.Errorf("untrusted: got %s, want the connection unchanged", proxied.RemoteAddr())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != header {
+		t.Errorf("untrusted: session got %q (%v), want the header as a command", line, err)
+	}
+
+	// Trusted balancer that never sends the header
+	start := time.Now()
+	_, err = acceptProxy(dialLoopback(t, ""), []*net.IPNet{loopback}, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("silent balancer: got error %v, want the timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("silent balancer: gave up after %s", elapsed)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/delivery"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/queue"
+	"github.com/ImBubbles/MySMTP/smtp"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// startRelay opens the outbound queue for relayed mail and starts delivering it
+// Relayed mail goes to the smarthost if SMTP_SMARTHOST is set, otherwise to the recipient MX hosts
+func startRelay(cfg *config.Config) (*queue.Queue, error) {
+	var sender queue.Sender = delivery.NewDeliverer(cfg)
+	if cfg.SmarthostHost != "" {
+		sender = delivery.NewSmarthost(cfg)
+	}
+	q, err := queue.New(cfg, sender)
+	if err != nil {
+		return nil, err
+	}
+	q.Start(context.Background())
+	return q, nil
+}
+
+// relayHandler queues accepted mail for the non-local recipients
+// The client gets 250 once the message is on disk; the queue retries and bounces from there
+func relayHandler(q *queue.Queue) smtp.RelayHandler {
+	return func(m *mail.Mail, recipients []string) error {
+		id, err := q.EnqueueEnvelope(m.GetFrom(), recipients, *m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SERVER: Failed to queue relayed mail: %v\n", err)
+			return &protocol.CommandError{Code: protocol.CODE_LOCAL_ERROR, Enhanced: "4.3.0", Message: "Message could not be queued, try again later"}
+		}
+		fmt.Printf("SERVER: Queued %s for relay to %v\n", id, recipients)
+		return nil
+	}
+}
+
+// withRelay returns handlers that also relay through q, unless a RelayHandler is already set
+func withRelay(handlers *smtp.Handlers, q *queue.Queue) *smtp.Handlers {
+	if q == nil || handlers.RelayHandler != nil {
+		return handlers
+	}
+	relaying := *handlers
+	relaying.RelayHandler = relayHandler(q)
+	return &relaying
+}
@@ -5,16 +5,24 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/queue"
 	"github.com/ImBubbles/MySMTP/smtp"
+	"github.com/ImBubbles/MySMTP/util/network"
 )
 
+// proxyHeaderTimeout bounds how long a trusted balancer may take to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
 type Server struct {
-	listener net.Listener
-	port     uint16
-	active   bool
-	config   *config.Config
+	listener      net.Listener
+	port          uint16
+	active        bool
+	config        *config.Config
+	proxyNetworks []*net.IPNet // Sources trusted to send a PROXY protocol header
+	relayQueue    *queue.Queue // Outbound queue for relayed mail (relay mode only)
 }
 
 func NewServer(address string, port uint16) *Server {
@@ -23,7 +31,7 @@ func NewServer(address string, port uint16) *Server {
 		fmt.Fprintf(os.Stderr, "Failed to start server on %s:%d: %v\n", address, port, err)
 		os.Exit(1)
 	}
-	return &Server{listener, port, false, nil}
+	return &Server{listener, port, false, nil, nil, nil}
 }
 
 func Listen(srv *Server, cfg *config.Config) {
@@ -32,6 +40,31 @@ func Listen(srv *Server, cfg *config.Config) {
 		return
 	}
 	srv.active = true
+
+	if cfg.ProxyProtocol {
+		networks, err := network.ParseNetworks(cfg.ProxyTrustedNetworks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid SMTP_PROXY_TRUSTED_NETWORKS: %v\n", err)
+			os.Exit(1)
+		}
+		// Anyone allowed to send a PROXY header can claim any client address, relay networks included
+		if len(networks) == 0 {
+			fmt.Fprintf(os.Stderr, "SMTP_PROXY_PROTOCOL requires SMTP_PROXY_TRUSTED_NETWORKS (the load balancer addresses)\n")
+			os.Exit(1)
+		}
+		srv.proxyNetworks = networks
+	}
+
+	// Relay mode: mail for non-local domains is queued and forwarded (LMTP never relays)
+	if cfg.Relay && !cfg.LMTP {
+		relayQueue, err := startRelay(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open relay queue: %v\n", err)
+			os.Exit(1)
+		}
+		srv.relayQueue = relayQueue
+	}
+
 	for {
 		conn, err := srv.listener.Accept()
 		if err != nil {
@@ -42,11 +75,11 @@ func Listen(srv *Server, cfg *config.Config) {
 		}
 		// Each connection is handled in its own goroutine
 		// The connection is closed by defer in handleConnection
-		go handleConnection(conn, cfg)
+		go handleConnection(conn, cfg, srv.proxyNetworks, srv.relayQueue)
 	}
 }
 
-func handleConnection(conn net.Conn, cfg *config.Config) {
+func handleConnection(conn net.Conn, cfg *config.Config, proxyNetworks []*net.IPNet, relayQueue *queue.Queue) {
 	// Ensure connection is closed when done
 	defer func() {
 		if conn != nil {
@@ -54,8 +87,20 @@ func handleConnection(conn net.Conn, cfg *config.Config) {
 		}
 	}()
 
+	// Behind a load balancer, read the PROXY header before the greeting so the real
+	// client address is what ServerConn (logging, policy, Received: header) sees
+	if cfg.ProxyProtocol {
+		proxied, err := acceptProxy(conn, proxyNetworks, proxyHeaderTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SERVER: Invalid PROXY header from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		conn = proxied
+	}
+	fmt.Printf("SERVER: Connection from %s\n", conn.RemoteAddr())
+
 	// Use default handlers if set, otherwise create new ones
-	handlers := GetDefaultHandlers()
+	handlers := withRelay(GetDefaultHandlers(), relayQueue)
 
 	// Load TLS certificate if TLS is enabled
 	var tlsConfig *tls.Config
@@ -78,6 +123,22 @@ func handleConnection(conn net.Conn, cfg *config.Config) {
 	// handle() is called inside NewServerConnWithHandlers and blocks until connection closes
 }
 
+// acceptProxy reads the PROXY header of a connection from a trusted network within timeout
+// Other sources are handled directly: a header they send is never parsed, so it cannot
+// change their address and the session rejects it as an unknown command
+func acceptProxy(conn net.Conn, proxyNetworks []*net.IPNet, timeout time.Duration) (net.Conn, error) {
+	if !network.Contains(proxyNetworks, network.AddrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	proxied, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return proxied, nil
+}
+
 // SetHandlers sets handlers for all new connections
 // Note: This sets default handlers. For per-connection handlers, use NewServerConnWithHandlers
 var defaultHandlers *smtp.Handlers
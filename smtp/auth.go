@@ -0,0 +1,348 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// ServerInfo describes the server an Auth mechanism is about to authenticate against
+type ServerInfo struct {
+	Name          string   // Server hostname (as used for TLS SNI)
+	TLS           bool     // Whether the connection is encrypted
+	Auth          []string // Mechanisms advertised in the EHLO AUTH extension
+	AllowInsecure bool     // Credentials may be sent without TLS (SetAllowInsecureAuth)
+}
+
+// Auth is a SASL mechanism used by ClientConn.Auth
+type Auth interface {
+	// Start begins authentication and returns the mechanism name and the optional initial response
+	// Returning an error aborts before anything is sent to the server
+	Start(server *ServerInfo) (mechanism string, toServer []byte, err error)
+
+	// Next answers a server challenge (already base64 decoded)
+	// more is true while the server expects another response (334), false once it accepted (235)
+	Next(fromServer []byte, more bool) (toServer []byte, err error)
+}
+
+// Auth authenticates with the given mechanism (RFC 4954)
+// Hello is sent first if it has not been sent yet
+func (c *ClientConn) Auth(a Auth) error {
+	if err := c.ensureHello(); err != nil {
+		return err
+	}
+
+	info := &ServerInfo{
+		Name:          c.tlsServerName(),
+		TLS:           c.isTLS(),
+		Auth:          c.authMechanisms(),
+		AllowInsecure: c.allowInsecureAuth,
+	}
+	mechanism, initial, err := a.Start(info)
+	if err != nil {
+		return fmt.Errorf("AUTH failed: %w", err)
+	}
+
+	command := fmt.Sprintf("%s %s", protocol.COMMAND_AUTH, mechanism)
+	if initial != nil {
+		// RFC 4954: an empty initial response is sent as "="
+		encoded := base64.StdEncoding.EncodeToString(initial)
+		if encoded == "" {
+			encoded = "="
+		}
+		command += " " + encoded
+	}
+	if err := c.write(command + "\r\n"); err != nil {
+		return fmt.Errorf("failed to write AUTH command: %w", err)
+	}
+
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return fmt.Errorf("failed to read AUTH response: %w", err)
+		}
+		switch reply.Code {
+		case protocol.CODE_AUTH_CONTINUE:
+			challenge, err := base64.StdEncoding.DecodeString(reply.Message())
+			if err != nil {
+				c.cancelAuth()
+				return fmt.Errorf("AUTH failed: invalid challenge from server: %s", reply.Message())
+			}
+			answer, err := a.Next(challenge, true)
+			if err != nil {
+				c.cancelAuth()
+				return fmt.Errorf("AUTH failed: %w", err)
+			}
+			if err := c.write(base64.StdEncoding.EncodeToString(answer) + "\r\n"); err != nil {
+				return fmt.Errorf("failed to write AUTH response: %w", err)
+			}
+		case protocol.CODE_AUTH_SUCCESS:
+			if _, err := a.Next(nil, false); err != nil {
+				return fmt.Errorf("AUTH failed: %w", err)
+			}
+			return nil
+		default:
+			return &ReplyError{Command: string(protocol.COMMAND_AUTH), Reply: reply}
+		}
+	}
+}
+
+// cancelAuth aborts a SASL exchange with "*" and consumes the server's 501 reply
+func (c *ClientConn) cancelAuth() {
+	if err := c.write("*\r\n"); err != nil {
+		return
+	}
+	c.readReply()
+}
+
+// authMechanisms returns the mechanisms listed in the EHLO AUTH extension
+func (c *ClientConn) authMechanisms() []string {
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		return nil
+	}
+	return strings.Fields(strings.ToUpper(params))
+}
+
+// SetAuth sets the credentials the NewClientConn* constructors authenticate with after EHLO
+// By default they come from SMTP_CLIENT_USERNAME / SMTP_CLIENT_PASSWORD; nil disables AUTH
+func (c *ClientConn) SetAuth(a Auth) {
+	c.auth = a
+}
+
+// SetAllowInsecureAuth allows mechanisms to send credentials over a connection without TLS
+func (c *ClientConn) SetAllowInsecureAuth(allow bool) {
+	c.allowInsecureAuth = allow
+}
+
+var errInsecureAuth = errors.New("refusing to send credentials over an unencrypted connection (use STARTTLS or SetAllowInsecureAuth)")
+
+// checkTLS refuses mechanisms that reveal the password on a plaintext connection
+func checkTLS(server *ServerInfo) error {
+	if !server.TLS && !server.AllowInsecure {
+		return errInsecureAuth
+	}
+	return nil
+}
+
+// checkAdvertised fails when the server did not offer the mechanism
+func checkAdvertised(server *ServerInfo, mechanism protocol.SMTPAuthMechanism) error {
+	if !containsString(server.Auth, string(mechanism)) {
+		return fmt.Errorf("server does not support AUTH %s", mechanism)
+	}
+	return nil
+}
+
+type plainAuth struct {
+	identity, username, password string
+}
+
+// PlainAuth returns an Auth implementing PLAIN (RFC 4616)
+// identity is normally "" to act as username
+func PlainAuth(identity, username, password string) Auth {
+	return &plainAuth{identity: identity, username: username, password: password}
+}
+
+func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkTLS(server); err != nil {
+		return "", nil, err
+	}
+	if err := checkAdvertised(server, protocol.AUTH_PLAIN); err != nil {
+		return "", nil, err
+	}
+	response := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+	return string(protocol.AUTH_PLAIN), response, nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+type loginAuth struct {
+	username, password string
+	step               int
+}
+
+// LoginAuth returns an Auth implementing the obsolete but widespread LOGIN mechanism
+// The server asks for the username, then the password
+func LoginAuth(username, password string) Auth {
+	return &loginAuth{username: username, password: password}
+}
+
+func (a *loginAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkTLS(server); err != nil {
+		return "", nil, err
+	}
+	if err := checkAdvertised(server, protocol.AUTH_LOGIN); err != nil {
+		return "", nil, err
+	}
+	a.step = 0
+	return string(protocol.AUTH_LOGIN), nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// The prompts ("Username:", "Password:") are not standardized, so answer by position
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+type cramMD5Auth struct {
+	username, secret string
+}
+
+// CRAMMD5Auth returns an Auth implementing CRAM-MD5 (RFC 2195)
+// The password never crosses the wire, so it is allowed without TLS
+func CRAMMD5Auth(username, secret string) Auth {
+	return &cramMD5Auth{username: username, secret: secret}
+}
+
+func (a *cramMD5Auth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkAdvertised(server, protocol.AUTH_CRAM_MD5); err != nil {
+		return "", nil, err
+	}
+	return string(protocol.AUTH_CRAM_MD5), nil, nil
+}
+
+func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	digest := hmac.New(md5.New, []byte(a.secret))
+	digest.Write(fromServer)
+	return []byte(a.username + " " + hex.EncodeToString(digest.Sum(nil))), nil
+}
+
+type xoauth2Auth struct {
+	username, token string
+}
+
+// XOAuth2Auth returns an Auth implementing XOAUTH2 (Gmail, Microsoft 365) with an OAuth 2.0 access token
+func XOAuth2Auth(username, token string) Auth {
+	return &xoauth2Auth{username: username, token: token}
+}
+
+func (a *xoauth2Auth) Start(server *ServerInfo) (string, []byte, error) {
+	if err := checkTLS(server); err != nil {
+		return "", nil, err
+	}
+	if err := checkAdvertised(server, protocol.AUTH_XOAUTH2); err != nil {
+		return "", nil, err
+	}
+	response := []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return string(protocol.AUTH_XOAUTH2), response, nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends a JSON error as challenge and expects an empty reply before its 535
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// credentialsAuth picks a mechanism from the server's AUTH list when authentication starts
+type credentialsAuth struct {
+	mechanism string
+	username  string
+	password  string
+	token     string
+	chosen    Auth
+}
+
+// CredentialsAuth returns an Auth that negotiates the mechanism from the EHLO AUTH extension
+// mechanism forces one of PLAIN, LOGIN, CRAM-MD5 or XOAUTH2; "" picks XOAUTH2 when a token is set,
+// otherwise PLAIN or LOGIN over TLS and CRAM-MD5 in preference on plaintext connections
+func CredentialsAuth(mechanism, username, password, token string) Auth {
+	return &credentialsAuth{
+		mechanism: strings.ToUpper(mechanism),
+		username:  username,
+		password:  password,
+		token:     token,
+	}
+}
+
+func (a *credentialsAuth) Start(server *ServerInfo) (string, []byte, error) {
+	mechanism := protocol.SMTPAuthMechanism(a.mechanism)
+	if mechanism == "" {
+		mechanism = a.negotiate(server)
+		if mechanism == "" {
+			return "", nil, fmt.Errorf("no supported AUTH mechanism (server offers %s)", strings.Join(server.Auth, " "))
+		}
+	}
+	switch mechanism {
+	case protocol.AUTH_PLAIN:
+		a.chosen = PlainAuth("", a.username, a.password)
+	case protocol.AUTH_LOGIN:
+		a.chosen = LoginAuth(a.username, a.password)
+	case protocol.AUTH_CRAM_MD5:
+		a.chosen = CRAMMD5Auth(a.username, a.password)
+	case protocol.AUTH_XOAUTH2:
+		a.chosen = XOAuth2Auth(a.username, a.token)
+	default:
+		return "", nil, fmt.Errorf("unsupported AUTH mechanism %s", mechanism)
+	}
+	return a.chosen.Start(server)
+}
+
+func (a *credentialsAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if a.chosen == nil {
+		return nil, errors.New("authentication not started")
+	}
+	return a.chosen.Next(fromServer, more)
+}
+
+// negotiate returns the preferred mechanism the server supports, or ""
+func (a *credentialsAuth) negotiate(server *ServerInfo) protocol.SMTPAuthMechanism {
+	var preference []protocol.SMTPAuthMechanism
+	switch {
+	case a.token != "":
+		preference = []protocol.SMTPAuthMechanism{protocol.AUTH_XOAUTH2}
+	case server.TLS:
+		preference = []protocol.SMTPAuthMechanism{protocol.AUTH_PLAIN, protocol.AUTH_LOGIN, protocol.AUTH_CRAM_MD5}
+	default:
+		// Without TLS only CRAM-MD5 keeps the password secret
+		preference = []protocol.SMTPAuthMechanism{protocol.AUTH_CRAM_MD5, protocol.AUTH_PLAIN, protocol.AUTH_LOGIN}
+	}
+	for _, mechanism := range preference {
+		if containsString(server.Auth, string(mechanism)) {
+			return mechanism
+		}
+	}
+	return ""
+}
+
+// authFromConfig returns the configured client credentials, or nil when AUTH is not configured
+func authFromConfig(cfg *config.Config) Auth {
+	if cfg.ClientUsername == "" {
+		return nil
+	}
+	return CredentialsAuth(cfg.ClientAuthMechanism, cfg.ClientUsername, cfg.ClientPassword, cfg.ClientOAuthToken)
+}
+
+// authFromJSON returns the credentials carried by a JSONMail, or nil
+func authFromJSON(jsonAuth *mail.JSONAuth) Auth {
+	if jsonAuth == nil || jsonAuth.Username == "" {
+		return nil
+	}
+	return CredentialsAuth(jsonAuth.Mechanism, jsonAuth.Username, jsonAuth.Password, jsonAuth.Token)
+}
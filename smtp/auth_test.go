@@ -0,0 +1,153 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+const authEHLO = "250-mx.example.com\r\n250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2\r\n"
+
+// authExchange runs Auth against a scripted server that first answers EHLO with ehlo
+// It returns the commands the server received after EHLO
+func authExchange(t *testing.T, ehlo string, replies []string, auth Auth, insecure bool) ([]string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	commands := scriptedServer(server, append([]string{ehlo}, replies...))
+	conn, err := NewClient(client, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetAllowInsecureAuth(insecure)
+	err = conn.Auth(auth)
+	client.Close()
+	received := <-commands
+	if len(received) == 0 || !strings.HasPrefix(received[0], "EHLO ") {
+		t.Fatalf("got commands %q, want EHLO first", received)
+	}
+	return received[1:], err
+}
+
+func TestAuthExchanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     Auth
+		replies  []string
+		insecure bool
+		want     []string
+	}{
+		{"PLAIN", PlainAuth("", "user", "pass"), []string{"235 2.7.0 Authentication successful\r\n"}, true,
+			[]string{"AUTH PLAIN AHVzZXIAcGFzcw=="}},
+		{"PLAIN with identity", PlainAuth("admin", "user", "pass"), []string{"235 2.7.0 OK\r\n"}, true,
+			[]string{"AUTH PLAIN YWRtaW4AdXNlcgBwYXNz"}},
+		{"LOGIN", LoginAuth("user", "pass"), []string{"334 VXNlcm5hbWU6\r\n", "334 UGFzc3dvcmQ6\r\n", "235 2.7.0 OK\r\n"}, true,
+			[]string{"AUTH LOGIN", "dXNlcg==", "cGFzcw=="}},
+		// RFC 2195 section 2 example; CRAM-MD5 is allowed without TLS
+		{"CRAM-MD5", CRAMMD5Auth("tim", "tanstaaftanstaaf"),
+			[]string{"334 PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UucmVzdG9uLm1jaS5uZXQ+\r\n", "235 2.7.0 OK\r\n"}, false,
+			[]string{"AUTH CRAM-MD5", "dGltIGI5MTNhNjAyYzdlZGE3YTQ5NWI0ZTZlNzMzNGQzODkw"}},
+		{"XOAUTH2", XOAuth2Auth("user@example.com", "ya29.token"), []string{"235 2.7.0 Accepted\r\n"}, true,
+			[]string{"AUTH XOAUTH2 dXNlcj11c2VyQGV4YW1wbGUuY29tAWF1dGg9QmVhcmVyIHlhMjkudG9rZW4BAQ=="}},
+		{"negotiated on plaintext", CredentialsAuth("", "tim", "tanstaaftanstaaf", ""),
+			[]string{"334 PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UucmVzdG9uLm1jaS5uZXQ+\r\n", "235 2.7.0 OK\r\n"}, false,
+			[]string{"AUTH CRAM-MD5", "dGltIGI5MTNhNjAyYzdlZGE3YTQ5NWI0ZTZlNzMzNGQzODkw"}},
+	}
+	for _, test := range tests {
+		commands, err := authExchange(t, authEHLO, test.replies, test.auth, test.insecure)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if strings.Join(commands, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: server got %q, want %q", test.name, commands, test.want)
+		}
+	}
+}
+
+func TestAuthXOAuth2Error(t *testing.T) {
+	// The server reports a bad token as a JSON challenge and fails only after an empty response
+	commands, err := authExchange(t, authEHLO, []string{
+		"334 eyJzdGF0dXMiOiI0MDEiLCJzY2hlbWVzIjoiYmVhcmVyIiwic2NvcGUiOiJodHRwczovL21haWwuZ29vZ2xlLmNvbS8ifQ==\r\n",
+		"535 5.7.8 Username and Password not accepted\r\n",
+	}, XOAuth2Auth("user@example.com", "expired"), true)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != protocol.CODE_AUTH_FAILED {
+		t.Errorf("got error %v, want the 535 reply", err)
+	}
+	if len(commands) != 2 || commands[1] != "" {
+		t.Errorf("server got %q, want the AUTH command and an empty response", commands)
+	}
+}
+
+func TestAuthCancelled(t *testing.T) {
+	// LOGIN answers two prompts; a third is cancelled with "*"
+	commands, err := authExchange(t, authEHLO, []string{
+		"334 VXNlcm5hbWU6\r\n", "334 UGFzc3dvcmQ6\r\n", "334 QWdhaW46\r\n", "501 5.7.0 Authentication cancelled\r\n",
+	}, LoginAuth("user", "pass"), true)
+	if err == nil || !strings.Contains(err.Error(), "unexpected server challenge") {
+		t.Errorf("got error %v", err)
+	}
+	if len(commands) != 4 || commands[3] != "*" {
+		t.Errorf("server got %q, want the exchange cancelled with *", commands)
+	}
+
+	// A challenge that is not base64 is cancelled too
+	commands, err = authExchange(t, authEHLO, []string{"334 not base64!\r\n", "501 5.7.0 Cancelled\r\n"},
+		CRAMMD5Auth("tim", "secret"), false)
+	if err == nil || len(commands) != 2 || commands[1] != "*" {
+		t.Errorf("got %q (%v), want the exchange cancelled with *", commands, err)
+	}
+}
+
+func TestAuthRefusedWithoutTLS(t *testing.T) {
+	auths := map[string]Auth{
+		"PLAIN":       PlainAuth("", "user", "pass"),
+		"LOGIN":       LoginAuth("user", "pass"),
+		"XOAUTH2":     XOAuth2Auth("user", "token"),
+		"credentials": CredentialsAuth("PLAIN", "user", "pass", ""),
+	}
+	for name, auth := range auths {
+		commands, err := authExchange(t, authEHLO, nil, auth, false)
+		if !errors.Is(err, errInsecureAuth) {
+			t.Errorf("%s: got error %v, want the refusal", name, err)
+		}
+		if len(commands) != 0 {
+			t.Errorf("%s: server got %q, want nothing after EHLO", name, commands)
+		}
+	}
+}
+
+func TestAuthNotAdvertised(t *testing.T) {
+	commands, err := authExchange(t, "250-mx.example.com\r\n250 AUTH LOGIN\r\n", nil, PlainAuth("", "user", "pass"), true)
+	if err == nil || !strings.Contains(err.Error(), "does not support AUTH PLAIN") || len(commands) != 0 {
+		t.Errorf("got %q (%v), want PLAIN refused before sending", commands, err)
+	}
+	commands, err = authExchange(t, "250 mx.example.com\r\n", nil, CredentialsAuth("", "user", "pass", ""), true)
+	if err == nil || !strings.Contains(err.Error(), "no supported AUTH mechanism") || len(commands) != 0 {
+		t.Errorf("got %q (%v), want no mechanism without the AUTH extension", commands, err)
+	}
+}
+
+func TestCredentialsAuthNegotiate(t *testing.T) {
+	all := []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2"}
+	tests := []struct {
+		name   string
+		token  string
+		server ServerInfo
+		want   string
+	}{
+		{"TLS prefers PLAIN", "", ServerInfo{TLS: true, Auth: all}, "PLAIN"},
+		{"TLS falls back to LOGIN", "", ServerInfo{TLS: true, Auth: []string{"LOGIN", "CRAM-MD5"}}, "LOGIN"},
+		{"plaintext prefers CRAM-MD5", "", ServerInfo{AllowInsecure: true, Auth: all}, "CRAM-MD5"},
+		{"plaintext PLAIN if allowed", "", ServerInfo{AllowInsecure: true, Auth: []string{"PLAIN"}}, "PLAIN"},
+		{"token picks XOAUTH2", "token", ServerInfo{TLS: true, Auth: all}, "XOAUTH2"},
+	}
+	for _, test := range tests {
+		mechanism, _, err := CredentialsAuth("", "user", "pass", test.token).Start(&test.server)
+		if err != nil || mechanism != test.want {
+			t.Errorf("%s: got %s (%v), want %s", test.name, mechanism, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// Step-wise client commands
+// A session is driven as Hello -> [StartTLS] -> [Auth] -> (Send | Mail, Rcpt..., Data)* -> Quit
+// Send may be called any number of times on the same connection
+
+// Hello sends EHLO (LHLO in LMTP mode) and records the extensions the server advertises
+// name is the client hostname to announce; "" uses the configured SMTP_CLIENT_HOSTNAME
+// If the server rejects EHLO, HELO is tried so old servers still work (without extensions)
+func (c *ClientConn) Hello(name string) error {
+	if name != "" {
+		c.hostname = name
+	}
+	greeting := protocol.COMMAND_EHLO
+	if c.lmtp {
+		greeting = protocol.COMMAND_LHLO
+	}
+	if err := c.write(fmt.Sprintf("%s %s\r\n", greeting, c.hostname)); err != nil {
+		return fmt.Errorf("failed to write %s command: %w", greeting, err)
+	}
+
+	// The first line is the server greeting, every other line is one extension
+	reply, err := c.readReply()
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %w", greeting, err)
+	}
+	if reply.Code != protocol.CODE_ACKNOWLEDGE {
+		// Old servers without ESMTP reject EHLO - fall back to HELO (not possible for LMTP)
+		if !c.lmtp && reply.Code >= protocol.CODE_INTERNAL_SERVER_ERROR && reply.Code <= protocol.CODE_BAD_SEQUENCE {
+			return c.helo()
+		}
+		return &ReplyError{Command: string(greeting), Reply: reply}
+	}
+	extensions := make(map[string]string)
+	for _, line := range reply.Lines[1:] {
+		// Extension line: "KEYWORD params"
+		keyword, params, _ := strings.Cut(line, " ")
+		if keyword != "" {
+			extensions[strings.ToUpper(keyword)] = params
+		}
+	}
+
+	c.extensions = extensions
+	c.didHello = true
+	c.state = protocol.STATE_MAIL_FROM
+	return nil
+}
+
+// helo sends HELO after the server rejected EHLO
+func (c *ClientConn) helo() error {
+	if _, err := c.cmd(protocol.CODE_ACKNOWLEDGE, "%s %s", protocol.COMMAND_HELO, c.hostname); err != nil {
+		return err
+	}
+	c.extensions = make(map[string]string)
+	c.didHello = true
+	c.state = protocol.STATE_MAIL_FROM
+	return nil
+}
+
+// ensureHello sends EHLO if the session has not greeted the server yet
+func (c *ClientConn) ensureHello() error {
+	if c.didHello {
+		return nil
+	}
+	return c.Hello("")
+}
+
+// Extension reports whether the server advertised an EHLO extension and returns its parameters
+// For example Extension("SIZE") may return (true, "35882577")
+func (c *ClientConn) Extension(name string) (bool, string) {
+	params, ok := c.extensions[strings.ToUpper(name)]
+	return ok, params
+}
+
+// StartTLS upgrades the connection with STARTTLS and sends EHLO again (RFC 3207)
+// config may be nil to use SetTLSConfig's config; the TLS policy decides whether the certificate is verified
+func (c *ClientConn) StartTLS(config *tls.Config) error {
+	if err := c.ensureHello(); err != nil {
+		return err
+	}
+	if config != nil {
+		c.tlsConfig = config
+	}
+	if err := c.sendSTARTTLS(); err != nil {
+		return err
+	}
+	// The server forgets everything it knew from before the handshake
+	c.didHello = false
+	c.extensions = nil
+	if err := c.Hello(""); err != nil {
+		return fmt.Errorf("after STARTTLS: %w", err)
+	}
+	return nil
+}
+
+// helloWithTLS greets the server and secures the connection as the TLS policy demands
+func (c *ClientConn) helloWithTLS() error {
+	if err := c.Hello(""); err != nil {
+		return err
+	}
+	return c.EnsureTLS()
+}
+
+// Mail starts a mail transaction with MAIL FROM
+// from may be "" for the null reverse-path (bounces); params are ESMTP parameters such as "BODY=8BITMIME"
+func (c *ClientConn) Mail(from string, params ...string) error {
+	if err := c.ensureHello(); err != nil {
+		return err
+	}
+	if _, err := c.cmd(protocol.CODE_ACKNOWLEDGE, "%s", mailCommand(from, params)); err != nil {
+		return err
+	}
+	c.recipients = nil
+	c.state = protocol.STATE_RCPT_TO
+	return nil
+}
+
+// Rcpt adds a recipient with RCPT TO; params are ESMTP parameters such as "NOTIFY=FAILURE"
+// A rejected recipient does not end the transaction, further recipients may still be added
+func (c *ClientConn) Rcpt(to string, params ...string) error {
+	_, err := c.rcpt(to, params...)
+	return err
+}
+
+// rcpt sends RCPT TO and returns the server's reply (nil if the connection failed)
+func (c *ClientConn) rcpt(to string, params ...string) (*Reply, error) {
+	reply, err := c.cmd(protocol.CODE_ACKNOWLEDGE, "%s", rcptCommand(to, params))
+	if err != nil {
+		return reply, err
+	}
+	c.recipients = append(c.recipients, to)
+	c.state = protocol.STATE_DATA
+	return reply, nil
+}
+
+// Data sends DATA and returns a writer for the message (headers, blank line, body)
+// The writer converts bare LF to CRLF and applies dot-stuffing; Close ends the message
+// with <CRLF>.<CRLF> and returns the server's verdict
+func (c *ClientConn) Data() (io.WriteCloser, error) {
+	if _, err := c.cmd(protocol.CODE_START_MAIL_INPUT, "%s", protocol.COMMAND_DATA); err != nil {
+		return nil, err
+	}
+	return c.newDataWriter(), nil
+}
+
+// newDataWriter returns the writer for the message once the server answered DATA with 354
+func (c *ClientConn) newDataWriter() *dataWriter {
+	return &dataWriter{c: c, writer: bufio.NewWriter(c.conn), atLineStart: true}
+}
+
+// Reset aborts the current mail transaction with RSET
+func (c *ClientConn) Reset() error {
+	if _, err := c.cmd(protocol.CODE_ACKNOWLEDGE, "%s", protocol.COMMAND_RSET); err != nil {
+		return err
+	}
+	c.recipients = nil
+	c.state = protocol.STATE_MAIL_FROM
+	return nil
+}
+
+// Noop sends NOOP, e.g. to check that the connection is still alive
+func (c *ClientConn) Noop() error {
+	if _, err := c.cmd(protocol.CODE_ACKNOWLEDGE, "%s", protocol.COMMAND_NOOP); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Quit sends QUIT and closes the connection
+// The connection is closed even if the server's reply is unexpected
+func (c *ClientConn) Quit() error {
+	_, err := c.cmd(protocol.CODE_QUIT, "%s", protocol.COMMAND_QUIT)
+	c.state = protocol.STATE_DEAD
+	closeErr := c.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Send delivers one message on the open connection: MAIL FROM, RCPT TO for every
+// To/Cc/Bcc recipient, DATA with the generated headers and body
+// Rejected recipients are recorded in the result and the message still goes to the others;
+// the error is only set when no recipient received the message
+// It can be called repeatedly; a failed transaction is reset so the connection stays usable
+func (c *ClientConn) Send(msg mail.Mail) (*SendResult, error) {
+	if msg.GetFrom() == "" {
+		c.result = &SendResult{Recipients: make([]RecipientResult, 0)}
+		return c.result, errors.New("no FROM address specified")
+	}
+	return c.SendEnvelope(msg.GetFrom(), mailRecipients(msg), msg)
+}
+
+// SendEnvelope is Send with an explicit envelope, independent of the message headers
+// from may be "" for the null reverse-path (bounces); recipients get RCPT TO in order
+// Used for relaying and MX delivery, where each server only gets the recipients of its domains
+func (c *ClientConn) SendEnvelope(from string, recipients []string, msg mail.Mail) (*SendResult, error) {
+	result := &SendResult{Recipients: make([]RecipientResult, 0)}
+	c.result = result
+	if err := c.ensureHello(); err != nil {
+		return result, err
+	}
+	c.mail = msg
+	if len(recipients) == 0 {
+		return result, errors.New("no recipients specified")
+	}
+
+	// Headers, blank line to separate headers from body, then the body
+	// A raw message (e.g. received by the server, or from mail.Builder) already has its headers
+	content, err := c.sign(msg.Render())
+	if err != nil {
+		return result, fmt.Errorf("DKIM signing failed: %w", err)
+	}
+	// The ESMTP parameters the message was received with, as far as the server supports them
+	params, err := c.envelopeParams(from, recipients, msg, len(content))
+	if err != nil {
+		return result, err
+	}
+	result.DSN = params.dsn
+
+	// With PIPELINING the whole envelope goes out in one write (RFC 2920)
+	var w io.WriteCloser
+	if c.canPipeline() {
+		w, err = c.envelopePipelined(from, recipients, params, result)
+	} else {
+		w, err = c.envelope(from, recipients, params, result)
+	}
+	if err != nil {
+		return result, err
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		return result, fmt.Errorf("sending email content failed: %w", err)
+	}
+	closeErr := w.Close()
+	c.applyDataReplies(result)
+	if c.lmtp {
+		// LMTP: the per-recipient replies are the verdict, a partial failure is in the result
+		if len(result.Accepted()) == 0 {
+			return result, fmt.Errorf("LMTP delivery failed: no recipient accepted (%s)", joinResults(result.Rejected()))
+		}
+		return result, nil
+	}
+	return result, closeErr
+}
+
+// envelope sends MAIL FROM, RCPT TO and DATA one command at a time
+func (c *ClientConn) envelope(from string, recipients []string, params *envelopeParams, result *SendResult) (io.WriteCloser, error) {
+	if err := c.Mail(from, params.mail...); err != nil {
+		return nil, err
+	}
+
+	accepted := 0
+	for _, rcpt := range recipients {
+		reply, err := c.rcpt(rcpt, params.rcpt[rcpt]...)
+		if reply == nil {
+			// No reply at all - the connection is gone
+			return nil, fmt.Errorf("RCPT TO failed for %s: %w", rcpt, err)
+		}
+		result.Recipients = append(result.Recipients, newRecipientResult(rcpt, reply))
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		c.Reset()
+		return nil, fmt.Errorf("RCPT TO failed: no recipient accepted (%s)", joinResults(result.Rejected()))
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		c.Reset()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Result returns the outcome of the last Send (nil before the first one)
+// Useful with the NewClientConn* constructors, which send a single message
+func (c *ClientConn) Result() *SendResult {
+	return c.result
+}
+
+// applyDataReplies copies the replies read after DATA into the result
+func (c *ClientConn) applyDataReplies(result *SendResult) {
+	if !c.lmtp {
+		if len(c.dataReplies) > 0 {
+			result.setDataReply(c.dataReplies[0])
+		}
+		return
+	}
+	// LMTP replies come in order, one for each recipient accepted by RCPT TO
+	next := 0
+	for i, rcpt := range result.Recipients {
+		if !rcpt.Accepted() {
+			continue
+		}
+		if next >= len(c.dataReplies) {
+			break
+		}
+		result.Recipients[i] = newRecipientResult(rcpt.Recipient, c.dataReplies[next])
+		next++
+	}
+	if next > 0 {
+		result.setDataReply(c.dataReplies[next-1])
+	}
+}
+
+// joinResults formats recipient results for error messages
+func joinResults(results []RecipientResult) string {
+	parts := make([]string, 0, len(results))
+	for _, result := range results {
+		parts = append(parts, result.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// mailRecipients returns every To, CC and BCC address of a mail
+// To and CC recipients appear in the headers, BCC recipients only get RCPT TO
+func mailRecipients(msg mail.Mail) []string {
+	recipients := make([]string, 0)
+	recipients = append(recipients, msg.GetTo()...)
+	recipients = append(recipients, msg.GetCC()...)
+	recipients = append(recipients, msg.GetBCC()...)
+	return recipients
+}
+
+// cmd writes one command line and reads the reply, which must carry the expected code
+// A reply with another code is returned together with a *ReplyError carrying its full text
+func (c *ClientConn) cmd(expect protocol.SMTPCode, format string, args ...any) (*Reply, error) {
+	line := fmt.Sprintf(format, args...)
+	command := commandName(line)
+	if err := c.write(line + "\r\n"); err != nil {
+		return nil, fmt.Errorf("failed to write %s command: %w", command, err)
+	}
+	return c.expectReply(command, expect)
+}
+
+// commandName returns the verb of a command line for error messages, e.g. "MAIL FROM" or "RSET"
+func commandName(line string) string {
+	upper := strings.ToUpper(line)
+	for _, command := range []protocol.SMTPCommands{protocol.COMMAND_MAIL_FROM, protocol.COMMAND_RCPT_TO} {
+		if strings.HasPrefix(upper, string(command)) {
+			return string(command)
+		}
+	}
+	verb, _, _ := strings.Cut(upper, " ")
+	return verb
+}
+
+// dataWriter streams a message after DATA
+type dataWriter struct {
+	c           *ClientConn
+	writer      *bufio.Writer
+	atLineStart bool // Next byte starts a line (dot-stuffing applies)
+	lastCR      bool // Previous byte was '\r'
+	written     int
+	closed      bool
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed DATA writer")
+	}
+	if err := w.c.deadline(w.c.conn.SetWriteDeadline, w.c.timeouts.Command); err != nil {
+		return 0, fmt.Errorf("write error: %w", err)
+	}
+	for i, b := range p {
+		// SMTP transparency: lines starting with "." get another "." prepended
+		if w.atLineStart && b == '.' {
+			if err := w.writer.WriteByte('.'); err != nil {
+				return i, err
+			}
+		}
+		// SMTP requires CRLF line endings
+		if b == '\n' && !w.lastCR {
+			if err := w.writer.WriteByte('\r'); err != nil {
+				return i, err
+			}
+		}
+		if err := w.writer.WriteByte(b); err != nil {
+			return i, err
+		}
+		w.lastCR = b == '\r'
+		w.atLineStart = b == '\n'
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+// Close terminates the message with <CRLF>.<CRLF> and reads the server's reply
+// In LMTP mode one reply per accepted recipient is read
+func (w *dataWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	c := w.c
+
+	// Make sure the message ends with CRLF before the terminator
+	terminator := ".\r\n"
+	if !w.atLineStart {
+		terminator = "\r\n.\r\n"
+	}
+	if _, err := w.writer.WriteString(terminator); err != nil {
+		return fmt.Errorf("failed to write terminator: %w", err)
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	fmt.Printf("CLIENT -> SERVER: (%d bytes of message data)\n", w.written)
+	fmt.Printf("CLIENT -> SERVER: .\n")
+
+	c.state = protocol.STATE_MAIL_FROM
+	recipients := c.recipients
+	c.recipients = nil
+	c.dataReplies = nil
+
+	// The server may take long to accept the message (filters, fsync): RFC 5321 allows 10 minutes
+	c.replyTimeout = c.timeouts.DataEnd
+	defer func() { c.replyTimeout = 0 }()
+
+	// LMTP: one reply per recipient instead of a single acknowledgment
+	if c.lmtp {
+		return c.readLMTPReplies(recipients)
+	}
+
+	// Read final acknowledgment
+	reply, err := c.expectReply("end of DATA", protocol.CODE_ACKNOWLEDGE)
+	if reply != nil {
+		c.dataReplies = []*Reply{reply}
+	}
+	return err
+}
+
+// readLMTPReplies reads the per-recipient replies after DATA (RFC 2033 section 4.2)
+// Replies arrive in RCPT order, one for each recipient the server accepted
+func (c *ClientConn) readLMTPReplies(recipients []string) error {
+	failed := make([]string, 0)
+	for _, rcpt := range recipients {
+		reply, err := c.readReply()
+		if err != nil {
+			return fmt.Errorf("failed to read LMTP reply for %s: %w", rcpt, err)
+		}
+		c.dataReplies = append(c.dataReplies, reply)
+		if reply.Code != protocol.CODE_ACKNOWLEDGE {
+			failed = append(failed, newRecipientResult(rcpt, reply).String())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("LMTP delivery failed for %d of %d recipients: %s", len(failed), len(recipients), strings.Join(failed, "; "))
+	}
+	return nil
+}
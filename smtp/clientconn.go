@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/dkim"
 	"github.com/ImBubbles/MySMTP/mail"
 	"github.com/ImBubbles/MySMTP/smtp/protocol"
 	"github.com/ImBubbles/MySMTP/util/conn"
@@ -19,17 +21,98 @@ import (
 
 // ClientConn handle client-side SMTP connections to send emails
 type ClientConn struct {
-	conn       net.Conn
-	state      protocol.SMTPStates
-	reader     *bufio.Reader
-	mail       mail.Mail
-	tlsConfig  *tls.Config
-	hostname   string // Client hostname (for EHLO)
-	serverName string // Server hostname (for TLS SNI)
-	serverHost string // Server host from DialSMTP (for SNI fallback)
+	conn         net.Conn
+	state        protocol.SMTPStates
+	reader       *bufio.Reader
+	mail         mail.Mail
+	tlsConfig    *tls.Config
+	hostname     string            // Client hostname (for EHLO)
+	serverName   string            // Server hostname (for TLS SNI)
+	serverHost   string            // Server host from DialSMTP (for SNI fallback)
+	lmtp         bool              // Speak LMTP (RFC 2033): LHLO and one reply per recipient after DATA
+	didHello     bool              // EHLO/HELO has been accepted
+	extensions   map[string]string // EHLO extensions (keyword -> parameters)
+	recipients   []string          // Recipients accepted in the current transaction
+	dataReplies  []*Reply          // Replies after the end of DATA (one per recipient in LMTP)
+	result       *SendResult       // Outcome of the last Send
+	noPipelining bool              // Never pipeline, even if the server offers PIPELINING
+	tlsPolicy    TLSPolicy         // STARTTLS use and certificate checks (see EnsureTLS)
+	dkim         *dkim.Signer      // Signs every message sent (nil = unsigned)
+	// Deadlines per phase, and the contexts that abort I/O (see NewClientContext and SendContext)
+	timeouts     Timeouts
+	replyTimeout time.Duration   // Timeout for the reply being read when it is not a command reply
+	ctx          context.Context // Bound for the lifetime of the connection (nil = none)
+	callCtx      context.Context // Bound for the current *Context call (nil = none)
+	// Credentials for the one-shot constructors (nil = no AUTH) and whether they may go out without TLS
+	auth              Auth
+	allowInsecureAuth bool
+}
+
+// NewClient wraps an established connection to an SMTP server and reads its greeting
+// Nothing else is sent, so the caller drives the session step by step:
+//
+//	client, err := smtp.NewClient(conn, "smtp.example.com")
+//	client.Hello("")
+//	client.StartTLS(nil)
+//	client.Send(firstMail)
+//	client.Send(secondMail)
+//	client.Quit()
+//
+// host is the server hostname used for TLS SNI ("" to derive it from the connection)
+func NewClient(conn net.Conn, host string) (*ClientConn, error) {
+	client := newClientConn(conn, mail.Mail{})
+	client.setServerHost(host)
+	if err := client.readGreeting(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewLMTPClient is NewClient for an LMTP (RFC 2033) server: Hello sends LHLO and
+// closing the Data writer reads one reply per accepted recipient
+// STARTTLS is opportunistic, SMTP_CLIENT_TLS_POLICY does not apply; SetTLSPolicy asks for more
+func NewLMTPClient(conn net.Conn, host string) (*ClientConn, error) {
+	client := newClientConn(conn, mail.Mail{})
+	client.lmtp = true
+	client.tlsPolicy = TLS_POLICY_OPPORTUNISTIC
+	client.setServerHost(host)
+	if err := client.readGreeting(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Dial connects to an SMTP server (see DialSMTP for the port) and reads its greeting
+// Usage: client, err := Dial("smtp.gmail.com"); client.Hello(""); client.StartTLS(nil); ...
+func Dial(host string, port ...uint16) (*ClientConn, error) {
+	return DialContext(context.Background(), host, port...)
+}
+
+// DialTLS connects to an SMTPS server (direct TLS, port 465 by default) and reads its greeting
+func DialTLS(host string, port ...uint16) (*ClientConn, error) {
+	return DialTLSContext(context.Background(), host, port...)
 }
 
 func NewClientConn(conn net.Conn, mail mail.Mail) (*ClientConn, error) {
+	clientConn := newClientConn(conn, mail)
+	err := clientConn.handle()
+	return clientConn, err
+}
+
+// NewLMTPClientConn delivers a mail over LMTP (RFC 2033), e.g. to a mailbox backend
+// The connection is usually a unix socket or TCP port 24
+// Every recipient gets its own reply after DATA; see Result for the verdict per recipient
+// Backends usually do not offer STARTTLS, so it is used only when offered (SMTP_CLIENT_TLS_POLICY does not apply)
+func NewLMTPClientConn(conn net.Conn, mail mail.Mail) (*ClientConn, error) {
+	clientConn := newClientConn(conn, mail)
+	clientConn.lmtp = true
+	clientConn.tlsPolicy = TLS_POLICY_OPPORTUNISTIC
+	err := clientConn.handle()
+	return clientConn, err
+}
+
+// newClientConn builds a ClientConn without reading the greeting or starting a transaction
+func newClientConn(conn net.Conn, mail mail.Mail) *ClientConn {
 	// Load config for hostname
 	cfg := config.GetConfig()
 	hostname := cfg.ClientHostname
@@ -43,32 +126,41 @@ func NewClientConn(conn net.Conn, mail mail.Mail) (*ClientConn, error) {
 	}
 
 	clientConn := &ClientConn{
-		conn:       conn,
-		state:      protocol.STATE_EHLO,
-		reader:     bufio.NewReader(conn),
-		mail:       mail,
-		hostname:   hostname,
-		serverHost: "", // Will be set if using NewClientConnFromHost
-	}
-	err := clientConn.handle()
-	return clientConn, err
+		conn:              conn,
+		state:             protocol.STATE_EHLO,
+		reader:            bufio.NewReader(conn),
+		mail:              mail,
+		hostname:          hostname,
+		serverHost:        "", // Will be set if using NewClientConnFromHost
+		auth:              authFromConfig(cfg),
+		allowInsecureAuth: cfg.ClientAllowInsecureAuth,
+		timeouts:          TimeoutsFromConfig(cfg),
+		tlsPolicy:         tlsPolicyFromConfig(cfg),
+		dkim:              dkimFromConfig(),
+	}
+	return clientConn
 }
 
 // NewClientConnFromHost creates a new client connection and stores the server hostname
 // This is useful for Gmail and other SMTP servers that require proper SNI in TLS
 // The host parameter should be the SMTP server hostname (e.g., "smtp.gmail.com")
 func NewClientConnFromHost(host string, conn net.Conn, mail mail.Mail) (*ClientConn, error) {
-	client, err := NewClientConn(conn, mail)
-	if err != nil {
+	client := newClientConn(conn, mail)
+	// Store the server host before the session starts so STARTTLS uses it for SNI
+	client.setServerHost(host)
+	if err := client.handle(); err != nil {
 		return nil, err
 	}
-	// Store the server host for SNI fallback if ServerName is not explicitly set
-	client.serverHost = host
+	return client, nil
+}
+
+// setServerHost stores the server host for SNI fallback if ServerName is not explicitly set
+func (c *ClientConn) setServerHost(host string) {
+	c.serverHost = host
 	// If ServerName is not set, use the host for SNI
-	if client.serverName == "" {
-		client.serverName = host
+	if c.serverName == "" {
+		c.serverName = host
 	}
-	return client, nil
 }
 
 // SetTLSConfig sets the TLS configuration for STARTTLS
@@ -84,12 +176,13 @@ func (c *ClientConn) SetServerName(serverName string) {
 
 // NewClientConnFromJSON creates a new client connection from JSON bytes
 // This is a convenience function to easily create a ClientConn from JSON (e.g., from a backend API)
+// An "auth" object in the JSON overrides the configured client credentials
 func NewClientConnFromJSON(conn net.Conn, jsonBytes []byte) (*ClientConn, error) {
-	mail, err := mail.FromJSON(jsonBytes)
+	jsonMail, err := mail.ParseJSONMail(string(jsonBytes))
 	if err != nil {
 		return nil, err
 	}
-	return NewClientConn(conn, *mail)
+	return NewClientConnFromJSONMail(conn, jsonMail)
 }
 
 // NewClientConnFromJSONString creates a new client connection from a JSON string
@@ -101,19 +194,31 @@ func NewClientConnFromJSONString(conn net.Conn, jsonStr string) (*ClientConn, er
 // NewClientConnFromJSONMail creates a new client connection from a JSONMail struct
 // This is a convenience function to easily create a ClientConn from a JSONMail
 func NewClientConnFromJSONMail(conn net.Conn, jsonMail *mail.JSONMail) (*ClientConn, error) {
-	mail := jsonMail.ToMail()
-	return NewClientConn(conn, *mail)
+	clientConn := newClientConn(conn, *jsonMail.ToMail())
+	if auth := authFromJSON(jsonMail.Auth); auth != nil {
+		clientConn.auth = auth
+	}
+	err := clientConn.handle()
+	return clientConn, err
 }
 
 // NewClientConnFromHostAndJSON creates a new client connection from host and JSON bytes
 // This stores the server hostname for proper SNI in TLS (required for Gmail and others)
 // The host parameter should be the SMTP server hostname (e.g., "smtp.gmail.com")
 func NewClientConnFromHostAndJSON(host string, conn net.Conn, jsonBytes []byte) (*ClientConn, error) {
-	mail, err := mail.FromJSON(jsonBytes)
+	jsonMail, err := mail.ParseJSONMail(string(jsonBytes))
 	if err != nil {
 		return nil, err
 	}
-	return NewClientConnFromHost(host, conn, *mail)
+	client := newClientConn(conn, *jsonMail.ToMail())
+	client.setServerHost(host)
+	if auth := authFromJSON(jsonMail.Auth); auth != nil {
+		client.auth = auth
+	}
+	if err := client.handle(); err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 // DialSMTP creates a TCP connection to an SMTP server
@@ -124,33 +229,7 @@ func NewClientConnFromHostAndJSON(host string, conn net.Conn, jsonBytes []byte)
 // IMPORTANT: For Gmail and other modern SMTP servers, use NewClientConnFromHost() or
 // NewClientConnDialSMTP() instead to ensure proper SNI for TLS
 func DialSMTP(host string, port ...uint16) (net.Conn, error) {
-	var smtpPort uint16
-
-	// Use provided port, or config port, or default to 587 (submission with STARTTLS)
-	if len(port) > 0 && port[0] != 0 {
-		smtpPort = port[0]
-	} else {
-		cfg := config.GetConfig()
-		if cfg.ClientPort != 0 {
-			smtpPort = cfg.ClientPort
-		} else {
-			smtpPort = 587 // Default to port 587 (submission with STARTTLS)
-		}
-	}
-
-	address := net.JoinHostPort(host, fmt.Sprintf("%d", smtpPort))
-
-	// Create dialer with timeout to prevent hanging
-	dialer := &net.Dialer{
-		Timeout: 10 * time.Second,
-	}
-
-	conn, err := dialer.Dial("tcp", address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SMTP server %s: %w", address, err)
-	}
-
-	return conn, nil
+	return DialSMTPContext(context.Background(), host, port...)
 }
 
 // DialSMTPS creates a direct TLS connection to an SMTP server (SMTPS on port 465)
@@ -160,56 +239,7 @@ func DialSMTP(host string, port ...uint16) (net.Conn, error) {
 // Returns a net.Conn wrapped in TLS ready for use with NewClientConn
 // IMPORTANT: Set ServerName with SetServerName() for proper SNI before calling NewClientConn
 func DialSMTPS(host string, port ...uint16) (net.Conn, error) {
-	var smtpPort uint16
-
-	// Use provided port, or default to 465 (SMTPS - secure submission)
-	if len(port) > 0 && port[0] != 0 {
-		smtpPort = port[0]
-	} else {
-		smtpPort = 465 // Default to port 465 (SMTPS - secure submission)
-	}
-
-	address := net.JoinHostPort(host, fmt.Sprintf("%d", smtpPort))
-
-	// Create dialer with timeout to prevent hanging
-	dialer := &net.Dialer{
-		Timeout: 10 * time.Second,
-	}
-
-	// Dial TCP connection first
-	conn, err := dialer.Dial("tcp", address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SMTP server %s: %w", address, err)
-	}
-
-	// Determine server name for TLS SNI
-	serverName := host
-	if net.ParseIP(host) != nil {
-		// It's an IP - we need a hostname for SNI
-		// Use hostname from config as fallback
-		cfg := config.GetConfig()
-		if cfg.ClientHostname != "" {
-			serverName = cfg.ClientHostname
-		} else {
-			serverName = "localhost"
-		}
-	}
-
-	// Create TLS config with server name
-	tlsConfig := &tls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: false,            // Don't skip verification for security
-		MinVersion:         tls.VersionTLS12, // Require TLS 1.2 or higher
-	}
-
-	// Perform TLS handshake immediately (SMTPS - TLS from the start)
-	tlsConn := tls.Client(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
-	}
-
-	return tlsConn, nil
+	return DialSMTPSContext(context.Background(), host, port...)
 }
 
 // NewClientConnDialSMTP is a convenience function that dials SMTP and creates a client connection
@@ -238,64 +268,56 @@ func NewClientConnDialSMTPS(host string, mail mail.Mail, port ...uint16) (*Clien
 	return NewClientConnFromHost(host, conn, mail)
 }
 
+// handle runs the one-shot session used by the NewClientConn* constructors:
+// greeting, EHLO (+ STARTTLS when offered), AUTH when credentials are set, one message, QUIT
 func (c *ClientConn) handle() error {
-	// Read server greeting (220 Service Ready)
-	response, err := c.read()
-	if err != nil {
-		return fmt.Errorf("failed to read server greeting: %w", err)
-	}
-	if response == "" {
-		return errors.New("connection closed by server")
-	}
-	if !c.isSuccessCode(response, protocol.CODE_READY) {
-		return fmt.Errorf("server greeting failed: %s", response)
-	}
-
-	// Send EHLO command
-	if err := c.sendEHLO(); err != nil {
-		return fmt.Errorf("EHLO failed: %w", err)
+	if err := c.readGreeting(); err != nil {
+		return err
 	}
 
-	// Send MAIL FROM command
-	if err := c.sendMailFrom(); err != nil {
-		return fmt.Errorf("MAIL FROM failed: %w", err)
+	// Send EHLO command (and upgrade to TLS if the server offers STARTTLS)
+	if err := c.helloWithTLS(); err != nil {
+		return err
 	}
 
-	// Send RCPT TO commands for all recipients
-	if err := c.sendRcptTo(); err != nil {
-		return fmt.Errorf("RCPT TO failed: %w", err)
+	// Authenticate for submission (SMTP_CLIENT_USERNAME or SetAuth)
+	if c.auth != nil {
+		if err := c.Auth(c.auth); err != nil {
+			c.Quit()
+			return err
+		}
 	}
 
-	// Send DATA command
-	if err := c.sendData(); err != nil {
-		return fmt.Errorf("DATA command failed: %w", err)
+	if _, err := c.Send(c.mail); err != nil {
+		return err
 	}
 
-	// Send email content (headers + body)
-	if err := c.sendEmailContent(); err != nil {
-		return fmt.Errorf("sending email content failed: %w", err)
-	}
+	// Send QUIT command (ignore errors as connection will close)
+	c.Quit()
+	return nil
+}
 
-	// Read final acknowledgment
-	response, err = c.read()
-	if err != nil {
-		return fmt.Errorf("failed to read final acknowledgment: %w", err)
-	}
-	if response == "" {
-		return errors.New("connection closed by server before final acknowledgment")
-	}
-	if !c.isSuccessCode(response, protocol.CODE_ACKNOWLEDGE) {
-		return fmt.Errorf("final acknowledgment failed: %s", response)
+// readGreeting reads the server greeting (220 Service Ready)
+func (c *ClientConn) readGreeting() error {
+	c.replyTimeout = c.timeouts.Greeting
+	defer func() { c.replyTimeout = 0 }()
+	if _, err := c.expectReply("server greeting", protocol.CODE_READY); err != nil {
+		return err
 	}
-
-	// Send QUIT command (ignore errors as connection will close)
-	c.sendQuit()
 	return nil
 }
 
+// isTLS reports whether the connection is encrypted (SMTPS or after STARTTLS)
+func (c *ClientConn) isTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
 func (c *ClientConn) write(str string) error {
-	// Update write deadline before each write (net.Conn interface supports SetWriteDeadline)
-	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	// Update write deadline before each write; a cancelled context fails the write at once
+	if err := c.deadline(c.conn.SetWriteDeadline, c.timeouts.Command); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
 
 	// Debug: Print what we're sending (trim \r\n for cleaner output)
 	output := strings.TrimRight(str, "\r\n")
@@ -327,16 +349,25 @@ func (c *ClientConn) write(str string) error {
 }
 
 func (c *ClientConn) read() (string, error) {
-	// Update read deadline before each read (net.Conn interface supports SetReadDeadline)
-	c.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Update read deadline before each read: the greeting and the end of DATA have their own
+	timeout := c.timeouts.Command
+	if c.replyTimeout != 0 {
+		timeout = c.replyTimeout
+	}
+	if err := c.deadline(c.conn.SetReadDeadline, timeout); err != nil {
+		return "", fmt.Errorf("read error: %w", err)
+	}
 	response := conn.Read(c.reader)
 
 	// Debug: Print what we're receiving (trim \r\n for cleaner output)
 	output := strings.TrimRight(response, "\r\n")
 	fmt.Printf("CLIENT <- SERVER: %s\n", output)
 
-	// Check for empty response (connection closed)
+	// Check for empty response (connection closed, timed out or cancelled)
 	if response == "" {
+		if err := c.contextErr(); err != nil {
+			return "", fmt.Errorf("read error: %w", err)
+		}
 		return "", errors.New("read error: empty response (connection may have closed)")
 	}
 
@@ -352,198 +383,23 @@ func (c *ClientConn) read() (string, error) {
 	return response, nil
 }
 
-// isSuccessCode checks if the response code matches the expected code
-func (c *ClientConn) isSuccessCode(response string, expectedCode protocol.SMTPCode) bool {
-	// Response format: "250 OK\r\n" or "220 Service Ready\r\n"
-	trimmed := strings.TrimSpace(response)
-
-	// Check for blank response
-	if trimmed == "" {
-		return false
-	}
-
-	if len(trimmed) >= 3 {
-		codeStr := trimmed[:3]
-		var code protocol.SMTPCode
-		n, err := fmt.Sscanf(codeStr, "%d", &code)
-		if err != nil || n != 1 {
-			// Failed to parse code - return false
-			return false
-		}
-		return code == expectedCode
-	}
-	return false
-}
-
-// parseResponseCode extracts the response code from server response
-func (c *ClientConn) parseResponseCode(response string) protocol.SMTPCode {
-	trimmed := strings.TrimSpace(response)
-
-	// Check for blank response
-	if trimmed == "" {
-		return protocol.CODE_INTERNAL_SERVER_ERROR
-	}
-
-	if len(trimmed) >= 3 {
-		var code protocol.SMTPCode
-		n, err := fmt.Sscanf(trimmed[:3], "%d", &code)
-		if err != nil || n != 1 {
-			// Failed to parse code - return error code
-			return protocol.CODE_INTERNAL_SERVER_ERROR
-		}
-		return code
-	}
-	return protocol.CODE_INTERNAL_SERVER_ERROR
-}
-
-// sendEHLO sends EHLO command and optionally upgrades to TLS if available
-// allowTLS controls whether to attempt STARTTLS (used to prevent recursion)
-func (c *ClientConn) sendEHLO() error {
-	return c.sendEHLOWithTLS(true)
-}
-
-// sendEHLOWithTLS is the internal implementation that allows controlling TLS behavior
-func (c *ClientConn) sendEHLOWithTLS(allowTLS bool) error {
-	ehloCmd := fmt.Sprintf("%s %s\r\n", protocol.COMMAND_EHLO, c.hostname)
-	if err := c.write(ehloCmd); err != nil {
-		return fmt.Errorf("failed to write EHLO command: %w", err)
-	}
-
-	// Read server responses (may be multiple lines)
-	// SMTP multi-line responses use "-" as 4th character for continuation
-	// Final line has space (or sometimes nothing) as 4th character
-	extensions := make([]string, 0)
-	firstResponseLine := ""
-	serverHostname := ""
-
-	for {
-		response, err := c.read()
-		if err != nil {
-			return fmt.Errorf("failed to read EHLO response: %w", err)
-		}
-		if response == "" {
-			return errors.New("EHLO failed: empty response")
-		}
-
-		// Store first response line to extract server hostname
-		if firstResponseLine == "" {
-			firstResponseLine = response
-		}
-
-		code := c.parseResponseCode(response)
-
-		// Check if this is an error
-		if code >= protocol.CODE_INTERNAL_SERVER_ERROR {
-			return fmt.Errorf("EHLO failed: %s", response)
-		}
-
-		// Check if this is a continuation line (SMTP standard: 4th char is "-")
-		// Continuation format: "250-extension\r\n"
-		// Final line format: "250 OK\r\n" or "250 message\r\n"
-		if len(response) >= 4 {
-			// Check the 4th character (index 3) after the 3-digit code
-			if response[3] == '-' {
-				// Continuation line - extract extension
-				// Format: "250-EXTENSION\r\n"
-				if len(response) > 5 {
-					extension := strings.TrimSpace(response[4:])
-					if extension != "" {
-						extensions = append(extensions, strings.ToUpper(extension))
-					}
-				}
-				continue
-			}
-			// If 4th char is space, it's the final line
-			if response[3] == ' ' {
-				break
-			}
-		}
-
-		// If code is 250 (ACKNOWLEDGE), this is the final line (even without space)
-		// This handles cases like "250OK\r\n" where there's no space
-		if code == protocol.CODE_ACKNOWLEDGE {
-			break
-		}
-
-		// If we got a valid success code (not 250), break anyway to avoid infinite loop
-		if code < protocol.CODE_INTERNAL_SERVER_ERROR && code != protocol.CODE_ACKNOWLEDGE {
-			break
-		}
-
-		// Safety: if we got here, break to avoid infinite loop
-		break
-	}
-
-	// Extract server hostname from first EHLO response line
-	// Format: "250-hostname Hello client" or "250 hostname Hello client"
-	// The server hostname is usually the first word after the response code
-	// NOTE: We extract this for informational purposes, but DON'T automatically use it for
-	// TLS ServerName verification, as it may not match the certificate's Subject Alternative Names
-	if firstResponseLine != "" && len(firstResponseLine) > 4 {
-		// Skip response code (3 digits) and separator (- or space)
-		remainder := strings.TrimSpace(firstResponseLine[4:])
-		// Find first space (hostname ends at "Hello" or similar word)
-		if spaceIdx := strings.Index(remainder, " "); spaceIdx > 0 {
-			serverHostname = strings.TrimSpace(remainder[:spaceIdx])
-		} else if spaceIdx == -1 {
-			// No space found, use entire remainder (shouldn't happen but be safe)
-			serverHostname = remainder
-		}
-		// Store server hostname, but only use it for ServerName if explicitly set by user
-		// For TLS verification, we prefer using serverHost (the host we connected to)
-		// This works better for servers with self-signed or mismatched certificates
-		if serverHostname != "" && c.serverName == "" {
-			// Only set if we have no better option - prefer serverHost for ServerName
-			// This helps with certificate verification when EHLO hostname doesn't match cert
-		}
+// tlsServerName returns the server name used for TLS SNI and certificate verification
+// Priority: 1) serverName (SetServerName), 2) serverHost (the host that was dialed), 3) the
+// connection's remote address; an IP is verified against the IP addresses in the certificate
+// Our own hostname is never used: a certificate can't be valid for it, so checks would fail
+func (c *ClientConn) tlsServerName() string {
+	if c.serverName != "" {
+		return c.serverName
 	}
-
-	// Check if connection is already TLS (SMTPS - direct TLS connection)
-	// If connection is already TLS-wrapped, skip STARTTLS
-	isAlreadyTLS := false
-	if _, ok := c.conn.(*tls.Conn); ok {
-		isAlreadyTLS = true
+	if c.serverHost != "" {
+		return c.serverHost
 	}
-
-	// Check if STARTTLS is supported and use it if available (only if allowTLS is true and not already TLS)
-	// After STARTTLS, we send EHLO again but don't check for STARTTLS again
-	// Many modern SMTP servers (like Gmail) require or strongly prefer STARTTLS
-	if allowTLS && !isAlreadyTLS {
-		supportsSTARTTLS := false
-		for _, ext := range extensions {
-			// Check for STARTTLS extension (case-insensitive)
-			if strings.Contains(strings.ToUpper(ext), "STARTTLS") {
-				supportsSTARTTLS = true
-				break
-			}
-		}
-
-		// If STARTTLS is available, use it
-		// Create default TLS config if none provided (required for many modern SMTP servers like Gmail)
-		if supportsSTARTTLS {
-			if c.tlsConfig == nil {
-				// Create default TLS config for STARTTLS
-				// For Gmail and other modern SMTP servers, we need proper ServerName
-				// The ServerName should match the MX hostname
-				c.tlsConfig = &tls.Config{
-					ServerName:         c.serverName,
-					InsecureSkipVerify: false,            // Don't skip verification for security
-					MinVersion:         tls.VersionTLS12, // Require TLS 1.2 or higher
-				}
-			}
-			if err := c.sendSTARTTLS(); err != nil {
-				return fmt.Errorf("STARTTLS failed: %w", err)
-			}
-			// After STARTTLS, must send EHLO again (but don't check for STARTTLS again)
-			if err := c.sendEHLOWithTLS(false); err != nil {
-				return fmt.Errorf("EHLO after STARTTLS failed: %w", err)
-			}
-			return nil
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
 		}
 	}
-
-	c.state = protocol.STATE_MAIL_FROM
-	return nil
+	return ""
 }
 
 // sendSTARTTLS sends STARTTLS command and upgrades connection to TLS
@@ -555,91 +411,17 @@ func (c *ClientConn) sendSTARTTLS() error {
 	}
 
 	// Read server response (220 Ready to start TLS)
-	response, err := c.read()
-	if err != nil {
-		return fmt.Errorf("failed to read STARTTLS response: %w", err)
-	}
-	if response == "" {
-		return errors.New("STARTTLS failed: empty response")
-	}
-
-	code := c.parseResponseCode(response)
-	if code != protocol.CODE_READY {
-		return fmt.Errorf("STARTTLS failed: %s", response)
-	}
-
-	// Perform TLS handshake
-	// Determine server name for TLS SNI (Server Name Indication)
-	// Priority: 1) serverName (explicitly set by user via SetServerName), 2) serverHost (from DialSMTP), 3) connection address
-	// NOTE: We prefer serverHost over EHLO-extracted hostname to avoid certificate mismatch issues
-	// For servers with self-signed or mismatched certificates, use SetServerName() or SetTLSConfig() with InsecureSkipVerify
-	serverName := c.serverName
-	if serverName == "" {
-		// Prefer the server host from DialSMTP - this is usually what the certificate is valid for
-		if c.serverHost != "" {
-			serverName = c.serverHost
-		} else {
-			// Try to get hostname from connection's remote address
-			if addr := c.conn.RemoteAddr(); addr != nil {
-				// For TLS SNI, we need the hostname, not the IP
-				addrStr := addr.String()
-				if colonIdx := strings.LastIndex(addrStr, ":"); colonIdx > 0 {
-					hostPart := addrStr[:colonIdx]
-					// Check if it's an IP address
-					if net.ParseIP(hostPart) != nil {
-						// It's an IP - we can't use it for SNI
-						// Use hostname as fallback (but this won't work well for certificate verification)
-						serverName = c.hostname
-					} else {
-						// It's a hostname - use it for SNI
-						serverName = hostPart
-					}
-				}
-			}
-			if serverName == "" {
-				serverName = c.hostname
-			}
-		}
-	}
-
-	// Create TLS config with server name if not already set
-	tlsConfig := c.tlsConfig
-	if tlsConfig == nil {
-		// Use default TLS config if none provided
-		// For most servers, ServerName should be the host we connected to (serverHost)
-		tlsConfig = &tls.Config{
-			ServerName:         serverName,
-			InsecureSkipVerify: false,
-			MinVersion:         tls.VersionTLS12, // Require TLS 1.2 or higher
-		}
-	} else if tlsConfig.ServerName == "" {
-		// Clone config fields without copying mutex - create new config
-		// This avoids copying the sync.RWMutex which shouldn't be copied
-		tlsConfig = &tls.Config{
-			ServerName:               serverName,
-			InsecureSkipVerify:       tlsConfig.InsecureSkipVerify,
-			MinVersion:               tlsConfig.MinVersion,
-			MaxVersion:               tlsConfig.MaxVersion,
-			CipherSuites:             tlsConfig.CipherSuites,
-			PreferServerCipherSuites: tlsConfig.PreferServerCipherSuites,
-			ClientAuth:               tlsConfig.ClientAuth,
-			ClientCAs:                tlsConfig.ClientCAs,
-			RootCAs:                  tlsConfig.RootCAs,
-			Certificates:             tlsConfig.Certificates,
-			GetCertificate:           tlsConfig.GetCertificate,
-			GetClientCertificate:     tlsConfig.GetClientCertificate,
-		}
-		// Ensure MinVersion if not set
-		if tlsConfig.MinVersion == 0 {
-			tlsConfig.MinVersion = tls.VersionTLS12
-		}
+	if _, err := c.expectReply(string(protocol.COMMAND_STARTTLS), protocol.CODE_READY); err != nil {
+		return err
 	}
 
+	// Perform TLS handshake; the TLS policy decides whether the certificate is verified
+	tlsConfig := policyTLSConfig(c.tlsConfig, c.tlsServerName(), c.tlsPolicy)
 	tlsConn := tls.Client(c.conn, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
 		// Provide more helpful error message for certificate verification failures
-		if strings.Contains(err.Error(), "certificate") || strings.Contains(err.Error(), "x509") {
-			return fmt.Errorf("TLS handshake failed: %w (tip: for self-signed certificates, use SetTLSConfig() with InsecureSkipVerify: true)", err)
+		if c.tlsPolicy == TLS_POLICY_VERIFY && (strings.Contains(err.Error(), "certificate") || strings.Contains(err.Error(), "x509")) {
+			return fmt.Errorf("TLS handshake failed: %w (tip: for self-signed certificates, add the CA with SetTLSConfig() RootCAs or use TLS policy required)", err)
 		}
 		return fmt.Errorf("TLS handshake failed: %w", err)
 	}
@@ -652,226 +434,6 @@ func (c *ClientConn) sendSTARTTLS() error {
 	return nil
 }
 
-func (c *ClientConn) sendMailFrom() error {
-	from := c.mail.GetFrom()
-	if from == "" {
-		return errors.New("no FROM address specified")
-	}
-
-	// Format: MAIL FROM:<address>
-	mailCmd := fmt.Sprintf("%s FROM:<%s>\r\n", protocol.COMMAND_MAIL, from)
-	if err := c.write(mailCmd); err != nil {
-		return fmt.Errorf("failed to write MAIL FROM command: %w", err)
-	}
-
-	response, err := c.read()
-	if err != nil {
-		return fmt.Errorf("failed to read MAIL FROM response: %w", err)
-	}
-	if response == "" {
-		return errors.New("MAIL FROM failed: empty response (connection closed)")
-	}
-	if !c.isSuccessCode(response, protocol.CODE_ACKNOWLEDGE) {
-		return fmt.Errorf("MAIL FROM failed: %s", response)
-	}
-
-	c.state = protocol.STATE_RCPT_TO
-	return nil
-}
-
-func (c *ClientConn) sendRcptTo() error {
-	// Send RCPT TO for all "to" recipients
-	for _, to := range c.mail.GetTo() {
-		rcptCmd := fmt.Sprintf("%s TO:<%s>\r\n", protocol.COMMAND_RCPT, to)
-		if err := c.write(rcptCmd); err != nil {
-			return fmt.Errorf("failed to write RCPT TO for %s: %w", to, err)
-		}
-
-		response, err := c.read()
-		if err != nil {
-			return fmt.Errorf("failed to read RCPT TO response for %s: %w", to, err)
-		}
-		if response == "" {
-			return fmt.Errorf("RCPT TO failed for %s: empty response (connection closed)", to)
-		}
-		if !c.isSuccessCode(response, protocol.CODE_ACKNOWLEDGE) {
-			return fmt.Errorf("RCPT TO failed for %s: %s", to, response)
-		}
-	}
-
-	// Send RCPT TO for CC recipients (they also need RCPT TO)
-	for _, cc := range c.mail.GetCC() {
-		rcptCmd := fmt.Sprintf("%s TO:<%s>\r\n", protocol.COMMAND_RCPT, cc)
-		if err := c.write(rcptCmd); err != nil {
-			return fmt.Errorf("failed to write RCPT TO for CC %s: %w", cc, err)
-		}
-
-		response, err := c.read()
-		if err != nil {
-			return fmt.Errorf("failed to read RCPT TO response for CC %s: %w", cc, err)
-		}
-		if response == "" {
-			return fmt.Errorf("RCPT TO failed for CC %s: empty response (connection closed)", cc)
-		}
-		if !c.isSuccessCode(response, protocol.CODE_ACKNOWLEDGE) {
-			return fmt.Errorf("RCPT TO failed for CC %s: %s", cc, response)
-		}
-	}
-
-	// BCC recipients also need RCPT TO, but are not included in headers
-	for _, bcc := range c.mail.GetBCC() {
-		rcptCmd := fmt.Sprintf("%s TO:<%s>\r\n", protocol.COMMAND_RCPT, bcc)
-		if err := c.write(rcptCmd); err != nil {
-			return fmt.Errorf("failed to write RCPT TO for BCC %s: %w", bcc, err)
-		}
-
-		response, err := c.read()
-		if err != nil {
-			return fmt.Errorf("failed to read RCPT TO response for BCC %s: %w", bcc, err)
-		}
-		if response == "" {
-			return fmt.Errorf("RCPT TO failed for BCC %s: empty response (connection closed)", bcc)
-		}
-		if !c.isSuccessCode(response, protocol.CODE_ACKNOWLEDGE) {
-			return fmt.Errorf("RCPT TO failed for BCC %s: %s", bcc, response)
-		}
-	}
-
-	c.state = protocol.STATE_DATA
-	return nil
-}
-
-func (c *ClientConn) sendData() error {
-	// Send DATA command
-	dataCmd := fmt.Sprintf("%s\r\n", protocol.COMMAND_DATA)
-	if err := c.write(dataCmd); err != nil {
-		return fmt.Errorf("failed to write DATA command: %w", err)
-	}
-
-	// Read server response (354 Start mail input)
-	response, err := c.read()
-	if err != nil {
-		return fmt.Errorf("failed to read DATA response: %w", err)
-	}
-	if response == "" {
-		return errors.New("DATA command failed: empty response (connection closed)")
-	}
-	if !c.isSuccessCode(response, protocol.CODE_START_MAIL_INPUT) {
-		return fmt.Errorf("DATA command failed: %s", response)
-	}
-	return nil
-}
-
-func (c *ClientConn) sendEmailContent() error {
-	// Build email headers
-	headers := c.buildHeaders()
-
-	// Send headers
-	if err := c.write(headers); err != nil {
-		return fmt.Errorf("failed to write headers: %w", err)
-	}
-
-	// Send blank line to separate headers from body
-	if err := c.write("\r\n"); err != nil {
-		return fmt.Errorf("failed to write header-body separator: %w", err)
-	}
-
-	// Send body with SMTP transparency handling
-	body := c.mail.GetData()
-	if err := c.writeBody(body); err != nil {
-		return fmt.Errorf("failed to write body: %w", err)
-	}
-
-	// Send terminator (line containing only ".")
-	if err := c.write(".\r\n"); err != nil {
-		return fmt.Errorf("failed to write terminator: %w", err)
-	}
-	return nil
-}
-
-func (c *ClientConn) buildHeaders() string {
-	var builder strings.Builder
-
-	// From header
-	from := c.mail.GetFrom()
-	if from != "" {
-		builder.WriteString(fmt.Sprintf("From: <%s>\r\n", from))
-	}
-
-	// To header
-	toList := c.mail.GetTo()
-	if len(toList) > 0 {
-		builder.WriteString(fmt.Sprintf("To: <%s>\r\n", strings.Join(toList, ">, <")))
-	}
-
-	// CC header
-	ccList := c.mail.GetCC()
-	if len(ccList) > 0 {
-		builder.WriteString(fmt.Sprintf("Cc: <%s>\r\n", strings.Join(ccList, ">, <")))
-	}
-
-	// Subject header
-	subject := c.mail.GetSubject()
-	if subject != "" {
-		builder.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	}
-
-	// Other headers from flags
-	flags := c.mail.GetFlags()
-	for _, flag := range flags {
-		// Format custom headers from flags if needed
-		if flag.GetKey() != "" && flag.GetValue() != "" {
-			builder.WriteString(fmt.Sprintf("%s: %s\r\n", flag.GetKey(), flag.GetValue()))
-		}
-	}
-
-	return builder.String()
-}
-
-func (c *ClientConn) writeBody(body string) error {
-	if body == "" {
-		return nil
-	}
-
-	// Handle SMTP transparency: lines starting with "." need to have "." prepended
-	lines := strings.Split(body, "\n")
-	lastIndex := len(lines) - 1
-	for i, line := range lines {
-		// Remove trailing \r if present (handle both \r\n and \n)
-		line = strings.TrimRight(line, "\r")
-
-		// Skip empty lines at the end (but not if it's the only line)
-		if line == "" && i == lastIndex && len(lines) > 1 {
-			continue
-		}
-
-		// If line starts with ".", prepend another "." (SMTP transparency)
-		if strings.HasPrefix(line, ".") {
-			line = "." + line
-		}
-
-		// Send line with CRLF
-		if err := c.write(line + "\r\n"); err != nil {
-			return fmt.Errorf("failed to write body line %d: %w", i, err)
-		}
-	}
-	return nil
-}
-
-func (c *ClientConn) sendQuit() {
-	quitCmd := fmt.Sprintf("%s\r\n", protocol.COMMAND_QUIT)
-	// Ignore write errors as connection will close anyway
-	c.write(quitCmd)
-
-	// Read server response (221 Bye)
-	// Ignore read errors as connection will close anyway
-	response, _ := c.read()
-	if response != "" && !c.isSuccessCode(response, protocol.CODE_QUIT) {
-		// Log but don't return error - connection will close anyway
-		fmt.Fprintf(os.Stderr, "QUIT response unexpected: %s\n", response)
-	}
-}
-
 // Close closes the client connection
 func (c *ClientConn) Close() error {
 	if c.conn != nil {
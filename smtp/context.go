@@ -0,0 +1,194 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+// Timeouts are the client deadlines per session phase (RFC 5321 section 4.5.3.2)
+// A zero timeout disables the deadline for that phase
+type Timeouts struct {
+	Connect  time.Duration // TCP connect and the TLS handshake of SMTPS
+	Greeting time.Duration // Waiting for the 220 greeting (RFC: 5 minutes)
+	Command  time.Duration // Each command and its reply, and each write of message data (RFC: 5 minutes)
+	DataEnd  time.Duration // Reply after <CRLF>.<CRLF> (RFC: 10 minutes)
+}
+
+// TimeoutsFromConfig returns the SMTP_CLIENT_*_TIMEOUT settings
+func TimeoutsFromConfig(cfg *config.Config) Timeouts {
+	return Timeouts{
+		Connect:  cfg.ClientConnectTimeout,
+		Greeting: cfg.ClientGreetingTimeout,
+		Command:  cfg.ClientCommandTimeout,
+		DataEnd:  cfg.ClientDataTimeout,
+	}
+}
+
+// SetTimeouts replaces the configured phase timeouts of this connection
+func (c *ClientConn) SetTimeouts(timeouts Timeouts) {
+	c.timeouts = timeouts
+}
+
+// aLongTimeAgo is a deadline in the past: it makes blocked reads and writes return at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+// DialSMTPContext is DialSMTP with a context that aborts the connect
+// The connection goes through DefaultDialer, so through the outbound proxy if one is set, and
+// leaves from the SMTP_SOURCE_ADDRESSES address for host
+func DialSMTPContext(ctx context.Context, host string, port ...uint16) (net.Conn, error) {
+	return dialSMTP(ctx, sourcesFromConfig().Select(ctx, "", host), host, port...)
+}
+
+// dialSMTP connects to the submission port of host from source (nil = default route)
+func dialSMTP(ctx context.Context, source *Source, host string, port ...uint16) (net.Conn, error) {
+	cfg := config.GetConfig()
+	smtpPort := cfg.ClientPort
+	if len(port) > 0 && port[0] != 0 {
+		smtpPort = port[0]
+	}
+	if smtpPort == 0 {
+		smtpPort = 587 // Submission with STARTTLS
+	}
+	address := net.JoinHostPort(host, fmt.Sprintf("%d", smtpPort))
+
+	if cfg.ClientConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ClientConnectTimeout)
+		defer cancel()
+	}
+	conn, err := SourceDialer(source).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server %s: %w", address, err)
+	}
+	return conn, nil
+}
+
+// DialSMTPSContext is DialSMTPS with a context that aborts the connect and the TLS handshake
+// The connect timeout covers both
+func DialSMTPSContext(ctx context.Context, host string, port ...uint16) (net.Conn, error) {
+	return dialSMTPS(ctx, sourcesFromConfig().Select(ctx, "", host), host, port...)
+}
+
+// dialSMTPS connects to the SMTPS port of host from source (nil = default route) and handshakes
+func dialSMTPS(ctx context.Context, source *Source, host string, port ...uint16) (net.Conn, error) {
+	cfg := config.GetConfig()
+	var smtpPort uint16 = 465 // SMTPS - secure submission
+	if len(port) > 0 && port[0] != 0 {
+		smtpPort = port[0]
+	}
+	address := net.JoinHostPort(host, fmt.Sprintf("%d", smtpPort))
+
+	if cfg.ClientConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ClientConnectTimeout)
+		defer cancel()
+	}
+	conn, err := SourceDialer(source).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server %s: %w", address, err)
+	}
+
+	// The TLS policy decides whether the certificate is verified; an IP is checked against
+	// the IP addresses in the certificate
+	tlsConn := tls.Client(conn, policyTLSConfig(nil, host, tlsPolicyFromConfig(cfg)))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// DialContext is Dial with a context that aborts the connect and the wait for the greeting
+// The SMTP_SOURCE_ADDRESSES rule for host picks the local address and the EHLO name
+func DialContext(ctx context.Context, host string, port ...uint16) (*ClientConn, error) {
+	return DialSourceContext(ctx, sourcesFromConfig().Select(ctx, "", host), host, port...)
+}
+
+// DialTLSContext is DialTLS with a context that aborts the connect, handshake and greeting
+func DialTLSContext(ctx context.Context, host string, port ...uint16) (*ClientConn, error) {
+	source := sourcesFromConfig().Select(ctx, "", host)
+	conn, err := dialSMTPS(ctx, source, host, port...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClientContext(ctx, conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.useSource(source)
+	return client, nil
+}
+
+// NewClientContext is NewClient bound to a context for the lifetime of the connection:
+// once ctx is cancelled every command in progress and every later one fails with ctx.Err()
+// Use it when the whole session belongs to one job, e.g. one delivery attempt
+func NewClientContext(ctx context.Context, conn net.Conn, host string) (*ClientConn, error) {
+	client := newClientConn(conn, mail.Mail{})
+	client.setServerHost(host)
+	client.ctx = ctx
+	// Not stopped on success: the binding lasts until ctx ends or the connection is closed
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	if err := client.readGreeting(); err != nil {
+		stop()
+		return nil, err
+	}
+	return client, nil
+}
+
+// SendContext is Send with a context: cancelling it aborts the transaction immediately
+// The connection is unusable after a cancellation and should be closed
+func (c *ClientConn) SendContext(ctx context.Context, msg mail.Mail) (*SendResult, error) {
+	defer c.watch(ctx)()
+	return c.Send(msg)
+}
+
+// SendEnvelopeContext is SendEnvelope with a context (see SendContext)
+func (c *ClientConn) SendEnvelopeContext(ctx context.Context, from string, recipients []string, msg mail.Mail) (*SendResult, error) {
+	defer c.watch(ctx)()
+	return c.SendEnvelope(from, recipients, msg)
+}
+
+// watch binds ctx to the connection until the returned function is called
+// On cancellation the deadline moves to the past, which unblocks any read or write in progress
+func (c *ClientConn) watch(ctx context.Context) func() {
+	c.callCtx = ctx
+	conn := c.conn // A TLS connection passes deadlines on to the connection below
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	return func() {
+		stop()
+		c.callCtx = nil
+	}
+}
+
+// deadline arms the deadline for the next read or write and reports a cancelled context
+// The context is checked after setting the deadline, so a cancellation racing with this call
+// is never lost: either it is seen here, or its deadline in the past replaces ours
+func (c *ClientConn) deadline(set func(time.Time) error, timeout time.Duration) error {
+	if timeout > 0 {
+		set(time.Now().Add(timeout))
+	} else {
+		set(time.Time{})
+	}
+	return c.contextErr()
+}
+
+// contextErr returns the error of the connection's or the current call's context, if one ended
+func (c *ClientConn) contextErr() error {
+	for _, ctx := range []context.Context{c.ctx, c.callCtx} {
+		if ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
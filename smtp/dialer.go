@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/proxy"
+)
+
+// Dialer opens the network connections of outgoing SMTP sessions
+// *net.Dialer and the proxies of package proxy (SOCKS5, HTTP CONNECT) satisfy it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+var (
+	defaultDialerMu sync.RWMutex
+	defaultDialer   Dialer
+)
+
+// SetDefaultDialer routes the connections of Dial*, DialSMTP*, Pool, and of delivery without
+// their own Dialer through d; nil restores the SMTP_OUTBOUND_PROXY setting
+func SetDefaultDialer(d Dialer) {
+	defaultDialerMu.Lock()
+	defaultDialer = d
+	defaultDialerMu.Unlock()
+}
+
+// DefaultDialer returns the dialer for outgoing connections: the one from SetDefaultDialer,
+// else the proxy from SMTP_OUTBOUND_PROXY, else a direct connection
+func DefaultDialer() Dialer {
+	defaultDialerMu.RLock()
+	d := defaultDialer
+	defaultDialerMu.RUnlock()
+	if d != nil {
+		return d
+	}
+	return dialerFromConfig(config.GetConfig(), nil)
+}
+
+// SourceDialer returns DefaultDialer with its direct connections (to the server, or to the
+// SMTP_OUTBOUND_PROXY) leaving from source; a nil source returns DefaultDialer itself
+// A dialer set with SetDefaultDialer is returned unchanged, binding is then up to it
+func SourceDialer(source *Source) Dialer {
+	defaultDialerMu.RLock()
+	d := defaultDialer
+	defaultDialerMu.RUnlock()
+	if d != nil {
+		return d
+	}
+	if source == nil {
+		return dialerFromConfig(config.GetConfig(), nil)
+	}
+	return dialerFromConfig(config.GetConfig(), source)
+}
+
+// dialerFromConfig returns the SMTP_OUTBOUND_PROXY dialer, reached through direct
+// (a plain net.Dialer if nil)
+// An invalid proxy fails every connection instead of silently going around the proxy
+func dialerFromConfig(cfg *config.Config, direct Dialer) Dialer {
+	if cfg.OutboundProxy == "" {
+		if direct == nil {
+			return &net.Dialer{}
+		}
+		return direct
+	}
+	dialer, err := proxy.FromURL(cfg.OutboundProxy, direct)
+	if err != nil {
+		return failingDialer{fmt.Errorf("SMTP_OUTBOUND_PROXY: %w", err)}
+	}
+	return dialer
+}
+
+// failingDialer refuses every connection with the same error
+type failingDialer struct {
+	err error
+}
+
+func (d failingDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, d.err
+}
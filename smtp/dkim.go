@@ -0,0 +1,172 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/dkim"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+// DKIM_VERIFY_TIMEOUT bounds the key lookups for one received message
+const DKIM_VERIFY_TIMEOUT = 30 * time.Second
+
+// DKIMFromConfig returns the signer for SMTP_DKIM_DOMAIN, SMTP_DKIM_SELECTOR and SMTP_DKIM_KEY_FILE,
+// or nil when no domain is set; an unusable key is reported and signing stays off
+func DKIMFromConfig(cfg *config.Config) *dkim.Signer {
+	if cfg.DKIMDomain == "" {
+		return nil
+	}
+	if cfg.DKIMSelector == "" {
+		fmt.Fprintf(os.Stderr, "CLIENT: SMTP_DKIM_SELECTOR is not set, DKIM signing disabled\n")
+		return nil
+	}
+	key, err := dkim.LoadKey(cfg.DKIMKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CLIENT: DKIM signing disabled: %v\n", err)
+		return nil
+	}
+	signer := dkim.NewSigner(cfg.DKIMDomain, cfg.DKIMSelector, key)
+	signer.Headers = cfg.DKIMHeaders
+	signer.Oversign = cfg.DKIMOversign
+	if cfg.DKIMCanonicalization != "" {
+		header, body, err := dkim.ParseCanonicalization(cfg.DKIMCanonicalization)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "CLIENT: Invalid SMTP_DKIM_CANONICALIZATION, using relaxed/relaxed: %v\n", err)
+		} else {
+			signer.HeaderCanonicalization = header
+			signer.BodyCanonicalization = body
+		}
+	}
+	return signer
+}
+
+var (
+	configDKIMOnce sync.Once
+	configDKIM     *dkim.Signer
+)
+
+// dkimFromConfig returns the shared signer of the configuration, so the key is read once
+func dkimFromConfig() *dkim.Signer {
+	configDKIMOnce.Do(func() {
+		configDKIM = DKIMFromConfig(config.GetConfig())
+	})
+	return configDKIM
+}
+
+// SetDKIM sets the signer for the messages sent on this connection (default from SMTP_DKIM_*,
+// nil = do not sign); only messages whose From domain is aligned with the signer are signed
+func (c *ClientConn) SetDKIM(signer *dkim.Signer) {
+	c.dkim = signer
+}
+
+// sign adds the DKIM-Signature to a message whose From domain is the signing domain or one of
+// its subdomains; mail of other domains (e.g. relayed for third parties) is sent unsigned
+// A signing failure is returned, so the message is not sent without the signature it should have
+func (c *ClientConn) sign(content string) (string, error) {
+	if c.dkim == nil {
+		return content, nil
+	}
+	domain := fromDomain(content)
+	if !c.dkim.Aligned(domain) {
+		fmt.Fprintf(os.Stderr, "CLIENT: Not DKIM signing mail from %q (signing domain %s)\n", domain, c.dkim.Domain)
+		return content, nil
+	}
+	signed, err := c.dkim.Sign([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// fromDomain returns the domain of the first author in the From header field of a message
+func fromDomain(content string) string {
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(content))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	addresses, _ := mail.ParseAddressList(header.Get("From"))
+	if len(addresses) == 0 {
+		return ""
+	}
+	address := addresses[0].GetAddress()
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// verifyDKIM checks the DKIM signatures of a received message (SMTP_DKIM_VERIFY)
+func (s *ServerConn) verifyDKIM(data string) []dkim.Result {
+	var resolver dkim.Resolver
+	if s.handlers != nil {
+		resolver = s.handlers.DKIMResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DKIM_VERIFY_TIMEOUT)
+	defer cancel()
+	results := dkim.Verify(ctx, []byte(data), resolver)
+	for _, result := range results {
+		fmt.Printf("SERVER: DKIM %s\n", result)
+	}
+	return results
+}
+
+// authenticationResults builds the Authentication-Results header field (RFC 8601) with
+// ServerDomain as authserv-id; a message without signatures gets dkim=none
+func (s *ServerConn) authenticationResults(results []dkim.Result) string {
+	methods := make([]string, 0, len(results))
+	for _, result := range results {
+		methods = append(methods, result.String())
+	}
+	if len(methods) == 0 {
+		methods = append(methods, "dkim=none")
+	}
+	return mail.FoldHeader("Authentication-Results", s.config.ServerDomain+"; "+strings.Join(methods, "; "))
+}
+
+// removeAuthenticationResults drops the Authentication-Results fields of a message that claim
+// to come from authservID, so a sender cannot forge our verdict (RFC 8601 section 5)
+func removeAuthenticationResults(data string, authservID string) string {
+	headerEnd := strings.Index(data, "\r\n\r\n")
+	if headerEnd < 0 {
+		headerEnd = len(data)
+	} else {
+		headerEnd += 2
+	}
+	// Group the lines into fields, continuation lines included
+	fields := make([]string, 0)
+	for _, line := range strings.SplitAfter(data[:headerEnd], "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	var builder strings.Builder
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") &&
+			strings.EqualFold(authservIDOf(value), authservID) {
+			continue
+		}
+		builder.WriteString(field)
+	}
+	return builder.String() + data[headerEnd:]
+}
+
+// authservIDOf returns the authserv-id at the start of an Authentication-Results value
+func authservIDOf(value string) string {
+	id, _, _ := strings.Cut(value, ";")
+	fields := strings.Fields(strings.TrimSpace(id))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
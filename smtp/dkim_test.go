@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/dkim"
+)
+
+func TestRemoveAuthenticationResults(t *testing.T) {
+	data := "Authentication-Results: mx.example.com;\r\n dkim=pass header.d=forged.example\r\n" +
+		"Authentication-Results: other.example.net; dkim=fail\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; in the body\r\n"
+	got := removeAuthenticationResults(data, "mx.example.com")
+	want := "Authentication-Results: other.example.net; dkim=fail\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.com; in the body\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDataAuthenticationResults(t *testing.T) {
+	cfg := testConfig(true)
+	cfg.DKIMVerify = true
+	script := envelope + "Authentication-Results: mx.example.com; dkim=pass\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+	_, received := runSession(t, cfg, nil, script)
+	if len(received) != 1 {
+		t.Fatalf("got %d messages, want 1", len(received))
+	}
+	data := received[0].GetData()
+	if strings.Count(data, "Authentication-Results:") != 1 || !strings.Contains(data, "Authentication-Results: mx.example.com; dkim=none\r\n") {
+		t.Errorf("unexpected header in %q", data)
+	}
+}
+
+func TestSignAlignedFrom(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ClientConn{dkim: dkim.NewSigner("example.com", "mail", key)}
+	tests := []struct {
+		from   string
+		signed bool
+	}{
+		{"Alice <alice@example.com>", true},
+		{"alice@News.Example.COM", true},
+		{"alice@example.org", false},
+		{"alice@notexample.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		content, err := c.sign("From: " + test.from + "\r\nSubject: hello\r\n\r\nbody\r\n")
+		if err != nil {
+			t.Errorf("%q: %v", test.from, err)
+			continue
+		}
+		if signed := strings.HasPrefix(content, "DKIM-Signature:"); signed != test.signed {
+			t.Errorf("%q: signed = %v, want %v", test.from, signed, test.signed)
+		}
+	}
+}
+
+func TestSignFailureAbortsSend(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	commands := scriptedServer(server, []string{pipeliningEHLO})
+	conn, err := NewClient(client, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a selector the signer cannot sign
+	conn.SetDKIM(dkim.NewSigner("example.org", "", key))
+	msg := pipeliningMail()
+	msg.SetData("From: alice@example.org\r\nSubject: test\r\n\r\nbody\r\n")
+	_, err = conn.SendEnvelope("alice@example.org", []string{"bob@example.com"}, msg)
+	conn.Close()
+	if err == nil {
+		t.Fatal("message was sent although signing failed")
+	}
+	if got := <-commands; len(got) != 1 {
+		t.Errorf("commands sent after the signing failure: %q", got)
+	}
+}
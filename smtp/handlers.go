@@ -1,27 +1,54 @@
 package smtp
 
-import "github.com/ImBubbles/MySMTP/mail"
+import (
+	"github.com/ImBubbles/MySMTP/dkim"
+	"github.com/ImBubbles/MySMTP/mail"
+)
 
 // MailHandler is a function that processes a completed email
+// m.Parse() gives its text and HTML bodies and attachments, m.GetDKIMResults() the DKIM verdicts
 // Return an error to reject the email, or nil to accept it
 type MailHandler func(m *mail.Mail) error
 
+// RecipientHandler is a function that processes a completed email for one recipient
+// It is used in LMTP mode, where every recipient gets its own reply after DATA
+// Return an error to reject the email for this recipient, or nil to accept it
+// Return a *protocol.CommandError to choose the reply code (e.g. 452 4.2.2 for a full mailbox)
+type RecipientHandler func(m *mail.Mail, recipient string) error
+
 // EmailExistsChecker is a function that checks if an email address exists
 // Return true if the email exists, false otherwise
 // Default implementation returns false
 type EmailExistsChecker func(email string) bool
 
+// Authenticator checks the credentials a client sent with AUTH PLAIN or AUTH LOGIN
+// Return true to accept them; an authenticated client may relay
+type Authenticator func(username string, password string) bool
+
+// RelayHandler takes a completed email for the recipients outside the local domains (relay mode)
+// It runs before MailHandler, which then gets a copy with only the local recipients
+// Return an error to reject the email; a *protocol.CommandError chooses the reply code
+type RelayHandler func(m *mail.Mail, recipients []string) error
+
 // Handlers holds all the callback handlers for the SMTP server
 type Handlers struct {
 	MailHandler        MailHandler
+	RecipientHandler   RecipientHandler // LMTP only; if nil, MailHandler's result applies to all recipients
 	EmailExistsChecker EmailExistsChecker
+	Authenticator      Authenticator // AUTH in relay mode; if nil, SMTP_RELAY_USERNAME/PASSWORD are checked
+	RelayHandler       RelayHandler  // Relay mode; if nil, MailHandler gets every recipient
+	DKIMResolver       dkim.Resolver // Key lookups for DKIM verification; if nil, net.DefaultResolver
 }
 
 // NewHandlers creates a new Handlers instance with default implementations
 func NewHandlers() *Handlers {
 	return &Handlers{
 		MailHandler:        nil, // No handler by default (accept all)
+		RecipientHandler:   nil, // LMTP falls back to MailHandler
 		EmailExistsChecker: defaultEmailExistsChecker,
+		Authenticator:      nil, // Credentials from the config
+		RelayHandler:       nil, // Relayed mail goes to MailHandler
+		DKIMResolver:       nil, // System resolver
 	}
 }
 
@@ -18,6 +18,8 @@
 //	handlers.MailHandler = func(m *mail.Mail) error {
 //		// Process the email
 //		fmt.Printf("Received email from %s\n", m.GetFrom())
+//		// Client address, HELO and login (overridden by XCLIENT/XFORWARD from trusted proxies)
+//		fmt.Printf("Client: %s\n", m.GetSession().ClientAddr)
 //		return nil // Accept the email
 //	}
 //
@@ -36,5 +38,36 @@
 //		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 //	}
 //	smtp.NewServerConnWithHandlers(conn, config, handlers, tlsConfig)
+//
+// Example client usage (several messages on one connection):
+//
+//	client, err := smtp.Dial("mail.example.com", 587)
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	if err := client.Hello("client.example.com"); err != nil {
+//		return err
+//	}
+//	if ok, _ := client.Extension("STARTTLS"); ok {
+//		if err := client.StartTLS(nil); err != nil {
+//			return err
+//		}
+//	}
+//	// PlainAuth, LoginAuth, CRAMMD5Auth, XOAuth2Auth, or CredentialsAuth to negotiate
+//	if err := client.Auth(smtp.PlainAuth("", "user@example.com", password)); err != nil {
+//		return err
+//	}
+//	for _, m := range messages {
+//		result, err := client.Send(m)
+//		if err != nil {
+//			return err
+//		}
+//		// Rejected recipients do not stop delivery to the others
+//		for _, rcpt := range result.Rejected() {
+//			fmt.Printf("Bounced: %s %s %s\n", rcpt.Recipient, rcpt.Enhanced, rcpt.Message)
+//		}
+//	}
+//	return client.Quit()
 package smtp
 
@@ -0,0 +1,109 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// ESMTP parameters of a relayed message
+// The server stores the MAIL FROM and RCPT TO parameters it received as flags of the mail;
+// SendEnvelope passes them on as far as the next server advertises their extensions
+
+// envelopeParams are the ESMTP parameters of one mail transaction
+type envelopeParams struct {
+	mail []string            // MAIL FROM parameters
+	rcpt map[string][]string // RCPT TO parameters per recipient
+	dsn  bool                // The server supports DSN and got the notification requests
+}
+
+// envelopeParams builds the parameters for a message of size bytes
+// A message that needs SMTPUTF8 or 8BITMIME is refused with a permanent error when the server
+// lacks the extension; it is never downgraded (RFC 6531 section 3.2, RFC 6152 section 3)
+func (c *ClientConn) envelopeParams(from string, recipients []string, msg mail.Mail, size int) (*envelopeParams, error) {
+	params := &envelopeParams{rcpt: make(map[string][]string)}
+
+	// RFC 1870: our own size, not the one the message was announced with
+	if ok, _ := c.Extension("SIZE"); ok {
+		params.mail = append(params.mail, fmt.Sprintf("%s=%d", protocol.FLAG_SIZE, size))
+	}
+
+	if body, ok := msg.GetFlag(string(protocol.FLAG_BODY)); ok {
+		body = strings.ToUpper(body)
+		if ok, _ := c.Extension("8BITMIME"); ok {
+			params.mail = append(params.mail, fmt.Sprintf("%s=%s", protocol.FLAG_BODY, body))
+		} else if protocol.SMTPBody(body) == protocol.BODY_8BITMIME {
+			return nil, refused("5.6.3", "8-bit message cannot be sent: the server does not support 8BITMIME")
+		}
+	}
+
+	_, utf8 := msg.GetFlag(string(protocol.FLAG_SMTPUTF8))
+	utf8Envelope := !isASCII(from)
+	for _, rcpt := range recipients {
+		utf8Envelope = utf8Envelope || !isASCII(rcpt)
+	}
+	if utf8 || utf8Envelope {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			if utf8Envelope {
+				return nil, refused("5.6.7", "Non-ASCII addresses cannot be sent: the server does not support SMTPUTF8")
+			}
+			return nil, refused("5.6.9", "UTF-8 message cannot be sent: the server does not support SMTPUTF8")
+		}
+		params.mail = append(params.mail, string(protocol.FLAG_SMTPUTF8))
+	}
+
+	// RFC 3461: a server with DSN takes over the notifications, one without gets none of the parameters
+	if ok, _ := c.Extension("DSN"); ok {
+		params.dsn = true
+		if ret, ok := msg.GetFlag(string(protocol.FLAG_RET)); ok {
+			params.mail = append(params.mail, fmt.Sprintf("%s=%s", protocol.FLAG_RET, strings.ToUpper(ret)))
+		}
+		if envID, ok := msg.GetFlag(string(protocol.FLAG_ENVID)); ok {
+			params.mail = append(params.mail, fmt.Sprintf("%s=%s", protocol.FLAG_ENVID, protocol.EncodeXtext(envID)))
+		}
+		for _, rcpt := range recipients {
+			if notify, ok := msg.GetRcptFlag(rcpt, string(protocol.FLAG_NOTIFY)); ok {
+				params.rcpt[rcpt] = append(params.rcpt[rcpt], fmt.Sprintf("%s=%s", protocol.FLAG_NOTIFY, strings.ToUpper(notify)))
+			}
+			if orcpt, ok := msg.GetRcptFlag(rcpt, string(protocol.FLAG_ORCPT)); ok {
+				params.rcpt[rcpt] = append(params.rcpt[rcpt], fmt.Sprintf("%s=%s", protocol.FLAG_ORCPT, protocol.EncodeXtext(orcpt)))
+			}
+		}
+	}
+	return params, nil
+}
+
+// refused is the permanent error for a message that cannot be sent to this server
+func refused(enhanced, message string) error {
+	return &ReplyError{Reply: &Reply{Code: protocol.CODE_FAILURE, Enhanced: enhanced, Lines: []string{message}}}
+}
+
+// isASCII reports whether s has only 7-bit characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// mailCommand returns the MAIL FROM command line (without CRLF)
+func mailCommand(from string, params []string) string {
+	command := fmt.Sprintf("%s FROM:<%s>", protocol.COMMAND_MAIL, from)
+	if len(params) > 0 {
+		command += " " + strings.Join(params, " ")
+	}
+	return command
+}
+
+// rcptCommand returns the RCPT TO command line (without CRLF)
+func rcptCommand(to string, params []string) string {
+	command := fmt.Sprintf("%s TO:<%s>", protocol.COMMAND_RCPT, to)
+	if len(params) > 0 {
+		command += " " + strings.Join(params, " ")
+	}
+	return command
+}
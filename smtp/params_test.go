@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// relayedMail is a message with the parameters the server stores for MAIL FROM and RCPT TO
+func relayedMail() mail.Mail {
+	msg := pipeliningMail()
+	for _, flag := range [][2]string{{"BODY", "8BITMIME"}, {"RET", "HDRS"}, {"ENVID", "id+1"}} {
+		msg.AppendFlag(mail.FromFlag(*mail.NewFlag(flag[0], flag[1])))
+	}
+	msg.AppendRcptFlag("bob@example.com", mail.FromFlag(*mail.NewFlag("NOTIFY", "NEVER")))
+	msg.AppendRcptFlag("bob@example.com", mail.FromFlag(*mail.NewFlag("ORCPT", "rfc822;bob@example.com")))
+	return msg
+}
+
+func TestEnvelopeParams(t *testing.T) {
+	relayed := relayedMail()
+	size := len(relayed.Render())
+	tests := []struct {
+		name string
+		ehlo string
+		mail string
+		rcpt string
+		dsn  bool
+	}{
+		{
+			"all extensions",
+			"250-mx.example.com\r\n250-SIZE 1000000\r\n250-8BITMIME\r\n250 DSN\r\n",
+			fmt.Sprintf("MAIL FROM:<alice@example.org> SIZE=%d BODY=8BITMIME RET=HDRS ENVID=id+2B1", size),
+			"RCPT TO:<bob@example.com> NOTIFY=NEVER ORCPT=rfc822;bob@example.com",
+			true,
+		},
+		{
+			"pipelined without DSN",
+			"250-mx.example.com\r\n250-PIPELINING\r\n250 8BITMIME\r\n",
+			"MAIL FROM:<alice@example.org> BODY=8BITMIME",
+			"RCPT TO:<bob@example.com>",
+			false,
+		},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		commands := scriptedServer(server, []string{test.ehlo, "250 OK\r\n", "250 OK\r\n", "354 Go ahead\r\n", "250 OK\r\n"})
+		conn, err := NewClient(client, "mx.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := conn.SendEnvelope("alice@example.org", []string{"bob@example.com"}, relayedMail())
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if result.DSN != test.dsn {
+			t.Errorf("%s: DSN = %v, want %v", test.name, result.DSN, test.dsn)
+		}
+		got := <-commands
+		if len(got) < 3 || got[1] != test.mail || got[2] != test.rcpt {
+			t.Errorf("%s: got commands %q", test.name, got)
+		}
+	}
+}
+
+func TestEnvelopeParamsRefused(t *testing.T) {
+	utf8Mail := pipeliningMail()
+	utf8Mail.AppendFlag(mail.FromFlag(*mail.NewFlag("SMTPUTF8", "")))
+	tests := []struct {
+		name     string
+		from     string
+		msg      mail.Mail
+		enhanced string
+	}{
+		{"UTF-8 envelope", "jürgen@example.org", pipeliningMail(), "5.6.7"},
+		{"SMTPUTF8 message", "alice@example.org", utf8Mail, "5.6.9"},
+		{"8-bit message", "alice@example.org", relayedMail(), "5.6.3"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		commands := scriptedServer(server, []string{pipeliningEHLO})
+		conn, err := NewClient(client, "mx.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.SendEnvelope(test.from, []string{"bob@example.com"}, test.msg)
+		conn.Close()
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Reply.Code != protocol.CODE_FAILURE || replyErr.Reply.Enhanced != test.enhanced {
+			t.Errorf("%s: got error %v, want a permanent %s", test.name, err, test.enhanced)
+		}
+		if got := <-commands; len(got) != 1 {
+			t.Errorf("%s: commands sent to a server without the extension: %q", test.name, got)
+		}
+	}
+}
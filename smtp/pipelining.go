@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// Command pipelining (RFC 2920)
+// MAIL FROM, every RCPT TO and DATA are written at once and the replies are read afterwards,
+// so a message costs one round trip for the envelope instead of one per command
+
+// SetPipelining enables or disables pipelining (enabled by default when the server offers it)
+func (c *ClientConn) SetPipelining(enabled bool) {
+	c.noPipelining = !enabled
+}
+
+// canPipeline reports whether the envelope may be sent as one batch
+func (c *ClientConn) canPipeline() bool {
+	if c.noPipelining {
+		return false
+	}
+	ok, _ := c.Extension("PIPELINING")
+	return ok
+}
+
+// envelopePipelined sends MAIL FROM, RCPT TO for every recipient and DATA in one write,
+// then reads one reply per command in order
+func (c *ClientConn) envelopePipelined(from string, recipients []string, params *envelopeParams, result *SendResult) (io.WriteCloser, error) {
+	// DATA must be the last command of the group (RFC 2920 section 3.1)
+	var batch strings.Builder
+	batch.WriteString(mailCommand(from, params.mail) + "\r\n")
+	for _, rcpt := range recipients {
+		batch.WriteString(rcptCommand(rcpt, params.rcpt[rcpt]) + "\r\n")
+	}
+	batch.WriteString(fmt.Sprintf("%s\r\n", protocol.COMMAND_DATA))
+	if err := c.write(batch.String()); err != nil {
+		return nil, fmt.Errorf("failed to write pipelined commands: %w", err)
+	}
+	c.recipients = nil
+
+	// Every command gets a reply, even the ones after a failure
+	mailReply, err := c.readReply()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MAIL FROM response: %w", err)
+	}
+	mailAccepted := mailReply.Code == protocol.CODE_ACKNOWLEDGE
+
+	for _, rcpt := range recipients {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RCPT TO response for %s: %w", rcpt, err)
+		}
+		// After a rejected MAIL FROM the RCPT replies (usually 503) say nothing about the
+		// recipients; the MAIL FROM reply decides for all of them
+		if !mailAccepted {
+			continue
+		}
+		result.Recipients = append(result.Recipients, newRecipientResult(rcpt, reply))
+		if reply.Code == protocol.CODE_ACKNOWLEDGE {
+			c.recipients = append(c.recipients, rcpt)
+		}
+	}
+
+	dataReply, err := c.readReply()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DATA response: %w", err)
+	}
+	dataAccepted := dataReply.Code == protocol.CODE_START_MAIL_INPUT
+
+	var failure error
+	switch {
+	case !mailAccepted:
+		failure = &ReplyError{Command: string(protocol.COMMAND_MAIL_FROM), Reply: mailReply}
+	case len(c.recipients) == 0:
+		failure = fmt.Errorf("RCPT TO failed: no recipient accepted (%s)", joinResults(result.Rejected()))
+	case !dataAccepted:
+		failure = &ReplyError{Command: string(protocol.COMMAND_DATA), Reply: dataReply}
+	}
+	if failure == nil {
+		c.state = protocol.STATE_DATA
+		return c.newDataWriter(), nil
+	}
+
+	if dataAccepted {
+		// The server wants a message although the transaction failed - send an empty one
+		// and let it reject that (RFC 2920 section 3.1)
+		if err := c.write(".\r\n"); err != nil {
+			return nil, fmt.Errorf("failed to abort DATA: %w", err)
+		}
+		c.readReply()
+	}
+	c.recipients = nil
+	c.Reset()
+	return nil, failure
+}
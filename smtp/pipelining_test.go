@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// scriptedServer answers the commands of one client with the given replies, in order
+// After a 354 reply the message is read up to <CRLF>.<CRLF> before the next reply is sent
+// It returns the commands it received
+func scriptedServer(conn net.Conn, replies []string) <-chan []string {
+	commands := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		received := make([]string, 0)
+		defer func() { commands <- received }()
+		reader := bufio.NewReader(conn)
+		if _, err := conn.Write([]byte("220 mx.example.com ESMTP\r\n")); err != nil {
+			return
+		}
+		message := false
+		for _, reply := range replies {
+			if message {
+				// The reply to the message itself
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+				}
+			} else {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				received = append(received, strings.TrimRight(line, "\r\n"))
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+			message = strings.HasPrefix(reply, "354")
+		}
+	}()
+	return commands
+}
+
+const pipeliningEHLO = "250-mx.example.com\r\n250 PIPELINING\r\n"
+
+func pipeliningMail() mail.Mail {
+	msg := mail.Mail{}
+	msg.SetFrom("alice@example.org")
+	msg.SetData("Subject: test\r\n\r\nbody\r\n")
+	msg.SetRaw(true)
+	return msg
+}
+
+func TestPipelinedEnvelope(t *testing.T) {
+	client, server := net.Pipe()
+	commands := scriptedServer(server, []string{
+		pipeliningEHLO,
+		"250 2.1.0 OK\r\n",
+		"250 2.1.5 OK\r\n",
+		"550 5.1.1 No such user\r\n",
+		"354 Go ahead\r\n",
+		"250 2.0.0 Queued as ABC123\r\n",
+	})
+	conn, err := NewClient(client, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := conn.SendEnvelope("alice@example.org", []string{"bob@example.com", "nobody@example.com"}, pipeliningMail())
+	conn.Close()
+	if err != nil {
+		t.Fatalf("SendEnvelope: %v", err)
+	}
+	if len(result.Recipients) != 2 || len(result.Accepted()) != 1 || len(result.Rejected()) != 1 {
+		t.Fatalf("unexpected recipients %+v", result.Recipients)
+	}
+	if rejected := result.Rejected()[0]; rejected.Recipient != "nobody@example.com" || rejected.Code != protocol.CODE_MAILBOX_UNAVAILABLE {
+		t.Errorf("unexpected rejection %+v", rejected)
+	}
+
+	got := <-commands
+	want := []string{"EHLO", "MAIL FROM:<alice@example.org>", "RCPT TO:<bob@example.com>", "RCPT TO:<nobody@example.com>", "DATA"}
+	if len(got) != len(want) {
+		t.Fatalf("got commands %q", got)
+	}
+	for i := 1; i < len(want); i++ {
+		if got[i] != want[i] {
+			t.Errorf("command %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPipelinedMailRejected(t *testing.T) {
+	client, server := net.Pipe()
+	scriptedServer(server, []string{
+		pipeliningEHLO,
+		"550 5.7.1 Sender rejected\r\n",
+		"503 5.5.1 Need MAIL first\r\n",
+		"503 5.5.1 Need MAIL first\r\n",
+		"503 5.5.1 Need MAIL first\r\n",
+		"250 2.0.0 OK\r\n",
+	})
+	conn, err := NewClient(client, "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := conn.SendEnvelope("alice@example.org", []string{"bob@example.com", "carol@example.com"}, pipeliningMail())
+	conn.Close()
+
+	// The MAIL FROM reply decides for every recipient, the 503 replies to RCPT TO are not recorded
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply.Code != protocol.CODE_MAILBOX_UNAVAILABLE {
+		t.Fatalf("got error %v, want the MAIL FROM reply", err)
+	}
+	if len(result.Recipients) != 0 {
+		t.Errorf("RCPT TO replies recorded after a rejected MAIL FROM: %+v", result.Recipients)
+	}
+}
@@ -0,0 +1,328 @@
+package smtp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+// ErrPoolClosed is returned by Send after the pool was closed
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// PoolServer identifies a server and the credentials used with it
+// Sessions are only shared between sends with the same PoolServer
+type PoolServer struct {
+	Host        string
+	Port        uint16    // SMTP_CLIENT_PORT (465 with ImplicitTLS) if 0
+	ImplicitTLS bool      // SMTPS instead of STARTTLS
+	TLSPolicy   TLSPolicy // STARTTLS policy ("" = SMTP_CLIENT_TLS_POLICY)
+	// AUTH credentials (no AUTH if Username is "")
+	Mechanism string // PLAIN, LOGIN, CRAM-MD5 or XOAUTH2 ("" = negotiate)
+	Username  string
+	Password  string
+	Token     string // OAuth 2.0 access token for XOAUTH2
+}
+
+// PoolOptions are the limits of a Pool
+type PoolOptions struct {
+	MaxSessions int           // Open sessions per server (1 if <= 0)
+	MaxMessages int           // Messages per session before it is replaced (unlimited if <= 0)
+	IdleTimeout time.Duration // Idle sessions are closed after this long (never if <= 0)
+	HealthCheck time.Duration // Idle sessions are checked with NOOP this often (never if <= 0)
+}
+
+// PoolOptionsFromConfig returns the pool limits from SMTP_POOL_* settings
+func PoolOptionsFromConfig(cfg *config.Config) PoolOptions {
+	return PoolOptions{
+		MaxSessions: cfg.PoolMaxSessions,
+		MaxMessages: cfg.PoolMaxMessages,
+		IdleTimeout: cfg.PoolIdleTimeout,
+		HealthCheck: cfg.PoolHealthCheck,
+	}
+}
+
+// Pool keeps greeted, TLS-secured and authenticated sessions open and reuses them
+// for many messages, so sending does not pay for connect, EHLO, TLS and AUTH every time
+//
+//	pool := smtp.NewPool(cfg)
+//	defer pool.Close()
+//	server := smtp.PoolServer{Host: "smtp.example.com", Username: "user", Password: "secret"}
+//	result, err := pool.Send(server, *m)
+//
+// Pool is safe for concurrent use; at most MaxSessions sends run in parallel per server
+type Pool struct {
+	options PoolOptions
+	mu      sync.Mutex
+	servers map[PoolServer]*poolServer
+	closed  bool
+	stop    chan struct{} // Stops the janitor
+	done    chan struct{} // Closed when the janitor exited
+}
+
+// poolServer holds the sessions of one PoolServer
+type poolServer struct {
+	idle []*pooledSession // Most recently used last
+	open int              // Idle, busy and connecting sessions
+	cond *sync.Cond       // Signalled when a session becomes idle or a slot frees up
+}
+
+type pooledSession struct {
+	client   *ClientConn
+	messages int       // Messages sent over this session
+	lastUsed time.Time // End of the last transaction or health check
+}
+
+// NewPool returns a pool with the SMTP_POOL_* limits
+func NewPool(cfg *config.Config) *Pool {
+	return NewPoolWithOptions(PoolOptionsFromConfig(cfg))
+}
+
+// NewPoolWithOptions returns a pool with explicit limits
+func NewPoolWithOptions(options PoolOptions) *Pool {
+	if options.MaxSessions <= 0 {
+		options.MaxSessions = 1
+	}
+	p := &Pool{
+		options: options,
+		servers: make(map[PoolServer]*poolServer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.janitor()
+	return p
+}
+
+// Send delivers a mail to its To, Cc and Bcc recipients over a pooled session
+func (p *Pool) Send(server PoolServer, msg mail.Mail) (*SendResult, error) {
+	if msg.GetFrom() == "" {
+		return &SendResult{Recipients: make([]RecipientResult, 0)}, errors.New("no FROM address specified")
+	}
+	return p.SendEnvelope(server, msg.GetFrom(), mailRecipients(msg), msg)
+}
+
+// SendEnvelope is Send with an explicit envelope (see ClientConn.SendEnvelope)
+// It blocks while all MaxSessions sessions of the server are busy
+func (p *Pool) SendEnvelope(server PoolServer, from string, recipients []string, msg mail.Mail) (*SendResult, error) {
+	session, err := p.acquire(server)
+	if err != nil {
+		return &SendResult{Recipients: make([]RecipientResult, 0)}, err
+	}
+	result, err := session.client.SendEnvelope(from, recipients, msg)
+	session.messages++
+	session.lastUsed = time.Now()
+
+	// A server reply leaves the session usable; anything else (I/O error) broke it
+	var replyErr *ReplyError
+	if err != nil && !errors.As(err, &replyErr) {
+		p.discard(server, session, false)
+		return result, err
+	}
+	p.release(server, session)
+	return result, err
+}
+
+// Close closes every idle session with QUIT; sessions in use are closed when their send ends
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	sessions := make([]*pooledSession, 0)
+	for _, ps := range p.servers {
+		sessions = append(sessions, ps.idle...)
+		ps.open -= len(ps.idle)
+		ps.idle = nil
+		ps.cond.Broadcast()
+	}
+	p.mu.Unlock()
+
+	close(p.stop)
+	<-p.done
+	for _, session := range sessions {
+		session.client.Quit()
+	}
+	return nil
+}
+
+// acquire returns a session ready for a transaction: a reused one after RSET, or a new one
+// A reused session that fails RSET went stale and is replaced by a new connection
+func (p *Pool) acquire(server PoolServer) (*pooledSession, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		ps := p.server(server)
+		for len(ps.idle) == 0 && ps.open >= p.options.MaxSessions && !p.closed {
+			ps.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(ps.idle); n > 0 {
+			session := ps.idle[n-1]
+			ps.idle = ps.idle[:n-1]
+			p.mu.Unlock()
+			// Start from a clean transaction state; this also proves the session is alive
+			if err := session.client.Reset(); err != nil {
+				p.discard(server, session, false)
+				continue
+			}
+			return session, nil
+		}
+		ps.open++
+		p.mu.Unlock()
+
+		client, err := dialPoolServer(server)
+		if err != nil {
+			p.mu.Lock()
+			ps.open--
+			ps.cond.Signal()
+			p.mu.Unlock()
+			return nil, err
+		}
+		return &pooledSession{client: client, lastUsed: time.Now()}, nil
+	}
+}
+
+// release returns a session to the idle list, or retires it after MaxMessages messages
+func (p *Pool) release(server PoolServer, session *pooledSession) {
+	if p.options.MaxMessages > 0 && session.messages >= p.options.MaxMessages {
+		p.discard(server, session, true)
+		return
+	}
+	p.mu.Lock()
+	ps := p.server(server)
+	if p.closed {
+		ps.open--
+		p.mu.Unlock()
+		session.client.Quit()
+		return
+	}
+	ps.idle = append(ps.idle, session)
+	ps.cond.Signal()
+	p.mu.Unlock()
+}
+
+// discard closes a session and frees its slot; quit says goodbye to a still healthy server
+func (p *Pool) discard(server PoolServer, session *pooledSession, quit bool) {
+	if quit {
+		session.client.Quit()
+	} else {
+		session.client.Close()
+	}
+	p.mu.Lock()
+	ps := p.server(server)
+	ps.open--
+	ps.cond.Signal()
+	p.mu.Unlock()
+}
+
+// server returns the sessions of a PoolServer, creating the entry on first use
+// The caller holds p.mu
+func (p *Pool) server(server PoolServer) *poolServer {
+	ps, ok := p.servers[server]
+	if !ok {
+		ps = &poolServer{cond: sync.NewCond(&p.mu)}
+		p.servers[server] = ps
+	}
+	return ps
+}
+
+// janitor closes sessions idle for longer than IdleTimeout and checks the others with NOOP
+func (p *Pool) janitor() {
+	defer close(p.done)
+	interval := p.options.HealthCheck
+	if interval <= 0 || (p.options.IdleTimeout > 0 && p.options.IdleTimeout < interval) {
+		interval = p.options.IdleTimeout
+	}
+	if interval <= 0 {
+		<-p.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.sweep(time.Now())
+		}
+	}
+}
+
+// sweep runs one janitor pass; sessions being checked are taken off the idle list meanwhile
+func (p *Pool) sweep(now time.Time) {
+	type checked struct {
+		server  PoolServer
+		session *pooledSession
+	}
+	expired := make([]checked, 0)
+	check := make([]checked, 0)
+
+	p.mu.Lock()
+	for server, ps := range p.servers {
+		keep := ps.idle[:0]
+		for _, session := range ps.idle {
+			idle := now.Sub(session.lastUsed)
+			switch {
+			case p.options.IdleTimeout > 0 && idle >= p.options.IdleTimeout:
+				expired = append(expired, checked{server, session})
+			case p.options.HealthCheck > 0 && idle >= p.options.HealthCheck:
+				check = append(check, checked{server, session})
+			default:
+				keep = append(keep, session)
+			}
+		}
+		ps.idle = keep
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		p.discard(c.server, c.session, true)
+	}
+	for _, c := range check {
+		if err := c.session.client.Noop(); err != nil {
+			p.discard(c.server, c.session, false)
+			continue
+		}
+		c.session.lastUsed = now
+		p.release(c.server, c.session)
+	}
+}
+
+// dialPoolServer opens a session: connect, EHLO, STARTTLS (unless implicit TLS) and AUTH
+func dialPoolServer(server PoolServer) (*ClientConn, error) {
+	var client *ClientConn
+	var err error
+	if server.ImplicitTLS {
+		client, err = DialTLS(server.Host, server.Port)
+	} else {
+		client, err = Dial(server.Host, server.Port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if server.TLSPolicy != "" {
+		client.SetTLSPolicy(server.TLSPolicy)
+	}
+	if err := client.helloWithTLS(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if server.Username != "" {
+		if err := client.Auth(CredentialsAuth(server.Mechanism, server.Username, server.Password, server.Token)); err != nil {
+			client.Quit()
+			return nil, err
+		}
+	}
+	return client, nil
+}
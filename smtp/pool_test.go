@@ -0,0 +1,315 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts any number of sessions and answers every command with success
+type fakeSMTP struct {
+	listener net.Listener
+	gate     chan struct{}                       // The end of DATA waits for it if set
+	hangup   func(conn int, command string) bool // Drops the connection instead of replying
+
+	mu       sync.Mutex
+	conns    int
+	commands []string // "<connection> <verb>"
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			n := f.conns
+			f.mu.Unlock()
+			go f.serve(conn, n)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn, n int) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("220 mx.example.com ESMTP\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		f.mu.Lock()
+		f.commands = append(f.commands, fmt.Sprintf("%d %s", n, verb))
+		hangup := f.hangup != nil && f.hangup(n, verb)
+		f.mu.Unlock()
+		if hangup {
+			return
+		}
+		switch verb {
+		case "EHLO":
+			conn.Write([]byte("250 mx.example.com\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 Go ahead\r\n"))
+			for line != ".\r\n" {
+				if line, err = reader.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			if f.gate != nil {
+				<-f.gate
+			}
+			conn.Write([]byte("250 2.0.0 Queued\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 Bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	}
+}
+
+// server returns the PoolServer for the fake server
+func (f *fakeSMTP) server() PoolServer {
+	return PoolServer{
+		Host:      "127.0.0.1",
+		Port:      uint16(f.listener.Addr().(*net.TCPAddr).Port),
+		TLSPolicy: TLS_POLICY_OPPORTUNISTIC,
+	}
+}
+
+// count returns the number of connections and of commands with the given verb
+func (f *fakeSMTP) count(verb string) (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, command := range f.commands {
+		if strings.HasSuffix(command, " "+verb) {
+			n++
+		}
+	}
+	return f.conns, n
+}
+
+// waitFor polls until the server got at least n commands with the given verb
+func (f *fakeSMTP) waitFor(t *testing.T, verb string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if _, got := f.count(verb); got >= n {
+			return
+		}
+	}
+	t.Fatalf("server did not get %d %s commands", n, verb)
+}
+
+// openSessions returns the open and idle sessions of a server
+func (p *Pool) openSessions(server PoolServer) (open, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps := p.server(server)
+	return ps.open, len(ps.idle)
+}
+
+func poolSend(p *Pool, server PoolServer) error {
+	_, err := p.SendEnvelope(server, "alice@example.org", []string{"bob@example.com"}, pipeliningMail())
+	return err
+}
+
+func TestPoolReuse(t *testing.T) {
+	fake := newFakeSMTP(t)
+	pool := NewPoolWithOptions(PoolOptions{MaxSessions: 2})
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := poolSend(pool, fake.server()); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	conns, resets := fake.count("RSET")
+	if conns != 1 || resets != 2 {
+		t.Errorf("got %d connections and %d RSETs, want 1 and 2", conns, resets)
+	}
+	if open, idle := pool.openSessions(fake.server()); open != 1 || idle != 1 {
+		t.Errorf("got %d open and %d idle sessions, want 1 and 1", open, idle)
+	}
+}
+
+func TestPoolMaxMessages(t *testing.T) {
+	fake := newFakeSMTP(t)
+	pool := NewPoolWithOptions(PoolOptions{MaxMessages: 2})
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := poolSend(pool, fake.server()); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	fake.waitFor(t, "QUIT", 1)
+	if conns, _ := fake.count("QUIT"); conns != 2 {
+		t.Errorf("got %d connections, want the first retired after 2 messages", conns)
+	}
+}
+
+func TestPoolDiscardsBrokenSession(t *testing.T) {
+	fake := newFakeSMTP(t)
+	// The first connection goes away while idle, the second in the middle of a transaction
+	fake.hangup = func(conn int, command string) bool {
+		return conn == 1 && command == "RSET" || conn == 2 && command == "RCPT"
+	}
+	pool := NewPoolWithOptions(PoolOptions{})
+	defer pool.Close()
+	server := fake.server()
+
+	if err := poolSend(pool, server); err != nil {
+		t.Fatal(err)
+	}
+	// RSET fails on the stale session, so the send goes over a new one that breaks
+	err := poolSend(pool, server)
+	var replyErr *ReplyError
+	if err == nil || errors.As(err, &replyErr) {
+		t.Fatalf("got error %v, want the broken connection", err)
+	}
+	if open, idle := pool.openSessions(server); open != 0 || idle != 0 {
+		t.Errorf("got %d open and %d idle sessions after the failure, want none", open, idle)
+	}
+	if err := poolSend(pool, server); err != nil {
+		t.Fatal(err)
+	}
+	if conns, _ := fake.count("MAIL"); conns != 3 {
+		t.Errorf("got %d connections, want 3", conns)
+	}
+}
+
+func TestPoolWaitsForBusySession(t *testing.T) {
+	fake := newFakeSMTP(t)
+	fake.gate = make(chan struct{})
+	pool := NewPoolWithOptions(PoolOptions{MaxSessions: 1})
+	defer pool.Close()
+	server := fake.server()
+
+	errs := make(chan error, 2)
+	go func() { errs <- poolSend(pool, server) }()
+	fake.waitFor(t, "DATA", 1)
+	go func() { errs <- poolSend(pool, server) }()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("a send finished while the only session was busy (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(fake.gate)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if conns, data := fake.count("DATA"); conns != 1 || data != 2 {
+		t.Errorf("got %d connections and %d messages, want 1 and 2", conns, data)
+	}
+}
+
+func TestPoolCloseWakesWaiters(t *testing.T) {
+	fake := newFakeSMTP(t)
+	fake.gate = make(chan struct{})
+	pool := NewPoolWithOptions(PoolOptions{MaxSessions: 1})
+	server := fake.server()
+
+	busy := make(chan error, 1)
+	go func() { busy <- poolSend(pool, server) }()
+	fake.waitFor(t, "DATA", 1)
+	waiting := make(chan error, 1)
+	go func() { waiting <- poolSend(pool, server) }()
+	time.Sleep(20 * time.Millisecond)
+
+	pool.Close()
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("waiting send: got %v, want ErrPoolClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake the waiting send")
+	}
+
+	// The busy send completes, then its session is closed with QUIT instead of kept
+	close(fake.gate)
+	if err := <-busy; err != nil {
+		t.Errorf("busy send: %v", err)
+	}
+	fake.waitFor(t, "QUIT", 1)
+	if open, idle := pool.openSessions(server); open != 0 || idle != 0 {
+		t.Errorf("got %d open and %d idle sessions after Close, want none", open, idle)
+	}
+	if err := poolSend(pool, server); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("send after Close: got %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestPoolJanitorHealthCheck(t *testing.T) {
+	fake := newFakeSMTP(t)
+	pool := NewPoolWithOptions(PoolOptions{HealthCheck: 10 * time.Millisecond})
+	defer pool.Close()
+	server := fake.server()
+
+	if err := poolSend(pool, server); err != nil {
+		t.Fatal(err)
+	}
+	fake.waitFor(t, "NOOP", 2)
+	if open, _ := pool.openSessions(server); open != 1 {
+		t.Errorf("got %d open sessions, want the checked one kept", open)
+	}
+}
+
+func TestPoolSweep(t *testing.T) {
+	fake := newFakeSMTP(t)
+	fake.hangup = func(conn int, command string) bool {
+		return conn == 2 && command == "NOOP"
+	}
+	// Long intervals: the test runs the janitor passes itself
+	pool := NewPoolWithOptions(PoolOptions{MaxSessions: 2, IdleTimeout: time.Hour, HealthCheck: time.Minute})
+	defer pool.Close()
+	server := fake.server()
+
+	// Two sessions at once, so both stay open
+	fake.gate = make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- poolSend(pool, server) }()
+	}
+	fake.waitFor(t, "DATA", 2)
+	close(fake.gate)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Due for a health check: the session that fails NOOP is dropped
+	pool.sweep(time.Now().Add(2 * time.Minute))
+	if open, idle := pool.openSessions(server); open != 1 || idle != 1 {
+		t.Errorf("after the health check: got %d open and %d idle sessions, want 1 and 1", open, idle)
+	}
+
+	// Idle for too long: closed with QUIT
+	pool.sweep(time.Now().Add(2 * time.Hour))
+	fake.waitFor(t, "QUIT", 1)
+	if open, idle := pool.openSessions(server); open != 0 || idle != 0 {
+		t.Errorf("after the idle timeout: got %d open and %d idle sessions, want none", open, idle)
+	}
+}
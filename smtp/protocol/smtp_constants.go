@@ -1,7 +1,5 @@
 package protocol
 
-import "github.com/ImBubbles/MySMTP/util/arraylist"
-
 type SMTPCode int16
 
 const (
@@ -10,14 +8,20 @@ const (
 	CODE_QUIT                  SMTPCode = 221
 	CODE_AUTH_SUCCESS          SMTPCode = 235
 	CODE_ACKNOWLEDGE           SMTPCode = 250
+	CODE_AUTH_CONTINUE         SMTPCode = 334
 	CODE_START_MAIL_INPUT      SMTPCode = 354
 	CODE_NOT_FOUND             SMTPCode = 404
 	CODE_UNAVAILABLE           SMTPCode = 421
+	CODE_LOCAL_ERROR           SMTPCode = 451
 	CODE_INTERNAL_SERVER_ERROR SMTPCode = 500
 	CODE_BAD_SYNTAX            SMTPCode = 501
 	CODE_BAD_SEQUENCE          SMTPCode = 503
+	CODE_PARAM_NOT_IMPLEMENTED SMTPCode = 504
 	CODE_AUTH_FAILED           SMTPCode = 535
+	CODE_ENCRYPTION_REQUIRED   SMTPCode = 538
+	CODE_MAILBOX_UNAVAILABLE   SMTPCode = 550
 	CODE_FAILURE               SMTPCode = 554
+	CODE_PARAM_NOT_RECOGNIZED  SMTPCode = 555
 )
 
 type SMTPCommands string
@@ -25,6 +29,7 @@ type SMTPCommands string
 const (
 	COMMAND_EHLO      SMTPCommands = "EHLO"
 	COMMAND_HELO      SMTPCommands = "HELO"
+	COMMAND_LHLO      SMTPCommands = "LHLO"
 	COMMAND_MAIL      SMTPCommands = "MAIL"
 	COMMAND_MAIL_FROM SMTPCommands = "MAIL FROM"
 	COMMAND_RCPT      SMTPCommands = "RCPT"
@@ -34,13 +39,24 @@ const (
 	COMMAND_RSET      SMTPCommands = "RSET"
 	COMMAND_AUTH      SMTPCommands = "AUTH"
 	COMMAND_STARTTLS  SMTPCommands = "STARTTLS"
+	COMMAND_NOOP      SMTPCommands = "NOOP"
 )
 
 type SMTPBody string
 
 const (
-	BODY_7BIT     SMTPBody = "7BIT"
-	BODY_8BITMIME SMTPBody = "8BITMIME"
+	BODY_7BIT       SMTPBody = "7BIT"
+	BODY_8BITMIME   SMTPBody = "8BITMIME"
+	BODY_BINARYMIME SMTPBody = "BINARYMIME"
+)
+
+type SMTPAuthMechanism string
+
+const (
+	AUTH_PLAIN    SMTPAuthMechanism = "PLAIN"
+	AUTH_LOGIN    SMTPAuthMechanism = "LOGIN"
+	AUTH_CRAM_MD5 SMTPAuthMechanism = "CRAM-MD5"
+	AUTH_XOAUTH2  SMTPAuthMechanism = "XOAUTH2"
 )
 
 type SMTPNotify string
@@ -49,6 +65,14 @@ const (
 	NOTIFY_SUCCESS SMTPNotify = "SUCCESS"
 	NOTIFY_FAILURE SMTPNotify = "FAILURE"
 	NOTIFY_DELAY   SMTPNotify = "DELAY"
+	NOTIFY_NEVER   SMTPNotify = "NEVER"
+)
+
+type SMTPRet string
+
+const (
+	RET_FULL SMTPRet = "FULL"
+	RET_HDRS SMTPRet = "HDRS"
 )
 
 type SMTPOrcpt string
@@ -75,6 +99,14 @@ const (
 	FLAG_SIZE     SMTPFromFlags = "SIZE"
 	FLAG_BODY     SMTPFromFlags = "BODY"
 	FLAG_SMTPUTF8 SMTPFromFlags = "SMTPUTF8"
+	FLAG_RET      SMTPFromFlags = "RET"
+	FLAG_ENVID    SMTPFromFlags = "ENVID"
+	FLAG_AUTH     SMTPFromFlags = "AUTH"
 )
 
-var SMTP_VALID_FLAGS = arraylist.NewArrayList([]SMTPFromFlags{FLAG_SIZE, FLAG_BODY, FLAG_SMTPUTF8})
+type SMTPRcptFlags string
+
+const (
+	FLAG_NOTIFY SMTPRcptFlags = "NOTIFY"
+	FLAG_ORCPT  SMTPRcptFlags = "ORCPT"
+)
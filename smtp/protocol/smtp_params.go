@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParamValue describes whether an ESMTP parameter takes a value
+type ParamValue int
+
+const (
+	PARAM_NO_VALUE       ParamValue = iota // KEYWORD only (e.g. SMTPUTF8)
+	PARAM_REQUIRED_VALUE                   // KEYWORD=value (e.g. SIZE=12345)
+)
+
+// ParamValidator checks a (decoded) parameter value
+// Return an error to reject the command with 501, or a *CommandError to choose the reply
+type ParamValidator func(value string) error
+
+// ParamSpec describes an ESMTP parameter accepted on MAIL FROM or RCPT TO
+type ParamSpec struct {
+	Value     ParamValue     // Whether the parameter takes a value
+	Xtext     bool           // Value is xtext encoded (RFC 3461) and is decoded before validation
+	Validate  ParamValidator // Optional value validator
+	Extension string         // EHLO keyword advertised for this parameter ("" to advertise nothing)
+}
+
+// ParamRegistry holds the ESMTP parameters the server understands
+// Extensions register their parameters here; anything not registered is rejected with 555
+type ParamRegistry struct {
+	mu     sync.RWMutex
+	params map[SMTPCommands]map[string]ParamSpec
+}
+
+// NewParamRegistry creates an empty parameter registry
+func NewParamRegistry() *ParamRegistry {
+	return &ParamRegistry{params: make(map[SMTPCommands]map[string]ParamSpec)}
+}
+
+// Register adds (or replaces) a parameter for a command (COMMAND_MAIL or COMMAND_RCPT)
+// Keywords are case-insensitive
+func (r *ParamRegistry) Register(command SMTPCommands, keyword string, spec ParamSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.params[command] == nil {
+		r.params[command] = make(map[string]ParamSpec)
+	}
+	r.params[command][strings.ToUpper(keyword)] = spec
+}
+
+// Unregister removes a parameter for a command
+func (r *ParamRegistry) Unregister(command SMTPCommands, keyword string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.params[command], strings.ToUpper(keyword))
+}
+
+// Lookup returns the spec registered for a parameter, if any
+func (r *ParamRegistry) Lookup(command SMTPCommands, keyword string) (ParamSpec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	spec, ok := r.params[command][strings.ToUpper(keyword)]
+	return spec, ok
+}
+
+// Extensions returns the sorted, de-duplicated EHLO keywords of all registered parameters
+func (r *ParamRegistry) Extensions() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[string]bool)
+	extensions := make([]string, 0)
+	for _, params := range r.params {
+		for _, spec := range params {
+			if spec.Extension != "" && !seen[spec.Extension] {
+				seen[spec.Extension] = true
+				extensions = append(extensions, spec.Extension)
+			}
+		}
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// DefaultParamRegistry is used by ServerConn to validate MAIL FROM and RCPT TO parameters
+// It starts with SIZE, BODY, SMTPUTF8, AUTH and the DSN parameters (RET, ENVID, NOTIFY, ORCPT)
+var DefaultParamRegistry = newDefaultParamRegistry()
+
+func newDefaultParamRegistry() *ParamRegistry {
+	r := NewParamRegistry()
+	// RFC 1870 SIZE
+	r.Register(COMMAND_MAIL, string(FLAG_SIZE), ParamSpec{Value: PARAM_REQUIRED_VALUE, Validate: validateSize, Extension: "SIZE"})
+	// RFC 6152 8BITMIME (BINARYMIME is not offered, it needs CHUNKING)
+	r.Register(COMMAND_MAIL, string(FLAG_BODY), ParamSpec{Value: PARAM_REQUIRED_VALUE, Validate: validateBody, Extension: "8BITMIME"})
+	// RFC 6531 SMTPUTF8
+	r.Register(COMMAND_MAIL, string(FLAG_SMTPUTF8), ParamSpec{Value: PARAM_NO_VALUE, Extension: "SMTPUTF8"})
+	// RFC 4954 AUTH=<mailbox> (advertised together with the AUTH mechanisms, not here)
+	r.Register(COMMAND_MAIL, string(FLAG_AUTH), ParamSpec{Value: PARAM_REQUIRED_VALUE, Xtext: true})
+	// RFC 3461 DSN
+	r.Register(COMMAND_MAIL, string(FLAG_RET), ParamSpec{Value: PARAM_REQUIRED_VALUE, Validate: validateRet, Extension: "DSN"})
+	r.Register(COMMAND_MAIL, string(FLAG_ENVID), ParamSpec{Value: PARAM_REQUIRED_VALUE, Xtext: true, Validate: validateEnvID, Extension: "DSN"})
+	r.Register(COMMAND_RCPT, string(FLAG_NOTIFY), ParamSpec{Value: PARAM_REQUIRED_VALUE, Validate: validateNotify, Extension: "DSN"})
+	r.Register(COMMAND_RCPT, string(FLAG_ORCPT), ParamSpec{Value: PARAM_REQUIRED_VALUE, Xtext: true, Validate: validateOrcpt, Extension: "DSN"})
+	return r
+}
+
+func validateSize(value string) error {
+	if value == "" {
+		return errors.New("SIZE requires a value")
+	}
+	if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return fmt.Errorf("invalid SIZE value %q", value)
+	}
+	return nil
+}
+
+func validateBody(value string) error {
+	switch SMTPBody(strings.ToUpper(value)) {
+	case BODY_7BIT, BODY_8BITMIME:
+		return nil
+	case BODY_BINARYMIME:
+		// RFC 3030 section 3: BINARYMIME is only valid with BDAT, which this server does not offer
+		return &CommandError{Code: CODE_PARAM_NOT_RECOGNIZED, Enhanced: "5.5.4", Message: "BODY=BINARYMIME requires CHUNKING, which is not supported"}
+	}
+	return fmt.Errorf("invalid BODY value %q", value)
+}
+
+func validateRet(value string) error {
+	switch SMTPRet(strings.ToUpper(value)) {
+	case RET_FULL, RET_HDRS:
+		return nil
+	}
+	return fmt.Errorf("invalid RET value %q", value)
+}
+
+func validateEnvID(value string) error {
+	// RFC 3461 section 4.4: ENVID is at most 100 characters
+	if value == "" || len(value) > 100 {
+		return errors.New("ENVID must be between 1 and 100 characters")
+	}
+	return nil
+}
+
+func validateNotify(value string) error {
+	// NOTIFY=NEVER or a comma separated list of SUCCESS, FAILURE, DELAY
+	parts := strings.Split(strings.ToUpper(value), ",")
+	for _, part := range parts {
+		switch SMTPNotify(part) {
+		case NOTIFY_NEVER:
+			if len(parts) != 1 {
+				return errors.New("NOTIFY=NEVER cannot be combined with other values")
+			}
+		case NOTIFY_SUCCESS, NOTIFY_FAILURE, NOTIFY_DELAY:
+		default:
+			return fmt.Errorf("invalid NOTIFY value %q", part)
+		}
+	}
+	return nil
+}
+
+func validateOrcpt(value string) error {
+	// ORCPT=addr-type;xtext (e.g. rfc822;user@example.com)
+	semi := strings.Index(value, ";")
+	if semi <= 0 || semi == len(value)-1 {
+		return fmt.Errorf("invalid ORCPT value %q", value)
+	}
+	return nil
+}
+
+// DecodeXtext decodes an RFC 3461 xtext value ("+2B" -> "+")
+func DecodeXtext(s string) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("truncated xtext escape in %q", s)
+			}
+			// RFC 3461 requires upper-case hex digits, but be lenient on input
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext escape in %q", s)
+			}
+			builder.WriteByte(byte(b))
+			i += 2
+			continue
+		}
+		if c < '!' || c > '~' || c == '=' {
+			return "", fmt.Errorf("invalid xtext character in %q", s)
+		}
+		builder.WriteByte(c)
+	}
+	return builder.String(), nil
+}
+
+// EncodeXtext encodes a value as RFC 3461 xtext
+func EncodeXtext(s string) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&builder, "+%02X", c)
+			continue
+		}
+		builder.WriteByte(c)
+	}
+	return builder.String()
+}
@@ -0,0 +1,374 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RFC 5321 section 4.5.3.1 size limits
+const (
+	MAX_LOCAL_PART_LENGTH = 64
+	MAX_DOMAIN_LENGTH     = 255
+	MAX_PATH_LENGTH       = 256
+)
+
+// CommandError is a parse or validation failure that maps directly to an SMTP reply
+type CommandError struct {
+	Code     SMTPCode
+	Enhanced string // Enhanced status code (RFC 3463), e.g. "5.5.4"
+	Message  string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+}
+
+// Reply returns the SMTP reply line for this error
+func (e *CommandError) Reply() string {
+	return NewSMTPBuilder().Code(e.Code).Message(e.Enhanced + " " + e.Message).Get()
+}
+
+func syntaxError(enhanced string, format string, args ...any) *CommandError {
+	return &CommandError{Code: CODE_BAD_SYNTAX, Enhanced: enhanced, Message: fmt.Sprintf(format, args...)}
+}
+
+// Path is a parsed reverse-path (MAIL FROM) or forward-path (RCPT TO)
+type Path struct {
+	SourceRoute string // Obsolete source route ("@a,@b"), kept for information only
+	LocalPart   string // Local part as written (quoted local parts keep their quotes)
+	Domain      string // Domain or address literal ("[192.0.2.1]")
+	Null        bool   // The null reverse-path "<>"
+	Postmaster  bool   // The special forward-path "<Postmaster>" without a domain
+}
+
+// Mailbox returns the address without brackets or source route
+// It is "" for the null reverse-path and "Postmaster" for <Postmaster>
+func (p *Path) Mailbox() string {
+	if p.Null {
+		return ""
+	}
+	if p.Domain == "" {
+		return p.LocalPart
+	}
+	return p.LocalPart + "@" + p.Domain
+}
+
+// String returns the path in SMTP form, e.g. "<user@example.com>"
+func (p *Path) String() string {
+	return "<" + p.Mailbox() + ">"
+}
+
+// Parameter is one ESMTP parameter from MAIL FROM or RCPT TO
+type Parameter struct {
+	Keyword string // Upper-cased esmtp-keyword
+	Value   string // Value, xtext decoded if the registry says so
+	Raw     string // Value exactly as sent by the client
+}
+
+// PathCommand is a parsed MAIL FROM or RCPT TO command line
+type PathCommand struct {
+	Command SMTPCommands
+	Path    Path
+	Params  []Parameter
+}
+
+// Param returns the parameter with the given keyword, if present
+func (c *PathCommand) Param(keyword string) (Parameter, bool) {
+	keyword = strings.ToUpper(keyword)
+	for _, param := range c.Params {
+		if param.Keyword == keyword {
+			return param, true
+		}
+	}
+	return Parameter{}, false
+}
+
+// ParseMailFrom parses "MAIL FROM:<reverse-path> [parameters]"
+// Parameters are checked against registry (DefaultParamRegistry if nil)
+func ParseMailFrom(line string, registry *ParamRegistry) (*PathCommand, error) {
+	return parsePathCommand(line, COMMAND_MAIL, "MAIL FROM:", registry)
+}
+
+// ParseRcptTo parses "RCPT TO:<forward-path> [parameters]"
+// Parameters are checked against registry (DefaultParamRegistry if nil)
+func ParseRcptTo(line string, registry *ParamRegistry) (*PathCommand, error) {
+	return parsePathCommand(line, COMMAND_RCPT, "RCPT TO:", registry)
+}
+
+func parsePathCommand(line string, command SMTPCommands, prefix string, registry *ParamRegistry) (*PathCommand, error) {
+	if registry == nil {
+		registry = DefaultParamRegistry
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < len(prefix) || !strings.EqualFold(line[:len(prefix)], prefix) {
+		return nil, syntaxError("5.5.2", "Syntax error, expected %s", prefix)
+	}
+	// RFC 5321 has no space after the colon, but many clients send one
+	rest := strings.TrimLeft(line[len(prefix):], " ")
+
+	addressStatus := "5.1.3"
+	if command == COMMAND_MAIL {
+		addressStatus = "5.1.7"
+	}
+	path, n, err := parsePath(rest, command == COMMAND_MAIL)
+	if err != nil {
+		return nil, syntaxError(addressStatus, "%s", err.Error())
+	}
+
+	result := &PathCommand{Command: command, Path: path}
+	rest = rest[n:]
+	if rest == "" {
+		return result, nil
+	}
+	if rest[0] != ' ' {
+		return nil, syntaxError("5.5.4", "Syntax error after %s", path.String())
+	}
+
+	seen := make(map[string]bool)
+	for _, token := range strings.Split(rest, " ") {
+		if token == "" {
+			continue
+		}
+		keyword, raw, hasValue := strings.Cut(token, "=")
+		if !isEsmtpKeyword(keyword) {
+			return nil, syntaxError("5.5.4", "Invalid parameter keyword %q", keyword)
+		}
+		keyword = strings.ToUpper(keyword)
+		if hasValue && !isEsmtpValue(raw) {
+			return nil, syntaxError("5.5.4", "Invalid value for parameter %s", keyword)
+		}
+		spec, ok := registry.Lookup(command, keyword)
+		if !ok {
+			return nil, &CommandError{Code: CODE_PARAM_NOT_RECOGNIZED, Enhanced: "5.5.4", Message: fmt.Sprintf("Parameter %s not recognized or not implemented", keyword)}
+		}
+		if seen[keyword] {
+			return nil, syntaxError("5.5.4", "Duplicate parameter %s", keyword)
+		}
+		seen[keyword] = true
+
+		switch spec.Value {
+		case PARAM_NO_VALUE:
+			if hasValue {
+				return nil, syntaxError("5.5.4", "Parameter %s does not take a value", keyword)
+			}
+		case PARAM_REQUIRED_VALUE:
+			if !hasValue {
+				return nil, syntaxError("5.5.4", "Parameter %s requires a value", keyword)
+			}
+		}
+
+		value := raw
+		if spec.Xtext {
+			value, err = DecodeXtext(raw)
+			if err != nil {
+				return nil, syntaxError("5.5.4", "Invalid xtext in parameter %s", keyword)
+			}
+		}
+		if spec.Validate != nil {
+			if err := spec.Validate(value); err != nil {
+				var cmdErr *CommandError
+				if errors.As(err, &cmdErr) {
+					return nil, cmdErr
+				}
+				return nil, syntaxError("5.5.4", "%s", err.Error())
+			}
+		}
+		result.Params = append(result.Params, Parameter{Keyword: keyword, Value: value, Raw: raw})
+	}
+	return result, nil
+}
+
+// parsePath parses an RFC 5321 Path starting at s[0] == '<'
+// Returns the path and the number of bytes consumed (including the closing '>')
+func parsePath(s string, allowNull bool) (Path, int, error) {
+	var path Path
+	if s == "" || s[0] != '<' {
+		return path, 0, fmt.Errorf("address must be enclosed in <>")
+	}
+	i := 1
+
+	// Null reverse-path "<>"
+	if i < len(s) && s[i] == '>' {
+		if !allowNull {
+			return path, 0, fmt.Errorf("null path not allowed here")
+		}
+		path.Null = true
+		return path, i + 1, nil
+	}
+
+	// Obsolete source route: "@one,@two:" - must be accepted and ignored (RFC 5321 4.1.2)
+	if i < len(s) && s[i] == '@' {
+		end := strings.IndexByte(s[i:], ':')
+		if end == -1 {
+			return path, 0, fmt.Errorf("unterminated source route")
+		}
+		path.SourceRoute = s[i : i+end]
+		i += end + 1
+	}
+
+	// Local part: Dot-string or Quoted-string
+	start := i
+	if i < len(s) && s[i] == '"' {
+		i++
+		closed := false
+		for i < len(s) {
+			c := s[i]
+			if c == '\\' {
+				if i+1 >= len(s) {
+					break
+				}
+				i += 2
+				continue
+			}
+			i++
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c < ' ' || c == 0x7f {
+				return path, 0, fmt.Errorf("control character in quoted local part")
+			}
+		}
+		if !closed {
+			return path, 0, fmt.Errorf("unterminated quoted local part")
+		}
+	} else {
+		for i < len(s) && isAtext(s[i]) {
+			i++
+		}
+		local := s[start:i]
+		if local == "" || strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+			return path, 0, fmt.Errorf("invalid local part")
+		}
+	}
+	path.LocalPart = s[start:i]
+	if len(path.LocalPart) > MAX_LOCAL_PART_LENGTH {
+		return path, 0, fmt.Errorf("local part too long")
+	}
+
+	if i >= len(s) {
+		return path, 0, fmt.Errorf("unterminated address")
+	}
+
+	// <Postmaster> without a domain is only valid as a forward-path
+	if s[i] == '>' {
+		if !allowNull && strings.EqualFold(path.LocalPart, "postmaster") {
+			path.Postmaster = true
+			return path, i + 1, nil
+		}
+		return path, 0, fmt.Errorf("address must include a domain")
+	}
+	if s[i] != '@' {
+		return path, 0, fmt.Errorf("invalid character in address")
+	}
+	i++
+
+	// Domain or address literal
+	start = i
+	if i < len(s) && s[i] == '[' {
+		end := strings.IndexByte(s[i:], ']')
+		if end == -1 {
+			return path, 0, fmt.Errorf("unterminated address literal")
+		}
+		i += end + 1
+		if !ValidAddressLiteral(s[start:i]) {
+			return path, 0, fmt.Errorf("invalid address literal")
+		}
+	} else {
+		for i < len(s) && isDomainChar(s[i]) {
+			i++
+		}
+		if !ValidDomain(s[start:i]) {
+			return path, 0, fmt.Errorf("invalid domain")
+		}
+	}
+	path.Domain = s[start:i]
+	if len(path.Domain) > MAX_DOMAIN_LENGTH {
+		return path, 0, fmt.Errorf("domain too long")
+	}
+
+	if i >= len(s) || s[i] != '>' {
+		return path, 0, fmt.Errorf("address must be enclosed in <>")
+	}
+	i++
+	if i > MAX_PATH_LENGTH {
+		return path, 0, fmt.Errorf("path too long")
+	}
+	return path, i, nil
+}
+
+// ValidDomain reports whether s is a domain name: labels of domain characters separated by single dots
+func ValidDomain(s string) bool {
+	if s == "" || strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDomainChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidAddressLiteral reports whether s is an IPv4 ("[192.0.2.1]") or IPv6 ("[IPv6:2001:db8::1]")
+// address literal (RFC 5321 section 4.1.3)
+func ValidAddressLiteral(s string) bool {
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return false
+	}
+	literal := s[1 : len(s)-1]
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		ip := net.ParseIP(literal[5:])
+		return ip != nil && strings.Contains(literal[5:], ":")
+	}
+	ip := net.ParseIP(literal)
+	return ip != nil && ip.To4() != nil && !strings.Contains(literal, ":")
+}
+
+// isAtext reports whether c may appear in a Dot-string (RFC 5321 atext plus '.')
+// Bytes >= 0x80 are allowed for SMTPUTF8 (RFC 6531) addresses
+func isAtext(c byte) bool {
+	if c >= 0x80 {
+		return true
+	}
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) != -1
+}
+
+// isDomainChar reports whether c may appear in a domain name
+func isDomainChar(c byte) bool {
+	return c >= 0x80 || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.'
+}
+
+// isEsmtpKeyword checks esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func isEsmtpKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !alnum && (i == 0 || c != '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isEsmtpValue checks esmtp-value = 1*(%d33-60 / %d62-126 / UTF8-non-ascii)
+func isEsmtpValue(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c == '=' || c == 127 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseMailFromParams(t *testing.T) {
+	tests := []struct {
+		line string
+		code SMTPCode // 0 = accepted
+	}{
+		{"MAIL FROM:<alice@example.org> BODY=8BITMIME SIZE=1000", 0},
+		{"MAIL FROM:<> BODY=7bit RET=HDRS ENVID=QQ314159", 0},
+		{"MAIL FROM:<alice@example.org> BODY=BINARYMIME", CODE_PARAM_NOT_RECOGNIZED},
+		{"MAIL FROM:<alice@example.org> BODY=UTF16", CODE_BAD_SYNTAX},
+		{"MAIL FROM:<alice@example.org> SIZE=big", CODE_BAD_SYNTAX},
+		{"MAIL FROM:<alice@example.org> SIZE=1 SIZE=2", CODE_BAD_SYNTAX},
+		{"MAIL FROM:<alice@example.org> XUNKNOWN=1", CODE_PARAM_NOT_RECOGNIZED},
+	}
+	for _, test := range tests {
+		_, err := ParseMailFrom(test.line, DefaultParamRegistry)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%q: %v", test.line, err)
+			}
+			continue
+		}
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != test.code {
+			t.Errorf("%q: got %v, want %d", test.line, err, test.code)
+		}
+	}
+}
+
+func TestParseRcptToAddressLiteral(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"RCPT TO:<bob@[192.0.2.1]>", true},
+		{"RCPT TO:<bob@[IPv6:2001:db8::1]>", true},
+		{"RCPT TO:<bob@[ipv6:::ffff:192.0.2.1]>", true},
+		{"RCPT TO:<bob@[192.0.2]>", false},
+		{"RCPT TO:<bob@[999.0.2.1]>", false},
+		{"RCPT TO:<bob@[2001:db8::1]>", false},
+		{"RCPT TO:<bob@[IPv6:192.0.2.1]>", false},
+		{"RCPT TO:<bob@[mail.example.com]>", false},
+		{"RCPT TO:<bob@[]>", false},
+	}
+	for _, test := range tests {
+		_, err := ParseRcptTo(test.line, DefaultParamRegistry)
+		if test.ok {
+			if err != nil {
+				t.Errorf("%q: %v", test.line, err)
+			}
+			continue
+		}
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Code != CODE_BAD_SYNTAX || cmdErr.Enhanced != "5.1.3" {
+			t.Errorf("%q: got %v, want 501 5.1.3", test.line, err)
+		}
+	}
+}
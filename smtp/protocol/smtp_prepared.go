@@ -15,13 +15,23 @@ var (
 	PREPARED_S_TLS_REQUIRED       string = NewSMTPBuilder().Code(CODE_BAD_SEQUENCE).Message("TLS connection required").Get()
 	PREPARED_S_AUTH_SUCCESS       string = NewSMTPBuilder().Code(CODE_AUTH_SUCCESS).Message("Auth successful").Get()
 	PREPARED_S_AUTH_FAILED        string = NewSMTPBuilder().Code(CODE_AUTH_FAILED).Message("Auth failed").Get()
-	PREPARED_S_USERNAME64         string = NewSMTPBuilder().Message(string2.To64("Username:")).Get()
-	PREPARED_S_PASSWORD64         string = NewSMTPBuilder().Message(string2.To64("Password:")).Get()
+	PREPARED_S_USERNAME64         string = NewSMTPBuilder().Code(CODE_AUTH_CONTINUE).Message(string2.To64("Username:")).Get()
+	PREPARED_S_PASSWORD64         string = NewSMTPBuilder().Code(CODE_AUTH_CONTINUE).Message(string2.To64("Password:")).Get()
+	PREPARED_S_AUTH_CONTINUE      string = NewSMTPBuilder().Code(CODE_AUTH_CONTINUE).Get()
+	PREPARED_S_AUTH_CANCELLED     string = NewSMTPBuilder().Code(CODE_BAD_SYNTAX).Message("5.0.0 Authentication cancelled").Get()
+	PREPARED_S_AUTH_BAD_RESPONSE  string = NewSMTPBuilder().Code(CODE_BAD_SYNTAX).Message("5.5.2 Cannot decode response").Get()
+	PREPARED_S_AUTH_UNSUPPORTED   string = NewSMTPBuilder().Code(CODE_PARAM_NOT_IMPLEMENTED).Message("5.5.4 Unrecognized authentication type").Get()
+	PREPARED_S_AUTH_ENCRYPTION    string = NewSMTPBuilder().Code(CODE_ENCRYPTION_REQUIRED).Message("5.7.11 Encryption required for requested authentication mechanism").Get()
 	PREPARED_S_TRANSACTION_FAILED string = NewSMTPBuilder().Code(CODE_FAILURE).Message("Transaction failed").Get()
 	PREPARED_S_RELAY_NOT_ALLOWED  string = NewSMTPBuilder().Code(CODE_FAILURE).Message("Cannot relay on this server").Get()
 	PREPARED_S_RELAY_ONLY         string = NewSMTPBuilder().Code(CODE_FAILURE).Message("Relay server").Get()
 	PREPARED_S_START_DATA         string = NewSMTPBuilder().Code(CODE_START_MAIL_INPUT).Message("Start mail input; end with <CRLF>.<CRLF>").Get()
 	PREPARED_S_BYE                string = NewSMTPBuilder().Code(CODE_QUIT).Message("Bye").Get()
+	PREPARED_S_LINE_TOO_LONG      string = NewSMTPBuilder().Code(CODE_INTERNAL_SERVER_ERROR).Message("5.5.2 Line too long").Get()
+	PREPARED_S_BARE_NEWLINE       string = NewSMTPBuilder().Code(CODE_INTERNAL_SERVER_ERROR).Message("5.5.2 Bare <CR> or <LF> not allowed, lines must end with <CRLF>").Get()
+	PREPARED_S_NO_RECIPIENTS      string = NewSMTPBuilder().Code(CODE_BAD_SEQUENCE).Message("5.5.1 No valid recipients").Get()
+	PREPARED_S_XCLIENT_DENIED     string = NewSMTPBuilder().Code(CODE_MAILBOX_UNAVAILABLE).Message("5.7.0 Error: insufficient authorization").Get()
+	PREPARED_S_LOCAL_ERROR        string = NewSMTPBuilder().Code(CODE_LOCAL_ERROR).Message("4.3.0 Local error in processing").Get()
 )
 
 // ADVERTISING
@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/util/network"
+)
+
+// Relay policy: in relay mode, recipients outside config.LocalDomains are relayed
+// Relaying is allowed for authenticated clients and for clients in config.RelayNetworks;
+// everyone else gets PREPARED_S_RELAY_NOT_ALLOWED at RCPT TO
+
+// isLocalRecipient reports whether mail for an address stays on this server
+// Without relay mode every recipient is local
+func (s *ServerConn) isLocalRecipient(address string) bool {
+	if !s.relay {
+		return true
+	}
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		// <Postmaster> without a domain (RFC 5321 section 4.5.1)
+		return true
+	}
+	domain := strings.TrimSuffix(address[at+1:], ".")
+	for _, local := range s.config.LocalDomains {
+		if strings.EqualFold(domain, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayAllowed reports whether the client may send mail to non-local recipients
+// A login or client address from a trusted XCLIENT proxy counts like a real one; XFORWARD does not
+func (s *ServerConn) relayAllowed() bool {
+	session := s.clientSession()
+	if session.Login != "" {
+		return true
+	}
+	return network.Contains(s.relayNetworks, net.ParseIP(session.ClientAddr))
+}
+
+// splitRecipients separates the recipients delivered locally from those to relay
+func (s *ServerConn) splitRecipients(recipients []string) (local []string, remote []string) {
+	local = make([]string, 0)
+	remote = make([]string, 0)
+	for _, rcpt := range recipients {
+		if s.isLocalRecipient(rcpt) {
+			local = append(local, rcpt)
+		} else {
+			remote = append(remote, rcpt)
+		}
+	}
+	return local, remote
+}
@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// Reply is a complete server reply, which may span several lines (RFC 5321 section 4.2.1)
+//
+//	250-mail.example.com Hello
+//	250-SIZE 35882577
+//	250 PIPELINING
+//
+// is one Reply with Code 250 and three Lines
+type Reply struct {
+	Code     protocol.SMTPCode
+	Enhanced string   // Enhanced status code (RFC 3463), e.g. "5.1.1"; "" if the server sent none
+	Lines    []string // Text of every line without the reply code and the enhanced code
+}
+
+// Message returns the reply text with lines joined by a space
+func (r *Reply) Message() string {
+	return strings.Join(r.Lines, " ")
+}
+
+// Positive reports whether the reply is a 2xx or 3xx reply
+func (r *Reply) Positive() bool {
+	return r.Code >= 200 && r.Code < 400
+}
+
+// Temporary reports whether the reply is a transient failure (4xx)
+func (r *Reply) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+// Permanent reports whether the reply is a permanent failure (5xx)
+func (r *Reply) Permanent() bool {
+	return r.Code >= 500 && r.Code < 600
+}
+
+// String returns the reply as sent by the server, one line per reply line
+func (r *Reply) String() string {
+	prefix := fmt.Sprintf("%d", r.Code)
+	if r.Enhanced != "" {
+		prefix += " " + r.Enhanced
+	}
+	lines := make([]string, 0, len(r.Lines))
+	for _, line := range r.Lines {
+		lines = append(lines, strings.TrimRight(prefix+" "+line, " "))
+	}
+	if len(lines) == 0 {
+		return prefix
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ReplyError is returned when the server answers a command with an unexpected reply
+// It carries the complete reply, so callers can inspect the code and every line of text
+type ReplyError struct {
+	Command string // Command that was answered, e.g. "RCPT TO"
+	Reply   *Reply
+}
+
+func (e *ReplyError) Error() string {
+	text := e.Reply.Message()
+	if e.Reply.Enhanced != "" {
+		text = e.Reply.Enhanced + " " + text
+	}
+	if e.Command == "" {
+		return fmt.Sprintf("%d %s", e.Reply.Code, text)
+	}
+	return fmt.Sprintf("%s failed: %d %s", e.Command, e.Reply.Code, text)
+}
+
+// Temporary reports whether the command may succeed if retried later (4xx)
+func (e *ReplyError) Temporary() bool {
+	return e.Reply.Temporary()
+}
+
+// replyFromError returns the server reply carried by err, or nil
+func replyFromError(err error) *Reply {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply
+	}
+	return nil
+}
+
+// Enhanced status codes are class.subject.detail (RFC 3463 section 2)
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// readReply reads one complete reply, following "-" continuation lines
+// Every line must carry the same code, otherwise the session is out of sync
+func (c *ClientConn) readReply() (*Reply, error) {
+	reply := &Reply{Lines: make([]string, 0, 1)}
+	for {
+		response, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		line := strings.TrimRight(response, "\r\n")
+		if len(line) < 3 {
+			return nil, fmt.Errorf("malformed reply: %q", line)
+		}
+		var code protocol.SMTPCode
+		if _, err := fmt.Sscanf(line[:3], "%d", &code); err != nil || code < 200 || code > 599 {
+			return nil, fmt.Errorf("malformed reply code: %q", line)
+		}
+		if len(reply.Lines) > 0 && code != reply.Code {
+			return nil, fmt.Errorf("inconsistent reply codes %d and %d in multi-line reply", reply.Code, code)
+		}
+		reply.Code = code
+
+		// "250-text" continues, "250 text" or a bare "250" ends the reply
+		more := len(line) > 3 && line[3] == '-'
+		if len(line) > 3 && line[3] != '-' && line[3] != ' ' {
+			return nil, fmt.Errorf("malformed reply: %q", line)
+		}
+		text := ""
+		if len(line) > 4 {
+			text = strings.TrimSpace(line[4:])
+		}
+		// The enhanced code is repeated on every line (RFC 2034 section 4)
+		if first, rest, _ := strings.Cut(text, " "); enhancedCodePattern.MatchString(first) {
+			if reply.Enhanced == "" {
+				reply.Enhanced = first
+			}
+			text = strings.TrimSpace(rest)
+		}
+		reply.Lines = append(reply.Lines, text)
+
+		if !more {
+			return reply, nil
+		}
+	}
+}
+
+// expectReply reads a reply and returns a *ReplyError if its code is not the expected one
+func (c *ClientConn) expectReply(command string, expect protocol.SMTPCode) (*Reply, error) {
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", command, err)
+	}
+	if reply.Code != expect {
+		return reply, &ReplyError{Command: command, Reply: reply}
+	}
+	return reply, nil
+}
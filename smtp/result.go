@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// RecipientResult is the server's verdict for one envelope recipient
+// Over SMTP it is the reply to RCPT TO; over LMTP the per-recipient reply after DATA
+// replaces it for every recipient that RCPT TO accepted
+type RecipientResult struct {
+	Recipient string
+	Code      protocol.SMTPCode
+	Enhanced  string // Enhanced status code (RFC 3463), e.g. "5.1.1"; "" if the server sent none
+	Message   string // Reply text without the codes
+}
+
+// Accepted reports whether the server took responsibility for this recipient (2xx)
+func (r RecipientResult) Accepted() bool {
+	return r.Code >= 200 && r.Code < 300
+}
+
+// Temporary reports whether the failure is transient (4xx) and may be retried later
+func (r RecipientResult) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+func (r RecipientResult) String() string {
+	if r.Enhanced != "" {
+		return fmt.Sprintf("%s: %d %s %s", r.Recipient, r.Code, r.Enhanced, r.Message)
+	}
+	return fmt.Sprintf("%s: %d %s", r.Recipient, r.Code, r.Message)
+}
+
+// SendResult describes the outcome of one Send
+// A message is delivered to the accepted recipients even if others were rejected
+type SendResult struct {
+	Recipients   []RecipientResult // One entry per envelope recipient, in RCPT TO order
+	DataCode     protocol.SMTPCode // Final reply to the message (0 if DATA was never completed)
+	DataEnhanced string
+	DataMessage  string
+	QueueID      string // Server queue ID parsed from the final reply ("" if not recognized)
+	DSN          bool   // The server supports DSN and got the NOTIFY/RET requests; it sends the notifications from now on
+}
+
+// Accepted returns the recipients the server accepted
+func (r *SendResult) Accepted() []RecipientResult {
+	return r.filter(true)
+}
+
+// Rejected returns the recipients the server refused, e.g. to record bounces per address
+func (r *SendResult) Rejected() []RecipientResult {
+	return r.filter(false)
+}
+
+func (r *SendResult) filter(accepted bool) []RecipientResult {
+	results := make([]RecipientResult, 0)
+	for _, rcpt := range r.Recipients {
+		if rcpt.Accepted() == accepted {
+			results = append(results, rcpt)
+		}
+	}
+	return results
+}
+
+// newRecipientResult builds the result for a recipient from the server's reply
+func newRecipientResult(recipient string, reply *Reply) RecipientResult {
+	return RecipientResult{Recipient: recipient, Code: reply.Code, Enhanced: reply.Enhanced, Message: reply.Message()}
+}
+
+// setDataReply records the final reply to the message
+func (r *SendResult) setDataReply(reply *Reply) {
+	r.DataCode = reply.Code
+	r.DataEnhanced = reply.Enhanced
+	r.DataMessage = reply.Message()
+	r.QueueID = parseQueueID(r.DataMessage)
+}
+
+// Common queue ID formats in final DATA replies
+var queueIDPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)queued as ([0-9A-Za-z]+)`),      // Postfix: "Ok: queued as 4F2D61C2A3"
+	regexp.MustCompile(`(?i)\bid=([0-9A-Za-z-]+)`),          // Exim: "OK id=1r2s3t-000AbC-4d"
+	regexp.MustCompile(`(?i)^OK\s+\d+\s+(\S+)\s+-\s+gsmtp`), // Gmail: "OK  1700000000 a1b2c3si - gsmtp"
+}
+
+// parseQueueID extracts the queue ID from the text of the final DATA reply
+func parseQueueID(message string) string {
+	for _, pattern := range queueIDPatterns {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package smtp
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+)
+
+// Server side SMTP AUTH (RFC 4954) with PLAIN (RFC 4616) and LOGIN
+// AUTH is only offered in relay mode, where it lets clients relay mail
+
+// authenticator returns the credential check for AUTH, or nil if AUTH is disabled
+// Handlers.Authenticator wins over the SMTP_RELAY_USERNAME / SMTP_RELAY_PASSWORD pair
+func (s *ServerConn) authenticator() Authenticator {
+	if s.handlers != nil && s.handlers.Authenticator != nil {
+		return s.handlers.Authenticator
+	}
+	if s.config.RelayUsername == "" {
+		return nil
+	}
+	return func(username string, password string) bool {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.RelayUsername)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.RelayPassword)) == 1
+		return userOK && passOK
+	}
+}
+
+// authAvailable reports whether EHLO advertises AUTH
+// With STARTTLS available, AUTH is only offered after it so passwords never travel in the clear
+func (s *ServerConn) authAvailable() bool {
+	return s.relay && s.authenticator() != nil && (s.tlsConfig == nil || s.isTLS())
+}
+
+// handleAuth runs an AUTH exchange
+// Format: AUTH PLAIN [initial-response] or AUTH LOGIN [base64-username]
+func (s *ServerConn) handleAuth(line string) {
+	authenticate := s.authenticator()
+	if !s.relay || authenticate == nil {
+		s.write(protocol.PREPARED_S_BAD_COMMAND)
+		return
+	}
+	// Only after EHLO, outside a transaction and once per session (RFC 4954 section 4)
+	if s.state != protocol.STATE_MAIL_FROM || !s.esmtp || s.login != "" {
+		s.write(protocol.PREPARED_S_BAD_SEQUENCE)
+		return
+	}
+	if s.tlsConfig != nil && !s.isTLS() {
+		s.write(protocol.PREPARED_S_AUTH_ENCRYPTION)
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		s.write(protocol.PREPARED_S_BAD_SYNTAX)
+		return
+	}
+	initial := ""
+	if len(fields) == 3 {
+		initial = fields[2]
+	}
+
+	var username, password string
+	switch protocol.SMTPAuthMechanism(strings.ToUpper(fields[1])) {
+	case protocol.AUTH_PLAIN:
+		response, ok := s.authResponse(initial, protocol.PREPARED_S_AUTH_CONTINUE)
+		if !ok {
+			return
+		}
+		// authzid NUL authcid NUL passwd; acting as another user is not supported
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+			s.write(protocol.PREPARED_S_AUTH_FAILED)
+			return
+		}
+		username, password = parts[1], parts[2]
+	case protocol.AUTH_LOGIN:
+		var ok bool
+		if username, ok = s.authResponse(initial, protocol.PREPARED_S_USERNAME64); !ok {
+			return
+		}
+		if password, ok = s.authResponse("", protocol.PREPARED_S_PASSWORD64); !ok {
+			return
+		}
+	default:
+		s.write(protocol.PREPARED_S_AUTH_UNSUPPORTED)
+		return
+	}
+
+	if username == "" || !authenticate(username, password) {
+		s.write(protocol.PREPARED_S_AUTH_FAILED)
+		return
+	}
+	s.login = username
+	s.write(protocol.PREPARED_S_AUTH_SUCCESS)
+}
+
+// authResponse returns the decoded client response: the initial response if one was given
+// ("=" stands for an empty one), otherwise the answer to challenge
+// It replies itself and returns false if the client cancelled or sent invalid base64
+func (s *ServerConn) authResponse(initial string, challenge string) (string, bool) {
+	encoded := initial
+	if encoded == "" {
+		if !s.write(challenge) {
+			return "", false
+		}
+		encoded = strings.TrimSpace(s.read())
+		if encoded == "" {
+			// Connection closed
+			return "", false
+		}
+		if encoded == "*" {
+			s.write(protocol.PREPARED_S_AUTH_CANCELLED)
+			return "", false
+		}
+	}
+	if encoded == "=" {
+		return "", true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		s.write(protocol.PREPARED_S_AUTH_BAD_RESPONSE)
+		return "", false
+	}
+	return string(decoded), true
+}
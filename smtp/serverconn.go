@@ -3,6 +3,7 @@ package smtp
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -14,25 +15,37 @@ import (
 	"github.com/ImBubbles/MySMTP/config"
 	"github.com/ImBubbles/MySMTP/mail"
 	"github.com/ImBubbles/MySMTP/smtp/protocol"
-	smtputil "github.com/ImBubbles/MySMTP/util/smtp"
+	"github.com/ImBubbles/MySMTP/util/conn"
+	"github.com/ImBubbles/MySMTP/util/network"
 	stringutil "github.com/ImBubbles/MySMTP/util/string"
 	"github.com/ImBubbles/MySMTP/util/verify"
 )
 
 // ServerConn handle client connections to the SMTP server
 type ServerConn struct {
-	client         net.Conn // Changed from *net.Conn to net.Conn - direct reference
-	state          protocol.SMTPStates
-	reader         *bufio.Reader
-	relay          bool
-	requireTLS     bool
-	tlsConfig      *tls.Config
-	size           uint64
-	body           protocol.SMTPBody
-	mail           mail.Mail
-	config         *config.Config
-	senderVerifier *verify.EmailVerifier
-	handlers       *Handlers
+	client          net.Conn // Changed from *net.Conn to net.Conn - direct reference
+	state           protocol.SMTPStates
+	reader          *bufio.Reader
+	relay           bool
+	requireTLS      bool
+	tlsConfig       *tls.Config
+	size            uint64
+	body            protocol.SMTPBody
+	mail            mail.Mail
+	config          *config.Config
+	senderVerifier  *verify.EmailVerifier
+	handlers        *Handlers
+	params          *protocol.ParamRegistry // Accepted MAIL FROM / RCPT TO parameters
+	strict          bool                    // CRLF-only lines of at most 1000 octets
+	helo            string                  // Domain given in HELO/EHLO
+	esmtp           bool                    // Client greeted with EHLO rather than HELO
+	peerIP          net.IP                  // Address of the connected peer (after any PROXY header)
+	xclientNetworks []*net.IPNet            // Peers allowed to use XCLIENT / XFORWARD
+	xclient         map[string]string       // Session attributes overridden by XCLIENT
+	xforward        map[string]string       // Session attributes overridden by XFORWARD (current transaction)
+	lmtp            bool                    // Speak LMTP (RFC 2033) instead of SMTP
+	login           string                  // User name from a successful AUTH
+	relayNetworks   []*net.IPNet            // Clients allowed to relay without AUTH
 }
 
 // NewServerConn creates a new server connection
@@ -60,18 +73,39 @@ func NewServerConnWithHandlers(conn net.Conn, cfg *config.Config, handlers *Hand
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
 
+	// Networks allowed to use XCLIENT / XFORWARD (invalid entries disable the feature)
+	xclientNetworks, err := network.ParseNetworks(cfg.XClientTrustedNetworks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SERVER: Invalid SMTP_XCLIENT_TRUSTED_NETWORKS, XCLIENT disabled: %v\n", err)
+		xclientNetworks = nil
+	}
+	// Networks allowed to relay without AUTH (invalid entries leave AUTH as the only way)
+	relayNetworks, err := network.ParseNetworks(cfg.RelayNetworks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SERVER: Invalid SMTP_RELAY_NETWORKS, relaying requires AUTH: %v\n", err)
+		relayNetworks = nil
+	}
+
 	serverConn := &ServerConn{
-		client:         conn, // Direct assignment, no pointer
-		state:          protocol.STATE_EHLO,
-		reader:         bufio.NewReader(conn),
-		relay:          cfg.Relay,
-		requireTLS:     cfg.RequireTLS,
-		tlsConfig:      tlsConfig, // Use provided TLS config
-		size:           0,
-		body:           protocol.BODY_8BITMIME,
-		config:         cfg,
-		senderVerifier: verifier,
-		handlers:       handlers}
+		client:          conn, // Direct assignment, no pointer
+		state:           protocol.STATE_EHLO,
+		reader:          bufio.NewReader(conn),
+		relay:           cfg.Relay && !cfg.LMTP, // LMTP never relays
+		requireTLS:      cfg.RequireTLS,
+		tlsConfig:       tlsConfig, // Use provided TLS config
+		size:            0,
+		body:            protocol.BODY_8BITMIME,
+		config:          cfg,
+		senderVerifier:  verifier,
+		handlers:        handlers,
+		params:          protocol.DefaultParamRegistry,
+		strict:          cfg.StrictProtocol,
+		peerIP:          network.AddrIP(conn.RemoteAddr()),
+		xclientNetworks: xclientNetworks,
+		xclient:         make(map[string]string),
+		xforward:        make(map[string]string),
+		lmtp:            cfg.LMTP,
+		relayNetworks:   relayNetworks}
 	serverConn.handle()
 	return serverConn
 }
@@ -133,7 +167,10 @@ func (s *ServerConn) handle() {
 		// Match commands - use strings.EqualFold for case-insensitive comparison
 		// This is more robust than string comparison
 		switch {
-		case command == "EHLO" || command == "HELO":
+		case (command == "EHLO" || command == "HELO") && !s.lmtp:
+			s.handleEHLO(line)
+		case command == "LHLO" && s.lmtp:
+			// LMTP (RFC 2033) uses LHLO instead of EHLO/HELO
 			s.handleEHLO(line)
 		case command == "MAIL":
 			s.handleMailFrom(line)
@@ -143,11 +180,22 @@ func (s *ServerConn) handle() {
 			s.handleData(line)
 		case command == "STARTTLS":
 			s.handleStartTLS(line)
+		case command == "AUTH" && !s.lmtp:
+			s.handleAuth(line)
 		case command == "QUIT":
 			s.handleQuit(line)
 			return // Connection will close
 		case command == "RSET":
 			s.handleRset(line)
+		case command == "NOOP":
+			// NOOP has no effect on the session (RFC 5321 section 4.1.1.9)
+			if !s.write(protocol.PREPARED_S_ACKNOWLEDGE) {
+				return
+			}
+		case command == "XCLIENT":
+			s.handleXClient(line)
+		case command == "XFORWARD":
+			s.handleXForward(line)
 		default:
 			if !s.write(protocol.PREPARED_S_BAD_COMMAND) {
 				return // Connection broken
@@ -204,63 +252,87 @@ func (s *ServerConn) write(str string) bool {
 	return true
 }
 
-func (s *ServerConn) read() string {
+// readLine reads one raw line from the client, keeping its original line ending
+// Lines longer than conn.MaxLineLength (conn.MaxLenientLineLength in lenient mode) are consumed
+// and reported as tooLong
+// ok is false when the connection is closed or broken
+func (s *ServerConn) readLine() (line string, tooLong bool, ok bool) {
 	if s.client == nil || s.reader == nil {
-		return ""
+		return "", false, false
 	}
 
 	// Set read deadline to prevent indefinite blocking
 	// Use longer timeout for SMTP (clients might take time to respond)
 	s.client.SetReadDeadline(time.Now().Add(60 * time.Second))
 
-	// Use ReadLine directly instead of wrapper for better control
-	line, isPrefix, err := s.reader.ReadLine()
+	limit := conn.MaxLenientLineLength
+	if s.strict {
+		limit = conn.MaxLineLength
+	}
+	raw, tooLong, err := conn.ReadRawLine(s.reader, limit)
 	if err != nil {
 		if err == io.EOF {
 			fmt.Printf("SERVER <- CLIENT: (EOF - connection closed)\n")
-			return ""
+			return "", false, false
 		}
 		// Check if it's a timeout error
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			// Timeout - might be normal, but log it
 			fmt.Printf("SERVER <- CLIENT: (timeout waiting for command)\n")
-			return ""
+			return "", false, false
 		}
 		// Other errors
 		fmt.Printf("SERVER <- CLIENT: (read error: %v)\n", err)
-		return ""
+		return "", false, false
 	}
 
-	// Handle long lines (shouldn't happen in SMTP, but be safe)
-	var fullLine []byte = line
-	for isPrefix {
-		line, isPrefix, err = s.reader.ReadLine()
-		if err != nil {
-			if err == io.EOF {
-				break
+	// Print transmission from client (trim \r\n for cleaner output)
+	if tooLong {
+		fmt.Printf("SERVER <- CLIENT: (line longer than %d octets)\n", limit)
+	} else {
+		fmt.Printf("SERVER <- CLIENT: %s\n", strings.TrimRight(string(raw), "\r\n"))
+	}
+	return string(raw), tooLong, true
+}
+
+// hasBareNewline reports whether a raw line violates CRLF-only line endings:
+// it must end with CRLF and contain no other CR or LF
+func hasBareNewline(raw string) bool {
+	if !strings.HasSuffix(raw, "\r\n") {
+		return true
+	}
+	return strings.ContainsAny(raw[:len(raw)-2], "\r\n")
+}
+
+// read reads the next command line, normalized to end with CRLF
+// Protocol violations (line too long, bare LF in strict mode) are answered here and skipped
+// Returns "" when the connection is closed
+func (s *ServerConn) read() string {
+	for {
+		raw, tooLong, ok := s.readLine()
+		if !ok {
+			return ""
+		}
+		if tooLong {
+			if !s.write(protocol.PREPARED_S_LINE_TOO_LONG) {
+				return ""
 			}
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				break
+			continue
+		}
+		if s.strict && hasBareNewline(raw) {
+			if !s.write(protocol.PREPARED_S_BARE_NEWLINE) {
+				return ""
 			}
-			break
+			continue
 		}
-		fullLine = append(fullLine, line...)
+		// Convert to string and append CRLF (SMTP standard)
+		return strings.TrimRight(raw, "\r\n") + "\r\n"
 	}
-
-	// Convert to string and append CRLF (SMTP standard)
-	lineStr := string(fullLine) + "\r\n"
-
-	// Print transmission from client (trim \r\n for cleaner output)
-	output := strings.TrimRight(lineStr, "\r\n")
-	fmt.Printf("SERVER <- CLIENT: %s\n", output)
-
-	return lineStr
 }
 
+// A repeated EHLO is allowed at any point and resets the mail transaction (RFC 5321 section 4.1.4)
 func (s *ServerConn) handleEHLO(line string) {
-	if s.state != protocol.STATE_EHLO {
-		return
-	}
+	s.resetTransaction()
 	// Extract domain (for validation)
 	parts := strings.Split(line, " ")
 	if len(parts) < 2 {
@@ -272,6 +344,8 @@ func (s *ServerConn) handleEHLO(line string) {
 
 	// Get client domain from EHLO command
 	clientDomain := parts[1]
+	s.helo = clientDomain
+	s.esmtp = strings.EqualFold(parts[0], string(protocol.COMMAND_EHLO)) || strings.EqualFold(parts[0], string(protocol.COMMAND_LHLO))
 	// Respond with success code and supported extensions
 	// Use configured server domain instead of client's domain
 	serverDomain := s.config.ServerDomain
@@ -292,15 +366,36 @@ func (s *ServerConn) handleEHLO(line string) {
 		}
 	}
 
-	if s.relay {
+	// XCLIENT / XFORWARD are only offered to trusted proxies
+	if s.isXClientTrusted() {
+		if !s.write(fmt.Sprintf("250-XCLIENT %s\r\n", strings.Join(xclientAttributes, " "))) {
+			return
+		}
+		if !s.write(fmt.Sprintf("250-XFORWARD %s\r\n", strings.Join(xforwardAttributes, " "))) {
+			return
+		}
+	}
+
+	if s.authAvailable() {
 		// 250-AUTH <method>
 		if !s.write("250-AUTH PLAIN LOGIN\r\n") {
 			return
 		}
 	}
-	// 250-8BITMIME
-	if !s.write("250-8BITMIME\r\n") {
-		return
+	// LMTP servers must support PIPELINING and ENHANCEDSTATUSCODES (RFC 2033 section 5)
+	if s.lmtp {
+		if !s.write("250-PIPELINING\r\n") {
+			return
+		}
+		if !s.write("250-ENHANCEDSTATUSCODES\r\n") {
+			return
+		}
+	}
+	// 250-8BITMIME, 250-SIZE, 250-DSN, ... from the registered MAIL/RCPT parameters
+	for _, extension := range s.params.Extensions() {
+		if !s.write(fmt.Sprintf("250-%s\r\n", extension)) {
+			return
+		}
 	}
 
 	// Final line: 250 <final message> (with space, not hyphen)
@@ -308,16 +403,12 @@ func (s *ServerConn) handleEHLO(line string) {
 		return
 	}
 
-	if s.relay {
-		s.state = protocol.STATE_AUTH
-		return
-	}
-	s.state = protocol.STATE_MAIL_FROM
-
+	s.state = s.readyState()
 }
 
 // Expecting MAIL FROM:<address>
 // OR something like MAIL FROM:<user@example.com> [SIZE=12345] [BODY=8BITMIME] [SMTPUTF8]
+// Parameters are validated against the parameter registry (unknown parameters get 555)
 
 func (s *ServerConn) handleMailFrom(line string) {
 	if s.state != protocol.STATE_MAIL_FROM {
@@ -327,51 +418,15 @@ func (s *ServerConn) handleMailFrom(line string) {
 		return
 	}
 
-	// MAIL FROM command should be case-insensitive per SMTP spec
-	upperLine := strings.ToUpper(line)
-	if !strings.HasPrefix(upperLine, "MAIL FROM:") {
-		if !s.write(protocol.PREPARED_S_BAD_COMMAND) {
-			return
-		}
-		return
-	}
-	// Find the colon (should be at ": " or just ":")
-	colonIndex := strings.Index(line, ":")
-	if colonIndex == -1 {
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
-		return
-	}
-	remainder := strings.TrimSpace(line[colonIndex+1:])
-
-	if remainder == "" {
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
-		return
-	}
-
-	// Extract address (should be in <address> format)
-	addEnd := strings.Index(remainder, ">")
-	if addEnd == -1 {
-		// No closing bracket found
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
-		return
-	}
-	address := smtputil.CleanEmail(remainder[:addEnd+1])
-	if address == "" {
-		// Invalid address
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
+	cmd, err := protocol.ParseMailFrom(line, s.params)
+	if err != nil {
+		s.writeCommandError(err)
 		return
 	}
 
-	// Verify sender email address
-	if s.senderVerifier != nil && !s.senderVerifier.VerifyEmail(address) {
+	// The null reverse-path (<>) is used for bounces and is never verified
+	address := cmd.Path.Mailbox()
+	if !cmd.Path.Null && s.senderVerifier != nil && !s.senderVerifier.VerifyEmail(address) {
 		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
 			return
 		}
@@ -379,34 +434,11 @@ func (s *ServerConn) handleMailFrom(line string) {
 	}
 
 	s.mail.SetFrom(address)
-
-	// Check if there are parameters after the address
-	if len(remainder) > addEnd+1 {
-		remainder = strings.ToUpper(remainder)
-		// get paramters now
-		params := strings.Split(strings.TrimSpace(remainder[addEnd+1:]), " ")
-
-		for _, param := range params {
-			param = strings.TrimSpace(param)
-			if param == "" {
-				continue
-			}
-			eqIndex := strings.Index(param, "=")
-			var key string
-			var value string = ""
-			if eqIndex == -1 {
-				// No value, just key
-				key = param
-			} else {
-				// Has value
-				key = strings.TrimSpace(param[:eqIndex])
-				value = strings.TrimSpace(param[eqIndex+1:])
-			}
-			if key != "" && protocol.SMTP_VALID_FLAGS.Contains(protocol.SMTPFromFlags(key)) {
-				// Valid flag
-				flag := mail.NewFlag(key, value)
-				s.mail.AppendFlag(mail.FromFlag(*flag))
-			}
+	for _, param := range cmd.Params {
+		flag := mail.NewFlag(param.Keyword, param.Value)
+		s.mail.AppendFlag(mail.FromFlag(*flag))
+		if param.Keyword == string(protocol.FLAG_BODY) {
+			s.body = protocol.SMTPBody(strings.ToUpper(param.Value))
 		}
 	}
 
@@ -419,57 +451,35 @@ func (s *ServerConn) handleMailFrom(line string) {
 
 }
 
-func (s *ServerConn) handleRctpTo(line string) { // todo handle NOTIFY=SUCCESS,FAILURE,DENY
+// Expecting RCPT TO:<address> [NOTIFY=SUCCESS,FAILURE,DELAY] [ORCPT=rfc822;address]
+
+func (s *ServerConn) handleRctpTo(line string) {
 	if s.state != protocol.STATE_RCPT_TO {
 		if !s.write(protocol.PREPARED_S_BAD_SEQUENCE) {
 			return
 		}
 		return
 	}
-	// RCPT TO command should be case-insensitive per SMTP spec
-	// Expected format is "RCPT TO:<address>"
-	upperLine := strings.ToUpper(line)
-	if !strings.HasPrefix(upperLine, "RCPT TO:") {
-		if !s.write(protocol.PREPARED_S_BAD_COMMAND) {
-			return
-		}
-		return
-	}
-	// Find the colon (should be at ": " or just ":")
-	colonIndex := strings.Index(line, ":")
-	if colonIndex == -1 {
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
-		return
-	}
-	remainder := strings.TrimSpace(line[colonIndex+1:])
-	if remainder == "" {
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
-		return
-	}
-	// Extract address (should be in <address> format)
-	addEnd := strings.Index(remainder, ">")
-	if addEnd == -1 {
-		// No closing bracket found
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
-			return
-		}
+
+	cmd, err := protocol.ParseRcptTo(line, s.params)
+	if err != nil {
+		s.writeCommandError(err)
 		return
 	}
-	address := smtputil.CleanEmail(remainder[:addEnd+1])
-	if address == "" {
-		// Invalid address
-		if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
+	address := cmd.Path.Mailbox()
+
+	// Relay mode: recipients outside the local domains need relay permission
+	// and are not checked against the local mailboxes
+	local := s.isLocalRecipient(address)
+	if !local && !s.relayAllowed() {
+		if !s.write(protocol.PREPARED_S_RELAY_NOT_ALLOWED) {
 			return
 		}
 		return
 	}
 
 	// Check if email exists using handler (default returns false)
-	if s.handlers != nil && s.handlers.EmailExistsChecker != nil {
+	if local && s.handlers != nil && s.handlers.EmailExistsChecker != nil {
 		if !s.handlers.EmailExistsChecker(address) {
 			// Email does not exist
 			if !s.write(protocol.PREPARED_S_BAD_SYNTAX) {
@@ -480,11 +490,25 @@ func (s *ServerConn) handleRctpTo(line string) { // todo handle NOTIFY=SUCCESS,F
 	}
 
 	s.mail.AppendTo(address)
+	for _, param := range cmd.Params {
+		flag := mail.NewFlag(param.Keyword, param.Value)
+		s.mail.AppendRcptFlag(address, mail.FromFlag(*flag))
+	}
 	if !s.write(protocol.PREPARED_S_ACKNOWLEDGE) {
 		return
 	}
 }
 
+// writeCommandError sends the reply for a MAIL/RCPT parse error
+func (s *ServerConn) writeCommandError(err error) {
+	var cmdErr *protocol.CommandError
+	if errors.As(err, &cmdErr) {
+		s.write(cmdErr.Reply())
+		return
+	}
+	s.write(protocol.PREPARED_S_BAD_SYNTAX)
+}
+
 func (s *ServerConn) handleData(line string) {
 	if s.state == protocol.STATE_RCPT_TO {
 		s.state = protocol.STATE_DATA
@@ -495,6 +519,12 @@ func (s *ServerConn) handleData(line string) {
 		}
 		return
 	}
+	// DATA needs at least one accepted recipient
+	if len(s.mail.GetTo()) == 0 {
+		s.state = protocol.STATE_RCPT_TO
+		s.write(protocol.PREPARED_S_NO_RECIPIENTS)
+		return
+	}
 	if !s.write(protocol.PREPARED_S_START_DATA) {
 		return
 	}
@@ -507,19 +537,26 @@ func (s *ServerConn) handleData(line string) {
 	currentHeaderName := ""
 	currentHeaderValue := *stringutil.NewStringBuilder()
 
+	// In strict mode a violation does not abort reading: the rest of the message is consumed
+	// up to the next ".<CRLF>" that follows a line ending in <CRLF>, and then rejected
+	var violation string
+	// The DATA command line ended with <CRLF>, so a "." on the first line ends the message
+	previousCRLF := true
+
 	for {
-		rawLine := s.read()
+		rawLine, tooLong, ok := s.readLine()
 		// Check if connection was closed (empty read means connection closed)
-		if rawLine == "" {
+		if !ok {
 			fmt.Printf("SERVER: Connection closed by client during DATA\n")
 			return // Connection broken during DATA phase
 		}
 
-		trimmedLine := strings.TrimSpace(rawLine)
-
-		// Check for terminator first (line containing only ".")
-		// The terminator is a line that when trimmed is just "."
-		isTerminator := trimmedLine == "."
+		// Check for terminator first
+		// Only <CRLF>.<CRLF> ends the message, in both modes: ".<LF>", a "." after a bare LF
+		// (<LF>.<CRLF>, <LF>.<LF>) and variants such as " . " are the SMTP smuggling patterns
+		// A bare-LF client therefore has to end the message with <CRLF>.<CRLF> even in lenient mode
+		isTerminator := previousCRLF && rawLine == ".\r\n"
+		previousCRLF = strings.HasSuffix(rawLine, "\r\n")
 		if isTerminator {
 			// Process any pending header before breaking
 			if inHeaders && currentHeaderName != "" {
@@ -529,6 +566,27 @@ func (s *ServerConn) handleData(line string) {
 			break
 		}
 
+		if tooLong {
+			if violation == "" {
+				violation = protocol.PREPARED_S_LINE_TOO_LONG
+			}
+			continue
+		}
+		if s.strict && hasBareNewline(rawLine) {
+			if violation == "" {
+				violation = protocol.PREPARED_S_BARE_NEWLINE
+			}
+			continue
+		}
+		if violation != "" {
+			// Message will be rejected - just drain it
+			continue
+		}
+
+		// Normalize line ending to CRLF (lenient mode may deliver bare LF)
+		rawLine = strings.TrimRight(rawLine, "\r\n") + "\r\n"
+		trimmedLine := strings.TrimSpace(rawLine)
+
 		// Handle SMTP transparency: lines starting with "." need the leading "." removed
 		// The terminator was already handled above, so we can safely remove leading dots
 		line := rawLine
@@ -587,16 +645,77 @@ func (s *ServerConn) handleData(line string) {
 		}
 	}
 
+	// Reject the message if a line violated the protocol
+	if violation != "" {
+		// LMTP expects one reply per accepted recipient
+		replies := 1
+		if s.lmtp {
+			replies = len(s.mail.GetTo())
+		}
+		s.resetTransaction()
+		s.state = s.readyState()
+		for i := 0; i < replies; i++ {
+			if !s.write(violation) {
+				return
+			}
+		}
+		return
+	}
+
 	// Store the complete email data (headers + body)
 	fullData := headers.AsString()
 	if bodyStarted {
 		fullData += body.AsString()
 	}
+	// DKIM (RFC 6376) is verified on the message as the client sent it; the verdict goes into
+	// Authentication-Results, replacing any that claim to be ours
+	if s.config.DKIMVerify {
+		results := s.verifyDKIM(fullData)
+		s.mail.SetDKIMResults(results)
+		fullData = s.authenticationResults(results) + removeAuthenticationResults(fullData, s.config.ServerDomain)
+	}
+	// Prepend the trace header (RFC 5321 section 4.4)
+	fullData = s.receivedHeader() + fullData
 	s.mail.SetData(fullData)
+	s.mail.SetRaw(true)
+	s.mail.SetSession(s.session())
+
+	// The handler gets its own copy so it may keep it after the transaction is reset
+	received := s.mail
+	s.resetTransaction()
+	s.state = s.readyState()
+
+	if s.lmtp {
+		s.deliverLMTP(&received)
+		return
+	}
+
+	// Relay mode: the RelayHandler takes the non-local recipients and MailHandler gets a copy
+	// with only the local ones; without a RelayHandler, MailHandler gets every recipient as before
+	local, remote := s.splitRecipients(received.GetTo())
+	if s.handlers == nil || s.handlers.RelayHandler == nil {
+		local, remote = received.GetTo(), nil
+	}
+
+	// Relayed mail is handed over first: if that fails nothing was delivered yet, so the
+	// client can safely retry the whole message without local recipients getting it twice
+	if len(remote) > 0 {
+		if err := s.handlers.RelayHandler(&received, remote); err != nil {
+			var cmdErr *protocol.CommandError
+			if errors.As(err, &cmdErr) {
+				s.write(cmdErr.Reply())
+				return
+			}
+			s.write(protocol.PREPARED_S_LOCAL_ERROR)
+			return
+		}
+	}
 
 	// Process mail using handler if set (override handling of finished email)
-	if s.handlers != nil && s.handlers.MailHandler != nil {
-		if err := s.handlers.MailHandler(&s.mail); err != nil {
+	if len(local) > 0 && s.handlers != nil && s.handlers.MailHandler != nil {
+		localMail := received
+		localMail.SetTo(local...)
+		if err := s.handlers.MailHandler(&localMail); err != nil {
 			// Handler rejected the mail
 			if !s.write(protocol.PREPARED_S_TRANSACTION_FAILED) {
 				return
@@ -609,9 +728,81 @@ func (s *ServerConn) handleData(line string) {
 	if !s.write(protocol.PREPARED_S_ACKNOWLEDGE) {
 		return
 	}
+}
 
-	// Reset state for next transaction
-	s.state = protocol.STATE_EHLO
+// deliverLMTP runs the handlers for a completed LMTP transaction and sends one reply
+// per accepted recipient, in RCPT order (RFC 2033 section 4.2)
+// RecipientHandler decides per recipient; without it MailHandler's result applies to everyone
+func (s *ServerConn) deliverLMTP(m *mail.Mail) {
+	var mailErr error
+	if s.handlers == nil || s.handlers.RecipientHandler == nil {
+		if s.handlers != nil && s.handlers.MailHandler != nil {
+			mailErr = s.handlers.MailHandler(m)
+		}
+	}
+
+	for _, rcpt := range m.GetTo() {
+		err := mailErr
+		if s.handlers != nil && s.handlers.RecipientHandler != nil {
+			err = s.handlers.RecipientHandler(m, rcpt)
+		}
+		if !s.write(lmtpReply(rcpt, err)) {
+			return
+		}
+	}
+}
+
+// lmtpReply builds the per-recipient reply after DATA
+// A *protocol.CommandError from the handler controls the reply code; other errors give 554
+func lmtpReply(rcpt string, err error) string {
+	if err == nil {
+		return protocol.NewSMTPBuilder().Code(protocol.CODE_ACKNOWLEDGE).Message(fmt.Sprintf("2.1.5 <%s> Delivered", rcpt)).Get()
+	}
+	var cmdErr *protocol.CommandError
+	if errors.As(err, &cmdErr) {
+		return protocol.NewSMTPBuilder().Code(cmdErr.Code).Message(fmt.Sprintf("%s <%s> %s", cmdErr.Enhanced, rcpt, cmdErr.Message)).Get()
+	}
+	return protocol.NewSMTPBuilder().Code(protocol.CODE_FAILURE).Message(fmt.Sprintf("5.0.0 <%s> Transaction failed", rcpt)).Get()
+}
+
+// resetTransaction discards the current mail transaction and any XFORWARD attributes
+func (s *ServerConn) resetTransaction() {
+	s.mail = mail.Mail{}
+	s.xforward = make(map[string]string)
+}
+
+// readyState is the state to return to once a transaction ends (DATA, RSET)
+// The greeting stays valid, so a greeted client can start the next transaction with MAIL FROM
+func (s *ServerConn) readyState() protocol.SMTPStates {
+	if s.helo == "" {
+		return protocol.STATE_EHLO
+	}
+	return protocol.STATE_MAIL_FROM
+}
+
+// isTLS reports whether the connection has been upgraded with STARTTLS
+func (s *ServerConn) isTLS() bool {
+	_, ok := s.client.(*tls.Conn)
+	return ok
+}
+
+// receivedHeader builds the Received: trace header for the current transaction
+// The client address comes from the connection, so it reflects any PROXY protocol header,
+// and is replaced by XCLIENT / XFORWARD attributes from a trusted proxy
+func (s *ServerConn) receivedHeader() string {
+	session := s.session()
+	clientAddr := session.ClientAddr
+	if clientAddr == "" {
+		clientAddr = "unknown"
+	}
+	from := session.Helo
+	if session.ClientName != "" {
+		from += " (" + session.ClientName + " [" + clientAddr + "])"
+	} else {
+		from += " ([" + clientAddr + "])"
+	}
+	return fmt.Sprintf("Received: from %s\r\n\tby %s with %s;\r\n\t%s\r\n",
+		from, s.config.ServerHostname, session.Protocol, time.Now().Format(time.RFC1123Z))
 }
 
 // processHeader parses and stores header information
@@ -621,17 +812,18 @@ func (s *ServerConn) processHeader(headerName string, headerValue string) {
 	// Parse common headers
 	switch headerNameUpper {
 	case "SUBJECT":
-		s.mail.SetSubject(headerValue)
+		// Encoded words (RFC 2047) are stored decoded
+		s.mail.SetSubject(mail.DecodeHeader(headerValue))
 	case "CC":
-		// Parse CC addresses (can be comma-separated)
-		addresses := mail.ParseNamedAddress(headerName + ": " + headerValue)
-		for _, addr := range *addresses {
+		// Parse CC addresses (RFC 5322 address list; malformed entries are skipped)
+		addresses, _ := mail.ParseAddressList(headerValue)
+		for _, addr := range addresses {
 			s.mail.AppendCC(addr.GetAddress())
 		}
 	case "BCC":
-		// Parse BCC addresses (can be comma-separated)
-		addresses := mail.ParseNamedAddress(headerName + ": " + headerValue)
-		for _, addr := range *addresses {
+		// Parse BCC addresses (RFC 5322 address list; malformed entries are skipped)
+		addresses, _ := mail.ParseAddressList(headerValue)
+		for _, addr := range addresses {
 			s.mail.AppendBCC(addr.GetAddress())
 		}
 	}
@@ -676,6 +868,10 @@ func (s *ServerConn) handleStartTLS(line string) {
 	s.reader = bufio.NewReader(tlsConn)
 
 	// Reset state to EHLO - client must send EHLO again after STARTTLS
+	// Everything learned before the handshake is discarded, including AUTH (RFC 3207 section 4.2)
+	s.resetTransaction()
+	s.helo = ""
+	s.login = ""
 	s.state = protocol.STATE_EHLO
 }
 
@@ -687,8 +883,8 @@ func (s *ServerConn) handleQuit(line string) {
 
 func (s *ServerConn) handleRset(line string) {
 	// Reset the mail transaction
-	s.mail = mail.Mail{}
-	s.state = protocol.STATE_EHLO
+	s.resetTransaction()
+	s.state = s.readyState()
 
 	// Send acknowledgment
 	if !s.write(protocol.PREPARED_S_ACKNOWLEDGE) {
@@ -0,0 +1,284 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+	"github.com/ImBubbles/MySMTP/util/conn"
+)
+
+// runSession plays a client script against a server connection and returns the server's replies
+// and the messages its MailHandler accepted
+func runSession(t *testing.T, cfg *config.Config, handlers *Handlers, script string) (string, []*mail.Mail) {
+	t.Helper()
+	if handlers == nil {
+		handlers = NewHandlers()
+	}
+	received := make([]*mail.Mail, 0)
+	if handlers.MailHandler == nil {
+		handlers.MailHandler = func(m *mail.Mail) error {
+			received = append(received, m)
+			return nil
+		}
+	}
+	handlers.EmailExistsChecker = func(email string) bool { return true }
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		NewServerConnWithHandlers(server, cfg, handlers, nil)
+		server.Close()
+		close(done)
+	}()
+	go func() {
+		io.WriteString(client, script)
+	}()
+	replies, _ := io.ReadAll(client)
+	client.Close()
+	<-done
+	return string(replies), received
+}
+
+func testConfig(strict bool) *config.Config {
+	return &config.Config{ServerDomain: "mx.example.com", StrictProtocol: strict}
+}
+
+const envelope = "EHLO client.example.org\r\nMAIL FROM:<alice@example.org>\r\nRCPT TO:<bob@example.com>\r\nDATA\r\n"
+
+func TestDataTerminator(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		script := envelope + "Subject: hello\r\n\r\nbody\r\n..stuffed\r\n.\r\nQUIT\r\n"
+		replies, received := runSession(t, testConfig(strict), nil, script)
+		if len(received) != 1 {
+			t.Fatalf("strict=%v: got %d messages, want 1\n%s", strict, len(received), replies)
+		}
+		data := received[0].GetData()
+		if !strings.HasSuffix(data, "Subject: hello\r\n\r\nbody\r\n.stuffed\r\n") {
+			t.Errorf("strict=%v: unexpected data %q", strict, data)
+		}
+		if !strings.Contains(replies, "221") {
+			t.Errorf("strict=%v: session did not reach QUIT\n%s", strict, replies)
+		}
+	}
+}
+
+func TestDataSmugglingStrict(t *testing.T) {
+	// <LF>.<CRLF> must not end the message: the smuggled transaction stays inside it
+	script := envelope + "Subject: hello\r\n\r\nbody\n.\r\nMAIL FROM:<mallory@example.com>\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, testConfig(true), nil, script)
+	if len(received) != 0 {
+		t.Fatalf("got %d messages, want the message rejected\n%s", len(received), replies)
+	}
+	if !strings.Contains(replies, "Bare <CR> or <LF>") {
+		t.Errorf("missing bare newline reply\n%s", replies)
+	}
+	if strings.Count(replies, "\r\n250 ") != 3 {
+		t.Errorf("smuggled MAIL FROM was answered\n%s", replies)
+	}
+}
+
+func TestDataSmugglingLenient(t *testing.T) {
+	for _, ending := range []string{"body\n.\r\n", "body\r\n.\n"} {
+		script := envelope + "Subject: hello\r\n\r\n" + ending + "MAIL FROM:<mallory@example.com>\r\n.\r\nQUIT\r\n"
+		replies, received := runSession(t, testConfig(false), nil, script)
+		if len(received) != 1 {
+			t.Fatalf("%q: got %d messages, want 1\n%s", ending, len(received), replies)
+		}
+		if !strings.Contains(received[0].GetData(), "MAIL FROM:<mallory@example.com>") {
+			t.Errorf("%q: smuggled command is not part of the message: %q", ending, received[0].GetData())
+		}
+	}
+}
+
+func TestDataLineTooLong(t *testing.T) {
+	script := envelope + "Subject: hello\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, testConfig(true), nil, script)
+	if len(received) != 0 {
+		t.Fatalf("got %d messages, want the message rejected", len(received))
+	}
+	if !strings.Contains(replies, "Line too long") || !strings.Contains(replies, "221") {
+		t.Errorf("unexpected replies\n%s", replies)
+	}
+}
+
+func relayConfig() *config.Config {
+	cfg := testConfig(true)
+	cfg.Relay = true
+	cfg.LocalDomains = []string{"example.com"}
+	return cfg
+}
+
+// AUTH PLAIN for user/pass, which allows relaying
+const relayEnvelope = "EHLO client.example.org\r\nAUTH PLAIN AHVzZXIAcGFzcw==\r\nMAIL FROM:<alice@example.org>\r\n" +
+	"RCPT TO:<bob@example.com>\r\nRCPT TO:<carol@example.net>\r\nDATA\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+
+func relayHandlers(relayErr error) (*Handlers, *[]string) {
+	relayed := make([]string, 0)
+	handlers := NewHandlers()
+	handlers.Authenticator = func(username string, password string) bool { return true }
+	handlers.RelayHandler = func(m *mail.Mail, recipients []string) error {
+		if relayErr != nil {
+			return relayErr
+		}
+		relayed = append(relayed, recipients...)
+		return nil
+	}
+	return handlers, &relayed
+}
+
+func TestDataRelayAndLocal(t *testing.T) {
+	handlers, relayed := relayHandlers(nil)
+	replies, received := runSession(t, relayConfig(), handlers, relayEnvelope)
+	if len(received) != 1 {
+		t.Fatalf("got %d local messages, want 1\n%s", len(received), replies)
+	}
+	if to := received[0].GetTo(); len(to) != 1 || to[0] != "bob@example.com" {
+		t.Errorf("MailHandler got recipients %v, want only the local one", to)
+	}
+	if len(*relayed) != 1 || (*relayed)[0] != "carol@example.net" {
+		t.Errorf("RelayHandler got recipients %v", *relayed)
+	}
+}
+
+func TestDataRelayFailure(t *testing.T) {
+	handlers, _ := relayHandlers(errors.New("queue full"))
+	replies, received := runSession(t, relayConfig(), handlers, relayEnvelope)
+	// The client retries after a failed relay, so the local copy must not be delivered yet
+	if len(received) != 0 {
+		t.Errorf("local recipients got the message although the relay failed")
+	}
+	if !strings.Contains(replies, "451") {
+		t.Errorf("missing temporary failure reply\n%s", replies)
+	}
+}
+
+func TestDataBareLFTerminatorLenient(t *testing.T) {
+	// <LF>.<LF> does not end the message; the next <CRLF>.<CRLF> does
+	script := envelope + "Subject: hello\n\nbody\n.\nQUIT\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, testConfig(false), nil, script)
+	if len(received) != 1 {
+		t.Fatalf("got %d messages, want 1\n%s", len(received), replies)
+	}
+	if data := received[0].GetData(); !strings.HasSuffix(data, "body\r\n\r\nQUIT\r\n") {
+		t.Errorf("unexpected data %q", data)
+	}
+	if strings.Count(replies, "221") != 1 {
+		t.Errorf("QUIT inside the message was answered\n%s", replies)
+	}
+}
+
+func TestLineTooLongLenient(t *testing.T) {
+	long := strings.Repeat("x", conn.MaxLenientLineLength+1)
+	script := "EHLO client.example.org\r\nNOOP " + long + "\r\n" + envelope + "Subject: hello\r\n\r\n" + long + "\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, testConfig(false), nil, script)
+	if len(received) != 0 {
+		t.Fatalf("got %d messages, want the message rejected", len(received))
+	}
+	if strings.Count(replies, "Line too long") != 2 || !strings.Contains(replies, "221") {
+		t.Errorf("unexpected replies\n%s", replies)
+	}
+}
+
+func lmtpConfig() *config.Config {
+	cfg := testConfig(true)
+	cfg.LMTP = true
+	return cfg
+}
+
+// dataReplies returns the reply lines after the 354 of the session, up to QUIT's 221
+func dataReplies(replies string) []string {
+	_, after, _ := strings.Cut(replies, "354 ")
+	lines := strings.Split(after, "\r\n")[1:]
+	result := make([]string, 0)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "221") || line == "" {
+			break
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func TestLMTPDataReplyPerRecipient(t *testing.T) {
+	// The syntax error is not an accepted recipient, so it gets no reply after DATA
+	script := "LHLO client.example.org\r\nMAIL FROM:<alice@example.org>\r\nRCPT TO:<bob@example.com>\r\n" +
+		"RCPT TO:<not an address>\r\nRCPT TO:<carol@example.com>\r\nDATA\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, lmtpConfig(), nil, script)
+	if len(received) != 1 {
+		t.Fatalf("got %d messages, want 1\n%s", len(received), replies)
+	}
+	if to := received[0].GetTo(); len(to) != 2 {
+		t.Errorf("got recipients %v, want bob and carol", to)
+	}
+	want := []string{"250 2.1.5 <bob@example.com> Delivered", "250 2.1.5 <carol@example.com> Delivered"}
+	if got := dataReplies(replies); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got replies after DATA %q, want %q\n%s", got, want, replies)
+	}
+	if !strings.Contains(replies, "250-PIPELINING") || !strings.Contains(replies, "250-ENHANCEDSTATUSCODES") {
+		t.Errorf("LHLO did not advertise PIPELINING and ENHANCEDSTATUSCODES\n%s", replies)
+	}
+}
+
+func TestLMTPRejectsEHLO(t *testing.T) {
+	replies, received := runSession(t, lmtpConfig(), nil, envelope+"Subject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	// The reply after the greeting is the one to EHLO
+	if lines := strings.Split(replies, "\r\n"); len(received) != 0 || len(lines) < 2 || !strings.HasPrefix(lines[1], "5") {
+		t.Errorf("EHLO was accepted in LMTP mode\n%s", replies)
+	}
+}
+
+func TestLMTPPartialFailure(t *testing.T) {
+	script := "LHLO client.example.org\r\nMAIL FROM:<alice@example.org>\r\nRCPT TO:<bob@example.com>\r\n" +
+		"RCPT TO:<carol@example.com>\r\nRCPT TO:<dave@example.com>\r\nDATA\r\nSubject: hello\r\n\r\nbody\r\n.\r\nQUIT\r\n"
+	delivered := make([]string, 0)
+	handlers := NewHandlers()
+	handlers.RecipientHandler = func(m *mail.Mail, recipient string) error {
+		switch recipient {
+		case "carol@example.com":
+			return &protocol.CommandError{Code: 452, Enhanced: "4.2.2", Message: "Mailbox full"}
+		case "dave@example.com":
+			return errors.New("disk error")
+		}
+		delivered = append(delivered, recipient)
+		return nil
+	}
+	replies, _ := runSession(t, lmtpConfig(), handlers, script)
+	want := []string{
+		"250 2.1.5 <bob@example.com> Delivered",
+		"452 4.2.2 <carol@example.com> Mailbox full",
+		"554 5.0.0 <dave@example.com> Transaction failed",
+	}
+	if got := dataReplies(replies); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got replies after DATA %q, want %q\n%s", got, want, replies)
+	}
+	if len(delivered) != 1 || delivered[0] != "bob@example.com" {
+		t.Errorf("delivered to %v, want only bob", delivered)
+	}
+
+	// Without a RecipientHandler the MailHandler's verdict applies to every recipient
+	handlers = NewHandlers()
+	handlers.MailHandler = func(m *mail.Mail) error { return errors.New("store failed") }
+	replies, _ = runSession(t, lmtpConfig(), handlers, script)
+	if got := dataReplies(replies); len(got) != 3 || strings.Count(strings.Join(got, "\n"), "554 5.0.0") != 3 {
+		t.Errorf("got replies after DATA %q, want three failures", got)
+	}
+}
+
+func TestLMTPRejectedMessage(t *testing.T) {
+	// A message rejected during DATA still gets one reply per recipient
+	script := "LHLO client.example.org\r\nMAIL FROM:<alice@example.org>\r\nRCPT TO:<bob@example.com>\r\n" +
+		"RCPT TO:<carol@example.com>\r\nDATA\r\nSubject: hello\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n.\r\nQUIT\r\n"
+	replies, received := runSession(t, lmtpConfig(), nil, script)
+	if len(received) != 0 {
+		t.Fatalf("got %d messages, want the message rejected", len(received))
+	}
+	if got := dataReplies(replies); len(got) != 2 || !strings.Contains(got[0], "Line too long") || got[0] != got[1] {
+		t.Errorf("got replies after DATA %q, want two rejections\n%s", got, replies)
+	}
+}
@@ -0,0 +1,261 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ImBubbles/MySMTP/config"
+)
+
+// Source is a local address outgoing connections leave from, with the EHLO name that matches it
+// Receivers check that the reverse DNS of the connecting IP and the EHLO name agree, so both
+// are chosen together
+type Source struct {
+	IPs      []net.IP // At most one IPv4 and one IPv6 address; the one of the remote address family is used
+	Hostname string   // EHLO name ("" = reverse DNS of the first IP, else SMTP_CLIENT_HOSTNAME)
+}
+
+// localIP returns the source address of the same family as remote (the first one if remote is nil)
+func (s *Source) localIP(remote net.IP) net.IP {
+	for _, ip := range s.IPs {
+		if remote == nil || (ip.To4() != nil) == (remote.To4() != nil) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// DialContext connects directly from the source address of the remote address family
+// A host name is resolved by the dialer; each source address is tried until one connects
+func (s *Source) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if remote := net.ParseIP(host); remote != nil {
+		local := s.localIP(remote)
+		if local == nil {
+			return nil, fmt.Errorf("no source address of the address family of %s", host)
+		}
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: local}}
+		return dialer.DialContext(ctx, network, address)
+	}
+	// The dialer only tries the resolved addresses of the local address family
+	var lastErr error = errors.New("no source addresses")
+	for _, local := range s.IPs {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: local}}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// SourceRule selects a Source by the sender domain and the destination
+// An empty field matches anything
+type SourceRule struct {
+	Sender      string // Domain of the envelope sender
+	Destination string // Recipient domain, or the host connected to (smarthost, Dial)
+	Source      Source
+}
+
+// matches reports whether the rule applies to a sender domain and destination
+func (r *SourceRule) matches(sender, destination string) bool {
+	return (r.Sender == "" || strings.EqualFold(r.Sender, sender)) &&
+		(r.Destination == "" || strings.EqualFold(r.Destination, destination))
+}
+
+// ParseSourceRule parses one SMTP_SOURCE_ADDRESSES entry:
+//
+//	from:example.com=192.0.2.10 2001:db8::10 mail.example.com
+//	to:gmail.com=192.0.2.11
+//	*=192.0.2.12 out.example.com
+//
+// The part before "=" is from:<sender domain>, to:<destination> (both may be given, separated
+// by "&") or "*"; after it come one or two IP addresses and optionally the EHLO name
+func ParseSourceRule(entry string) (SourceRule, error) {
+	rule := SourceRule{}
+	selector, value, ok := strings.Cut(entry, "=")
+	if !ok {
+		return rule, fmt.Errorf("missing \"=\" in %q", entry)
+	}
+	selector = strings.TrimSpace(selector)
+	if selector != "*" {
+		for _, part := range strings.Split(selector, "&") {
+			kind, domain, ok := strings.Cut(strings.TrimSpace(part), ":")
+			domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+			if !ok || domain == "" {
+				return rule, fmt.Errorf("invalid selector %q (from:<domain>, to:<domain> or *)", part)
+			}
+			switch strings.ToLower(kind) {
+			case "from":
+				rule.Sender = domain
+			case "to":
+				rule.Destination = domain
+			default:
+				return rule, fmt.Errorf("invalid selector %q (from:<domain>, to:<domain> or *)", part)
+			}
+		}
+	}
+
+	ipv4, ipv6 := false, false
+	for _, field := range strings.Fields(value) {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			if rule.Source.Hostname != "" {
+				return rule, fmt.Errorf("more than one EHLO name in %q", entry)
+			}
+			rule.Source.Hostname = field
+			continue
+		}
+		if ip.To4() != nil {
+			if ipv4 {
+				return rule, fmt.Errorf("more than one IPv4 address in %q", entry)
+			}
+			ipv4 = true
+		} else {
+			if ipv6 {
+				return rule, fmt.Errorf("more than one IPv6 address in %q", entry)
+			}
+			ipv6 = true
+		}
+		rule.Source.IPs = append(rule.Source.IPs, ip)
+	}
+	if len(rule.Source.IPs) == 0 {
+		return rule, fmt.Errorf("no source address in %q", entry)
+	}
+	return rule, nil
+}
+
+// AddrResolver looks up the names of an IP address; *net.Resolver satisfies it
+type AddrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Sources picks the source address for outgoing connections; it is safe for concurrent use
+//
+//	sources := smtp.SourcesFromConfig(cfg)
+//	source := sources.Select(ctx, "example.com", "gmail.com")
+//	client, err := smtp.DialSourceContext(ctx, source, "gmail-smtp-in.l.google.com", 25)
+type Sources struct {
+	Rules    []SourceRule // The first matching rule wins
+	Resolver AddrResolver // Reverse DNS for rules without EHLO name (net.DefaultResolver if nil)
+
+	mu    sync.Mutex
+	names map[string]string // Reverse DNS name by IP ("" = lookup failed)
+}
+
+// SourcesFromConfig returns the SMTP_SOURCE_ADDRESSES rules; invalid entries are skipped
+func SourcesFromConfig(cfg *config.Config) *Sources {
+	sources := &Sources{Rules: make([]SourceRule, 0, len(cfg.SourceAddresses))}
+	for _, entry := range cfg.SourceAddresses {
+		rule, err := ParseSourceRule(entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "CLIENT: Invalid SMTP_SOURCE_ADDRESSES entry skipped: %v\n", err)
+			continue
+		}
+		sources.Rules = append(sources.Rules, rule)
+	}
+	return sources
+}
+
+var (
+	configSourcesOnce sync.Once
+	configSources     *Sources
+)
+
+// sourcesFromConfig returns the shared SMTP_SOURCE_ADDRESSES rules, so reverse DNS names are cached once
+func sourcesFromConfig() *Sources {
+	configSourcesOnce.Do(func() {
+		configSources = SourcesFromConfig(config.GetConfig())
+	})
+	return configSources
+}
+
+// Select returns the source for mail from a sender domain to a destination, or nil for the
+// default route; the EHLO name is filled in from reverse DNS when the rule has none
+// sender may be "" (bounces, or unknown when dialing) and then only matches rules without from:
+// Rules without an IP address bind nothing and are skipped
+func (s *Sources) Select(ctx context.Context, sender, destination string) *Source {
+	if s == nil {
+		return nil
+	}
+	sender = strings.ToLower(strings.TrimSuffix(sender, "."))
+	destination = strings.ToLower(strings.TrimSuffix(destination, "."))
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		if len(rule.Source.IPs) == 0 || !rule.matches(sender, destination) {
+			continue
+		}
+		source := rule.Source
+		if source.Hostname == "" {
+			source.Hostname = s.reverseName(ctx, source.IPs[0])
+		}
+		return &source
+	}
+	return nil
+}
+
+// reverseName returns the first PTR name of an IP, or "" if it has none; results are cached
+func (s *Sources) reverseName(ctx context.Context, ip net.IP) string {
+	key := ip.String()
+	s.mu.Lock()
+	name, ok := s.names[key]
+	s.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	var resolver AddrResolver = net.DefaultResolver
+	if s.Resolver != nil {
+		resolver = s.Resolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	names, err := resolver.LookupAddr(ctx, key)
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	if err != nil && ctx.Err() != nil {
+		// Not an answer - ask again next time
+		return name
+	}
+	s.mu.Lock()
+	if s.names == nil {
+		s.names = make(map[string]string)
+	}
+	s.names[key] = name
+	s.mu.Unlock()
+	return name
+}
+
+// DialSourceContext is DialContext from a source address, announcing its EHLO name
+// A nil source uses the default route and SMTP_CLIENT_HOSTNAME
+func DialSourceContext(ctx context.Context, source *Source, host string, port ...uint16) (*ClientConn, error) {
+	conn, err := dialSMTP(ctx, source, host, port...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClientContext(ctx, conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.useSource(source)
+	return client, nil
+}
+
+// useSource announces the EHLO name of the source the connection was made from
+func (c *ClientConn) useSource(source *Source) {
+	if source != nil && source.Hostname != "" {
+		c.hostname = source.Hostname
+	}
+}
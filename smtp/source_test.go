@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// stubAddrResolver answers reverse lookups from a map
+type stubAddrResolver map[string]string
+
+func (r stubAddrResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if name, ok := r[addr]; ok {
+		return []string{name + "."}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestSourcesSelect(t *testing.T) {
+	rules := make([]SourceRule, 0)
+	for _, entry := range []string{
+		"from:example.com&to:gmail.com=192.0.2.9 special.example.com",
+		"from:example.com=192.0.2.10 2001:db8::10",
+		"to:example.net=192.0.2.11 out.example.com",
+	} {
+		rule, err := ParseSourceRule(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	// A rule built in code without addresses is skipped rather than used
+	rules = append([]SourceRule{{Sender: "example.com"}}, rules...)
+	sources := &Sources{Rules: rules, Resolver: stubAddrResolver{"192.0.2.10": "mail.example.com"}}
+
+	tests := []struct {
+		sender, destination string
+		ip, hostname        string
+	}{
+		{"example.com", "gmail.com", "192.0.2.9", "special.example.com"},
+		{"EXAMPLE.COM.", "yahoo.com", "192.0.2.10", "mail.example.com"},
+		{"", "example.net", "192.0.2.11", "out.example.com"},
+	}
+	for _, test := range tests {
+		source := sources.Select(context.Background(), test.sender, test.destination)
+		if source == nil {
+			t.Errorf("%s -> %s: no source", test.sender, test.destination)
+			continue
+		}
+		if !source.IPs[0].Equal(net.ParseIP(test.ip)) || source.Hostname != test.hostname {
+			t.Errorf("%s -> %s: got %v %s, want %s %s", test.sender, test.destination, source.IPs, source.Hostname, test.ip, test.hostname)
+		}
+	}
+	if source := sources.Select(context.Background(), "other.org", "gmail.com"); source != nil {
+		t.Errorf("unmatched mail got source %+v", source)
+	}
+	if source := (&Sources{Rules: []SourceRule{{}}}).Select(context.Background(), "", "gmail.com"); source != nil {
+		t.Errorf("rule without addresses was selected: %+v", source)
+	}
+}
+
+func TestParseSourceRuleErrors(t *testing.T) {
+	for _, entry := range []string{
+		"192.0.2.10",
+		"from:example.com=mail.example.com",
+		"*=192.0.2.10 192.0.2.11",
+		"via:example.com=192.0.2.10",
+		"*=192.0.2.10 a.example.com b.example.com",
+	} {
+		if _, err := ParseSourceRule(entry); err == nil {
+			t.Errorf("%q: accepted", entry)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/config"
+)
+
+// TLSPolicy decides whether the client uses STARTTLS and how it checks the server certificate
+type TLSPolicy string
+
+const (
+	TLS_POLICY_NONE          TLSPolicy = "none"          // Never use STARTTLS
+	TLS_POLICY_OPPORTUNISTIC TLSPolicy = "opportunistic" // STARTTLS when offered, certificate not verified, plaintext otherwise (RFC 7435)
+	TLS_POLICY_REQUIRED      TLSPolicy = "required"      // STARTTLS is mandatory, certificate not verified
+	TLS_POLICY_VERIFY        TLSPolicy = "verify"        // STARTTLS is mandatory and the certificate must be valid for the server name
+)
+
+// ErrTLSUnavailable is returned when the TLS policy requires STARTTLS but the server does not offer it
+var ErrTLSUnavailable = errors.New("server does not offer STARTTLS")
+
+// ParseTLSPolicy returns the policy for its name (case-insensitive)
+func ParseTLSPolicy(value string) (TLSPolicy, error) {
+	policy := TLSPolicy(strings.ToLower(strings.TrimSpace(value)))
+	switch policy {
+	case TLS_POLICY_NONE, TLS_POLICY_OPPORTUNISTIC, TLS_POLICY_REQUIRED, TLS_POLICY_VERIFY:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown TLS policy %q (none, opportunistic, required or verify)", value)
+}
+
+// tlsPolicyFromConfig returns SMTP_CLIENT_TLS_POLICY; an empty or invalid value keeps the
+// opportunistic STARTTLS of the one-shot constructors
+func tlsPolicyFromConfig(cfg *config.Config) TLSPolicy {
+	if cfg.ClientTLSPolicy == "" {
+		return TLS_POLICY_OPPORTUNISTIC
+	}
+	policy, err := ParseTLSPolicy(cfg.ClientTLSPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CLIENT: Invalid SMTP_CLIENT_TLS_POLICY, using %s: %v\n", TLS_POLICY_OPPORTUNISTIC, err)
+		return TLS_POLICY_OPPORTUNISTIC
+	}
+	return policy
+}
+
+// SetTLSPolicy sets how EnsureTLS and StartTLS secure the connection (default SMTP_CLIENT_TLS_POLICY)
+func (c *ClientConn) SetTLSPolicy(policy TLSPolicy) {
+	c.tlsPolicy = policy
+}
+
+// EnsureTLS applies the TLS policy after Hello: it upgrades the connection with STARTTLS when the
+// policy asks for it, and fails with ErrTLSUnavailable when TLS is required but not offered
+// A connection that is already encrypted (SMTPS or after StartTLS) satisfies every policy
+func (c *ClientConn) EnsureTLS() error {
+	if err := c.ensureHello(); err != nil {
+		return err
+	}
+	if c.isTLS() || c.tlsPolicy == TLS_POLICY_NONE {
+		return nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if c.tlsPolicy == TLS_POLICY_OPPORTUNISTIC {
+			return nil
+		}
+		return fmt.Errorf("%w (TLS policy %s)", ErrTLSUnavailable, c.tlsPolicy)
+	}
+	return c.StartTLS(nil)
+}
+
+// policyTLSConfig returns the config for a handshake under a policy
+// An explicit config is kept as it is (e.g. one that verifies with VerifyConnection), except that
+// TLS_POLICY_VERIFY always verifies; without one, only TLS_POLICY_VERIFY checks the certificate
+func policyTLSConfig(base *tls.Config, serverName string, policy TLSPolicy) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if config.ServerName == "" {
+		// An IP address is not sent as SNI and is verified against the IP addresses of the certificate
+		config.ServerName = serverName
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12 // Require TLS 1.2 or higher
+	}
+	switch {
+	case policy == TLS_POLICY_VERIFY:
+		config.InsecureSkipVerify = false
+	case base == nil:
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
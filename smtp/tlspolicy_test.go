@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/config"
+	"github.com/ImBubbles/MySMTP/mail"
+)
+
+func TestTLSPolicyFromConfig(t *testing.T) {
+	tests := map[string]TLSPolicy{
+		"":         TLS_POLICY_OPPORTUNISTIC,
+		"verify":   TLS_POLICY_VERIFY,
+		"Required": TLS_POLICY_REQUIRED,
+		"strict":   TLS_POLICY_OPPORTUNISTIC,
+	}
+	for value, want := range tests {
+		if got := tlsPolicyFromConfig(&config.Config{ClientTLSPolicy: value}); got != want {
+			t.Errorf("%q: got %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestLMTPClientConnWithoutSTARTTLS(t *testing.T) {
+	client, server := net.Pipe()
+	commands := scriptedServer(server, []string{
+		"250-backend.example.com\r\n250 PIPELINING\r\n",
+		"250 2.1.0 OK\r\n",
+		"250 2.1.5 OK\r\n",
+		"354 Go ahead\r\n",
+		"250 2.0.0 Delivered\r\n",
+		"221 2.0.0 Bye\r\n",
+	})
+	msg := mail.Mail{}
+	msg.SetFrom("alice@example.org").AppendTo("bob@example.com")
+	msg.SetData("Subject: test\r\n\r\nbody\r\n").SetRaw(true)
+
+	conn, err := NewLMTPClientConn(client, msg)
+	if err != nil {
+		t.Fatalf("NewLMTPClientConn: %v", err)
+	}
+	conn.Close()
+	got := <-commands
+	if len(got) == 0 || got[0] != "LHLO "+conn.hostname {
+		t.Errorf("got commands %q", got)
+	}
+	for _, command := range got {
+		if command == "STARTTLS" {
+			t.Errorf("STARTTLS sent to a server that does not offer it")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/ImBubbles/MySMTP/mail"
+	"github.com/ImBubbles/MySMTP/smtp/protocol"
+	"github.com/ImBubbles/MySMTP/util/network"
+)
+
+// Postfix-compatible XCLIENT / XFORWARD (https://www.postfix.org/XCLIENT_README.html)
+// Both are only offered to clients in config.XClientTrustedNetworks
+
+// Attribute names accepted by XCLIENT and XFORWARD
+var (
+	xclientAttributes  = []string{"ADDR", "NAME", "HELO", "LOGIN", "PROTO"}
+	xforwardAttributes = []string{"ADDR", "NAME", "HELO", "PROTO", "IDENT", "SOURCE"}
+)
+
+// isXClientTrusted reports whether the connected peer may use XCLIENT / XFORWARD
+// The check uses the real peer address, never an address set by XCLIENT itself
+func (s *ServerConn) isXClientTrusted() bool {
+	return network.Contains(s.xclientNetworks, s.peerIP)
+}
+
+// handleXClient overrides the session attributes for the rest of the connection
+// Format: XCLIENT ADDR=192.0.2.1 NAME=mail.example.com HELO=mail.example.com LOGIN=user PROTO=ESMTP
+func (s *ServerConn) handleXClient(line string) {
+	if !s.isXClientTrusted() {
+		s.write(protocol.PREPARED_S_XCLIENT_DENIED)
+		return
+	}
+	// Not allowed inside a mail transaction
+	if s.state == protocol.STATE_RCPT_TO || s.state == protocol.STATE_DATA {
+		s.write(protocol.PREPARED_S_BAD_SEQUENCE)
+		return
+	}
+	attributes, err := parseXAttributes(line, xclientAttributes)
+	if err != nil {
+		s.write(protocol.NewSMTPBuilder().Code(protocol.CODE_BAD_SYNTAX).Message("5.5.4 " + err.Error()).Get())
+		return
+	}
+	for key, value := range attributes {
+		s.xclient[key] = value
+	}
+
+	// XCLIENT starts a new session: the client gets a fresh greeting and must send EHLO again
+	s.resetTransaction()
+	s.helo = ""
+	s.login = ""
+	s.state = protocol.STATE_EHLO
+	s.write(protocol.PREPARED_S_ACCEPTANCE)
+}
+
+// handleXForward overrides the session attributes for the next mail transaction only
+// Format: XFORWARD ADDR=192.0.2.1 NAME=mail.example.com HELO=mail.example.com PROTO=ESMTP
+func (s *ServerConn) handleXForward(line string) {
+	if !s.isXClientTrusted() {
+		s.write(protocol.PREPARED_S_XCLIENT_DENIED)
+		return
+	}
+	// Must be sent before MAIL FROM
+	if s.state == protocol.STATE_RCPT_TO || s.state == protocol.STATE_DATA {
+		s.write(protocol.PREPARED_S_BAD_SEQUENCE)
+		return
+	}
+	attributes, err := parseXAttributes(line, xforwardAttributes)
+	if err != nil {
+		s.write(protocol.NewSMTPBuilder().Code(protocol.CODE_BAD_SYNTAX).Message("5.5.4 " + err.Error()).Get())
+		return
+	}
+	for key, value := range attributes {
+		s.xforward[key] = value
+	}
+	s.write(protocol.PREPARED_S_ACKNOWLEDGE)
+}
+
+// parseXAttributes parses "NAME=value ..." pairs after the command word
+// Values are xtext encoded; [UNAVAILABLE] and [TEMPUNAVAIL] mean "unknown" and become ""
+func parseXAttributes(line string, allowed []string) (map[string]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%s requires at least one attribute", strings.ToUpper(fields[0]))
+	}
+	attributes := make(map[string]string)
+	for _, field := range fields[1:] {
+		key, raw, ok := strings.Cut(field, "=")
+		key = strings.ToUpper(key)
+		if !ok || !containsString(allowed, key) {
+			return nil, fmt.Errorf("Bad %s attribute name: %s", strings.ToUpper(fields[0]), key)
+		}
+		value, err := protocol.DecodeXtext(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Bad %s attribute value: %s", strings.ToUpper(fields[0]), key)
+		}
+		switch strings.ToUpper(value) {
+		case "[UNAVAILABLE]", "[TEMPUNAVAIL]":
+			value = ""
+		}
+		value, ok = validXAttribute(key, value)
+		if !ok {
+			return nil, fmt.Errorf("Bad %s attribute value: %s", strings.ToUpper(fields[0]), key)
+		}
+		attributes[key] = value
+	}
+	return attributes, nil
+}
+
+// xclientProtocol matches the PROTO values of RFC 3848 (SMTP, ESMTP, ESMTPSA, LMTPA, ...)
+var xclientProtocol = regexp.MustCompile(`(?i)^(SMTP|ESMTP|LMTP)S?A?$`)
+
+// validXAttribute checks a decoded attribute value and returns it normalized
+// The values end up in the session and in the Received header, so none may carry control
+// characters or spaces (xtext can encode both)
+func validXAttribute(key, value string) (string, bool) {
+	if value == "" {
+		return "", true
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] <= ' ' || value[i] == 0x7f {
+			return "", false
+		}
+	}
+	switch key {
+	case "ADDR":
+		// IPv6 addresses may be sent as "IPV6:2001:db8::1"
+		if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+			value = value[5:]
+		}
+		// The address feeds relay and access decisions, so it must be a real one
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", false
+		}
+		return ip.String(), true
+	case "NAME", "HELO":
+		return value, protocol.ValidDomain(value) || protocol.ValidAddressLiteral(value)
+	case "PROTO":
+		return value, xclientProtocol.MatchString(value)
+	}
+	return value, true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// session returns the attributes of the client as seen by handlers
+// Connection values are overridden by XCLIENT, then by XFORWARD for the current transaction
+func (s *ServerConn) session() mail.Session {
+	return s.sessionWith(true)
+}
+
+// clientSession is session without the XFORWARD overrides, for relay and access decisions:
+// XFORWARD only describes where a message came from, XCLIENT stands in for the client itself
+func (s *ServerConn) clientSession() mail.Session {
+	return s.sessionWith(false)
+}
+
+// sessionWith builds the session, with or without the XFORWARD overrides
+func (s *ServerConn) sessionWith(forwarded bool) mail.Session {
+	session := mail.Session{
+		Helo:     s.helo,
+		Protocol: "SMTP",
+	}
+	if s.peerIP != nil {
+		session.ClientAddr = s.peerIP.String()
+	}
+	if s.lmtp {
+		session.Protocol = "LMTP"
+	} else if s.esmtp {
+		session.Protocol = "ESMTP"
+	}
+	if s.isTLS() {
+		session.Protocol += "S"
+	}
+	if s.login != "" {
+		// ESMTPA / ESMTPSA (RFC 3848)
+		session.Login = s.login
+		session.Protocol += "A"
+	}
+
+	layers := []map[string]string{s.xclient}
+	if forwarded {
+		layers = append(layers, s.xforward)
+	}
+	for _, overrides := range layers {
+		for key, value := range overrides {
+			switch key {
+			case "ADDR":
+				session.ClientAddr = value
+			case "NAME":
+				session.ClientName = value
+			case "HELO":
+				session.Helo = value
+			case "LOGIN":
+				session.Login = value
+			case "PROTO":
+				session.Protocol = strings.ToUpper(value)
+			}
+		}
+	}
+	return session
+}
@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/ImBubbles/MySMTP/util/network"
+)
+
+func TestParseXAttributesAddr(t *testing.T) {
+	tests := map[string]string{
+		"XCLIENT ADDR=192.0.2.1":               "192.0.2.1",
+		"XCLIENT ADDR=IPV6:2001:db8::1":        "2001:db8::1",
+		"XCLIENT ADDR=[UNAVAILABLE]":           "",
+		"XFORWARD ADDR=::ffff:192.0.2.1":       "192.0.2.1",
+		"XCLIENT NAME=mx.example.com ADDR=::1": "::1",
+	}
+	for line, want := range tests {
+		attributes, err := parseXAttributes(line, xclientAttributes)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if attributes["ADDR"] != want {
+			t.Errorf("%q: ADDR = %q, want %q", line, attributes["ADDR"], want)
+		}
+	}
+	for _, line := range []string{"XCLIENT ADDR=mail.example.com", "XCLIENT ADDR=192.0.2", "XCLIENT ADDR=IPV6:nonsense"} {
+		if _, err := parseXAttributes(line, xclientAttributes); err == nil {
+			t.Errorf("%q: accepted an invalid address", line)
+		}
+	}
+}
+
+func TestXForwardDoesNotGrantRelay(t *testing.T) {
+	relayNetworks, err := network.ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ServerConn{
+		relayNetworks: relayNetworks,
+		xclient:       map[string]string{},
+		xforward:      map[string]string{"ADDR": "10.0.0.1", "LOGIN": "admin"},
+	}
+	if s.relayAllowed() {
+		t.Error("XFORWARD attributes allowed relaying")
+	}
+	if session := s.session(); session.ClientAddr != "10.0.0.1" {
+		t.Errorf("session ClientAddr = %q, want the forwarded address", session.ClientAddr)
+	}
+
+	s.xclient["ADDR"] = "10.0.0.2"
+	if !s.relayAllowed() {
+		t.Error("XCLIENT address in the relay networks was not allowed to relay")
+	}
+}
+
+func TestParseXAttributesValues(t *testing.T) {
+	all := append(append([]string{}, xclientAttributes...), xforwardAttributes...)
+	valid := []string{
+		"XCLIENT NAME=mail.example.com HELO=[192.0.2.1] PROTO=ESMTP",
+		"XCLIENT HELO=[IPv6:2001:db8::1] PROTO=esmtpsa LOGIN=alice",
+		"XFORWARD NAME=[UNAVAILABLE] PROTO=LMTP IDENT=ABC123 SOURCE=REMOTE",
+	}
+	for _, line := range valid {
+		if _, err := parseXAttributes(line, all); err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+	invalid := []string{
+		"XCLIENT NAME=mail.example.com+0D+0AX-Injected:+yes",
+		"XCLIENT HELO=client+20example",
+		"XCLIENT HELO=[192.0.2]",
+		"XCLIENT HELO=..",
+		"XCLIENT PROTO=HTTP",
+		"XCLIENT PROTO=ESMTP+0A",
+		"XCLIENT LOGIN=alice+00",
+		"XFORWARD IDENT=abc+09def",
+	}
+	for _, line := range invalid {
+		if _, err := parseXAttributes(line, all); err == nil {
+			t.Errorf("%q: accepted an invalid value", line)
+		}
+	}
+}
@@ -23,5 +23,8 @@ func (al *ArrayList[T]) Contains(against T) bool {
 }
 
 func NewArrayList[T comparable](items []T) *ArrayList[T] {
-	return &ArrayList[T]{}
+	// Copy the initial items so later pushes never alias the caller's slice
+	list := &ArrayList[T]{items: make([]T, 0, len(items))}
+	list.items = append(list.items, items...)
+	return list
 }
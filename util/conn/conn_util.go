@@ -6,6 +6,13 @@ import (
 	"net"
 )
 
+// MaxLineLength is the RFC 5321 limit for a command or text line, including the CRLF
+const MaxLineLength = 1000
+
+// MaxLenientLineLength caps lines in lenient mode, so a client that never ends a line cannot
+// make the server buffer without limit
+const MaxLenientLineLength = 64 * 1024
+
 func Write(conn *net.Conn, str string) error {
 	// Ensure SMTP protocol compliance: all lines must end with \r\n
 	// Add \r\n if not already present
@@ -75,3 +82,39 @@ func Read(r *bufio.Reader) string {
 	// We add \r\n here so callers get the proper SMTP line ending
 	return string(fullLine) + "\r\n"
 }
+
+// ReadRawLine reads one line up to and including its '\n', without normalizing the line ending
+// so callers can tell CRLF from a bare LF. If limit > 0 and the line is longer than limit bytes,
+// the rest of the line is still consumed (so the stream stays in sync), tooLong is true and
+// line holds only the line ending ("\r\n" or "\n").
+// err is the underlying read error; a final line without '\n' is returned together with io.EOF.
+func ReadRawLine(r *bufio.Reader, limit int) (line []byte, tooLong bool, err error) {
+	var last byte // Byte before the current chunk, to find a CR split from its LF
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && limit > 0 && len(line)+len(chunk) > limit {
+			tooLong = true
+			if len(line) > 0 {
+				last = line[len(line)-1]
+			}
+			line = nil
+		}
+		if !tooLong {
+			// ReadSlice's buffer is reused by the next read, so copy it out
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			if len(chunk) > 0 {
+				last = chunk[len(chunk)-1]
+			}
+			continue
+		}
+		if tooLong && len(chunk) > 0 && chunk[len(chunk)-1] == '\n' {
+			line = []byte("\n")
+			if (len(chunk) > 1 && chunk[len(chunk)-2] == '\r') || (len(chunk) == 1 && last == '\r') {
+				line = []byte("\r\n")
+			}
+		}
+		return line, tooLong, err
+	}
+}
@@ -27,17 +27,19 @@ func RemoveAll(s string, regex string) string {
 	return re.ReplaceAllString(s, "")
 }
 
+// CleanFromData splits 'John Doe <me@email.com>' into its name and address
+// The name may contain spaces and be quoted ("Doe, John"); without brackets the whole value is the address
 func CleanFromData(s string) (name, address string) {
-	spaceIndex := strings.Index(s, " ")
-	name = ""
-	if spaceIndex != -1 {
-		// Has name part
-		name = RemoveAll(s[:spaceIndex], "\"")
-		name = strings.TrimSpace(name)
-		address = CleanEmail(s[spaceIndex+1:])
-	} else {
+	s = strings.TrimSpace(s)
+	open := strings.LastIndex(s, "<")
+	if open == -1 || !strings.Contains(s[open:], ">") {
 		// No name, just address
-		address = CleanEmail(s)
+		return "", CleanEmail(s)
+	}
+	address = CleanEmail(s[open:])
+	name = strings.TrimSpace(s[:open])
+	if len(name) >= 2 && strings.HasPrefix(name, "\"") && strings.HasSuffix(name, "\"") {
+		name = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(name[1 : len(name)-1])
 	}
 	return
 }